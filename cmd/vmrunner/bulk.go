@@ -0,0 +1,89 @@
+//go:build windows
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/api"
+	"github.com/microsoft/hcsshim/vmrunner/internal/cli"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vm"
+)
+
+// selectorFlags are -selector and -all, which make stop, kill and exec act
+// on every matching running VM instead of one ID.
+type selectorFlags struct {
+	selectors stringList
+	all       bool
+	parallel  int
+}
+
+func addSelectorFlags(fs *flag.FlagSet) *selectorFlags {
+	f := &selectorFlags{}
+	fs.Var(&f.selectors, "selector", "Act on every running VM whose labels match (k=v, k!=v, k, !k; comma-separated or repeated)")
+	fs.BoolVar(&f.all, "all", false, "Act on every running VM vmrunner owns")
+	fs.IntVar(&f.parallel, "parallel", cli.DefaultParallel, "With -selector or -all, VMs handled at once")
+	return f
+}
+
+// set reports whether the command acts on VMs selected by the flags.
+func (f *selectorFlags) set() bool { return f.all || len(f.selectors) > 0 }
+
+// targets returns the IDs of the running VMs selected by the flags.
+func (f *selectorFlags) targets(client *api.Client, cmd string) []string {
+	vms, err := client.List(vm.ListOptions{Labels: f.selectors})
+	if err != nil {
+		log.Fatalf("%s: %v", cmd, err)
+	}
+	ids := make([]string, len(vms))
+	for i, v := range vms {
+		ids[i] = v.Id
+	}
+	return ids
+}
+
+// bulk calls fn for every VM selected by f, several at once, logs each VM's
+// result and exits non-zero if any failed. done describes a success, as in
+// `VM "x" stopped`.
+func (f *selectorFlags) bulk(client *api.Client, cmd, done string, fn func(id string) error) {
+	ids := f.targets(client, cmd)
+	if len(ids) == 0 {
+		log.Printf("[vmrunner] %s: no running VMs match", cmd)
+		return
+	}
+	failed := cli.ForEach(ids, f.parallel, fn, func(id string, err error) {
+		if err != nil {
+			log.Printf("[vmrunner] VM %q: %s failed: %v", id, cmd, err)
+			return
+		}
+		log.Printf("[vmrunner] VM %q %s", id, done)
+	})
+	if failed > 0 {
+		log.Fatalf("%s: %d of %d VMs failed", cmd, failed, len(ids))
+	}
+}
+
+// bulkExec runs req in every VM selected by f, with each line of output
+// prefixed by the VM's ID. A command that exits non-zero counts as failed.
+func (f *selectorFlags) bulkExec(client *api.Client, req api.ExecRequest) {
+	var mu sync.Mutex
+	f.bulk(client, "exec", "done", func(id string) error {
+		prefix := fmt.Sprintf("[%s] ", id)
+		stdout := &cli.PrefixWriter{W: os.Stdout, Mu: &mu, Prefix: prefix}
+		stderr := &cli.PrefixWriter{W: os.Stderr, Mu: &mu, Prefix: prefix}
+		code, err := client.Exec(id, req, stdout, stderr)
+		stdout.Flush()
+		stderr.Flush()
+		switch {
+		case err != nil:
+			return err
+		case code != 0:
+			return fmt.Errorf("exit code %d", code)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,104 @@
+//go:build windows
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/api"
+	"github.com/microsoft/hcsshim/vmrunner/internal/cli"
+	"github.com/microsoft/hcsshim/vmrunner/internal/daemon"
+)
+
+// globalOpts are the global flags main was started with.
+var globalOpts cli.Options
+
+// Process creation flags that detach vmrunnerd from this console, so that
+// closing the terminal or pressing Ctrl+C here does not stop it.
+const (
+	detachedProcess       = 0x00000008
+	createNewProcessGroup = 0x00000200
+)
+
+// connect returns a client for the daemon serving this command. With
+// --no-daemon (or a flag that implies it) the daemon runs inside this
+// process; otherwise vmrunnerd is started if nothing answers on the socket.
+func connect() *api.Client {
+	if globalOpts.Local() {
+		return serveLocal()
+	}
+	client := api.NewClient(globalOpts.Socket)
+	if _, err := client.Info(); err == nil {
+		return client
+	}
+	if err := spawnDaemon(); err != nil {
+		log.Fatalf("vmrunner: start vmrunnerd: %v", err)
+	}
+	if err := client.WaitReady(10 * time.Second); err != nil {
+		log.Fatalf("vmrunner: %v", err)
+	}
+	return client
+}
+
+// spawnDaemon starts vmrunnerd from the directory of this executable with
+// the same global flags, logging to vmrunnerd.log next to its socket.
+func spawnDaemon() error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	logPath := filepath.Join(filepath.Dir(globalOpts.Socket), "vmrunnerd.log")
+	if err := os.MkdirAll(filepath.Dir(logPath), 0o755); err != nil {
+		return err
+	}
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(filepath.Join(filepath.Dir(self), "vmrunnerd.exe"), globalOpts.DaemonArgs()...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: detachedProcess | createNewProcessGroup}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	log.Printf("[vmrunner] started vmrunnerd (pid %d), logging to %s", cmd.Process.Pid, logPath)
+	return cmd.Process.Release()
+}
+
+// serveLocal runs a daemon in this process on a private socket. It lives
+// as long as the command; VMs it started keep running after it. It refuses
+// to share the state store with a running vmrunnerd.
+func serveLocal() *api.Client {
+	if err := globalOpts.CheckLocalStore(); err != nil {
+		log.Fatalf("vmrunner: %v", err)
+	}
+	dir, err := os.MkdirTemp("", "vmrunner-")
+	if err != nil {
+		log.Fatalf("vmrunner: %v", err)
+	}
+	socket := filepath.Join(dir, "vmrunnerd.sock")
+	l, err := api.Listen(socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		log.Fatalf("vmrunner: %v", err)
+	}
+	cli.AtExit(func() {
+		l.Close()
+		os.RemoveAll(dir)
+	})
+	st, err := globalOpts.OpenStore()
+	if err != nil {
+		log.Fatalf("vmrunner: %v", err)
+	}
+	go http.Serve(l, api.NewHandler(daemon.New(st)))
+	return api.NewClient(socket)
+}
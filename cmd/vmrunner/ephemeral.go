@@ -0,0 +1,77 @@
+//go:build windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/api"
+	"github.com/microsoft/hcsshim/vmrunner/internal/cli"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vm"
+)
+
+// removeTimeout bounds how long a command waits for vmrunnerd to remove a
+// VM run with -rm once it has exited.
+const removeTimeout = 30 * time.Second
+
+// onInterrupt calls fn and exits with code on Ctrl+C or SIGTERM, until the
+// returned function is called.
+func onInterrupt(code int, fn func()) (stop func()) {
+	sigCh := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-sigCh:
+			log.Printf("[vmrunner] received signal %v, shutting down VM", sig)
+			fn()
+			cli.Exit(code)
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(sigCh)
+		close(done)
+	}
+}
+
+// shutdown stops VM id and, if it was run with -rm, waits for vmrunnerd to
+// remove it.
+func shutdown(client *api.Client, id string, rm bool) {
+	if err := client.Stop(id, vm.StopOptions{}); err != nil && !api.IsNotFound(err) {
+		log.Printf("[vmrunner] shutdown error: %v", err)
+	}
+	if rm {
+		waitRemoved(client, id)
+	}
+}
+
+// discard terminates VM id, run with -rm, and waits for its removal: it
+// holds nothing worth a graceful shutdown.
+func discard(client *api.Client, id string) {
+	if err := client.Kill(id); err != nil && !api.IsNotFound(err) {
+		log.Printf("[vmrunner] kill VM %q: %v", id, err)
+	}
+	waitRemoved(client, id)
+}
+
+// waitRemoved waits until vmrunnerd no longer knows VM id.
+func waitRemoved(client *api.Client, id string) {
+	deadline := time.Now().Add(removeTimeout)
+	for {
+		_, err := client.Inspect(id)
+		if api.IsNotFound(err) {
+			log.Printf("[vmrunner] VM %q removed", id)
+			return
+		}
+		if time.Now().After(deadline) {
+			log.Printf("[vmrunner] VM %q not removed after %s; check vmrunnerd's log", id, removeTimeout)
+			return
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
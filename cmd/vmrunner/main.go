@@ -3,37 +3,86 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
-	"os/signal"
-	"syscall"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/microsoft/hcsshim/vmrunner/internal/api"
+	"github.com/microsoft/hcsshim/vmrunner/internal/cli"
+	"github.com/microsoft/hcsshim/vmrunner/internal/compose"
 	"github.com/microsoft/hcsshim/vmrunner/internal/config"
+	"github.com/microsoft/hcsshim/vmrunner/internal/consolelog"
 	"github.com/microsoft/hcsshim/vmrunner/internal/vm"
 )
 
 func main() {
-	if len(os.Args) > 1 {
-		switch os.Args[1] {
+	opts, args := cli.ParseGlobalFlags("vmrunner", os.Args[1:])
+	if err := cli.Setup(opts); err != nil {
+		log.Fatalf("vmrunner: %v", err)
+	}
+	globalOpts = opts
+	defer cli.Finish()
+
+	if len(args) > 0 {
+		switch args[0] {
 		case "run":
-			cmdRun(os.Args[2:])
+			cmdRun(args[1:])
 			return
 		case "exec":
-			cmdExec(os.Args[2:])
+			cmdExec(args[1:])
 			return
 		case "list":
-			cmdList()
+			cmdList(args[1:])
 			return
 		case "attach":
-			cmdAttach(os.Args[2:])
+			cmdAttach(args[1:])
+			return
+		case "logs":
+			cmdLogs(args[1:])
+			return
+		case "inspect":
+			cmdInspect(args[1:])
 			return
 		case "stop":
-			cmdStop(os.Args[2:])
+			cmdStop(args[1:])
 			return
 		case "kill":
-			cmdKill(os.Args[2:])
+			cmdKill(args[1:])
+			return
+		case "reap":
+			cmdReap(args[1:])
+			return
+		case "wait":
+			cmdWait(args[1:])
+			return
+		case "up":
+			cmdUp(args[1:])
+			return
+		case "down":
+			cmdDown(args[1:])
+			return
+		case "ps":
+			cmdPs(args[1:])
+			return
+		case "disk":
+			cmdDisk(args[1:])
+			return
+		case "share":
+			cmdShare(args[1:])
+			return
+		case "update":
+			cmdUpdate(args[1:])
+			return
+		case "save":
+			cmdSave(args[1:])
+			return
+		case "restore":
+			cmdRestore(args[1:])
 			return
 		case "help", "-h", "--help", "-help":
 			printUsage()
@@ -41,89 +90,392 @@ func main() {
 		}
 	}
 	// Backward compatibility: no subcommand → treat all args as "run".
-	cmdRun(os.Args[1:])
+	cmdRun(args)
 }
 
 func printUsage() {
-	fmt.Fprintf(os.Stderr, `Usage: vmrunner <command> [flags] [args]
+	fmt.Fprintf(os.Stderr, `Usage: vmrunner [global flags] <command> [flags] [args]
 
+Global flags:
+%s
 Commands:
   run    [flags]            Start a VM (detached, or interactive with -i)
   exec   [flags] <cmd...>  Run a command in a VM (starts VM if not running)
-  list                     List running VMs
+  list   [flags]           List VMs (default: those owned by vmrunner)
   attach <vm-id>           Connect to a running VM's serial console
-  stop   <vm-id>           Gracefully shut down a running VM
-  kill   <vm-id>           Forcibly terminate a running VM
+  logs   [flags] <vm-id>   Print a VM's console output, logged by vmrunnerd
+  inspect <vm-id>          Print a VM's recorded configuration and state
+  stop   [flags] <vm-id>   Shut down a running VM, gracefully if it can
+  kill   [flags] <vm-id>   Forcibly terminate a running VM
+  reap   [flags]           Stop the VMs past their -ttl or -idle-timeout
+  wait   <vm-id>           Wait for a VM to exit; the exit code tells how
+  up     [flags]           Start the VMs of a compose file in dependency order
+  down   [flags]           Stop the VMs of a compose file in reverse order
+  ps     [flags]           Show the state of a compose file's VMs
+  disk   attach|detach [flags] <vm-id> <path>
+                           Hot-plug a VHD/VHDX on the VM's SCSI bus
+  share  add [flags] <vm-id>
+                           Hot-add a Plan9 share of a host directory
+  update [flags] <vm-id>   Change a running VM's resources
+  save   [flags] <vm-id> <dir>
+                           Save a VM's state to dir (VM is terminated)
+  restore [flags] <dir>
+                           Start a VM from a state saved with save
   help                     Show this help
 
+Every command is served by vmrunnerd, which holds the VM handles and
+consoles, logs the consoles and records every VM it starts and every change
+made to it; it is started on first use if not running.
+Commands take a VM by ID, by the name it was run with (-name) or by a
+prefix of its ID that no other VM shares.
+
+Before creating a VM, vmrunner checks that the host has the memory (plus
+512 MB for itself) and logical processors for it, and that the VMs it runs
+stay within --memory-overcommit and --cpu-overcommit; a VM that does not fit
+is refused rather than left to fail in HCS.
+
 Run flags:
   -i                 Connect interactive shell (VM is shut down on exit)
-  -id string         VM identifier (default "vmrunner-vm")
+  -id string         VM identifier (default: a new GUID, printed on start)
+  -name string       Name the VM; commands accept it in place of the ID. No
+                     two running VMs share a name (-replace replaces the VM
+                     holding it)
+  -rm                Throwaway VM: its writes go to a differencing disk over
+                     the image's rootfs.vhdx, in the state directory, and
+                     the VM, disk, console log and record are removed once
+                     it exits (with -i: when the shell ends or on Ctrl+C)
   -memory uint       Memory in MB (default 2048)
   -cpu uint          Number of virtual CPUs (default 2)
   -image-dir string  VM image directory (default C:\source\hcsshim\vm-image)
   -kernel-args       Override kernel command line
+  -stop-command cmd  Console command that shuts the guest down, typed by
+                     stop (default poweroff)
+  -hooks file        JSON file of host executables to run around start and
+                     stop (see Hooks below)
+  -replace           Terminate an existing VM with the same ID first (run
+                     fails if the ID is taken otherwise)
+  -force             With -replace, also replace a system that Docker or
+                     another tool owns
+  -wait-for-capacity duration
+                     If the host cannot take the VM yet (see --memory-
+                     overcommit and --cpu-overcommit), wait up to this long
+                     for other VMs to free resources instead of failing
+  -restart policy    Restart the VM when it exits: no (default), always, or
+                     on-failure[:max] (only after a crash or failed exit, at
+                     most max times); vmrunnerd retries with backoff
+  -wait-ready[=timeout]
+                     Return only once the guest is ready (default timeout
+                     2m); exits non-zero with the last console output if
+                     the VM fails or times out first
+  -label key=value   Label the VM (repeatable); see Labels below
+  -ttl duration      Stop the VM this long after it is run (e.g. 2h), even
+                     across restarts; see Reap below
+  -idle-timeout duration
+                     Stop the VM once its console has seen neither input
+                     nor output for this long (e.g. 30m)
+  -ready-probe probe How -wait-ready tells the guest is ready (implies it):
+                     prompt (default; a shell prompt on the console),
+                     regex:<expr> (console output matches), marker[:<text>]
+                     (init echoes text, default VMRUNNER-READY) or
+                     vsock:<port> (a guest service accepts connections)
   -debug             Print HCS JSON config before creating VM
 
 Exec flags:
-  -id string         VM identifier to target (default "vmrunner-vm")
+  -id string         VM to target: an ID, name or ID prefix; an unknown
+                     one is started under that ID (default "vmrunner-vm")
   -memory uint       Memory in MB if VM needs to be started (default 2048)
   -cpu uint          CPUs if VM needs to be started (default 2)
   -image-dir string  Image directory if VM needs to be started
   -debug             Print HCS JSON config if VM needs to be started
+  -ttl, -idle-timeout
+                     As for run, if VM needs to be started
+  -gcs               Run via the guest GCS (HcsCreateProcess) instead of the
+                     serial console; exits with the guest exit code
+  -rm                Run in a new VM (ID from -id, else generated) that
+                     writes to a scratch disk and is removed, disk included,
+                     when the command ends or on Ctrl+C
+  -selector, -all    Run in every matching running VM instead (see Bulk
+                     flags); output lines are prefixed with [vm-id]
+
+Stop flags:
+  -timeout duration  How long each graceful step may take (default 30s)
+  -command string    Console command to type instead of the VM's
+                     -stop-command
+  stop types the command on the serial console and waits for the VM to
+  exit, then asks HCS to shut it down (needs the GCS guest agent), and
+  terminates it only if both fail.
+
+Bulk flags (stop, kill, exec):
+  -selector sel      Act on every running VM whose labels match sel
+                     (repeatable; see Labels below) instead of one ID
+  -all               Act on every running VM vmrunner owns
+  -parallel n        VMs handled at once (default 8)
+  Each VM's result is logged; the command fails if any VM failed.
+
+Reap flags:
+  -list              List the VMs due and why without stopping them
+  vmrunnerd reaps every minute: it stops the VMs past their -ttl or
+  -idle-timeout as stop does, and cancels the pending restarts of those
+  past their TTL. reap does the same at once, for a scheduler; with
+  --no-daemon it also works while vmrunnerd is not running. Without
+  vmrunnerd nothing watches the consoles, so a VM counts as idle from the
+  last activity a reap recorded, else from when it was run. The exit
+  reason is recorded (see inspect), and -rm VMs are removed.
+
+Wait:
+  wait prints how the VM exited (its last exit at once if it is not
+  running) and exits with a code per reason; inspect shows the details
+  under LastExit:
+    0  GuestShutdown  the guest shut down cleanly (poweroff, or stop)
+    3  HostTerminate  the host terminated it (kill, or stop escalating)
+    4  GuestCrash     the guest crashed
+    5  Unexpected     it failed or vanished without being asked to stop
+  1 and 2 are vmrunner's own errors and usage errors, as for every command.
+
+Logs flags:
+  -f                 Follow: keep printing new output until the VM exits
+                     for good
+  -since t           Only lines since a duration ago (10m) or an RFC 3339
+                     time
+  -tail n            Only the last n lines (default: all)
+  -t                 Prefix each line with the time it was logged
+  Logs are kept in the state directory, in three files of up to 10 MiB.
+
+List flags:
+  -all               List compute systems of every owner (Docker, …)
+  -owner string      List systems of this owner only
+  -filter key=value  Filter on id, state or type; repeatable
+                     (same key ORs, different keys AND)
+  -q                 Print IDs only
+  -exited            Also list VMs that have exited (from the state store)
+  -l selector        Only VMs whose labels match; repeatable
+
+Labels:
+  run -label key=value records labels with the VM. A selector is a
+  comma-separated list of requirements, all of which must hold: key=value,
+  key!=value, key (label set) or !key (label not set). Keys may not contain
+  '=', ',', '!' or spaces, and values may not contain ','.
+
+Compose flags (up, down, ps):
+  -f file            Compose file (default vmrunner.compose.yaml)
+  -p name            Project name (default: the file's name key, else its
+                     directory's name); VMs are named <project>-<vm>
+  -parallel n        VMs started or stopped at once (default 4; up, down)
+  -replace, -force   Replace running VMs of the project (up; as for run)
+  -wait-for-capacity duration
+                     As for run (up)
+  -timeout duration  As for stop (down)
+
+Compose file:
+  name: itest
+  vms:
+    server:
+      memory: 4096                  # also cpus, imageDir, kernelArgs,
+      ready:                        # restart, stopCommand, hooks, labels
+        probe: marker:SERVER-UP     # as for -ready-probe (default prompt)
+        timeout: 90s
+    client:
+      dependsOn: [server]           # started once server is up (and ready)
+  Relative paths are relative to the compose file. Each VM is labelled
+  vmrunner.compose.project and vmrunner.compose.vm.
+
+Disk flags:
+  -controller uint   SCSI controller (default 0, the only one VMs have)
+  -lun uint          SCSI LUN (default 1; 0:0 is the root disk)
+  -readonly          Attach read-only (attach only)
+
+Share flags:
+  -path string       Host directory to share (required)
+  -name string       Share name seen by the guest (default: base name of -path)
+  -readonly          Share read-only
+
+Update flags:
+  -memory uint       New memory size in MB
+  disk, share and update go through vmrunnerd, which records the change:
+  a restart under the VM's restart policy keeps its memory size, disks
+  and shares.
+
+Save flags:
+  -leave-running     Resume the VM after saving instead of terminating it
+  The snapshot records the configuration the VM was run with, from the
+  state store, disks and shares added since included; VMs started without
+  vmrunner, or run with -rm, cannot be saved. Every disk of the VM must
+  still exist, unmodified, to restore it.
+
+Restore flags:
+  -id string         ID for the restored VM (default: the saved VM's ID)
+  -replace, -force, -wait-for-capacity
+                     As for run
+  The restored VM keeps the saved VM's restart policy, TTL and labels;
+  when it is restarted it boots afresh rather than from the snapshot.
+
+Hooks:
+  A hooks file lists executables per stage; all fields but path are optional:
+    {"preStart":  [{"path": "C:\\lab\\inventory.exe", "args": ["add"]}],
+     "postStop":  [{"path": "C:\\lab\\inventory.exe", "args": ["remove"],
+                    "timeout": "10s", "onFailure": "warn"}]}
+  Stages are preStart, postStart, preStop and postStop (which runs however
+  the VM exits). Hooks get VMRUNNER_HOOK, VMRUNNER_VM_ID, VMRUNNER_PIPE and
+  VMRUNNER_IMAGE_DIR, and postStop also VMRUNNER_STATE,
+  VMRUNNER_EXIT_REASON (GuestShutdown, HostTerminate, GuestCrash or
+  Unexpected, as wait reports it) and VMRUNNER_EXIT_DETAIL. A failing pre-
+  hook aborts the start or stop by default; a failing post- hook is logged
+  ("onFailure": "abort" or "warn" overrides). Hooks time out after 30s
+  unless given a timeout.
 
 Examples:
   vmrunner run                        # start VM, detach
   vmrunner run -i                     # start VM, interactive shell
   vmrunner run -memory 4096 -cpu 4 -i
+  vmrunner run -name web              # prints the new VM's ID
+  vmrunner run -id soak-1 -restart on-failure:5
+  vmrunner run -wait-ready=90s -ready-probe 'regex:login:'
+  vmrunner run -memory 8192 -wait-for-capacity 10m
   vmrunner exec ls -la                # run command (start VM if needed)
   vmrunner exec -id my-vm ls -la
+  vmrunner exec -rm make test         # in a throwaway VM
+  vmrunner run -rm -i                 # shell in a throwaway VM
   vmrunner list
+  vmrunner list --all --filter state=Running
+  vmrunner list -q
+  vmrunner run -id st-1 -label team=storage -label ttl=1h
+  vmrunner list -l team=storage
+  vmrunner stop -selector team=storage
+  vmrunner exec -all uname -r         # in every running VM
   vmrunner attach vmrunner-vm
+  vmrunner attach web                 # by name
+  vmrunner stop 3f2a                  # by ID prefix
+  vmrunner logs -f -tail 50 vmrunner-vm
+  vmrunner inspect vmrunner-vm
   vmrunner stop   vmrunner-vm
+  vmrunner stop -timeout 10s -command "shutdown -h now" vmrunner-vm
   vmrunner kill   vmrunner-vm
-`)
+  vmrunner run -ttl 2h -idle-timeout 30m -name ci-build
+  vmrunner reap -list
+  vmrunner wait ci-build || echo "exited badly: $?"
+  vmrunner up -f itest.compose.yaml   # start server, then client
+  vmrunner ps -f itest.compose.yaml
+  vmrunner down -f itest.compose.yaml
+  vmrunner disk attach -lun 2 vmrunner-vm C:\disks\data.vhdx
+  vmrunner share add -path C:\src vmrunner-vm
+  vmrunner update --memory 4096 vmrunner-vm
+  vmrunner save vmrunner-vm C:\snapshots\booted
+  vmrunner restore -id test-1 C:\snapshots\booted
+`, cli.GlobalUsage)
 }
 
 // runFlags holds flags shared between cmdRun and cmdExec.
 type runFlags struct {
-	imageDir   string
-	memoryMB   uint
-	cpuCount   uint
-	kernelArgs string
-	vmID       string
-	debug      bool
+	imageDir    string
+	memoryMB    uint
+	cpuCount    uint
+	kernelArgs  string
+	vmID        string
+	debug       bool
+	ttl         time.Duration
+	idleTimeout time.Duration
 }
 
 func addRunFlags(fs *flag.FlagSet) *runFlags {
 	f := &runFlags{}
-	fs.StringVar(&f.imageDir,   "image-dir",    `C:\source\hcsshim\vm-image`, "VM image directory (Windows path)")
-	fs.UintVar(&f.memoryMB,     "memory",        2048,          "Memory size in MB")
-	fs.UintVar(&f.cpuCount,     "cpu",           2,             "Number of virtual CPUs")
+	fs.StringVar(&f.imageDir,   "image-dir",    config.DefaultImageDir, "VM image directory (Windows path)")
+	fs.UintVar(&f.memoryMB,     "memory",        config.DefaultMemoryMB, "Memory size in MB")
+	fs.UintVar(&f.cpuCount,     "cpu",           config.DefaultCPUCount, "Number of virtual CPUs")
 	fs.StringVar(&f.kernelArgs, "kernel-args",  "",             "Override kernel command line")
-	fs.StringVar(&f.vmID,       "id",            "vmrunner-vm", "VM identifier")
+	fs.StringVar(&f.vmID,       "id",            "",            "VM identifier (default: a new GUID)")
 	fs.BoolVar(&f.debug,        "debug",         false,         "Print HCS JSON config before creating VM")
+	fs.DurationVar(&f.ttl,         "ttl",          0, "Stop the VM this long after it is run (e.g. 2h)")
+	fs.DurationVar(&f.idleTimeout, "idle-timeout", 0, "Stop the VM once its console has been idle this long (e.g. 30m)")
 	return f
 }
 
 func (f *runFlags) vmConfig() config.VMConfig {
 	cfg := config.VMConfig{
-		ImageDir:   f.imageDir,
-		MemoryMB:   uint32(f.memoryMB),
-		CPUCount:   uint32(f.cpuCount),
-		KernelArgs: f.kernelArgs,
-		VMID:       f.vmID,
+		ImageDir:    f.imageDir,
+		MemoryMB:    uint32(f.memoryMB),
+		CPUCount:    uint32(f.cpuCount),
+		KernelArgs:  f.kernelArgs,
+		VMID:        f.vmID,
+		TTL:         config.Duration(f.ttl),
+		IdleTimeout: config.Duration(f.idleTimeout),
+	}
+	if f.vmID != "" {
+		// Otherwise vmrunnerd picks the ID and with it the pipe.
+		cfg.PipeName = config.ConsolePipe(f.vmID)
 	}
-	cfg.PipeName = fmt.Sprintf(`\\.\pipe\%s-console`, f.vmID)
 	return cfg
 }
 
+// addStartFlags adds the flags that allow replacing an existing system.
+func addStartFlags(fs *flag.FlagSet) *vm.StartOptions {
+	opts := &vm.StartOptions{}
+	fs.BoolVar(&opts.Replace, "replace", false, "Terminate an existing VM with the same ID first")
+	fs.BoolVar(&opts.Force, "force", false, "With -replace, also replace a system vmrunner does not own")
+	fs.DurationVar(&opts.WaitForCapacity, "wait-for-capacity", 0, "Wait up to this long for host capacity instead of failing at once")
+	return opts
+}
+
+// waitReadyFlag is -wait-ready[=timeout]. A bare -wait-ready waits up to
+// vm.DefaultReadyTimeout.
+type waitReadyFlag struct {
+	set     bool
+	timeout time.Duration
+}
+
+func (f *waitReadyFlag) String() string {
+	if !f.set {
+		return ""
+	}
+	return f.timeout.String()
+}
+
+func (f *waitReadyFlag) IsBoolFlag() bool { return true }
+
+func (f *waitReadyFlag) Set(s string) error {
+	switch s {
+	case "true":
+		f.set, f.timeout = true, vm.DefaultReadyTimeout
+	case "false":
+		f.set = false
+	default:
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("want a timeout such as 90s")
+		}
+		f.set, f.timeout = true, d
+	}
+	return nil
+}
+
+// startHint explains how to get past an ID that is already taken or a host
+// that is full.
+func startHint(err error) string {
+	switch {
+	case api.IsExists(err):
+		return "\n(use -replace to terminate it first; systems of other owners also need -force)"
+	case api.IsCapacity(err):
+		return "\n(use -wait-for-capacity to wait for other VMs to free resources; --memory-overcommit and --cpu-overcommit set the limits)"
+	}
+	return ""
+}
+
 // cmdRun starts a VM. With -i it attaches an interactive shell and shuts the
 // VM down on exit. Without -i it detaches immediately (VM keeps running).
 func cmdRun(args []string) {
 	fs := flag.NewFlagSet("run", flag.ExitOnError)
 	f := addRunFlags(fs)
+	name := fs.String("name", "", "Name the VM; commands accept it in place of the ID")
+	rm := fs.Bool("rm", false, "Write to a scratch disk, not the image's rootfs.vhdx, and remove the VM once it exits")
 	interactive := fs.Bool("i", false, "Interactive shell mode (VM is shut down on exit)")
+	restart := fs.String("restart", "no", "Restart policy: no, on-failure[:max] or always")
+	stopCommand := fs.String("stop-command", "", "Console command that shuts the guest down (default poweroff)")
+	hooksFile := fs.String("hooks", "", "JSON file of host hooks to run around start and stop")
+	startOpts := addStartFlags(fs)
+	var waitReady waitReadyFlag
+	fs.Var(&waitReady, "wait-ready", "Wait until the guest is ready, up to the given timeout (default 2m)")
+	readyProbe := fs.String("ready-probe", "", "Readiness probe: prompt, regex:<expr>, marker[:<text>] or vsock:<port> (implies -wait-ready)")
+	var labels stringList
+	fs.Var(&labels, "label", "Label the VM with key=value; repeatable")
 	trace := fs.Bool("trace", false, "") // superset of -debug; omitted from help
 	_ = fs.Parse(args)
 
@@ -133,6 +485,54 @@ func cmdRun(args []string) {
 	}
 
 	cfg := f.vmConfig()
+	if *name != "" {
+		if err := config.CheckName(*name); err != nil {
+			log.Fatalf("run: %v", err)
+		}
+		cfg.Name = *name
+	}
+	policy, err := config.ParseRestartPolicy(*restart)
+	if err != nil {
+		log.Fatalf("run: %v", err)
+	}
+	if policy.Name != config.RestartNo && globalOpts.Local() {
+		log.Printf("[vmrunner] warning: restart policy %s is not applied without vmrunnerd", policy)
+	}
+	cfg.Restart = policy
+	if (cfg.TTL > 0 || cfg.IdleTimeout > 0) && globalOpts.Local() {
+		log.Printf("[vmrunner] warning: -ttl and -idle-timeout are only enforced by vmrunnerd or vmrunner reap")
+	}
+	if *rm {
+		if policy.Name != config.RestartNo {
+			log.Fatal("run: -rm and -restart cannot be combined")
+		}
+		cfg.Remove = true
+	}
+	ready := vm.ReadyOptions{Probe: vm.ReadyProbe{Kind: vm.ProbePrompt}, Timeout: waitReady.timeout}
+	if *readyProbe != "" {
+		if ready.Probe, err = vm.ParseReadyProbe(*readyProbe); err != nil {
+			log.Fatalf("run: %v", err)
+		}
+		waitReady.set = true
+	}
+	cfg.StopCommand = *stopCommand
+	for _, l := range labels {
+		k, v, err := config.ParseLabel(l)
+		if err != nil {
+			log.Fatalf("run: %v", err)
+		}
+		if cfg.Labels == nil {
+			cfg.Labels = map[string]string{}
+		}
+		cfg.Labels[k] = v
+	}
+	if *hooksFile != "" {
+		hooks, err := config.LoadHooks(*hooksFile)
+		if err != nil {
+			log.Fatalf("run: %v", err)
+		}
+		cfg.Hooks = hooks
+	}
 
 	if f.debug {
 		j, err := config.BuildJSON(cfg)
@@ -142,47 +542,64 @@ func cmdRun(args []string) {
 		log.Printf("[vmrunner] HCS config JSON:\n%s", j)
 	}
 
-	machine, err := vm.Start(cfg)
+	client := connect()
+	info, err := client.Run(cfg, *startOpts)
 	if err != nil {
-		log.Fatalf("failed to start VM: %v", err)
+		log.Fatalf("failed to start VM: %v%s", err, startHint(err))
 	}
-	log.Printf("[vmrunner] VM %q started", f.vmID)
+	id := info.ID
+	log.Printf("[vmrunner] VM %q started", id)
 
-	if !*interactive {
-		// Detached: release the handle and exit. The VM keeps running.
-		if err := machine.Close(); err != nil {
-			log.Printf("[vmrunner] close handle: %v", err)
+	if waitReady.set {
+		// A throwaway VM is not left behind by giving up on it.
+		stop := func() {}
+		if *rm {
+			stop = onInterrupt(1, func() { discard(client, id) })
+		}
+		log.Printf("[vmrunner] waiting for VM %q to be ready (probe %s)", id, ready.Probe)
+		if err := client.Ready(id, ready); err != nil {
+			if *rm {
+				discard(client, id)
+			}
+			log.Fatalf("run: %v", err)
 		}
+		stop()
+		log.Printf("[vmrunner] VM %q ready", id)
+	}
+
+	if !*interactive {
+		// Detached: the daemon keeps the VM's handle and console. Print
+		// the ID for scripts.
+		fmt.Println(id)
 		return
 	}
 
 	// Interactive mode: connect console, shut down VM on exit.
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		sig := <-sigCh
-		log.Printf("[vmrunner] received signal %v, shutting down VM", sig)
-		if err := machine.Shutdown(); err != nil {
-			log.Printf("[vmrunner] shutdown error: %v", err)
-		}
-		os.Exit(0)
-	}()
-
-	if err := machine.InteractiveShell(cfg.PipeName); err != nil {
-		log.Printf("[vmrunner] interactive shell ended: %v", err)
+	console, err := client.Attach(id)
+	if err != nil {
+		log.Fatalf("attach %q: %v", id, err)
 	}
+	onInterrupt(0, func() { shutdown(client, id, *rm) })
 
-	if err := machine.Shutdown(); err != nil {
-		log.Printf("[vmrunner] shutdown error: %v", err)
+	if err := vm.Terminal(console); err != nil {
+		log.Printf("[vmrunner] interactive shell ended: %v", err)
 	}
+	console.Close()
+	shutdown(client, id, *rm)
 }
 
+// defaultExecID is the VM exec targets, and starts, without -id.
+const defaultExecID = "vmrunner-vm"
+
 // cmdExec runs a command inside a VM via the serial console.
 // If the VM is not already running it is started and left running after the
 // command completes (detached).
 func cmdExec(args []string) {
 	fs := flag.NewFlagSet("exec", flag.ExitOnError)
 	f := addRunFlags(fs)
+	gcs := fs.Bool("gcs", false, "Run the command as a GCS process and exit with its exit code")
+	rm := fs.Bool("rm", false, "Run the command in a new throwaway VM, removed with its scratch disk when the command ends")
+	sel := addSelectorFlags(fs)
 	trace := fs.Bool("trace", false, "") // hidden; superset of -debug
 	_ = fs.Parse(args)
 
@@ -196,25 +613,103 @@ func cmdExec(args []string) {
 		log.Fatal("exec: command required\nusage: vmrunner exec [flags] <cmd> [args...]")
 	}
 
-	cfg := f.vmConfig()
-
-	if f.debug {
-		j, err := config.BuildJSON(cfg)
-		if err != nil {
-			log.Fatalf("config build error: %v", err)
+	req := api.ExecRequest{Args: cmdArgs, GCS: *gcs}
+	if *rm {
+		if sel.set() {
+			log.Fatal("exec: -rm cannot be combined with -selector or -all")
 		}
-		log.Printf("[vmrunner] HCS config JSON:\n%s", j)
+		execRemoved(f.vmConfig(), req)
+		return
+	}
+	if f.vmID == "" {
+		f.vmID = defaultExecID
+	}
+	if sel.set() {
+		// Only VMs already running are selected; none is started.
+		sel.bulkExec(connect(), req)
+		return
+	}
+	if !*gcs {
+		// The serial console path starts the VM if it is not running.
+		cfg := f.vmConfig()
+		if f.debug {
+			j, err := config.BuildJSON(cfg)
+			if err != nil {
+				log.Fatalf("config build error: %v", err)
+			}
+			log.Printf("[vmrunner] HCS config JSON:\n%s", j)
+		}
+		req.Config = &cfg
 	}
 
-	if err := vm.Exec(cfg, cmdArgs); err != nil {
+	code, err := connect().Exec(f.vmID, req, os.Stdout, os.Stderr)
+	if err != nil {
 		log.Fatalf("exec: %v", err)
 	}
+	if *gcs {
+		cli.Exit(code)
+	}
 }
 
-func cmdList() {
-	if err := vm.List(); err != nil {
+// execRemoved runs req in a new VM started with cfg and removed, with its
+// scratch disk, once the command ends or is interrupted.
+func execRemoved(cfg config.VMConfig, req api.ExecRequest) {
+	cfg.Remove = true
+	client := connect()
+	info, err := client.Run(cfg, vm.StartOptions{})
+	if err != nil {
+		log.Fatalf("exec: failed to start VM: %v%s", err, startHint(err))
+	}
+	id := info.ID
+	log.Printf("[vmrunner] VM %q started", id)
+	stop := onInterrupt(130, func() { discard(client, id) })
+
+	if req.GCS {
+		// The console path waits for the shell itself; the guest agent
+		// is up by then too.
+		prompt := vm.ReadyOptions{Probe: vm.ReadyProbe{Kind: vm.ProbePrompt}}
+		if err := client.Ready(id, prompt); err != nil {
+			discard(client, id)
+			log.Fatalf("exec: %v", err)
+		}
+	}
+	code, err := client.Exec(id, req, os.Stdout, os.Stderr)
+	stop()
+	discard(client, id)
+	if err != nil {
+		log.Fatalf("exec: %v", err)
+	}
+	if req.GCS {
+		cli.Exit(code)
+	}
+}
+
+func cmdList(args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	var opts vm.ListOptions
+	fs.BoolVar(&opts.All, "all", false, "List systems of every owner")
+	fs.StringVar(&opts.Owner, "owner", "", "List systems of this owner only")
+	fs.Var((*stringList)(&opts.Filters), "filter", "Filter by key=value (id, state, type); repeatable")
+	fs.Var((*stringList)(&opts.Labels), "l", "Filter by label selector (k=v, k!=v, k, !k); repeatable")
+	fs.BoolVar(&opts.Quiet, "q", false, "Print IDs only")
+	fs.BoolVar(&opts.Exited, "exited", false, "Also list VMs that have exited")
+	_ = fs.Parse(args)
+
+	vms, err := connect().List(opts)
+	if err != nil {
 		log.Fatalf("list: %v", err)
 	}
+	api.WriteList(os.Stdout, vms, opts.Quiet)
+}
+
+// stringList is a flag.Value collecting every occurrence of a repeatable flag.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
 }
 
 func cmdAttach(args []string) {
@@ -225,35 +720,359 @@ func cmdAttach(args []string) {
 		log.Fatal("attach: VM ID required\nusage: vmrunner attach <vm-id>")
 	}
 	id := fs.Arg(0)
-	if err := vm.Attach(id); err != nil {
+	console, err := connect().Attach(id)
+	if err != nil {
+		log.Fatalf("attach %q: %v", id, err)
+	}
+	defer console.Close()
+	log.Printf("[vmrunner] attached to VM %q", id)
+	if err := vm.Terminal(console); err != nil {
 		log.Fatalf("attach %q: %v", id, err)
 	}
 }
 
+func cmdLogs(args []string) {
+	fs := flag.NewFlagSet("logs", flag.ExitOnError)
+	follow := fs.Bool("f", false, "Keep printing new output until the VM exits for good")
+	since := fs.String("since", "", "Only lines since a duration ago (10m) or an RFC 3339 time")
+	tail := fs.Int("tail", -1, "Only the last n lines (default: all)")
+	timestamps := fs.Bool("t", false, "Prefix each line with the time it was logged")
+	_ = fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		log.Fatal("logs: VM ID required\nusage: vmrunner logs [-f] [-since t] [-tail n] [-t] <vm-id>")
+	}
+	id := fs.Arg(0)
+	opts := consolelog.ReadOptions{Tail: *tail, Follow: *follow, Timestamps: *timestamps}
+	if *since != "" {
+		t, err := consolelog.ParseSince(*since, time.Now())
+		if err != nil {
+			log.Fatalf("logs: %v", err)
+		}
+		opts.Since = t
+	}
+	if err := connect().Logs(id, opts, os.Stdout); err != nil {
+		log.Fatalf("logs %q: %v", id, err)
+	}
+}
+
+func cmdInspect(args []string) {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	_ = fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		log.Fatal("inspect: VM ID required\nusage: vmrunner inspect <vm-id>")
+	}
+	id := fs.Arg(0)
+	rec, err := connect().Inspect(id)
+	if err != nil {
+		log.Fatalf("inspect %q: %v", id, err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(rec); err != nil {
+		log.Fatalf("inspect %q: %v", id, err)
+	}
+}
+
 func cmdStop(args []string) {
 	fs := flag.NewFlagSet("stop", flag.ExitOnError)
+	var opts vm.StopOptions
+	fs.DurationVar(&opts.Timeout, "timeout", vm.DefaultStopTimeout, "How long each graceful step may take before escalating")
+	fs.StringVar(&opts.Command, "command", "", "Console command that shuts the guest down (default: the VM's -stop-command, else poweroff)")
+	sel := addSelectorFlags(fs)
 	_ = fs.Parse(args)
 
+	if sel.set() {
+		client := connect()
+		sel.bulk(client, "stop", "stopped", func(id string) error { return client.Stop(id, opts) })
+		return
+	}
 	if fs.NArg() < 1 {
-		log.Fatal("stop: VM ID required\nusage: vmrunner stop <vm-id>")
+		log.Fatal("stop: VM ID required\nusage: vmrunner stop [-timeout 30s] [-command cmd] <vm-id>|-selector sel|-all")
 	}
 	id := fs.Arg(0)
-	if err := vm.Stop(id); err != nil {
+	if err := connect().Stop(id, opts); err != nil {
 		log.Fatalf("stop %q: %v", id, err)
 	}
 	log.Printf("[vmrunner] VM %q stopped", id)
 }
 
+// addComposeFlags adds the flags naming a compose project and returns a
+// function loading it once the flags are parsed.
+func addComposeFlags(fs *flag.FlagSet) func() *compose.Project {
+	file := fs.String("f", compose.DefaultFile, "Compose file")
+	name := fs.String("p", "", "Project name (default: the file's name key, else its directory's name)")
+	return func() *compose.Project {
+		p, err := compose.Load(*file, *name)
+		if err != nil {
+			log.Fatalf("%s: %v", fs.Name(), err)
+		}
+		return p
+	}
+}
+
+func cmdUp(args []string) {
+	fs := flag.NewFlagSet("up", flag.ExitOnError)
+	load := addComposeFlags(fs)
+	parallel := fs.Int("parallel", compose.DefaultParallel, "VMs started at once")
+	startOpts := addStartFlags(fs)
+	_ = fs.Parse(args)
+
+	p := load()
+	opts := compose.UpOptions{Parallel: *parallel, Start: *startOpts}
+	if err := compose.Up(connect(), p, opts); err != nil {
+		log.Fatalf("up %s: %v%s", p.Name, err, startHint(err))
+	}
+	log.Printf("[vmrunner] project %s up", p.Name)
+}
+
+func cmdDown(args []string) {
+	fs := flag.NewFlagSet("down", flag.ExitOnError)
+	load := addComposeFlags(fs)
+	parallel := fs.Int("parallel", compose.DefaultParallel, "VMs stopped at once")
+	var opts vm.StopOptions
+	fs.DurationVar(&opts.Timeout, "timeout", vm.DefaultStopTimeout, "How long each graceful step may take before escalating")
+	_ = fs.Parse(args)
+
+	p := load()
+	if err := compose.Down(connect(), p, *parallel, opts); err != nil {
+		log.Fatalf("down %s: %v", p.Name, err)
+	}
+	log.Printf("[vmrunner] project %s down", p.Name)
+}
+
+func cmdPs(args []string) {
+	fs := flag.NewFlagSet("ps", flag.ExitOnError)
+	load := addComposeFlags(fs)
+	_ = fs.Parse(args)
+
+	p := load()
+	rows, err := compose.PS(connect(), p)
+	if err != nil {
+		log.Fatalf("ps %s: %v", p.Name, err)
+	}
+	compose.WritePS(os.Stdout, rows)
+}
+
 func cmdKill(args []string) {
 	fs := flag.NewFlagSet("kill", flag.ExitOnError)
+	sel := addSelectorFlags(fs)
 	_ = fs.Parse(args)
 
+	if sel.set() {
+		client := connect()
+		sel.bulk(client, "kill", "terminated", client.Kill)
+		return
+	}
 	if fs.NArg() < 1 {
-		log.Fatal("kill: VM ID required\nusage: vmrunner kill <vm-id>")
+		log.Fatal("kill: VM ID required\nusage: vmrunner kill <vm-id>|-selector sel|-all")
 	}
 	id := fs.Arg(0)
-	if err := vm.Kill(id); err != nil {
+	if err := connect().Kill(id); err != nil {
 		log.Fatalf("kill %q: %v", id, err)
 	}
 	log.Printf("[vmrunner] VM %q terminated", id)
 }
+
+// cmdReap stops the VMs past their TTL or idle timeout now, rather than at
+// vmrunnerd's next reap.
+func cmdReap(args []string) {
+	fs := flag.NewFlagSet("reap", flag.ExitOnError)
+	list := fs.Bool("list", false, "List the VMs due without stopping them")
+	_ = fs.Parse(args)
+
+	reaped, err := connect().Reap(*list)
+	if err != nil {
+		log.Fatalf("reap: %v", err)
+	}
+	if len(reaped) == 0 {
+		log.Printf("[vmrunner] reap: no VMs due")
+		return
+	}
+	failed := 0
+	for _, r := range reaped {
+		switch {
+		case *list:
+			log.Printf("[vmrunner] VM %q due: %s", r.ID, r.Reason)
+		case r.Error != "":
+			failed++
+			log.Printf("[vmrunner] VM %q: reap failed (%s): %s", r.ID, r.Reason, r.Error)
+		default:
+			log.Printf("[vmrunner] VM %q reaped: %s", r.ID, r.Reason)
+		}
+	}
+	if failed > 0 {
+		log.Fatalf("reap: %d of %d VMs failed", failed, len(reaped))
+	}
+}
+
+// waitExitCodes are the exit codes of wait per exit reason, clear of 1 and
+// 2, which vmrunner exits with on its own errors.
+var waitExitCodes = map[vm.ExitReason]int{
+	vm.ExitGuestShutdown: 0,
+	vm.ExitHostTerminate: 3,
+	vm.ExitGuestCrash:    4,
+	vm.ExitUnexpected:    5,
+}
+
+func cmdWait(args []string) {
+	fs := flag.NewFlagSet("wait", flag.ExitOnError)
+	_ = fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		log.Fatal("wait: VM ID required\nusage: vmrunner wait <vm-id>")
+	}
+	id := fs.Arg(0)
+	x, err := connect().Wait(id)
+	if err != nil {
+		log.Fatalf("wait %q: %v", id, err)
+	}
+	fmt.Println(x.Reason)
+	if x.Detail != "" {
+		log.Printf("[vmrunner] VM %q exited at %s: %s", id, x.Time.Local().Format(time.RFC3339), x)
+	}
+	code, ok := waitExitCodes[x.Reason]
+	if !ok {
+		code = waitExitCodes[vm.ExitUnexpected]
+	}
+	cli.Exit(code)
+}
+
+func cmdDisk(args []string) {
+	const usage = "usage: vmrunner disk attach|detach [flags] <vm-id> <path>"
+	if len(args) < 1 {
+		log.Fatal("disk: subcommand required\n" + usage)
+	}
+	op := args[0]
+	if op != "attach" && op != "detach" {
+		log.Fatalf("disk: unknown subcommand %q\n%s", op, usage)
+	}
+
+	fs := flag.NewFlagSet("disk "+op, flag.ExitOnError)
+	controller := fs.Uint("controller", 0, "SCSI controller")
+	lun := fs.Uint("lun", 1, "SCSI LUN")
+	readOnly := fs.Bool("readonly", false, "Attach read-only")
+	_ = fs.Parse(args[1:])
+
+	if fs.NArg() < 2 {
+		log.Fatalf("disk %s: VM ID and disk path required\n%s", op, usage)
+	}
+	id := fs.Arg(0)
+	// vmrunnerd opens the disk, from another working directory.
+	path, err := filepath.Abs(fs.Arg(1))
+	if err != nil {
+		log.Fatalf("disk %s: %v", op, err)
+	}
+	disk := &config.SCSIDisk{
+		Controller: *controller,
+		LUN:        *lun,
+		Path:       path,
+		ReadOnly:   *readOnly,
+	}
+
+	if op == "attach" {
+		if err := connect().Update(id, api.UpdateRequest{AttachDisk: disk}); err != nil {
+			log.Fatalf("disk attach %q: %v", id, err)
+		}
+		log.Printf("[vmrunner] disk %q attached to VM %q", path, id)
+		return
+	}
+	if err := connect().Update(id, api.UpdateRequest{DetachDisk: disk}); err != nil {
+		log.Fatalf("disk detach %q: %v", id, err)
+	}
+	log.Printf("[vmrunner] disk %q detached from VM %q", path, id)
+}
+
+func cmdShare(args []string) {
+	const usage = "usage: vmrunner share add -path <host-dir> [-name name] [-readonly] <vm-id>"
+	if len(args) < 1 || args[0] != "add" {
+		log.Fatal("share: subcommand required\n" + usage)
+	}
+
+	fs := flag.NewFlagSet("share add", flag.ExitOnError)
+	path := fs.String("path", "", "Host directory to share")
+	name := fs.String("name", "", "Share name seen by the guest")
+	readOnly := fs.Bool("readonly", false, "Share read-only")
+	_ = fs.Parse(args[1:])
+
+	if fs.NArg() < 1 || *path == "" {
+		log.Fatal("share add: VM ID and -path required\n" + usage)
+	}
+	id := fs.Arg(0)
+	hostPath, err := filepath.Abs(*path)
+	if err != nil {
+		log.Fatalf("share add: %v", err)
+	}
+	share := &config.Plan9Share{
+		Name:     *name,
+		HostPath: hostPath,
+		ReadOnly: *readOnly,
+	}
+	if share.Name == "" {
+		share.Name = filepath.Base(hostPath)
+	}
+	if err := connect().Update(id, api.UpdateRequest{AddShare: share}); err != nil {
+		log.Fatalf("share add %q: %v", id, err)
+	}
+	log.Printf("[vmrunner] share %q added to VM %q (vsock port %d)", share.Name, id, config.Plan9Port)
+}
+
+func cmdUpdate(args []string) {
+	fs := flag.NewFlagSet("update", flag.ExitOnError)
+	memoryMB := fs.Uint("memory", 0, "New memory size in MB")
+	_ = fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		log.Fatal("update: VM ID required\nusage: vmrunner update --memory <MB> <vm-id>")
+	}
+	if *memoryMB == 0 {
+		log.Fatal("update: nothing to change\nusage: vmrunner update --memory <MB> <vm-id>")
+	}
+	id := fs.Arg(0)
+	if err := connect().Update(id, api.UpdateRequest{MemoryMB: uint32(*memoryMB)}); err != nil {
+		log.Fatalf("update %q: %v", id, err)
+	}
+	log.Printf("[vmrunner] VM %q memory set to %d MB", id, *memoryMB)
+}
+
+// cmdSave has vmrunnerd save a VM with the configuration it recorded when
+// it started it, which restore rebuilds the VM from.
+func cmdSave(args []string) {
+	fs := flag.NewFlagSet("save", flag.ExitOnError)
+	leaveRunning := fs.Bool("leave-running", false, "Resume the VM after saving")
+	_ = fs.Parse(args)
+
+	if fs.NArg() < 2 {
+		log.Fatal("save: VM ID and directory required\nusage: vmrunner save [flags] <vm-id> <dir>")
+	}
+	ref := fs.Arg(0)
+	dir, err := filepath.Abs(fs.Arg(1))
+	if err != nil {
+		log.Fatalf("save %q: %v", ref, err)
+	}
+	if err := connect().Save(ref, dir, *leaveRunning); err != nil {
+		log.Fatalf("save %q: %v", ref, err)
+	}
+	log.Printf("[vmrunner] VM %q saved to %s", ref, dir)
+}
+
+func cmdRestore(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	id := fs.String("id", "", "ID for the restored VM (default: the saved VM's ID)")
+	startOpts := addStartFlags(fs)
+	_ = fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		log.Fatal("restore: directory required\nusage: vmrunner restore [-id new-id] <dir>")
+	}
+	dir, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("restore: %v", err)
+	}
+	info, err := connect().Restore(dir, *id, *startOpts)
+	if err != nil {
+		log.Fatalf("restore: %v%s", err, startHint(err))
+	}
+	log.Printf("[vmrunner] VM %q restored", info.ID)
+}
@@ -0,0 +1,60 @@
+//go:build windows
+
+// vmrunnerd holds the HCS handles and serial consoles of the VMs vmrunner
+// starts, and serves the vmrunner control API on a local socket.
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/api"
+	"github.com/microsoft/hcsshim/vmrunner/internal/cli"
+	"github.com/microsoft/hcsshim/vmrunner/internal/daemon"
+)
+
+func main() {
+	opts, args := cli.ParseGlobalFlags("vmrunnerd", os.Args[1:])
+	if len(args) > 0 {
+		fmt.Fprintf(os.Stderr, "Usage: vmrunnerd [flags]\n\nFlags:\n%s", cli.GlobalUsage)
+		os.Exit(2)
+	}
+	if err := cli.Setup(opts); err != nil {
+		log.Fatalf("vmrunnerd: %v", err)
+	}
+
+	l, err := api.Listen(opts.Socket)
+	if err != nil {
+		log.Fatalf("vmrunnerd: %v", err)
+	}
+	st, err := opts.OpenStore()
+	if err != nil {
+		log.Fatalf("vmrunnerd: %v", err)
+	}
+	d := daemon.New(st)
+	if err := d.Adopt(); err != nil {
+		log.Printf("[vmrunnerd] adopt running VMs: %v", err)
+	}
+	d.StartReaper()
+
+	srv := &http.Server{Handler: api.NewHandler(d)}
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigCh
+		log.Printf("[vmrunnerd] received signal %v, exiting (VMs keep running)", sig)
+		srv.Close()
+	}()
+
+	log.Printf("[vmrunnerd] serving API %s on %s (pid %d)", api.Version, opts.Socket, os.Getpid())
+	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+		log.Printf("[vmrunnerd] serve: %v", err)
+	}
+	d.Close()
+	os.Remove(opts.Socket)
+	cli.Finish()
+}
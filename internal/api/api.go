@@ -0,0 +1,269 @@
+// Package api is the control API between vmrunner and vmrunnerd: JSON over
+// HTTP on a local socket, with every path under the API version ("/v1/...").
+// Attaching to a console upgrades the connection to a raw byte stream.
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/config"
+	"github.com/microsoft/hcsshim/vmrunner/internal/consolelog"
+	"github.com/microsoft/hcsshim/vmrunner/internal/store"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vm"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vmcompute"
+)
+
+// Version is the API version served and requested. Incompatible changes get
+// a new version; the daemon keeps serving the old one alongside.
+const Version = "v1"
+
+// consoleProtocol is the Upgrade token of an attach connection.
+const consoleProtocol = "vmrunner-console"
+
+// Service is what the daemon implements. The HTTP layer only translates
+// requests and errors, so it can be exercised with a fake Service or with the
+// real daemon over a fake backend.
+type Service interface {
+	Info() Info
+	// Run creates and starts a VM and keeps its handle and console.
+	Run(cfg config.VMConfig, opts vm.StartOptions) (VMInfo, error)
+	List(opts vm.ListOptions) ([]VMSummary, error)
+	// Inspect returns the stored record of a VM, with its current state if
+	// it is still running.
+	Inspect(id string) (store.Record, error)
+	// Stop shuts the VM down, escalating from the guest's stop command to
+	// HCS shutdown to terminate; see vm.VM.Stop. An empty opts.Command
+	// means the VM's configured stop command.
+	Stop(id string, opts vm.StopOptions) error
+	// Ready waits until the VM passes a readiness probe, failing with a
+	// vm.NotReadyError that quotes the console if it exits or times out.
+	Ready(id string, opts vm.ReadyOptions) error
+	// Wait waits until the VM exits, or returns at once if it is not
+	// running, and returns how it last exited. It ends early when ctx is
+	// done.
+	Wait(ctx context.Context, id string) (vm.Exit, error)
+	Kill(id string) error
+	// Exec runs a command in the VM, writing its output as it is produced,
+	// and returns its exit code.
+	Exec(id string, req ExecRequest, stdout, stderr io.Writer) (int, error)
+	// Logs writes the VM's console log as selected by opts. A follow ends
+	// when ctx is done or the VM has exited for good.
+	Logs(ctx context.Context, id string, opts consolelog.ReadOptions, w io.Writer) error
+	// Attach returns a session on the VM's serial console: reads return
+	// console output from now on, writes are typed into the console.
+	Attach(id string) (io.ReadWriteCloser, error)
+	// Update changes the resources of a running VM and records the change,
+	// so that a restart of the VM keeps it.
+	Update(id string, req UpdateRequest) error
+	// Save writes the state of a VM to a snapshot directory, with the
+	// configuration recorded for it, then terminates it unless
+	// leaveRunning. The exit does not restart the VM.
+	Save(id, dir string, leaveRunning bool) error
+	// Restore creates and starts a VM from a snapshot directory written by
+	// Save, under id if it is not empty, and keeps it as Run does.
+	Restore(dir, id string, opts vm.StartOptions) (VMInfo, error)
+	// Reap stops, gracefully with escalation, the VMs past their TTL or
+	// idle timeout and returns them; with dryRun it only returns them.
+	Reap(dryRun bool) ([]Reaped, error)
+}
+
+// Info describes the daemon.
+type Info struct {
+	APIVersion string
+	Backend    string
+	PID        int
+	// StateDir is the state store directory the daemon writes.
+	StateDir string
+}
+
+// RunRequest is the body of POST /v1/vms.
+type RunRequest struct {
+	Config  config.VMConfig
+	Options vm.StartOptions
+}
+
+// VMInfo describes a VM managed by the daemon.
+type VMInfo struct {
+	ID    string
+	State string
+}
+
+// VMSummary is one VM in a listing: what HCS reports about it, plus what the
+// daemon has recorded.
+type VMSummary struct {
+	vmcompute.SystemSummary
+	Restarts    int               `json:",omitempty"`
+	LastFailure string            `json:",omitempty"`
+	Labels      map[string]string `json:",omitempty"`
+	Name        string            `json:",omitempty"`
+}
+
+// StopRequest is the body of POST /v1/vms/{id}/stop.
+type StopRequest struct {
+	Options vm.StopOptions
+}
+
+// ReadyRequest is the body of POST /v1/vms/{id}/ready.
+type ReadyRequest struct {
+	Options vm.ReadyOptions
+}
+
+// ExecRequest is the body of POST /v1/vms/{id}/exec.
+type ExecRequest struct {
+	Args []string
+	// GCS runs the command as a GCS process rather than on the serial
+	// console; only then is the exit code meaningful.
+	GCS bool
+	// Config, if set, starts the VM with this configuration when it is not
+	// running.
+	Config *config.VMConfig `json:",omitempty"`
+}
+
+// UpdateRequest is the body of POST /v1/vms/{id}/update: the changes to
+// make, in the order of the fields. A disk is detached by its slot.
+type UpdateRequest struct {
+	MemoryMB   uint32             `json:",omitempty"`
+	DetachDisk *config.SCSIDisk   `json:",omitempty"`
+	AttachDisk *config.SCSIDisk   `json:",omitempty"`
+	AddShare   *config.Plan9Share `json:",omitempty"`
+}
+
+// SaveRequest is the body of POST /v1/vms/{id}/save. Dir is absolute: the
+// daemon does not share the client's working directory.
+type SaveRequest struct {
+	Dir          string
+	LeaveRunning bool
+}
+
+// RestoreRequest is the body of POST /v1/restore. Dir is absolute, as in
+// SaveRequest; ID, if set, replaces the saved VM's ID.
+type RestoreRequest struct {
+	Dir     string
+	ID      string `json:",omitempty"`
+	Options vm.StartOptions
+}
+
+// ReapRequest is the body of POST /v1/reap.
+type ReapRequest struct {
+	DryRun bool
+}
+
+// Reaped is a VM the reaper stopped, or would stop, and why.
+type Reaped struct {
+	ID     string
+	Name   string `json:",omitempty"`
+	Reason string
+	// Error is set if stopping the VM failed; the next reap tries again.
+	Error string `json:",omitempty"`
+}
+
+// ExecEvent is one line of the newline-delimited JSON stream returned by
+// exec: a chunk of output, or the final exit code or error.
+type ExecEvent struct {
+	Stream   string `json:",omitempty"` // "stdout" or "stderr"
+	Data     []byte `json:",omitempty"`
+	ExitCode *int   `json:",omitempty"`
+	Error    *Error `json:",omitempty"`
+}
+
+// Error kinds, which carry the meaning of an error across the API.
+const (
+	KindNotFound  = "NotFound"
+	KindExists    = "Exists"    // the VM's ID is taken; see vm.ExistsError
+	KindConflict  = "Conflict"  // operation not valid in the VM's state
+	KindNotReady  = "NotReady"  // the VM failed its readiness probe
+	KindCapacity  = "Capacity"  // the host cannot take the VM; see vm.CapacityError
+	KindAmbiguous = "Ambiguous" // a VM name or ID prefix matches several VMs
+	KindInvalid   = "Invalid"
+	KindInternal  = "Internal"
+)
+
+// Error is an error returned by the daemon.
+type Error struct {
+	Kind    string
+	Message string
+}
+
+func (e *Error) Error() string { return e.Message }
+
+// ErrNotFound is returned by a Service for a VM it does not know.
+var ErrNotFound = errors.New("VM not found")
+
+// NotFound returns an error for the unknown VM id.
+func NotFound(id string) error { return fmt.Errorf("VM %q: %w", id, ErrNotFound) }
+
+// IsNotFound reports whether err, from a Service or a Client, means the VM
+// does not exist.
+func IsNotFound(err error) bool {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind == KindNotFound
+	}
+	return errors.Is(err, ErrNotFound) || errors.Is(err, store.ErrNotFound) || vmcompute.IsNotFound(err)
+}
+
+// IsExists reports whether err, from a Service or a Client, means the VM's
+// ID is taken by a system that may not be replaced.
+func IsExists(err error) bool {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind == KindExists
+	}
+	var existsErr *vm.ExistsError
+	return errors.As(err, &existsErr)
+}
+
+// IsCapacity reports whether err, from a Service or a Client, means the
+// host had no capacity for the VM.
+func IsCapacity(err error) bool {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind == KindCapacity
+	}
+	var capErr *vm.CapacityError
+	return errors.As(err, &capErr)
+}
+
+// toError classifies a Service error for the wire.
+func toError(err error) (*Error, int) {
+	var apiErr *Error
+	var stateErr *vm.StateError
+	var existsErr *vm.ExistsError
+	var notReadyErr *vm.NotReadyError
+	var capErr *vm.CapacityError
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr, statusOf(apiErr.Kind)
+	case IsNotFound(err):
+		return &Error{Kind: KindNotFound, Message: err.Error()}, http.StatusNotFound
+	case errors.As(err, &existsErr):
+		return &Error{Kind: KindExists, Message: err.Error()}, http.StatusConflict
+	case errors.As(err, &notReadyErr):
+		return &Error{Kind: KindNotReady, Message: err.Error()}, http.StatusServiceUnavailable
+	case errors.As(err, &capErr):
+		return &Error{Kind: KindCapacity, Message: err.Error()}, http.StatusServiceUnavailable
+	case errors.As(err, &stateErr):
+		return &Error{Kind: KindConflict, Message: err.Error()}, http.StatusConflict
+	default:
+		return &Error{Kind: KindInternal, Message: err.Error()}, http.StatusInternalServerError
+	}
+}
+
+func statusOf(kind string) int {
+	switch kind {
+	case KindNotFound:
+		return http.StatusNotFound
+	case KindConflict, KindExists, KindAmbiguous:
+		return http.StatusConflict
+	case KindInvalid:
+		return http.StatusBadRequest
+	case KindNotReady, KindCapacity:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,295 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/config"
+	"github.com/microsoft/hcsshim/vmrunner/internal/consolelog"
+	"github.com/microsoft/hcsshim/vmrunner/internal/store"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vm"
+)
+
+// Client calls a daemon over its socket.
+type Client struct {
+	socket string
+	http   *http.Client
+}
+
+// NewClient returns a client for the daemon listening on socket. No
+// connection is made until the first call.
+func NewClient(socket string) *Client {
+	return &Client{
+		socket: socket,
+		http: &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}},
+	}
+}
+
+// Socket returns the socket path the client connects to.
+func (c *Client) Socket() string { return c.socket }
+
+func (c *Client) url(path string) string { return "http://vmrunnerd/" + Version + path }
+
+func vmPath(id, action string) string { return "/vms/" + url.PathEscape(id) + "/" + action }
+
+// do sends a JSON request and decodes a JSON response into out (if non-nil).
+func (c *Client) do(method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.url(path), body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("vmrunnerd: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return readError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("vmrunnerd: decode response: %w", err)
+	}
+	return nil
+}
+
+func readError(resp *http.Response) error {
+	var e Error
+	if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Message == "" {
+		return &Error{Kind: KindInternal, Message: fmt.Sprintf("vmrunnerd: %s", resp.Status)}
+	}
+	return &e
+}
+
+// Info returns the daemon's description; it doubles as a liveness check.
+func (c *Client) Info() (Info, error) {
+	var info Info
+	err := c.do(http.MethodGet, "/info", nil, &info)
+	return info, err
+}
+
+// WaitReady polls Info until the daemon answers or timeout elapses.
+func (c *Client) WaitReady(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		_, err := c.Info()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("daemon on %s not ready after %s: %w", c.socket, timeout, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (c *Client) Run(cfg config.VMConfig, opts vm.StartOptions) (VMInfo, error) {
+	var info VMInfo
+	err := c.do(http.MethodPost, "/vms", RunRequest{Config: cfg, Options: opts}, &info)
+	return info, err
+}
+
+func (c *Client) List(opts vm.ListOptions) ([]VMSummary, error) {
+	q := url.Values{}
+	if opts.All {
+		q.Set("all", "1")
+	}
+	if opts.Owner != "" {
+		q.Set("owner", opts.Owner)
+	}
+	for _, f := range opts.Filters {
+		q.Add("filter", f)
+	}
+	if opts.Exited {
+		q.Set("exited", "1")
+	}
+	for _, l := range opts.Labels {
+		q.Add("label", l)
+	}
+	var vms []VMSummary
+	err := c.do(http.MethodGet, "/vms?"+q.Encode(), nil, &vms)
+	return vms, err
+}
+
+func (c *Client) Inspect(id string) (store.Record, error) {
+	var rec store.Record
+	err := c.do(http.MethodGet, "/vms/"+url.PathEscape(id), nil, &rec)
+	return rec, err
+}
+
+func (c *Client) Stop(id string, opts vm.StopOptions) error {
+	return c.do(http.MethodPost, vmPath(id, "stop"), StopRequest{Options: opts}, nil)
+}
+
+// Ready waits until VM id passes opts.Probe. The request lasts as long as
+// the wait.
+func (c *Client) Ready(id string, opts vm.ReadyOptions) error {
+	return c.do(http.MethodPost, vmPath(id, "ready"), ReadyRequest{Options: opts}, nil)
+}
+
+// Wait waits until VM id exits and returns how it did. The request lasts
+// as long as the wait.
+func (c *Client) Wait(id string) (vm.Exit, error) {
+	var x vm.Exit
+	err := c.do(http.MethodPost, vmPath(id, "wait"), nil, &x)
+	return x, err
+}
+
+func (c *Client) Kill(id string) error {
+	return c.do(http.MethodPost, vmPath(id, "kill"), nil, nil)
+}
+
+// Update changes the resources of running VM id.
+func (c *Client) Update(id string, req UpdateRequest) error {
+	return c.do(http.MethodPost, vmPath(id, "update"), req, nil)
+}
+
+// Save saves VM id to dir, an absolute path on the daemon's host. The
+// request lasts until the state is written.
+func (c *Client) Save(id, dir string, leaveRunning bool) error {
+	return c.do(http.MethodPost, vmPath(id, "save"), SaveRequest{Dir: dir, LeaveRunning: leaveRunning}, nil)
+}
+
+// Restore restores the VM saved in dir, an absolute path on the daemon's
+// host, under id if it is not empty.
+func (c *Client) Restore(dir, id string, opts vm.StartOptions) (VMInfo, error) {
+	var info VMInfo
+	err := c.do(http.MethodPost, "/restore", RestoreRequest{Dir: dir, ID: id, Options: opts}, &info)
+	return info, err
+}
+
+// Reap stops the VMs past their TTL or idle timeout, or with dryRun only
+// lists them. The request lasts until every stop has ended.
+func (c *Client) Reap(dryRun bool) ([]Reaped, error) {
+	var reaped []Reaped
+	err := c.do(http.MethodPost, "/reap", ReapRequest{DryRun: dryRun}, &reaped)
+	return reaped, err
+}
+
+// Exec runs a command in VM id, copying its output to stdout and stderr as
+// it arrives, and returns its exit code.
+func (c *Client) Exec(id string, req ExecRequest, stdout, stderr io.Writer) (int, error) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return -1, err
+	}
+	resp, err := c.http.Post(c.url(vmPath(id, "exec")), "application/json", bytes.NewReader(b))
+	if err != nil {
+		return -1, fmt.Errorf("vmrunnerd: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return -1, readError(resp)
+	}
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev ExecEvent
+		if err := dec.Decode(&ev); err != nil {
+			return -1, fmt.Errorf("vmrunnerd: exec stream ended early: %w", err)
+		}
+		switch {
+		case ev.Error != nil:
+			return -1, ev.Error
+		case ev.ExitCode != nil:
+			return *ev.ExitCode, nil
+		case ev.Stream == "stderr":
+			stderr.Write(ev.Data)
+		default:
+			stdout.Write(ev.Data)
+		}
+	}
+}
+
+// Logs copies the console log of VM id to w as it arrives. A follow lasts
+// until the VM has exited for good or the process is interrupted.
+func (c *Client) Logs(id string, opts consolelog.ReadOptions, w io.Writer) error {
+	q := url.Values{}
+	if opts.Follow {
+		q.Set("follow", "1")
+	}
+	if opts.Timestamps {
+		q.Set("timestamps", "1")
+	}
+	if !opts.Since.IsZero() {
+		q.Set("since", opts.Since.UTC().Format(time.RFC3339Nano))
+	}
+	if opts.Tail >= 0 {
+		q.Set("tail", strconv.Itoa(opts.Tail))
+	}
+	resp, err := c.http.Get(c.url(vmPath(id, "logs") + "?" + q.Encode()))
+	if err != nil {
+		return fmt.Errorf("vmrunnerd: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return readError(resp)
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return fmt.Errorf("vmrunnerd: logs: %w", err)
+	}
+	return nil
+}
+
+// Attach opens a raw stream to VM id's serial console. Closing it detaches;
+// the VM keeps running.
+func (c *Client) Attach(id string) (io.ReadWriteCloser, error) {
+	conn, err := net.Dial("unix", c.socket)
+	if err != nil {
+		return nil, fmt.Errorf("vmrunnerd: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, c.url(vmPath(id, "attach")), nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", consoleProtocol)
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("vmrunnerd: %w", err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("vmrunnerd: %w", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer conn.Close()
+		return nil, readError(resp)
+	}
+	return &upgradedConn{Conn: conn, r: br}, nil
+}
+
+// upgradedConn reads through the bufio.Reader used for the response headers,
+// which may already hold console output.
+type upgradedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *upgradedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
@@ -0,0 +1,28 @@
+package api
+
+import (
+	"fmt"
+	"io"
+)
+
+// WriteList prints vms as a table, or one ID per line if quiet.
+func WriteList(w io.Writer, vms []VMSummary, quiet bool) {
+	if quiet {
+		for _, v := range vms {
+			fmt.Fprintln(w, v.Id)
+		}
+		return
+	}
+	if len(vms) == 0 {
+		fmt.Fprintln(w, "(no running VMs)")
+		return
+	}
+
+	fmt.Fprintf(w, "%-16s  %-16s  %-10s  %-8s  %-24s  %-36s  %s\n", "OWNER", "SYSTEMTYPE", "STATE", "RESTARTS", "NAME", "ID", "LAST FAILURE")
+	fmt.Fprintf(w, "%-16s  %-16s  %-10s  %-8s  %-24s  %-36s  %s\n",
+		"----------------", "----------------", "----------", "--------", "------------------------", "------------------------------------", "------------")
+	for _, v := range vms {
+		fmt.Fprintf(w, "%-16s  %-16s  %-10s  %-8d  %-24s  %-36s  %s\n",
+			v.Owner, v.SystemType, v.State, v.Restarts, v.Name, v.Id, v.LastFailure)
+	}
+}
@@ -0,0 +1,371 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/consolelog"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vm"
+)
+
+// NewHandler returns the HTTP handler serving s:
+//
+//	GET  /v1/info
+//	GET  /v1/vms?all=1&owner=o&filter=k=v&label=sel&exited=1…
+//	POST /v1/vms                 RunRequest → VMInfo
+//	GET  /v1/vms/{id}            store.Record
+//	POST /v1/vms/{id}/stop       StopRequest
+//	POST /v1/vms/{id}/kill
+//	POST /v1/vms/{id}/ready      ReadyRequest
+//	POST /v1/vms/{id}/wait       → vm.Exit
+//	POST /v1/vms/{id}/update     UpdateRequest
+//	POST /v1/vms/{id}/save       SaveRequest
+//	POST /v1/vms/{id}/exec       ExecRequest → stream of ExecEvent
+//	GET  /v1/vms/{id}/logs?follow=1&since=t&tail=n&timestamps=1
+//	                             → console output as text/plain
+//	POST /v1/vms/{id}/attach     upgrade to a raw console stream
+//	POST /v1/restore             RestoreRequest → VMInfo
+//	POST /v1/reap                ReapRequest → []Reaped
+func NewHandler(s Service) http.Handler {
+	return &server{s: s}
+}
+
+type server struct {
+	s Service
+}
+
+func (h *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/")
+	if parts[0] != Version {
+		writeError(w, &Error{Kind: KindNotFound, Message: fmt.Sprintf("unsupported API path %s (this daemon serves %s)", r.URL.Path, Version)})
+		return
+	}
+	route := parts[1:]
+	switch {
+	case len(route) == 1 && route[0] == "info" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, h.s.Info())
+	case len(route) == 1 && route[0] == "vms" && r.Method == http.MethodGet:
+		h.list(w, r)
+	case len(route) == 1 && route[0] == "vms" && r.Method == http.MethodPost:
+		h.run(w, r)
+	case len(route) == 1 && route[0] == "restore" && r.Method == http.MethodPost:
+		var req RestoreRequest
+		if !decode(w, r, &req) {
+			return
+		}
+		info, err := h.s.Restore(req.Dir, req.ID, req.Options)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, info)
+	case len(route) == 1 && route[0] == "reap" && r.Method == http.MethodPost:
+		var req ReapRequest
+		if !decode(w, r, &req) {
+			return
+		}
+		reaped, err := h.s.Reap(req.DryRun)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, reaped)
+	case len(route) == 2 && route[0] == "vms" && r.Method == http.MethodGet:
+		id, ok := pathID(w, route[1])
+		if !ok {
+			return
+		}
+		rec, err := h.s.Inspect(id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, rec)
+	case len(route) == 3 && route[0] == "vms" && route[2] == "logs" && r.Method == http.MethodGet:
+		id, ok := pathID(w, route[1])
+		if ok {
+			h.logs(w, r, id)
+		}
+	case len(route) == 3 && route[0] == "vms" && r.Method == http.MethodPost:
+		id, ok := pathID(w, route[1])
+		if !ok {
+			return
+		}
+		switch route[2] {
+		case "stop":
+			var req StopRequest
+			if decode(w, r, &req) {
+				writeResult(w, h.s.Stop(id, req.Options))
+			}
+		case "kill":
+			writeResult(w, h.s.Kill(id))
+		case "ready":
+			var req ReadyRequest
+			if decode(w, r, &req) {
+				writeResult(w, h.s.Ready(id, req.Options))
+			}
+		case "wait":
+			x, err := h.s.Wait(r.Context(), id)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, x)
+		case "update":
+			var req UpdateRequest
+			if decode(w, r, &req) {
+				writeResult(w, h.s.Update(id, req))
+			}
+		case "save":
+			var req SaveRequest
+			if decode(w, r, &req) {
+				writeResult(w, h.s.Save(id, req.Dir, req.LeaveRunning))
+			}
+		case "exec":
+			h.exec(w, r, id)
+		case "attach":
+			h.attach(w, r, id)
+		default:
+			http.NotFound(w, r)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// pathID unescapes the VM ID segment of a path.
+func pathID(w http.ResponseWriter, segment string) (string, bool) {
+	id, err := url.PathUnescape(segment)
+	if err != nil {
+		writeError(w, &Error{Kind: KindInvalid, Message: "invalid VM ID in path"})
+		return "", false
+	}
+	return id, true
+}
+
+func (h *server) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	opts := vm.ListOptions{
+		All:     q.Get("all") == "1",
+		Owner:   q.Get("owner"),
+		Filters: q["filter"],
+		Exited:  q.Get("exited") == "1",
+		Labels:  q["label"],
+	}
+	systems, err := h.s.List(opts)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, systems)
+}
+
+func (h *server) run(w http.ResponseWriter, r *http.Request) {
+	var req RunRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	info, err := h.s.Run(req.Config, req.Options)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, info)
+}
+
+// logs streams the console log. Errors found before any output are
+// returned as usual; later ones can only end the stream.
+func (h *server) logs(w http.ResponseWriter, r *http.Request, id string) {
+	q := r.URL.Query()
+	opts := consolelog.ReadOptions{
+		Tail:       -1,
+		Follow:     q.Get("follow") == "1",
+		Timestamps: q.Get("timestamps") == "1",
+	}
+	if s := q.Get("since"); s != "" {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			writeError(w, &Error{Kind: KindInvalid, Message: fmt.Sprintf("invalid since %q", s)})
+			return
+		}
+		opts.Since = t
+	}
+	if s := q.Get("tail"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			writeError(w, &Error{Kind: KindInvalid, Message: fmt.Sprintf("invalid tail %q", s)})
+			return
+		}
+		opts.Tail = n
+	}
+
+	sw := &streamWriter{w: w}
+	sw.flush, _ = w.(http.Flusher)
+	err := h.s.Logs(r.Context(), id, opts, sw)
+	switch {
+	case err != nil && !sw.started:
+		writeError(w, err)
+	case err != nil:
+		log.Printf("[vmrunnerd] logs %q: %v", id, err)
+	case !sw.started:
+		sw.start()
+	}
+}
+
+// streamWriter starts a text/plain response on the first write and flushes
+// every write, so that followed output arrives as it is logged.
+type streamWriter struct {
+	w       http.ResponseWriter
+	flush   http.Flusher
+	started bool
+}
+
+func (sw *streamWriter) start() {
+	sw.w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	sw.w.WriteHeader(http.StatusOK)
+	sw.started = true
+	if sw.flush != nil {
+		sw.flush.Flush()
+	}
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	if !sw.started {
+		sw.start()
+	}
+	n, err := sw.w.Write(p)
+	if sw.flush != nil {
+		sw.flush.Flush()
+	}
+	return n, err
+}
+
+// exec streams the command's output as ExecEvents. The status is always 200
+// once the stream starts; failures are reported in the final event.
+func (h *server) exec(w http.ResponseWriter, r *http.Request, id string) {
+	var req ExecRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	ew := &eventWriter{enc: json.NewEncoder(w)}
+	ew.flush, _ = w.(http.Flusher)
+
+	code, err := h.s.Exec(id, req, ew.stream("stdout"), ew.stream("stderr"))
+	if err != nil {
+		apiErr, _ := toError(err)
+		ew.send(ExecEvent{Error: apiErr})
+		return
+	}
+	ew.send(ExecEvent{ExitCode: &code})
+}
+
+// eventWriter serializes ExecEvents from the command's output goroutines.
+type eventWriter struct {
+	mu    sync.Mutex
+	enc   *json.Encoder
+	flush http.Flusher
+}
+
+func (ew *eventWriter) send(ev ExecEvent) error {
+	ew.mu.Lock()
+	defer ew.mu.Unlock()
+	if err := ew.enc.Encode(ev); err != nil {
+		return err
+	}
+	if ew.flush != nil {
+		ew.flush.Flush()
+	}
+	return nil
+}
+
+func (ew *eventWriter) stream(name string) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		if err := ew.send(ExecEvent{Stream: name, Data: p}); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	})
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+// attach upgrades the connection and splices it to a console session until
+// either side closes.
+func (h *server) attach(w http.ResponseWriter, r *http.Request, id string) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), consoleProtocol) {
+		writeError(w, &Error{Kind: KindInvalid, Message: "attach requires Upgrade: " + consoleProtocol})
+		return
+	}
+	session, err := h.s.Attach(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer session.Close()
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		writeError(w, fmt.Errorf("connection cannot be upgraded"))
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		log.Printf("[vmrunnerd] attach %q: hijack: %v", id, err)
+		return
+	}
+	defer conn.Close()
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", consoleProtocol)
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(session, rw.Reader) // rw.Reader holds anything already buffered
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, session)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+func decode(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil && err != io.EOF {
+		writeError(w, &Error{Kind: KindInvalid, Message: fmt.Sprintf("invalid request body: %v", err)})
+		return false
+	}
+	return true
+}
+
+func writeResult(w http.ResponseWriter, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	apiErr, status := toError(err)
+	writeJSON(w, status, apiErr)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
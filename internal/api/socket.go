@@ -0,0 +1,55 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// DefaultSocket returns the daemon socket path: $VMRUNNER_SOCKET, else
+// %ProgramData%\vmrunner\vmrunnerd.sock on Windows and
+// $XDG_RUNTIME_DIR/vmrunnerd.sock (or the temp dir) elsewhere. Windows 10
+// 1803 and later support Unix sockets, so one transport serves both.
+func DefaultSocket() string {
+	if s := os.Getenv("VMRUNNER_SOCKET"); s != "" {
+		return s
+	}
+	if runtime.GOOS == "windows" {
+		dir := os.Getenv("ProgramData")
+		if dir == "" {
+			dir = `C:\ProgramData`
+		}
+		return filepath.Join(dir, "vmrunner", "vmrunnerd.sock")
+	}
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "vmrunnerd.sock")
+}
+
+// Listen listens on the socket at path, replacing a stale socket file left by
+// a daemon that exited without removing it. It fails if a daemon is still
+// answering there.
+func Listen(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("socket dir: %w", err)
+	}
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("a daemon is already listening on %s", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("remove stale socket: %w", err)
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("listen on %s: %w", path, err)
+	}
+	return l, nil
+}
@@ -0,0 +1,92 @@
+package cli
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// DefaultParallel is how many VMs a bulk command (stop, kill or exec with
+// -selector or -all) handles at once.
+const DefaultParallel = 8
+
+// ForEach calls fn for every ID, at most parallel (default DefaultParallel)
+// at a time, and report with each ID's result as it completes; report calls
+// do not overlap. It returns how many IDs failed.
+func ForEach(ids []string, parallel int, fn func(id string) error, report func(id string, err error)) int {
+	if parallel <= 0 {
+		parallel = DefaultParallel
+	}
+	var (
+		mu     sync.Mutex
+		failed int
+		wg     sync.WaitGroup
+	)
+	sem := make(chan struct{}, parallel)
+	for _, id := range ids {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(id string) {
+			defer wg.Done()
+			err := fn(id)
+			<-sem
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed++
+			}
+			report(id, err)
+		}(id)
+	}
+	wg.Wait()
+	return failed
+}
+
+// PrefixWriter writes whole lines to W, each starting with Prefix, so that
+// the output of several VMs can share a terminal without mixing lines.
+// Writers sharing W must share Mu. Flush writes a last, unterminated line.
+type PrefixWriter struct {
+	W      io.Writer
+	Mu     *sync.Mutex
+	Prefix string
+
+	partial []byte
+}
+
+func (p *PrefixWriter) Write(b []byte) (int, error) {
+	p.partial = append(p.partial, b...)
+	i := bytes.LastIndexByte(p.partial, '\n')
+	if i < 0 {
+		return len(b), nil
+	}
+	lines := p.partial[:i+1]
+	var out []byte
+	for len(lines) > 0 {
+		j := bytes.IndexByte(lines, '\n')
+		out = append(out, p.Prefix...)
+		out = append(out, lines[:j+1]...)
+		lines = lines[j+1:]
+	}
+	p.partial = append(p.partial[:0], p.partial[i+1:]...)
+	if err := p.write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Flush writes what is left of the last line, with a newline.
+func (p *PrefixWriter) Flush() error {
+	if len(p.partial) == 0 {
+		return nil
+	}
+	out := append([]byte(p.Prefix), p.partial...)
+	p.partial = p.partial[:0]
+	return p.write(append(out, '\n'))
+}
+
+func (p *PrefixWriter) write(b []byte) error {
+	p.Mu.Lock()
+	defer p.Mu.Unlock()
+	_, err := p.W.Write(b)
+	return err
+}
@@ -0,0 +1,242 @@
+// Package cli holds what vmrunner and vmrunnerd share on their command
+// lines: the global flags and the backend they select.
+package cli
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/api"
+	"github.com/microsoft/hcsshim/vmrunner/internal/handles"
+	"github.com/microsoft/hcsshim/vmrunner/internal/store"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vm"
+)
+
+// Options holds the global flags, accepted before the subcommand.
+type Options struct {
+	Backend string
+	DryRun  bool
+	Record  string
+	Replay  string
+
+	DebugHandles bool
+	// Retries overrides the attempt count of every retry policy; 0 keeps
+	// the defaults and 1 disables retries.
+	Retries int
+
+	// Socket is the daemon's socket path.
+	Socket string
+	// NoDaemon runs the daemon inside the vmrunner process for this one
+	// command instead of using (or starting) vmrunnerd.
+	NoDaemon bool
+	// StateDir is the daemon's state store directory.
+	StateDir string
+	// Capacity is the policy VMs are admitted to the host by.
+	Capacity vm.CapacityPolicy
+}
+
+// ParseGlobalFlags consumes leading global flags (e.g. --backend computecore)
+// and returns the remaining arguments. It stops at the first argument it does
+// not recognise so that the no-subcommand form ("vmrunner -memory 4096 -i")
+// keeps working.
+func ParseGlobalFlags(prog string, args []string) (Options, []string) {
+	opts := Options{
+		Backend:      os.Getenv("VMRUNNER_BACKEND"),
+		DebugHandles: os.Getenv("VMRUNNER_DEBUG_HANDLES") != "",
+		Socket:       api.DefaultSocket(),
+		StateDir:     store.DefaultDir(),
+		Capacity:     vm.DefaultCapacityPolicy,
+	}
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		name, value, hasValue := strings.Cut(strings.TrimLeft(args[0], "-"), "=")
+		switch name {
+		case "dry-run":
+			opts.DryRun = !hasValue || value == "true"
+		case "debug-handles":
+			opts.DebugHandles = !hasValue || value == "true"
+		case "no-daemon":
+			opts.NoDaemon = !hasValue || value == "true"
+		case "backend", "record", "replay", "retries", "socket", "state-dir", "memory-overcommit", "cpu-overcommit":
+			if !hasValue {
+				if len(args) < 2 {
+					log.Fatalf("%s: flag --%s requires a value", prog, name)
+				}
+				args = args[1:]
+				value = args[0]
+			}
+			switch name {
+			case "backend":
+				opts.Backend = value
+			case "record":
+				opts.Record = value
+			case "replay":
+				opts.Replay = value
+			case "socket":
+				opts.Socket = value
+			case "state-dir":
+				opts.StateDir = value
+			case "retries":
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 1 {
+					log.Fatalf("%s: invalid --retries %q (want a count >= 1)", prog, value)
+				}
+				opts.Retries = n
+			case "memory-overcommit", "cpu-overcommit":
+				r, err := strconv.ParseFloat(value, 64)
+				if err != nil || r < 0 {
+					log.Fatalf("%s: invalid --%s %q (want a ratio such as 1.5, or 0 for no limit)", prog, name, value)
+				}
+				if name == "memory-overcommit" {
+					opts.Capacity.MemoryOvercommit = r
+				} else {
+					opts.Capacity.CPUOvercommit = r
+				}
+			}
+		default:
+			return opts, args
+		}
+		args = args[1:]
+	}
+	return opts, args
+}
+
+// Local reports whether commands must run against this process's backend:
+// dry runs, recording and replay act on the HCS calls of this process, so a
+// shared daemon cannot serve them.
+func (o Options) Local() bool {
+	return o.NoDaemon || o.DryRun || o.Record != "" || o.Replay != ""
+}
+
+// DaemonArgs returns the global flags to start vmrunnerd with so that it
+// matches this invocation.
+func (o Options) DaemonArgs() []string {
+	args := []string{"--socket", o.Socket, "--state-dir", o.StateDir}
+	if o.Backend != "" {
+		args = append(args, "--backend", o.Backend)
+	}
+	if o.Retries > 0 {
+		args = append(args, "--retries", strconv.Itoa(o.Retries))
+	}
+	if o.DebugHandles {
+		args = append(args, "--debug-handles")
+	}
+	if r := o.Capacity.MemoryOvercommit; r != vm.DefaultCapacityPolicy.MemoryOvercommit {
+		args = append(args, "--memory-overcommit", strconv.FormatFloat(r, 'g', -1, 64))
+	}
+	if r := o.Capacity.CPUOvercommit; r != vm.DefaultCapacityPolicy.CPUOvercommit {
+		args = append(args, "--cpu-overcommit", strconv.FormatFloat(r, 'g', -1, 64))
+	}
+	return args
+}
+
+// OpenStore opens the state store and has admission control count the
+// running VMs it records. Dry runs and replays create no real VMs, so they
+// get a throwaway store instead of recording fakes in the real one.
+func (o Options) OpenStore() (*store.Store, error) {
+	dir := o.StateDir
+	if o.DryRun || o.Replay != "" {
+		tmp, err := os.MkdirTemp("", "vmrunner-state-")
+		if err != nil {
+			return nil, fmt.Errorf("state store: %w", err)
+		}
+		dir = tmp
+		AtExit(func() { os.RemoveAll(tmp) })
+	}
+	st, err := store.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	vm.ResourcesFunc = st.Resources
+	return st, nil
+}
+
+// CheckLocalStore returns an error if vmrunnerd answers on the socket and
+// writes the state store this process would open. A daemon run inside this
+// process writes the store on every command (even list reconciles it), and
+// two writers would overwrite each other's records.
+func (o Options) CheckLocalStore() error {
+	if o.DryRun || o.Replay != "" {
+		return nil
+	}
+	info, err := api.NewClient(o.Socket).Info()
+	if err != nil {
+		return nil
+	}
+	// A daemon that does not report its store may be writing ours.
+	if info.StateDir != "" && !strings.EqualFold(filepath.Clean(info.StateDir), filepath.Clean(o.StateDir)) {
+		return nil
+	}
+	return fmt.Errorf("vmrunnerd (pid %d) is serving %s and writes the state store in %s; stop it, or run without --no-daemon", info.PID, o.Socket, o.StateDir)
+}
+
+// atExit are the functions registered with AtExit.
+var atExit []func()
+
+// AtExit registers f to run when the command finishes through Finish or
+// Exit, e.g. to remove temporary files.
+func AtExit(f func()) {
+	atExit = append(atExit, f)
+}
+
+// Finish runs the functions registered with AtExit, most recent first, and
+// reports leaked handles. main defers it.
+func Finish() {
+	for i := len(atExit) - 1; i >= 0; i-- {
+		atExit[i]()
+	}
+	atExit = nil
+	ReportHandles()
+}
+
+// Exit finishes the command, like a normal return from main, and exits.
+func Exit(code int) {
+	Finish()
+	os.Exit(code)
+}
+
+// ReportHandles prints the HCS handles still open, with the stacks that
+// opened them, when --debug-handles is set.
+func ReportHandles() {
+	if !handles.Enabled {
+		return
+	}
+	if n := handles.Report(os.Stderr); n > 0 {
+		log.Printf("[vmrunner] %d HCS handle(s) not closed", n)
+	}
+}
+
+// GlobalUsage is the help text for the flags ParseGlobalFlags accepts.
+const GlobalUsage = `  --backend string   HCS API to use: auto, vmcompute or computecore
+                     (default $VMRUNNER_BACKEND, else auto: computecore.dll
+                     when available, vmcompute.dll otherwise)
+  --socket path      vmrunnerd control socket (default $VMRUNNER_SOCKET, else
+                     %ProgramData%\vmrunner\vmrunnerd.sock)
+  --state-dir path   Where vmrunnerd records VM configurations and exits
+                     (default $VMRUNNER_STATE_DIR, else
+                     %ProgramData%\vmrunner\state)
+  --no-daemon        Run without vmrunnerd: this process holds the VM handles
+                     and console for the duration of the command (refused
+                     while vmrunnerd runs on the same state directory)
+  --dry-run          Print the HCS calls that would change a system instead
+                     of making them (queries still run; implies --no-daemon)
+  --record file      Write every HCS call, result and notification to a
+                     JSONL trace (implies --no-daemon)
+  --replay file      Serve HCS calls from a trace written by --record
+                     instead of calling HCS (implies --no-daemon)
+  --retries n        Attempts per HCS call on transient failures such as a
+                     busy service or an ID still being torn down (default
+                     5, 8 for create; 1 disables retries)
+  --debug-handles    Report HCS handles still open at exit, with the stack
+                     that opened each (also $VMRUNNER_DEBUG_HANDLES)
+  --memory-overcommit ratio
+                     Memory vmrunner's VMs may commit, as a multiple of the
+                     host's physical memory (default 1; 0 for no limit)
+  --cpu-overcommit ratio
+                     Virtual CPUs vmrunner's VMs may have, as a multiple of
+                     the host's logical processors (default 4; 0 for no
+                     limit)
+`
@@ -0,0 +1,63 @@
+package cli
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/api"
+)
+
+// fakeDaemon answers /info on a Unix socket in a temporary directory as a
+// vmrunnerd writing stateDir would, and returns the socket.
+func fakeDaemon(t *testing.T, stateDir string) string {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "vmrunnerd.sock")
+	l, err := api.Listen(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(api.Info{APIVersion: api.Version, PID: 42, StateDir: stateDir})
+	})}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return socket
+}
+
+func TestCheckLocalStore(t *testing.T) {
+	state := t.TempDir()
+	idle := filepath.Join(t.TempDir(), "vmrunnerd.sock")
+	for _, tt := range []struct {
+		name   string
+		opts   Options
+		refuse bool
+	}{
+		{"no daemon", Options{Socket: idle, StateDir: state, NoDaemon: true}, false},
+		{"same store", Options{Socket: fakeDaemon(t, state), StateDir: state, NoDaemon: true}, true},
+		{"same store unclean", Options{Socket: fakeDaemon(t, state+"/."), StateDir: state, NoDaemon: true}, true},
+		{"old daemon", Options{Socket: fakeDaemon(t, ""), StateDir: state, NoDaemon: true}, true},
+		{"record", Options{Socket: fakeDaemon(t, state), StateDir: state, Record: "trace.jsonl"}, true},
+		{"other store", Options{Socket: fakeDaemon(t, t.TempDir()), StateDir: state, NoDaemon: true}, false},
+		{"dry run", Options{Socket: fakeDaemon(t, state), StateDir: state, DryRun: true}, false},
+		{"replay", Options{Socket: fakeDaemon(t, state), StateDir: state, Replay: "trace.jsonl"}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.opts.CheckLocalStore(); (err != nil) != tt.refuse {
+				t.Fatalf("CheckLocalStore: %v, want refused %v", err, tt.refuse)
+			}
+		})
+	}
+}
+
+func TestFinish(t *testing.T) {
+	var ran []int
+	AtExit(func() { ran = append(ran, 1) })
+	AtExit(func() { ran = append(ran, 2) })
+	Finish()
+	Finish()
+	if len(ran) != 2 || ran[0] != 2 || ran[1] != 1 {
+		t.Fatalf("ran %v, want [2 1] once", ran)
+	}
+}
@@ -0,0 +1,79 @@
+//go:build windows
+
+package cli
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/handles"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vm"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vmcompute"
+)
+
+// Setup points the vm package at the backend selected by o: a trace replay,
+// or the real backend, optionally wrapped for dry run and/or recording, with
+// retries on transient failures.
+func Setup(o Options) error {
+	handles.Enabled = o.DebugHandles
+
+	var backend vmcompute.Backend
+	if o.Replay != "" {
+		f, err := os.Open(o.Replay)
+		if err != nil {
+			return fmt.Errorf("open trace: %w", err)
+		}
+		defer f.Close()
+		replay, err := vmcompute.NewReplay(f)
+		if err != nil {
+			return err
+		}
+		backend = replay
+	} else {
+		real, err := vmcompute.NewBackend(o.Backend)
+		if err != nil {
+			return err
+		}
+		backend = real
+	}
+
+	if o.DryRun {
+		backend = vmcompute.NewDryRun(backend, os.Stdout)
+		vm.OpenConsole = func(name string, timeout time.Duration) (io.ReadWriteCloser, error) {
+			fmt.Fprintf(os.Stdout, "[dry-run] open console %s\n", name)
+			return nil, fmt.Errorf("dry run: console %s not opened", name)
+		}
+		vm.CreateScratchDisk = func(id, parent, path string) error {
+			fmt.Fprintf(os.Stdout, "[dry-run] create scratch disk %s over %s for %s\n", path, parent, id)
+			return nil
+		}
+	}
+	if o.Record != "" {
+		// Written unbuffered: commands exit through log.Fatal and os.Exit.
+		f, err := os.Create(o.Record)
+		if err != nil {
+			return fmt.Errorf("create trace: %w", err)
+		}
+		backend = vmcompute.NewRecorder(backend, f)
+	}
+
+	// Retry outside the recorder so that a trace shows every attempt.
+	policies := vmcompute.DefaultRetryPolicies()
+	if o.Retries > 0 {
+		for call, p := range policies {
+			p.MaxAttempts = o.Retries
+			policies[call] = p
+		}
+	}
+	vm.Compute = vmcompute.NewRetrying(backend, policies, log.Printf)
+
+	// A replay answers for the host it was recorded on, not this one.
+	vm.Capacity = o.Capacity
+	if o.Replay != "" {
+		vm.HostStatsFunc = nil
+	}
+	return nil
+}
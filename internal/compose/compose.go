@@ -0,0 +1,305 @@
+// Package compose runs a project of several VMs described in a compose file
+// (vmrunner.compose.yaml):
+//
+//	name: itest
+//	vms:
+//	  server:
+//	    memory: 4096
+//	    imageDir: C:\images\server
+//	    ready: {probe: "marker:SERVER-UP", timeout: 90s}
+//	  client:
+//	    dependsOn: [server]
+//	    hooks: client-hooks.json
+//
+// Each VM gets the ID <project>-<name> and labels naming its project and
+// compose name. Up starts the VMs in dependency order, a VM only once the VMs
+// it depends on are up (started, and ready if they have a readiness probe);
+// Down stops them in reverse.
+package compose
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/config"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vm"
+)
+
+// DefaultFile is the compose file looked for in the current directory.
+const DefaultFile = "vmrunner.compose.yaml"
+
+// Labels recorded on every VM of a project.
+const (
+	LabelProject = "vmrunner.compose.project"
+	LabelVM      = "vmrunner.compose.vm"
+)
+
+// Project is a loaded compose file.
+type Project struct {
+	Name string
+	VMs  map[string]*VM
+	// Dir is the directory of the compose file; relative paths in it are
+	// relative to Dir.
+	Dir string
+}
+
+// VM is one VM of a project. Unset settings take the defaults of vmrunner
+// run.
+type VM struct {
+	ImageDir    string            `json:"imageDir"`
+	Memory      Count             `json:"memory"`
+	CPUs        Count             `json:"cpus"`
+	KernelArgs  string            `json:"kernelArgs"`
+	Restart     string            `json:"restart"`
+	StopCommand string            `json:"stopCommand"`
+	Hooks       string            `json:"hooks"` // hooks file, as for run -hooks
+	Labels      map[string]string `json:"labels"`
+	DependsOn   []string          `json:"dependsOn"`
+	Ready       *Ready            `json:"ready"`
+}
+
+// Count is a whole number in a compose file. The YAML parser leaves every
+// scalar a string, so Count decodes from a JSON string as well as a number.
+type Count uint32
+
+func (c *Count) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if len(b) > 0 && b[0] == '"' {
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid number %s", b)
+	}
+	*c = Count(n)
+	return nil
+}
+
+// Ready is the readiness condition of a VM, as for run -wait-ready.
+type Ready struct {
+	Probe   string `json:"probe"`   // as for -ready-probe; default prompt
+	Timeout string `json:"timeout"` // default vm.DefaultReadyTimeout
+}
+
+type file struct {
+	Name string         `json:"name"`
+	VMs  map[string]*VM `json:"vms"`
+}
+
+// Load reads the compose file at path. The project is named name if that is
+// not empty, else by the file's name key, else after the file's directory.
+func Load(path, name string) (*Project, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("compose: %w", err)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("compose: %w", err)
+	}
+	p, err := parse(src, filepath.Dir(abs), name)
+	if err != nil {
+		return nil, fmt.Errorf("compose %s: %w", path, err)
+	}
+	return p, nil
+}
+
+func parse(src []byte, dir, name string) (*Project, error) {
+	tree, err := parseYAML(src)
+	if err != nil {
+		return nil, err
+	}
+	// Decode through JSON to get field checks and types for free.
+	b, err := json.Marshal(tree)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	var f file
+	if err := dec.Decode(&f); err != nil {
+		return nil, err
+	}
+
+	p := &Project{Name: name, VMs: f.VMs, Dir: dir}
+	if p.Name == "" {
+		p.Name = f.Name
+	}
+	if p.Name == "" {
+		p.Name = strings.ToLower(filepath.Base(dir))
+	}
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Project) validate() error {
+	// Project and VM names make up VM IDs.
+	if config.CheckName(p.Name) != nil {
+		return fmt.Errorf("invalid project name %q", p.Name)
+	}
+	if len(p.VMs) == 0 {
+		return fmt.Errorf("no vms defined")
+	}
+	for name, v := range p.VMs {
+		if err := config.CheckName(name); err != nil {
+			return err
+		}
+		if v == nil {
+			p.VMs[name] = &VM{}
+			continue
+		}
+		for _, dep := range v.DependsOn {
+			if _, ok := p.VMs[dep]; !ok {
+				return fmt.Errorf("VM %s depends on undefined VM %q", name, dep)
+			}
+		}
+		if v.Restart != "" {
+			if _, err := config.ParseRestartPolicy(v.Restart); err != nil {
+				return fmt.Errorf("VM %s: %w", name, err)
+			}
+		}
+		if _, err := v.readyOptions(); err != nil {
+			return fmt.Errorf("VM %s: %w", name, err)
+		}
+		for k, val := range v.Labels {
+			if err := config.CheckLabel(k, val); err != nil {
+				return fmt.Errorf("VM %s: label %q: %w", name, k, err)
+			}
+		}
+	}
+	if _, err := p.Order(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Names returns the VM names, sorted.
+func (p *Project) Names() []string {
+	names := make([]string, 0, len(p.VMs))
+	for name := range p.VMs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ID returns the VM ID of the project's VM name.
+func (p *Project) ID(name string) string { return p.Name + "-" + name }
+
+// Order returns the VM names in an order that starts every VM after the VMs
+// it depends on, or an error naming a dependency cycle.
+func (p *Project) Order() ([]string, error) {
+	var order []string
+	state := map[string]int{} // 1 visiting, 2 done
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case 1:
+			return fmt.Errorf("dependency cycle: %s", strings.Join(append(path, name), " -> "))
+		case 2:
+			return nil
+		}
+		state[name] = 1
+		deps := append([]string(nil), p.VMs[name].DependsOn...)
+		sort.Strings(deps)
+		for _, dep := range deps {
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = 2
+		order = append(order, name)
+		return nil
+	}
+	for _, name := range p.Names() {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// Config returns the configuration VM name is run with.
+func (p *Project) Config(name string) (config.VMConfig, error) {
+	v := p.VMs[name]
+	id := p.ID(name)
+	cfg := config.VMConfig{
+		VMID:        id,
+		PipeName:    config.ConsolePipe(id),
+		ImageDir:    v.ImageDir,
+		MemoryMB:    uint32(v.Memory),
+		CPUCount:    uint32(v.CPUs),
+		KernelArgs:  v.KernelArgs,
+		StopCommand: v.StopCommand,
+		Labels:      map[string]string{},
+	}
+	if cfg.ImageDir == "" {
+		cfg.ImageDir = config.DefaultImageDir
+	} else {
+		cfg.ImageDir = p.path(cfg.ImageDir)
+	}
+	if cfg.MemoryMB == 0 {
+		cfg.MemoryMB = config.DefaultMemoryMB
+	}
+	if cfg.CPUCount == 0 {
+		cfg.CPUCount = config.DefaultCPUCount
+	}
+	restart, err := config.ParseRestartPolicy(v.Restart)
+	if err != nil {
+		return config.VMConfig{}, err
+	}
+	cfg.Restart = restart
+	if v.Hooks != "" {
+		if cfg.Hooks, err = config.LoadHooks(p.path(v.Hooks)); err != nil {
+			return config.VMConfig{}, err
+		}
+	}
+	for k, val := range v.Labels {
+		cfg.Labels[k] = val
+	}
+	cfg.Labels[LabelProject] = p.Name
+	cfg.Labels[LabelVM] = name
+	return cfg, nil
+}
+
+// path resolves a path of the compose file against its directory.
+func (p *Project) path(name string) string {
+	if filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return name
+	}
+	return filepath.Join(p.Dir, name)
+}
+
+// readyOptions returns how to wait for the VM, or nil if nothing waits.
+func (v *VM) readyOptions() (*vm.ReadyOptions, error) {
+	if v.Ready == nil {
+		return nil, nil
+	}
+	opts := &vm.ReadyOptions{Probe: vm.ReadyProbe{Kind: vm.ProbePrompt}}
+	if v.Ready.Probe != "" {
+		probe, err := vm.ParseReadyProbe(v.Ready.Probe)
+		if err != nil {
+			return nil, err
+		}
+		opts.Probe = probe
+	}
+	if v.Ready.Timeout != "" {
+		d, err := time.ParseDuration(v.Ready.Timeout)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("ready timeout %q: want a duration such as 90s", v.Ready.Timeout)
+		}
+		opts.Timeout = d
+	}
+	return opts, nil
+}
@@ -0,0 +1,111 @@
+package compose
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/config"
+)
+
+const testFile = `name: itest
+vms:
+  server:
+    memory: 4096
+    cpus: "2"
+    imageDir: images/server
+    kernelArgs: 1
+    stopCommand: 0
+    labels: {build: 1234, debug: true, owner: ci}
+    ready: {probe: "marker:SERVER-UP", timeout: 90s}
+  client:
+    dependsOn: [server]
+    restart: on-failure
+`
+
+func TestParse(t *testing.T) {
+	p, err := parse([]byte(testFile), `C:\work`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "itest" {
+		t.Fatalf("project %q", p.Name)
+	}
+	order, err := p.Order()
+	if err != nil || !reflect.DeepEqual(order, []string{"server", "client"}) {
+		t.Fatalf("order %q, %v", order, err)
+	}
+	server := p.VMs["server"]
+	if server.Memory != 4096 || server.CPUs != 2 {
+		t.Fatalf("memory %d, cpus %d", server.Memory, server.CPUs)
+	}
+	// Numbers and booleans stay strings where strings are wanted.
+	if server.KernelArgs != "1" || server.StopCommand != "0" {
+		t.Fatalf("kernelArgs %q, stopCommand %q", server.KernelArgs, server.StopCommand)
+	}
+	wantLabels := map[string]string{"build": "1234", "debug": "true", "owner": "ci"}
+	if !reflect.DeepEqual(server.Labels, wantLabels) {
+		t.Fatalf("labels %q, want %q", server.Labels, wantLabels)
+	}
+
+	cfg, err := p.Config("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.VMID != "itest-client" || cfg.MemoryMB != config.DefaultMemoryMB || cfg.CPUCount != config.DefaultCPUCount {
+		t.Fatalf("client config %+v", cfg)
+	}
+	if cfg.Restart.Name != config.RestartOnFailure {
+		t.Fatalf("client restart %v", cfg.Restart)
+	}
+	if cfg.Labels[LabelProject] != "itest" || cfg.Labels[LabelVM] != "client" {
+		t.Fatalf("client labels %q", cfg.Labels)
+	}
+}
+
+func TestParseName(t *testing.T) {
+	src := []byte("vms:\n  a:\n")
+	for _, tt := range []struct {
+		dir, name, want string
+	}{
+		{filepath.Join("work", "MyProject"), "", "myproject"},
+		{filepath.Join("work", "MyProject"), "override", "override"},
+	} {
+		p, err := parse(src, tt.dir, tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Name != tt.want {
+			t.Fatalf("project %q, want %q", p.Name, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"no vms", "name: x\n", "no vms defined"},
+		{"bad project name", "name: -x\nvms:\n  a:\n", `invalid project name "-x"`},
+		{"bad VM name", "name: x\nvms:\n  a/b:\n", `invalid VM name "a/b"`},
+		{"unknown field", "name: x\nvms:\n  a:\n    memroy: 1\n", `unknown field "memroy"`},
+		{"bad memory", "name: x\nvms:\n  a:\n    memory: 4G\n", `invalid number "4G"`},
+		{"negative cpus", "name: x\nvms:\n  a:\n    cpus: -1\n", `invalid number "-1"`},
+		{"undefined dependency", "name: x\nvms:\n  a:\n    dependsOn: [b]\n", `depends on undefined VM "b"`},
+		{"cycle", "name: x\nvms:\n  a:\n    dependsOn: [b]\n  b:\n    dependsOn: [a]\n", "dependency cycle: a -> b -> a"},
+		{"bad restart", "name: x\nvms:\n  a:\n    restart: sometimes\n", "VM a:"},
+		{"bad label", "name: x\nvms:\n  a:\n    labels: {tier: 'web,db'}\n", `VM a: label "tier": value "web,db" may not contain ','`},
+		{"bad timeout", "name: x\nvms:\n  a:\n    ready: {timeout: soon}\n", `ready timeout "soon"`},
+		{"yaml", "name: x\nvms:\n\ta:\n", "line 3: tabs"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parse([]byte(tt.src), `C:\work`, "")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
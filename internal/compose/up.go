@@ -0,0 +1,242 @@
+package compose
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/api"
+	"github.com/microsoft/hcsshim/vmrunner/internal/config"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vm"
+)
+
+// DefaultParallel is how many VMs Up and Down handle at once by default.
+const DefaultParallel = 4
+
+// Client is the part of the daemon API that compose uses; *api.Client
+// implements it.
+type Client interface {
+	Run(cfg config.VMConfig, opts vm.StartOptions) (api.VMInfo, error)
+	Ready(id string, opts vm.ReadyOptions) error
+	Stop(id string, opts vm.StopOptions) error
+	List(opts vm.ListOptions) ([]api.VMSummary, error)
+}
+
+// UpOptions controls Up.
+type UpOptions struct {
+	// Parallel bounds how many VMs start at once; 0 means
+	// DefaultParallel.
+	Parallel int
+	// Start is passed to every run; with Replace, running VMs of the
+	// project are replaced rather than kept.
+	Start vm.StartOptions
+}
+
+// Up starts the project's VMs in dependency order. A VM already running
+// is kept as it is, unless opts.Start.Replace, but still waited for. After a
+// failure no further VMs are started; those already up keep running.
+func Up(c Client, p *Project, opts UpOptions) error {
+	deps := make(map[string][]string, len(p.VMs))
+	for name, v := range p.VMs {
+		deps[name] = v.DependsOn
+	}
+	return walk(p.Names(), deps, opts.Parallel, false, func(name string) error {
+		return up(c, p, name, opts.Start)
+	})
+}
+
+func up(c Client, p *Project, name string, start vm.StartOptions) error {
+	id := p.ID(name)
+	cfg, err := p.Config(name)
+	if err != nil {
+		return err
+	}
+	_, err = c.Run(cfg, start)
+	switch {
+	case err == nil:
+		log.Printf("[vmrunner] %s: VM %q started", p.Name, id)
+	case api.IsExists(err) && !start.Replace && p.running(c, id):
+		log.Printf("[vmrunner] %s: VM %q already running", p.Name, id)
+	default:
+		return err
+	}
+	ready, err := p.VMs[name].readyOptions()
+	if err != nil || ready == nil {
+		return err
+	}
+	log.Printf("[vmrunner] %s: waiting for VM %q (probe %s)", p.Name, id, ready.Probe)
+	if err := c.Ready(id, *ready); err != nil {
+		return err
+	}
+	log.Printf("[vmrunner] %s: VM %q ready", p.Name, id)
+	return nil
+}
+
+// running reports whether VM id runs as a VM of the project, rather than
+// being some other system that took its ID.
+func (p *Project) running(c Client, id string) bool {
+	vms, err := c.List(vm.ListOptions{})
+	if err != nil {
+		return false
+	}
+	for _, v := range vms {
+		if v.Id == id {
+			return v.Labels[LabelProject] == p.Name
+		}
+	}
+	return false
+}
+
+// Down stops the project's VMs, each after the VMs that depend on it. A VM
+// that fails to stop does not hold up the others; all failures are
+// returned.
+func Down(c Client, p *Project, parallel int, opts vm.StopOptions) error {
+	dependents := make(map[string][]string, len(p.VMs))
+	for name, v := range p.VMs {
+		for _, dep := range v.DependsOn {
+			dependents[dep] = append(dependents[dep], name)
+		}
+	}
+	return walk(p.Names(), dependents, parallel, true, func(name string) error {
+		id := p.ID(name)
+		err := c.Stop(id, opts)
+		switch {
+		case api.IsNotFound(err):
+			return nil
+		case err != nil:
+			return err
+		}
+		log.Printf("[vmrunner] %s: VM %q stopped", p.Name, id)
+		return nil
+	})
+}
+
+// walk calls fn for each name once fn has succeeded for every name it waits
+// for, at most parallel (default DefaultParallel) calls at a time. Unless
+// keepGoing, a failure stops further calls and the names left are reported;
+// with keepGoing a failed name counts as done. The failures are returned
+// together.
+func walk(names []string, waitsFor map[string][]string, parallel int, keepGoing bool, fn func(string) error) error {
+	if parallel <= 0 {
+		parallel = DefaultParallel
+	}
+	pending := make(map[string]int, len(names))
+	next := make(map[string][]string)
+	var queue []string
+	for _, name := range names {
+		pending[name] = len(waitsFor[name])
+		for _, w := range waitsFor[name] {
+			next[w] = append(next[w], name)
+		}
+		if pending[name] == 0 {
+			queue = append(queue, name)
+		}
+	}
+
+	type result struct {
+		name string
+		err  error
+	}
+	results := make(chan result)
+	var errs []error
+	done, running := 0, 0
+	for {
+		for len(queue) > 0 && running < parallel && (keepGoing || len(errs) == 0) {
+			name := queue[0]
+			queue = queue[1:]
+			running++
+			go func() { results <- result{name, fn(name)} }()
+		}
+		if running == 0 {
+			break
+		}
+		r := <-results
+		running--
+		done++
+		if r.err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", r.name, r.err))
+			if !keepGoing {
+				continue
+			}
+		}
+		for _, n := range next[r.name] {
+			if pending[n]--; pending[n] == 0 {
+				queue = append(queue, n)
+			}
+		}
+		sort.Strings(queue)
+	}
+	if done < len(names) {
+		var left []string
+		for _, name := range names {
+			if pending[name] > 0 || contains(queue, name) {
+				left = append(left, name)
+			}
+		}
+		errs = append(errs, fmt.Errorf("not started: %s", strings.Join(left, ", ")))
+	}
+	return errors.Join(errs...)
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Status is one row of ps.
+type Status struct {
+	Name string // compose name, or "" for a VM no longer in the file
+	api.VMSummary
+}
+
+// PS returns the state of the project's VMs: those of the file, created or
+// not, then any others recorded with the project's label.
+func PS(c Client, p *Project) ([]Status, error) {
+	vms, err := c.List(vm.ListOptions{Exited: true})
+	if err != nil {
+		return nil, err
+	}
+	byName := map[string]api.VMSummary{}
+	var orphans []Status
+	for _, v := range vms {
+		if v.Labels[LabelProject] != p.Name {
+			continue
+		}
+		name := v.Labels[LabelVM]
+		if _, ok := p.VMs[name]; ok && v.Id == p.ID(name) {
+			byName[name] = v
+		} else {
+			orphans = append(orphans, Status{VMSummary: v})
+		}
+	}
+	rows := make([]Status, 0, len(p.VMs)+len(orphans))
+	for _, name := range p.Names() {
+		v, ok := byName[name]
+		if !ok {
+			v = api.VMSummary{}
+			v.Id, v.State = p.ID(name), "(not created)"
+		}
+		rows = append(rows, Status{Name: name, VMSummary: v})
+	}
+	return append(rows, orphans...), nil
+}
+
+// WritePS prints rows as a table.
+func WritePS(w io.Writer, rows []Status) {
+	const format = "%-16s  %-32s  %-14s  %-8d  %s\n"
+	fmt.Fprintf(w, "%-16s  %-32s  %-14s  %-8s  %s\n", "NAME", "ID", "STATE", "RESTARTS", "LAST FAILURE")
+	for _, r := range rows {
+		name := r.Name
+		if name == "" {
+			name = "(orphan)"
+		}
+		fmt.Fprintf(w, format, name, r.Id, r.State, r.Restarts, r.LastFailure)
+	}
+}
@@ -0,0 +1,413 @@
+package compose
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseYAML parses the subset of YAML that compose files need, without
+// pulling a YAML library into vmrunner:
+//
+//   - block mappings and sequences, nested by indentation (spaces only),
+//     including sequences of mappings ("- name: x");
+//   - single-line flow sequences and mappings ([a, b], {k: v});
+//   - plain, 'single-quoted' and "double-quoted" scalars;
+//   - # comments and a leading --- document marker.
+//
+// Anchors, tags, multi-line scalars and multiple documents are rejected.
+// Mappings decode to map[string]any, sequences to []any, null (null, ~) to
+// nil and other scalars to strings, numbers and booleans included: the
+// fields they decode into give them their type, so "labels: {build: 1234}"
+// keeps a string where it needs one.
+func parseYAML(src []byte) (any, error) {
+	p := &yamlParser{}
+	if err := p.split(string(src)); err != nil {
+		return nil, err
+	}
+	if len(p.lines) == 0 {
+		return nil, nil
+	}
+	v, err := p.block(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, p.errorf("unexpected indentation")
+	}
+	return v, nil
+}
+
+type yamlLine struct {
+	num    int // 1-based line number in the source
+	indent int
+	text   string // without indentation and comment
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func (p *yamlParser) errorf(format string, args ...any) error {
+	num := 0
+	if p.pos < len(p.lines) {
+		num = p.lines[p.pos].num
+	} else if len(p.lines) > 0 {
+		num = p.lines[len(p.lines)-1].num
+	}
+	return fmt.Errorf("line %d: %s", num, fmt.Sprintf(format, args...))
+}
+
+// split breaks src into significant lines.
+func (p *yamlParser) split(src string) error {
+	for i, raw := range strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n") {
+		num := i + 1
+		trimmed := strings.TrimLeft(raw, " ")
+		if strings.HasPrefix(trimmed, "\t") {
+			return fmt.Errorf("line %d: tabs are not allowed in indentation", num)
+		}
+		text := strings.TrimRight(stripComment(trimmed), " \t")
+		if text == "" {
+			continue
+		}
+		if len(p.lines) == 0 && text == "---" {
+			continue
+		}
+		switch {
+		case text == "---" || text == "...":
+			return fmt.Errorf("line %d: only one document is supported", num)
+		case strings.HasPrefix(text, "&") || strings.HasPrefix(text, "*") || strings.HasPrefix(text, "!"):
+			return fmt.Errorf("line %d: anchors, aliases and tags are not supported", num)
+		}
+		p.lines = append(p.lines, yamlLine{num: num, indent: len(raw) - len(trimmed), text: text})
+	}
+	return nil
+}
+
+// stripComment removes a # comment: one at the start of the text or after
+// whitespace, outside quotes.
+func stripComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			switch {
+			case quote == '"' && c == '\\':
+				i++ // an escape, maybe of a quote
+			case quote == '\'' && c == '\'' && i+1 < len(s) && s[i+1] == '\'':
+				i++ // a quote doubled in a single-quoted string
+			case c == quote:
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			if i == 0 || strings.ContainsRune(" [{,:-", rune(s[i-1])) {
+				quote = c
+			}
+		case c == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return s[:i]
+		}
+	}
+	return s
+}
+
+func isSeqItem(text string) bool { return text == "-" || strings.HasPrefix(text, "- ") }
+
+// block parses the mapping or sequence whose lines are indented by indent.
+func (p *yamlParser) block(indent int) (any, error) {
+	if isSeqItem(p.lines[p.pos].text) {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+func (p *yamlParser) mapping(indent int) (any, error) {
+	m := map[string]any{}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent {
+			return nil, p.errorf("unexpected indentation")
+		}
+		if isSeqItem(l.text) {
+			return nil, p.errorf("sequence item in a mapping")
+		}
+		key, rest, err := splitKey(l.text)
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		if _, dup := m[key]; dup {
+			return nil, p.errorf("duplicate key %q", key)
+		}
+		if rest != "" {
+			if m[key], err = scalarOrFlow(rest); err != nil {
+				return nil, p.errorf("%v", err)
+			}
+			p.pos++
+			continue
+		}
+		p.pos++
+		// A nested block, which for a sequence may sit at the key's own
+		// indentation, or nothing (null).
+		switch {
+		case p.pos < len(p.lines) && p.lines[p.pos].indent > indent:
+			m[key], err = p.block(p.lines[p.pos].indent)
+		case p.pos < len(p.lines) && p.lines[p.pos].indent == indent && isSeqItem(p.lines[p.pos].text):
+			m[key], err = p.sequence(indent)
+		default:
+			m[key] = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (p *yamlParser) sequence(indent int) (any, error) {
+	seq := []any{}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent || (l.indent == indent && !isSeqItem(l.text)) {
+			break
+		}
+		if l.indent > indent {
+			return nil, p.errorf("unexpected indentation")
+		}
+		rest := strings.TrimLeft(strings.TrimPrefix(l.text, "-"), " ")
+		switch {
+		case rest == "":
+			p.pos++
+			if p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+				v, err := p.block(p.lines[p.pos].indent)
+				if err != nil {
+					return nil, err
+				}
+				seq = append(seq, v)
+			} else {
+				seq = append(seq, nil)
+			}
+		case isSeqItem(rest) || isMappingEntry(rest):
+			// "- key: value" starts a mapping, and "- - x" a sequence,
+			// indented to where rest is; reparse the line as its first.
+			p.lines[p.pos] = yamlLine{num: l.num, indent: l.indent + len(l.text) - len(rest), text: rest}
+			v, err := p.block(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+		default:
+			v, err := scalarOrFlow(rest)
+			if err != nil {
+				return nil, p.errorf("%v", err)
+			}
+			seq = append(seq, v)
+			p.pos++
+		}
+	}
+	return seq, nil
+}
+
+// isMappingEntry reports whether text is "key: value" or "key:" rather than
+// a scalar.
+func isMappingEntry(text string) bool {
+	if strings.HasPrefix(text, "[") || strings.HasPrefix(text, "{") {
+		return false
+	}
+	_, _, err := splitKey(text)
+	return err == nil
+}
+
+// splitKey splits "key: rest" at the first colon followed by a space or the
+// end of the line. Keys may be quoted.
+func splitKey(text string) (key, rest string, err error) {
+	if text[0] == '"' || text[0] == '\'' {
+		s, n, err := quoted(text)
+		if err != nil {
+			return "", "", err
+		}
+		after := text[n:]
+		if after != ":" && !strings.HasPrefix(after, ": ") {
+			return "", "", fmt.Errorf("expected ':' after key %q", s)
+		}
+		return s, strings.TrimSpace(after[1:]), nil
+	}
+	for i := 0; i < len(text); i++ {
+		if text[i] == ':' && (i == len(text)-1 || text[i+1] == ' ') {
+			key = strings.TrimSpace(text[:i])
+			if key == "" {
+				break
+			}
+			return key, strings.TrimSpace(text[i+1:]), nil
+		}
+	}
+	return "", "", fmt.Errorf("expected 'key: value', got %q", text)
+}
+
+// scalarOrFlow parses a value written on one line.
+func scalarOrFlow(s string) (any, error) {
+	switch s[0] {
+	case '[', '{':
+		v, n, err := flow(s)
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(s[n:]) != "" {
+			return nil, fmt.Errorf("unexpected %q after %s", s[n:], s[:n])
+		}
+		return v, nil
+	case '"', '\'':
+		v, n, err := quoted(s)
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(s[n:]) != "" {
+			return nil, fmt.Errorf("unexpected %q after quoted string", s[n:])
+		}
+		return v, nil
+	case '|', '>':
+		return nil, fmt.Errorf("multi-line scalars are not supported")
+	case '&', '*', '!':
+		return nil, fmt.Errorf("anchors, aliases and tags are not supported")
+	}
+	return plain(s), nil
+}
+
+// plain returns an unquoted scalar: nil for null, else the text.
+func plain(s string) any {
+	switch s {
+	case "null", "Null", "NULL", "~":
+		return nil
+	}
+	return s
+}
+
+// quoted parses the quoted string at the start of s and returns it with the
+// number of bytes it took.
+func quoted(s string) (string, int, error) {
+	q := s[0]
+	if q == '\'' {
+		var b strings.Builder
+		for i := 1; i < len(s); i++ {
+			if s[i] != '\'' {
+				b.WriteByte(s[i])
+				continue
+			}
+			if i+1 < len(s) && s[i+1] == '\'' {
+				b.WriteByte('\'')
+				i++
+				continue
+			}
+			return b.String(), i + 1, nil
+		}
+		return "", 0, fmt.Errorf("unterminated string %s", s)
+	}
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			v, err := strconv.Unquote(s[:i+1])
+			if err != nil {
+				return "", 0, fmt.Errorf("invalid string %s: %v", s[:i+1], err)
+			}
+			return v, i + 1, nil
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string %s", s)
+}
+
+// flow parses the flow sequence or mapping at the start of s and returns it
+// with the number of bytes it took.
+func flow(s string) (any, int, error) {
+	isMap := s[0] == '{'
+	closing := byte(']')
+	if isMap {
+		closing = '}'
+	}
+	seq := []any{}
+	m := map[string]any{}
+	i := skipSpaces(s, 1)
+	if i < len(s) && s[i] == closing {
+		return flowResult(isMap, seq, m), i + 1, nil
+	}
+	for {
+		var key string
+		if isMap {
+			k, n, err := flowItem(s[i:], closing, true)
+			if err != nil {
+				return nil, 0, err
+			}
+			i = skipSpaces(s, i+n)
+			if i >= len(s) || s[i] != ':' {
+				return nil, 0, fmt.Errorf("expected ':' in %s", s)
+			}
+			key = fmt.Sprint(k)
+			if _, dup := m[key]; dup {
+				return nil, 0, fmt.Errorf("duplicate key %q", key)
+			}
+			i = skipSpaces(s, i+1)
+		}
+		v, n, err := flowItem(s[i:], closing, false)
+		if err != nil {
+			return nil, 0, err
+		}
+		if isMap {
+			m[key] = v
+		} else {
+			seq = append(seq, v)
+		}
+		i = skipSpaces(s, i+n)
+		switch {
+		case i >= len(s):
+			return nil, 0, fmt.Errorf("unterminated %s", s)
+		case s[i] == ',':
+			i = skipSpaces(s, i+1)
+		case s[i] == closing:
+			return flowResult(isMap, seq, m), i + 1, nil
+		default:
+			return nil, 0, fmt.Errorf("expected ',' or '%c' in %s", closing, s)
+		}
+	}
+}
+
+func flowResult(isMap bool, seq []any, m map[string]any) any {
+	if isMap {
+		return m
+	}
+	return seq
+}
+
+// flowItem parses one item of a flow collection: a nested collection, a
+// quoted string or plain text up to the next comma, the closing bracket
+// or, for a key, the colon.
+func flowItem(s string, closing byte, isKey bool) (any, int, error) {
+	if s == "" {
+		return nil, 0, fmt.Errorf("unterminated flow collection")
+	}
+	switch s[0] {
+	case '[', '{':
+		return flow(s)
+	case '"', '\'':
+		return quoted(s)
+	}
+	i := 0
+	for i < len(s) && s[i] != ',' && s[i] != closing && !(isKey && s[i] == ':') {
+		i++
+	}
+	text := strings.TrimSpace(s[:i])
+	if isKey {
+		return text, i, nil
+	}
+	return plain(text), i, nil
+}
+
+func skipSpaces(s string, i int) int {
+	for i < len(s) && s[i] == ' ' {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,111 @@
+package compose
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type m = map[string]any
+type s = []any
+
+func TestParseYAML(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		src  string
+		want any
+	}{
+		{"empty", "", nil},
+		{"only comments", "# nothing\n\n  # here\n", nil},
+		{"document marker", "---\nname: x\n", m{"name": "x"}},
+		{
+			"block mapping",
+			"name: itest\nvms:\n  server:\n    memory: 4096\n    imageDir: C:\\images\\server\n  client:\n",
+			m{"name": "itest", "vms": m{"server": m{"memory": "4096", "imageDir": `C:\images\server`}, "client": nil}},
+		},
+		{
+			"block sequence",
+			"dependsOn:\n  - server\n  - db\n",
+			m{"dependsOn": s{"server", "db"}},
+		},
+		{
+			"sequence at key indentation",
+			"dependsOn:\n- server\n- db\nname: x\n",
+			m{"dependsOn": s{"server", "db"}, "name": "x"},
+		},
+		{
+			"sequence of mappings",
+			"- name: a\n  memory: 1\n- name: b\n-\n- - x\n  - y\n",
+			s{m{"name": "a", "memory": "1"}, m{"name": "b"}, nil, s{"x", "y"}},
+		},
+		{
+			"flow",
+			"ready: {probe: \"marker:UP\", timeout: 90s}\ndependsOn: [a, 'b', [c], {}]\nempty: []\n",
+			m{"ready": m{"probe": "marker:UP", "timeout": "90s"}, "dependsOn": s{"a", "b", s{"c"}, m{}}, "empty": s{}},
+		},
+		{
+			"scalars stay strings",
+			"a: 1234\nb: true\nc: 0x10\nd: -1\ne: 1.5\nf: null\ng: ~\nh: {n: 1, b: false, z: null}\n",
+			m{"a": "1234", "b": "true", "c": "0x10", "d": "-1", "e": "1.5", "f": nil, "g": nil, "h": m{"n": "1", "b": "false", "z": nil}},
+		},
+		{
+			"quoting",
+			`a: 'it''s # not a comment'` + "\n" + `b: "tab\there \"q\""` + "\n" + `"quoted key": 'null'` + "\n" + `c: ""` + "\n" + `d: "\" # still quoted"` + "\n",
+			m{"a": "it's # not a comment", "b": "tab\there \"q\"", "quoted key": "null", "c": "", "d": `" # still quoted`},
+		},
+		{
+			"colons in values",
+			"probe: marker:UP\nurl: http://host:80/x\n",
+			m{"probe": "marker:UP", "url": "http://host:80/x"},
+		},
+		{
+			"comments",
+			"# head\nname: x # trailing\nprobe: a#b\nvms: # nested\n  a: # none\n",
+			m{"name": "x", "probe": "a#b", "vms": m{"a": nil}},
+		},
+		{"CRLF", "name: x\r\nvms:\r\n  a:\r\n", m{"name": "x", "vms": m{"a": nil}}},
+		{"tab after a value", "name: x\t\t# c\n", m{"name": "x"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseYAML([]byte(tt.src))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("parsed %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"tab indentation", "vms:\n\tserver:\n", "line 2: tabs are not allowed"},
+		{"tab after spaces", "vms:\n  \tserver:\n", "line 2: tabs are not allowed"},
+		{"over-indented", "name: x\n  memory: 1\n", "line 2: unexpected indentation"},
+		{"over-indented in a block", "vms:\n  a:\n    memory: 1\n      cpus: 2\n", "line 4: unexpected indentation"},
+		{"duplicate key", "# c\nname: x\n\nname: y\n", `line 4: duplicate key "name"`},
+		{"duplicate flow key", "a: {b: 1, b: 2}\n", `line 1: duplicate key "b"`},
+		{"not a mapping", "name: x\njust text\n", "line 2: expected 'key: value'"},
+		{"sequence in a mapping", "name: x\n- a\n", "line 2: sequence item in a mapping"},
+		{"unterminated quote", "a: 1\nb: 'open\n", "line 2: unterminated string"},
+		{"text after quote", "a: 'x' y\n", "line 1: unexpected"},
+		{"unterminated flow", "a:\n  b: [x, y\n", "line 2: unterminated"},
+		{"bad flow separator", "a: [x y] z\n", "line 1: unexpected"},
+		{"multi-line scalar", "a: |\n  text\n", "line 1: multi-line scalars"},
+		{"anchor", "a: &x 1\n", "line 1: anchors, aliases and tags"},
+		{"anchor line", "&x\n", "line 1: anchors, aliases and tags"},
+		{"second document", "a: 1\n---\nb: 2\n", "line 2: only one document"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseYAML([]byte(tt.src))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -1,11 +1,10 @@
-//go:build windows
-
 package config
 
 import (
 	"encoding/json"
 	"fmt"
 	"path/filepath"
+	"strconv"
 )
 
 // VMConfig holds user-facing VM configuration options.
@@ -16,6 +15,71 @@ type VMConfig struct {
 	KernelArgs string
 	VMID       string
 	PipeName   string
+
+	// RestoreStatePath, when set, creates the VM from a saved state file
+	// (written by HcsSaveComputeSystem) instead of booting the kernel.
+	RestoreStatePath string
+
+	// Restart is applied by vmrunnerd when the VM exits without being
+	// asked to.
+	Restart RestartPolicy
+
+	// StopCommand is typed on the serial console to shut the guest down
+	// (default "poweroff").
+	StopCommand string
+
+	// Hooks are run on the host around the VM's start and stop.
+	Hooks Hooks
+
+	// Labels are free-form key=value metadata recorded with the VM.
+	Labels map[string]string `json:",omitempty"`
+
+	// Name is a human-friendly name that commands accept in place of
+	// VMID; no two running VMs share one.
+	Name string `json:",omitempty"`
+
+	// ScratchDisk, when set, is a differencing disk over the image's
+	// rootfs.vhdx, created when the VM starts, that takes the VM's writes
+	// instead of the shared image.
+	ScratchDisk string `json:",omitempty"`
+
+	// Remove deletes the VM once it exits: its scratch disk, console log
+	// and record (run -rm).
+	Remove bool `json:",omitempty"`
+
+	// TTL, when set, is how long the VM may live from when it was run;
+	// IdleTimeout how long its console may see neither input nor output.
+	// The reaper of vmrunnerd (or vmrunner reap) stops VMs past either.
+	TTL         Duration `json:",omitempty"`
+	IdleTimeout Duration `json:",omitempty"`
+
+	// Disks and Shares are attached on top of the root disk when the VM is
+	// created. vmrunnerd records those hot-added to a running VM here, so
+	// that a restart attaches them again.
+	Disks  []SCSIDisk   `json:",omitempty"`
+	Shares []Plan9Share `json:",omitempty"`
+}
+
+// Defaults of the VM settings that vmrunner run and compose files leave
+// out.
+const (
+	DefaultImageDir = `C:\source\hcsshim\vm-image`
+	DefaultMemoryMB = 2048
+	DefaultCPUCount = 2
+)
+
+// ConsolePipe returns the default name of the named pipe HCS connects VM
+// id's serial console (COM1) to.
+func ConsolePipe(id string) string {
+	return fmt.Sprintf(`\\.\pipe\%s-console`, id)
+}
+
+// Console returns the serial console pipe name of cfg.
+func (cfg VMConfig) Console() string {
+	if cfg.PipeName != "" {
+		return cfg.PipeName
+	}
+	return ConsolePipe(cfg.VMID)
 }
 
 // --- HCS Schema2 JSON structures ---
@@ -49,8 +113,9 @@ type computeTopology struct {
 }
 
 type scsiAttachment struct {
-	Type string `json:"Type"`
-	Path string `json:"Path"`
+	Type     string `json:"Type"`
+	Path     string `json:"Path"`
+	ReadOnly bool   `json:"ReadOnly,omitempty"`
 }
 
 type scsiController struct {
@@ -61,15 +126,27 @@ type comPort struct {
 	NamedPipe string `json:"NamedPipe"`
 }
 
+// plan9 is the Plan9 file-sharing device. It must be present at create time
+// (even with no shares) for shares to be hot-added later.
+type plan9 struct {
+	Shares []plan9Share `json:"Shares,omitempty"`
+}
+
 type devices struct {
 	Scsi     map[string]scsiController `json:"Scsi"`
 	ComPorts map[string]comPort        `json:"ComPorts"`
+	Plan9    *plan9                    `json:"Plan9,omitempty"`
+}
+
+type restoreState struct {
+	SaveStateFilePath string `json:"SaveStateFilePath"`
 }
 
 type virtualMachine struct {
 	Chipset         chipset         `json:"Chipset"`
 	ComputeTopology computeTopology `json:"ComputeTopology"`
 	Devices         devices         `json:"Devices"`
+	RestoreState    *restoreState   `json:"RestoreState,omitempty"`
 }
 
 type hcsDocument struct {
@@ -78,6 +155,9 @@ type hcsDocument struct {
 	VirtualMachine virtualMachine `json:"VirtualMachine"`
 }
 
+// Owner is the HCS Owner recorded on every compute system vmrunner creates.
+const Owner = "vmrunner"
+
 // DefaultKernelArgs is the default kernel command line.
 const DefaultKernelArgs = "console=ttyS0 root=/dev/sda1 rw init=/sbin/init"
 // const DefaultKernelArgs = "console=ttyS0 root=/dev/sda1 rw init=/bin/bash"
@@ -93,19 +173,16 @@ func BuildJSON(cfg VMConfig) (string, error) {
 		kernelArgs = DefaultKernelArgs
 	}
 
-	pipeName := cfg.PipeName
-	if pipeName == "" {
-		pipeName = fmt.Sprintf(`\\.\pipe\%s-console`, cfg.VMID)
-	}
+	pipeName := cfg.Console()
 
 	// Windows paths use backslashes; filepath.Join on Linux produces forward
 	// slashes, so we use a helper that always produces Windows-style paths.
 	kernelPath := winPath(cfg.ImageDir, "vmlinuz")
 	initrdPath := winPath(cfg.ImageDir, "initrd")
-	vhdxPath := winPath(cfg.ImageDir, "rootfs.vhdx")
+	vhdxPath := RootDiskPath(cfg)
 
 	doc := hcsDocument{
-		Owner:         "vmrunner",
+		Owner:         Owner,
 		SchemaVersion: schemaVersion{Major: 2, Minor: 1},
 		VirtualMachine: virtualMachine{
 			Chipset: chipset{
@@ -133,10 +210,33 @@ func BuildJSON(cfg VMConfig) (string, error) {
 				ComPorts: map[string]comPort{
 					"0": {NamedPipe: pipeName},
 				},
+				Plan9: &plan9{},
 			},
 		},
 	}
 
+	attachments := doc.VirtualMachine.Devices.Scsi["0"].Attachments
+	for _, d := range cfg.Disks {
+		if err := d.validate(); err != nil {
+			return "", err
+		}
+		lun := strconv.FormatUint(uint64(d.LUN), 10)
+		if _, ok := attachments[lun]; ok {
+			return "", fmt.Errorf("SCSI LUN %d is attached twice", d.LUN)
+		}
+		attachments[lun] = d.attachment()
+	}
+	for _, s := range cfg.Shares {
+		if err := s.validate(); err != nil {
+			return "", err
+		}
+		doc.VirtualMachine.Devices.Plan9.Shares = append(doc.VirtualMachine.Devices.Plan9.Shares, s.settings())
+	}
+
+	if cfg.RestoreStatePath != "" {
+		doc.VirtualMachine.RestoreState = &restoreState{SaveStateFilePath: cfg.RestoreStatePath}
+	}
+
 	b, err := json.Marshal(doc)
 	if err != nil {
 		return "", fmt.Errorf("marshal HCS config: %w", err)
@@ -144,6 +244,41 @@ func BuildJSON(cfg VMConfig) (string, error) {
 	return string(b), nil
 }
 
+// RootDiskPath returns the path of the root filesystem disk attached at
+// SCSI controller 0, LUN 0: the scratch disk if the VM has one, else the
+// image's.
+func RootDiskPath(cfg VMConfig) string {
+	if cfg.ScratchDisk != "" {
+		return cfg.ScratchDisk
+	}
+	return ImageRootDisk(cfg)
+}
+
+// ImageRootDisk returns the root filesystem disk of cfg's image directory,
+// which scratch disks are created over.
+func ImageRootDisk(cfg VMConfig) string {
+	return winPath(cfg.ImageDir, "rootfs.vhdx")
+}
+
+// SaveOptions is the HCS schema2 options document for HcsSaveComputeSystem.
+type SaveOptions struct {
+	SaveType          string `json:"SaveType"`
+	SaveStateFilePath string `json:"SaveStateFilePath"`
+}
+
+// BuildSaveJSON returns the HcsSaveComputeSystem options that write the VM
+// state to statePath.
+func BuildSaveJSON(statePath string) (string, error) {
+	if statePath == "" {
+		return "", fmt.Errorf("save state path must not be empty")
+	}
+	b, err := json.Marshal(SaveOptions{SaveType: "ToFile", SaveStateFilePath: statePath})
+	if err != nil {
+		return "", fmt.Errorf("marshal save options: %w", err)
+	}
+	return string(b), nil
+}
+
 // winPath joins a Windows-style base directory with a filename.
 // cfg.ImageDir may already be a Windows path (e.g. "C:\source\...").
 func winPath(dir, file string) string {
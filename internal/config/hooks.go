@@ -0,0 +1,135 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Hook stages.
+const (
+	HookPreStart  = "preStart"
+	HookPostStart = "postStart"
+	HookPreStop   = "preStop"
+	HookPostStop  = "postStop"
+)
+
+// Hook failure policies.
+const (
+	HookAbort = "abort" // fail the operation
+	HookWarn  = "warn"  // log and carry on
+)
+
+// DefaultHookTimeout bounds a hook without a timeout of its own.
+const DefaultHookTimeout = 30 * time.Second
+
+// Hooks are host executables run around a VM's start and stop.
+type Hooks struct {
+	// PreStart runs before the VM is created; PostStart once it runs.
+	PreStart  []Hook `json:"preStart,omitempty"`
+	PostStart []Hook `json:"postStart,omitempty"`
+	// PreStop runs before a stop or kill; PostStop once the VM has
+	// exited, however it exited.
+	PreStop  []Hook `json:"preStop,omitempty"`
+	PostStop []Hook `json:"postStop,omitempty"`
+}
+
+// Hook is one executable to run. It gets the environment of vmrunnerd plus
+// Env and VMRUNNER_* variables describing the VM.
+type Hook struct {
+	Path    string   `json:"path"`
+	Args    []string `json:"args,omitempty"`
+	Env     []string `json:"env,omitempty"`
+	Timeout Duration `json:"timeout,omitempty"`
+	// OnFailure is HookAbort or HookWarn. It defaults to abort for the
+	// pre- hooks and warn for the post- hooks, whose operation has already
+	// happened.
+	OnFailure string `json:"onFailure,omitempty"`
+}
+
+// Stage returns the hooks of stage.
+func (h Hooks) Stage(stage string) []Hook {
+	switch stage {
+	case HookPreStart:
+		return h.PreStart
+	case HookPostStart:
+		return h.PostStart
+	case HookPreStop:
+		return h.PreStop
+	case HookPostStop:
+		return h.PostStop
+	default:
+		return nil
+	}
+}
+
+// Aborts reports whether a failure of h at stage fails the operation.
+func (h Hook) Aborts(stage string) bool {
+	if h.OnFailure != "" {
+		return h.OnFailure == HookAbort
+	}
+	return stage == HookPreStart || stage == HookPreStop
+}
+
+// TimeoutOrDefault returns how long h may run.
+func (h Hook) TimeoutOrDefault() time.Duration {
+	if h.Timeout > 0 {
+		return time.Duration(h.Timeout)
+	}
+	return DefaultHookTimeout
+}
+
+// LoadHooks reads a JSON hooks file:
+//
+//	{"preStart": [{"path": "C:\\lab\\register.exe", "args": ["--add"],
+//	               "timeout": "10s", "onFailure": "warn"}], ...}
+func LoadHooks(path string) (Hooks, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return Hooks{}, fmt.Errorf("read hooks: %w", err)
+	}
+	var h Hooks
+	if err := json.Unmarshal(b, &h); err != nil {
+		return Hooks{}, fmt.Errorf("hooks %s: %w", path, err)
+	}
+	if err := h.Validate(); err != nil {
+		return Hooks{}, fmt.Errorf("hooks %s: %w", path, err)
+	}
+	return h, nil
+}
+
+// Validate checks every hook has a path and a known failure policy.
+func (h Hooks) Validate() error {
+	for _, stage := range []string{HookPreStart, HookPostStart, HookPreStop, HookPostStop} {
+		for i, hook := range h.Stage(stage) {
+			if hook.Path == "" {
+				return fmt.Errorf("%s hook %d: path required", stage, i)
+			}
+			if hook.OnFailure != "" && hook.OnFailure != HookAbort && hook.OnFailure != HookWarn {
+				return fmt.Errorf("%s hook %d: onFailure %q (want %s or %s)", stage, i, hook.OnFailure, HookAbort, HookWarn)
+			}
+		}
+	}
+	return nil
+}
+
+// Duration is a time.Duration written in JSON as a string such as "30s".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
@@ -0,0 +1,30 @@
+package config
+
+import (
+	"crypto/rand"
+	"fmt"
+	"regexp"
+)
+
+// NewVMID returns a new random (version 4) GUID to identify a VM run
+// without an ID.
+func NewVMID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("vmrunner: random VM ID: %v", err))
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+var validName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// CheckName checks a VM name given with run -name: letters, digits and
+// "_.-", not starting with a punctuation character.
+func CheckName(name string) error {
+	if !validName.MatchString(name) {
+		return fmt.Errorf("invalid VM name %q: want letters, digits, '_', '.' and '-', starting with a letter or digit", name)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseLabel parses a key=value label; see CheckLabel.
+func ParseLabel(s string) (key, value string, err error) {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok {
+		return "", "", fmt.Errorf("label %q: want key=value", s)
+	}
+	if err := CheckLabel(key, value); err != nil {
+		return "", "", fmt.Errorf("label %q: %w", s, err)
+	}
+	return key, value, nil
+}
+
+// CheckLabel returns an error if key=value cannot be a label. Keys may not
+// contain '=', ',' or '!' or spaces, and values may not contain ',', so
+// that labels can be used in selectors.
+func CheckLabel(key, value string) error {
+	if err := checkLabelKey(key); err != nil {
+		return err
+	}
+	if strings.Contains(value, ",") {
+		return fmt.Errorf("value %q may not contain ','", value)
+	}
+	return nil
+}
+
+func checkLabelKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("empty key")
+	}
+	if strings.ContainsAny(key, "=,! \t") {
+		return fmt.Errorf("key %q may not contain '=', ',', '!' or spaces", key)
+	}
+	return nil
+}
+
+// Selector matches VMs by label. It is a list of requirements, all of which
+// must hold.
+type Selector []Requirement
+
+// Requirement is one condition of a Selector.
+type Requirement struct {
+	Key string
+	// Op is "=", "!=", "exists" or "!exists".
+	Op    string
+	Value string
+}
+
+// ParseSelector parses selector expressions, each a comma-separated list of
+// requirements, all of which must hold:
+//
+//	key=value   the label is set to value
+//	key!=value  the label is not set to value (or not set at all)
+//	key         the label is set
+//	!key        the label is not set
+func ParseSelector(exprs []string) (Selector, error) {
+	var sel Selector
+	for _, expr := range exprs {
+		for _, term := range strings.Split(expr, ",") {
+			term = strings.TrimSpace(term)
+			var r Requirement
+			switch {
+			case term == "":
+				return nil, fmt.Errorf("selector %q: empty requirement", expr)
+			case strings.Contains(term, "!="):
+				r.Key, r.Value, _ = strings.Cut(term, "!=")
+				r.Op = "!="
+			case strings.Contains(term, "="):
+				r.Key, r.Value, _ = strings.Cut(term, "=")
+				r.Op = "="
+			case strings.HasPrefix(term, "!"):
+				r.Key, r.Op = term[1:], "!exists"
+			default:
+				r.Key, r.Op = term, "exists"
+			}
+			r.Key = strings.TrimSpace(r.Key)
+			if err := checkLabelKey(r.Key); err != nil {
+				return nil, fmt.Errorf("selector %q: %w", expr, err)
+			}
+			sel = append(sel, r)
+		}
+	}
+	return sel, nil
+}
+
+// Matches reports whether labels satisfy every requirement of s. An empty
+// selector matches everything.
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, r := range s {
+		v, ok := labels[r.Key]
+		switch r.Op {
+		case "=":
+			if !ok || v != r.Value {
+				return false
+			}
+		case "!=":
+			if ok && v == r.Value {
+				return false
+			}
+		case "exists":
+			if !ok {
+				return false
+			}
+		case "!exists":
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseLabel(t *testing.T) {
+	for _, tt := range []struct {
+		in, key, value string
+		err            string
+	}{
+		{in: "tier=web", key: "tier", value: "web"},
+		{in: "empty=", key: "empty", value: ""},
+		{in: "url=http://h/?a=b", key: "url", value: "http://h/?a=b"},
+		{in: "tier", err: "want key=value"},
+		{in: "=web", err: "empty key"},
+		{in: "ti!er=web", err: "may not contain"},
+		{in: "tier=web,db", err: `value "web,db" may not contain ','`},
+	} {
+		key, value, err := ParseLabel(tt.in)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%q: error %v, want %q", tt.in, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || key != tt.key || value != tt.value {
+			t.Errorf("%q: %q=%q, %v", tt.in, key, value, err)
+		}
+	}
+}
+
+func TestParseSelector(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		exprs []string
+		want  Selector
+		err   string
+	}{
+		{"none", nil, nil, ""},
+		{"equals", []string{"tier=web"}, Selector{{"tier", "=", "web"}}, ""},
+		{"not equals", []string{"tier!=web"}, Selector{{"tier", "!=", "web"}}, ""},
+		{"exists", []string{"debug"}, Selector{{"debug", "exists", ""}}, ""},
+		{"not exists", []string{"!debug"}, Selector{{"debug", "!exists", ""}}, ""},
+		{"empty value", []string{"tier="}, Selector{{"tier", "=", ""}}, ""},
+		{
+			"list and spaces", []string{"tier=web, !debug", " owner "},
+			Selector{{"tier", "=", "web"}, {"debug", "!exists", ""}, {"owner", "exists", ""}}, "",
+		},
+		{"empty requirement", []string{"tier=web,"}, nil, "empty requirement"},
+		{"empty", []string{""}, nil, "empty requirement"},
+		{"empty key", []string{"=web"}, nil, "empty key"},
+		{"bad key", []string{"!!debug"}, nil, "may not contain"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			sel, err := ParseSelector(tt.exprs)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(sel, tt.want) {
+				t.Fatalf("parsed %+v, want %+v", sel, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	labels := map[string]string{"tier": "web", "owner": "ci", "empty": ""}
+	for _, tt := range []struct {
+		sel  string
+		want bool
+	}{
+		{"", true},
+		{"tier=web", true},
+		{"tier=db", false},
+		{"missing=web", false},
+		{"empty=", true},
+		{"tier!=db", true},
+		{"tier!=web", false},
+		{"missing!=web", true},
+		{"owner", true},
+		{"missing", false},
+		{"empty", true},
+		{"!missing", true},
+		{"!owner", false},
+		{"tier=web,owner=ci", true},
+		{"tier=web,owner=qa", false},
+	} {
+		var exprs []string
+		if tt.sel != "" {
+			exprs = []string{tt.sel}
+		}
+		sel, err := ParseSelector(exprs)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.sel, err)
+		}
+		if got := sel.Matches(labels); got != tt.want {
+			t.Errorf("%q matches %v: %v, want %v", tt.sel, labels, got, tt.want)
+		}
+	}
+	if !(Selector{{"tier", "!exists", ""}}).Matches(nil) {
+		t.Error("!tier does not match a VM without labels")
+	}
+}
@@ -0,0 +1,224 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// RequestType is the RequestType field of an HCS ModifySettingRequest.
+type RequestType string
+
+const (
+	RequestAdd    RequestType = "Add"
+	RequestRemove RequestType = "Remove"
+	RequestUpdate RequestType = "Update"
+)
+
+// ModifySettingRequest is the HCS schema2 document passed to
+// HcsModifyComputeSystem. Build it with one of the typed constructors below
+// rather than by hand so that the resource path and settings are validated.
+type ModifySettingRequest struct {
+	ResourcePath string      `json:"ResourcePath"`
+	RequestType  RequestType `json:"RequestType"`
+	Settings     interface{} `json:"Settings,omitempty"`
+}
+
+// JSON returns the request serialized for HcsModifyComputeSystem.
+func (r ModifySettingRequest) JSON() (string, error) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return "", fmt.Errorf("marshal modify request: %w", err)
+	}
+	return string(b), nil
+}
+
+// Limits of the synthetic SCSI bus. HCS allows up to four controllers, but
+// BuildJSON defines controller 0 only, so that is the only one disks can be
+// hot-added to.
+const (
+	SCSIControllers = 1
+	MaxSCSILUNs     = 64
+)
+
+// SCSIDisk identifies a virtual disk slot on the VM's SCSI bus.
+// Controller 0 / LUN 0 holds rootfs.vhdx and cannot be hot-plugged.
+type SCSIDisk struct {
+	Controller uint
+	LUN        uint
+	Path       string
+	ReadOnly   bool
+}
+
+func (d SCSIDisk) resourcePath() string {
+	return fmt.Sprintf("VirtualMachine/Devices/Scsi/%d/Attachments/%d", d.Controller, d.LUN)
+}
+
+func (d SCSIDisk) validateSlot() error {
+	if d.Controller >= SCSIControllers {
+		return fmt.Errorf("SCSI controller %d does not exist: VMs have controller 0 only", d.Controller)
+	}
+	if d.LUN >= MaxSCSILUNs {
+		return fmt.Errorf("SCSI LUN %d out of range (0-%d)", d.LUN, MaxSCSILUNs-1)
+	}
+	if d.Controller == 0 && d.LUN == 0 {
+		return fmt.Errorf("SCSI controller 0 LUN 0 is the root disk")
+	}
+	return nil
+}
+
+// validate checks that the disk can be attached.
+func (d SCSIDisk) validate() error {
+	if err := d.validateSlot(); err != nil {
+		return err
+	}
+	if d.Path == "" {
+		return fmt.Errorf("disk path must not be empty")
+	}
+	switch strings.ToLower(filepath.Ext(d.Path)) {
+	case ".vhd", ".vhdx":
+	default:
+		return fmt.Errorf("disk %q: expected a .vhd or .vhdx file", d.Path)
+	}
+	return nil
+}
+
+func (d SCSIDisk) attachment() scsiAttachment {
+	return scsiAttachment{Type: "VirtualDisk", Path: d.Path, ReadOnly: d.ReadOnly}
+}
+
+// AddRequest returns the request that hot-adds the disk.
+func (d SCSIDisk) AddRequest() (ModifySettingRequest, error) {
+	if err := d.validate(); err != nil {
+		return ModifySettingRequest{}, err
+	}
+	return ModifySettingRequest{
+		ResourcePath: d.resourcePath(),
+		RequestType:  RequestAdd,
+		Settings:     d.attachment(),
+	}, nil
+}
+
+// RemoveRequest returns the request that hot-removes the disk. Only the slot
+// is used; Path is informational.
+func (d SCSIDisk) RemoveRequest() (ModifySettingRequest, error) {
+	if err := d.validateSlot(); err != nil {
+		return ModifySettingRequest{}, err
+	}
+	return ModifySettingRequest{
+		ResourcePath: d.resourcePath(),
+		RequestType:  RequestRemove,
+	}, nil
+}
+
+// Plan9Port is the vsock port the Linux guest uses to mount Plan9 shares.
+const Plan9Port = 564
+
+// Plan9 share flags (HCS Plan9ShareFlags).
+const (
+	plan9FlagReadOnly      = 0x00000001
+	plan9FlagLinuxMetadata = 0x00000004
+)
+
+type plan9Share struct {
+	Name       string `json:"Name"`
+	AccessName string `json:"AccessName"`
+	Path       string `json:"Path"`
+	Port       uint32 `json:"Port"`
+	Flags      uint32 `json:"Flags,omitempty"`
+}
+
+// Plan9Share describes a host directory exposed to the guest over Plan9.
+// The guest reaches it on vsock port Plan9Port with aname=<Name>.
+type Plan9Share struct {
+	Name     string
+	HostPath string
+	ReadOnly bool
+}
+
+// validate checks that the share can be added.
+func (s Plan9Share) validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("share name must not be empty")
+	}
+	if strings.ContainsAny(s.Name, `/\ `) {
+		return fmt.Errorf("share name %q must not contain slashes or spaces", s.Name)
+	}
+	if s.HostPath == "" {
+		return fmt.Errorf("share host path must not be empty")
+	}
+	return nil
+}
+
+func (s Plan9Share) settings() plan9Share {
+	flags := uint32(plan9FlagLinuxMetadata)
+	if s.ReadOnly {
+		flags |= plan9FlagReadOnly
+	}
+	return plan9Share{
+		Name:       s.Name,
+		AccessName: s.Name,
+		Path:       s.HostPath,
+		Port:       Plan9Port,
+		Flags:      flags,
+	}
+}
+
+// AddRequest returns the request that hot-adds the share.
+func (s Plan9Share) AddRequest() (ModifySettingRequest, error) {
+	if err := s.validate(); err != nil {
+		return ModifySettingRequest{}, err
+	}
+	return ModifySettingRequest{
+		ResourcePath: "VirtualMachine/Devices/Plan9/Shares",
+		RequestType:  RequestAdd,
+		Settings:     s.settings(),
+	}, nil
+}
+
+// SetDisk records disk in cfg.Disks, in place of the disk in its slot if
+// there is one.
+func (cfg *VMConfig) SetDisk(disk SCSIDisk) {
+	cfg.RemoveDisk(disk)
+	cfg.Disks = append(cfg.Disks, disk)
+}
+
+// RemoveDisk removes the disk in disk's slot from cfg.Disks.
+func (cfg *VMConfig) RemoveDisk(disk SCSIDisk) {
+	var disks []SCSIDisk
+	for _, d := range cfg.Disks {
+		if d.Controller != disk.Controller || d.LUN != disk.LUN {
+			disks = append(disks, d)
+		}
+	}
+	cfg.Disks = disks
+}
+
+// SetShare records share in cfg.Shares, in place of the share of the same
+// name if there is one.
+func (cfg *VMConfig) SetShare(share Plan9Share) {
+	var shares []Plan9Share
+	for _, s := range cfg.Shares {
+		if s.Name != share.Name {
+			shares = append(shares, s)
+		}
+	}
+	cfg.Shares = append(shares, share)
+}
+
+// MemoryUpdateRequest returns the request that resizes guest memory to sizeMB.
+// HCS requires the size to be a multiple of 2 MB.
+func MemoryUpdateRequest(sizeMB uint32) (ModifySettingRequest, error) {
+	if sizeMB == 0 {
+		return ModifySettingRequest{}, fmt.Errorf("memory size must be greater than 0")
+	}
+	if sizeMB%2 != 0 {
+		return ModifySettingRequest{}, fmt.Errorf("memory size %d MB must be a multiple of 2 MB", sizeMB)
+	}
+	return ModifySettingRequest{
+		ResourcePath: "VirtualMachine/ComputeTopology/Memory/SizeInMB",
+		RequestType:  RequestUpdate,
+		Settings:     sizeMB,
+	}, nil
+}
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Restart policy names accepted by ParseRestartPolicy.
+const (
+	RestartNo        = "no"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
+// RestartPolicy says whether vmrunnerd starts a VM again after it exits.
+// The zero value never restarts.
+type RestartPolicy struct {
+	Name string
+	// MaxRetries limits the restarts of an on-failure policy; 0 means no
+	// limit.
+	MaxRetries int `json:",omitempty"`
+}
+
+// ParseRestartPolicy parses "no", "always", "on-failure" or
+// "on-failure:<max>".
+func ParseRestartPolicy(s string) (RestartPolicy, error) {
+	name, max, hasMax := strings.Cut(s, ":")
+	switch {
+	case name == "" || name == RestartNo || name == RestartAlways:
+		if hasMax {
+			return RestartPolicy{}, fmt.Errorf("restart policy %q takes no retry count", name)
+		}
+		if name == "" {
+			name = RestartNo
+		}
+		return RestartPolicy{Name: name}, nil
+	case name == RestartOnFailure:
+		p := RestartPolicy{Name: name}
+		if hasMax {
+			n, err := strconv.Atoi(max)
+			if err != nil || n < 0 {
+				return RestartPolicy{}, fmt.Errorf("invalid retry count %q in restart policy (want a count >= 0)", max)
+			}
+			p.MaxRetries = n
+		}
+		return p, nil
+	default:
+		return RestartPolicy{}, fmt.Errorf("unknown restart policy %q (want no, on-failure[:max] or always)", s)
+	}
+}
+
+func (p RestartPolicy) String() string {
+	switch {
+	case p.Name == "":
+		return RestartNo
+	case p.Name == RestartOnFailure && p.MaxRetries > 0:
+		return fmt.Sprintf("%s:%d", p.Name, p.MaxRetries)
+	default:
+		return p.Name
+	}
+}
+
+// ShouldRestart reports whether a VM that exited, having already been
+// restarted restarts times, is to be started again. Exits the user asked for
+// are never restarted; callers do not ask about them.
+func (p RestartPolicy) ShouldRestart(failed bool, restarts int) bool {
+	switch p.Name {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return failed && (p.MaxRetries == 0 || restarts < p.MaxRetries)
+	default:
+		return false
+	}
+}
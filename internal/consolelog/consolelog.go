@@ -0,0 +1,202 @@
+// Package consolelog records a VM's serial console output in a log file,
+// rotated by size, and reads it back. Every line of the file starts with the
+// time its first byte arrived:
+//
+//	2026-10-18T13:06:06.123456Z [    0.000000] Linux version 6.1.0 ...
+//
+// Output is written as it arrives, so a prompt without a newline is in the
+// file at once; its line ends when the guest next prints a newline.
+package consolelog
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TimeFormat is the layout of the timestamp starting each line, always in
+// UTC so that every stamp has the same width.
+const TimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// stampLen is the length of a stamp and the space after it.
+var stampLen = len(time.Time{}.UTC().Format(TimeFormat)) + 1
+
+// Rotation defaults: the log of a VM takes at most DefaultMaxFiles files of
+// about DefaultMaxSize bytes.
+const (
+	DefaultMaxSize  = 10 << 20
+	DefaultMaxFiles = 3
+)
+
+// Logger writes timestamped console output to a file. When the file reaches
+// MaxSize it is renamed to <path>.1, older files shift up to
+// <path>.<MaxFiles-1> and the oldest is deleted. Rotation only happens
+// between lines.
+type Logger struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	// Now stamps the lines; Open sets it to time.Now.
+	Now func() time.Time
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	inLine bool // the last byte written was not a newline
+}
+
+// Open opens the log at path for appending, creating it and its directory
+// if needed. maxSize and maxFiles of 0 mean the defaults.
+func Open(path string, maxSize int64, maxFiles int) (*Logger, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	if maxFiles <= 0 {
+		maxFiles = DefaultMaxFiles
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("console log: %w", err)
+	}
+	l := &Logger{path: path, maxSize: maxSize, maxFiles: maxFiles, Now: time.Now}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the current file. A file left ending mid-line, say by a VM
+// that exited at a prompt, gets a newline so that new output starts a line
+// of its own.
+func (l *Logger) open() error {
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("console log: %w", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("console log: %w", err)
+	}
+	l.f, l.size, l.inLine = f, fi.Size(), false
+	if l.size > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, l.size-1); err == nil && last[0] != '\n' {
+			n, _ := f.Write([]byte{'\n'})
+			l.size += int64(n)
+		}
+	}
+	return nil
+}
+
+// Write logs console output p. Carriage returns are dropped: the file is
+// read line by line.
+func (l *Logger) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return 0, os.ErrClosed
+	}
+	out := make([]byte, 0, len(p)+stampLen)
+	for _, c := range p {
+		if c == '\r' {
+			continue
+		}
+		if !l.inLine {
+			if l.size+int64(len(out)) >= l.maxSize {
+				if err := l.flush(out); err != nil {
+					return 0, err
+				}
+				out = out[:0]
+				if err := l.rotate(); err != nil {
+					return 0, err
+				}
+			}
+			out = append(out, l.Now().UTC().Format(TimeFormat)...)
+			out = append(out, ' ')
+			l.inLine = true
+		}
+		out = append(out, c)
+		if c == '\n' {
+			l.inLine = false
+		}
+	}
+	if err := l.flush(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (l *Logger) flush(b []byte) error {
+	n, err := l.f.Write(b)
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("console log: %w", err)
+	}
+	return nil
+}
+
+// rotate shifts the files up by one and starts an empty current file.
+func (l *Logger) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return fmt.Errorf("console log: %w", err)
+	}
+	l.f = nil
+	os.Remove(rotated(l.path, l.maxFiles-1))
+	for i := l.maxFiles - 2; i >= 1; i-- {
+		os.Rename(rotated(l.path, i), rotated(l.path, i+1))
+	}
+	var err error
+	if l.maxFiles > 1 {
+		err = os.Rename(l.path, rotated(l.path, 1))
+	} else {
+		err = os.Remove(l.path)
+	}
+	// Carry on in the same file if it could not be moved away.
+	if openErr := l.open(); openErr != nil {
+		return openErr
+	}
+	if err != nil {
+		return fmt.Errorf("console log: rotate: %w", err)
+	}
+	return nil
+}
+
+// Close closes the file. Writes after Close fail.
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+var _ io.WriteCloser = (*Logger)(nil)
+
+// Remove deletes the log at path and its rotated files. The logger must be
+// closed.
+func Remove(path string) error {
+	var errs []error
+	for _, name := range append(rotatedFiles(path), path) {
+		if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("console log: %w", err)
+	}
+	return nil
+}
+
+// rotated returns the name of the i-th rotated file of path.
+func rotated(path string, i int) string {
+	return path + "." + strconv.Itoa(i)
+}
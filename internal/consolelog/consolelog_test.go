@@ -0,0 +1,208 @@
+package consolelog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// base is the time of the first line the tests log.
+var base = time.Date(2026, 10, 18, 13, 6, 6, 0, time.UTC)
+
+// clock returns a Now that starts at base and advances a second per call.
+func clock() func() time.Time {
+	next := base
+	return func() time.Time {
+		t := next
+		next = next.Add(time.Second)
+		return t
+	}
+}
+
+// stamp returns the stamp of the line begun at the i-th second after base.
+func stamp(i int) string {
+	return base.Add(time.Duration(i)*time.Second).Format(TimeFormat) + " "
+}
+
+// openTest opens a log in a temporary directory, stamped by clock.
+func openTest(t *testing.T, maxSize int64, maxFiles int) (*Logger, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "logs", "vm1.log")
+	l, err := Open(path, maxSize, maxFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Now = clock()
+	t.Cleanup(func() { l.Close() })
+	return l, path
+}
+
+func write(t *testing.T, l *Logger, chunks ...string) {
+	t.Helper()
+	for _, c := range chunks {
+		if n, err := l.Write([]byte(c)); err != nil || n != len(c) {
+			t.Fatalf("write %q: %d, %v", c, n, err)
+		}
+	}
+}
+
+func readFile(t *testing.T, name string) string {
+	t.Helper()
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestWriteStamps(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		chunks []string
+		want   string
+	}{
+		{
+			name:   "whole lines",
+			chunks: []string{"one\ntwo\n"},
+			want:   stamp(0) + "one\n" + stamp(1) + "two\n",
+		},
+		{
+			name:   "split lines",
+			chunks: []string{"hel", "lo\nwor", "ld\n"},
+			want:   stamp(0) + "hello\n" + stamp(1) + "world\n",
+		},
+		{
+			name:   "byte at a time",
+			chunks: strings.Split("ab\ncd\n", ""),
+			want:   stamp(0) + "ab\n" + stamp(1) + "cd\n",
+		},
+		{
+			name:   "prompt",
+			chunks: []string{"login: "},
+			want:   stamp(0) + "login: ",
+		},
+		{
+			name:   "prompt answered later",
+			chunks: []string{"login: ", "root\n", "# "},
+			want:   stamp(0) + "login: root\n" + stamp(1) + "# ",
+		},
+		{
+			name:   "carriage returns",
+			chunks: []string{"one\r\n", "two\r", "\n\r\r", "three\r\n"},
+			want:   stamp(0) + "one\n" + stamp(1) + "two\n" + stamp(2) + "three\n",
+		},
+		{
+			name:   "only carriage returns",
+			chunks: []string{"\r", "\r\r"},
+			want:   "",
+		},
+		{
+			name:   "empty lines",
+			chunks: []string{"\n\n"},
+			want:   stamp(0) + "\n" + stamp(1) + "\n",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			l, path := openTest(t, 0, 0)
+			write(t, l, tt.chunks...)
+			if got := readFile(t, path); got != tt.want {
+				t.Fatalf("logged %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestReopen checks that a log left mid-line gets its line ended, so that
+// the next VM's output starts a stamped line of its own.
+func TestReopen(t *testing.T) {
+	l, path := openTest(t, 0, 0)
+	write(t, l, "one\n", "# ")
+	l.Close()
+	if _, err := l.Write([]byte("x")); err == nil {
+		t.Fatal("write after close succeeded")
+	}
+	l, err := Open(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.Now = func() time.Time { return base.Add(time.Minute) }
+	write(t, l, "two\n")
+	want := stamp(0) + "one\n" + stamp(1) + "# \n" + stamp(60) + "two\n"
+	if got := readFile(t, path); got != want {
+		t.Fatalf("logged %q, want %q", got, want)
+	}
+}
+
+// line returns the i-th test line as logged, stamp included.
+func line(i int) string {
+	return fmt.Sprintf("%sline %02d\n", stamp(i), i)
+}
+
+func TestRotate(t *testing.T) {
+	lineLen := int64(len(line(0)))
+	// Three lines fill a file; the fourth starts a new one.
+	l, path := openTest(t, 3*lineLen, 3)
+	for i := 0; i < 10; i++ {
+		write(t, l, fmt.Sprintf("line %02d\n", i))
+	}
+	for _, tt := range []struct {
+		name  string
+		lines []int
+	}{
+		{path + ".2", []int{3, 4, 5}},
+		{path + ".1", []int{6, 7, 8}},
+		{path, []int{9}},
+	} {
+		var want string
+		for _, i := range tt.lines {
+			want += line(i)
+		}
+		if got := readFile(t, tt.name); got != want {
+			t.Errorf("%s: %q, want %q", filepath.Base(tt.name), got, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("more than three files kept: %v", err)
+	}
+	if got, want := rotatedFiles(path), []string{path + ".2", path + ".1"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("rotated files %q, want %q", got, want)
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if matches, _ := filepath.Glob(path + "*"); len(matches) != 0 {
+		t.Fatalf("left after Remove: %q", matches)
+	}
+}
+
+// TestRotateBetweenLines checks that a line written in pieces across the
+// size limit stays in one file.
+func TestRotateBetweenLines(t *testing.T) {
+	l, path := openTest(t, 40, 2)
+	write(t, l, "a long line ", "that goes past ", "the size limit\n", "next\n")
+	if got, want := readFile(t, path+".1"), stamp(0)+"a long line that goes past the size limit\n"; got != want {
+		t.Fatalf("rotated %q, want %q", got, want)
+	}
+	if got, want := readFile(t, path), stamp(1)+"next\n"; got != want {
+		t.Fatalf("current %q, want %q", got, want)
+	}
+}
+
+func TestRotateSingleFile(t *testing.T) {
+	l, path := openTest(t, 10, 1)
+	write(t, l, "one\n", "two\n")
+	if got, want := readFile(t, path), stamp(1)+"two\n"; got != want {
+		t.Fatalf("logged %q, want %q", got, want)
+	}
+	if files := rotatedFiles(path); len(files) != 0 {
+		t.Fatalf("rotated files %q with one file kept", files)
+	}
+}
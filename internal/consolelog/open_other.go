@@ -0,0 +1,10 @@
+//go:build !windows
+
+package consolelog
+
+import "os"
+
+// openShared opens a log file for reading.
+func openShared(name string) (*os.File, error) {
+	return os.Open(name)
+}
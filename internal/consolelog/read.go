@@ -0,0 +1,266 @@
+package consolelog
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pollInterval is how often a follow checks the log for new output.
+const pollInterval = 250 * time.Millisecond
+
+// ReadOptions selects what Read writes.
+type ReadOptions struct {
+	// Since skips lines that began before it; zero keeps them all.
+	Since time.Time
+	// Tail keeps only the last Tail lines of what is already logged; a
+	// negative Tail keeps them all.
+	Tail int
+	// Follow keeps writing new output as it is logged.
+	Follow bool
+	// Timestamps keeps each line's stamp instead of stripping it.
+	Timestamps bool
+}
+
+// ParseSince parses a --since value: a duration before now ("10m") or an
+// RFC 3339 time.
+func ParseSince(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("since %q: want a duration such as 10m or an RFC 3339 time", s)
+	}
+	return t, nil
+}
+
+// Read writes the log at path, rotated files first, to w as selected by
+// opts. A log that does not exist yet reads as empty. When following, it
+// returns once ctx is done and the output logged until then is written.
+func Read(ctx context.Context, path string, w io.Writer, opts ReadOptions) error {
+	out := &filter{w: w, opts: opts}
+	var lines [][]byte // the kept lines when tailing
+	emit := func(line []byte) error {
+		if opts.Tail < 0 {
+			_, err := out.Write(line)
+			return err
+		}
+		if !opts.Since.IsZero() {
+			if t, ok := lineTime(line); ok && t.Before(opts.Since) {
+				return nil
+			}
+		}
+		lines = append(lines, line)
+		if len(lines) > opts.Tail {
+			lines = lines[1:]
+		}
+		return nil
+	}
+
+	for _, name := range rotatedFiles(path) {
+		if err := readLines(name, emit); err != nil {
+			return err
+		}
+	}
+	cur, err := openShared(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("console log: %w", err)
+	}
+	if cur != nil {
+		defer func() { cur.Close() }()
+		if err := scanLines(cur, emit); err != nil {
+			return err
+		}
+	}
+	for _, line := range lines {
+		if _, err := out.Write(line); err != nil {
+			return err
+		}
+	}
+	if !opts.Follow {
+		return nil
+	}
+
+	buf := make([]byte, 32<<10)
+	for {
+		if cur != nil {
+			if _, err := io.CopyBuffer(out, cur, buf); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(pollInterval):
+		}
+		// Move on to the new current file once the logger has rotated
+		// this one away, after reading what it got meanwhile.
+		next, err := openShared(path)
+		if err != nil {
+			continue
+		}
+		if cur != nil && sameFile(cur, next) {
+			next.Close()
+			continue
+		}
+		if cur != nil {
+			if _, err := io.CopyBuffer(out, cur, buf); err != nil {
+				next.Close()
+				return err
+			}
+			cur.Close()
+		}
+		cur = next
+	}
+}
+
+// rotatedFiles returns the rotated files of path, oldest first.
+func rotatedFiles(path string) []string {
+	matches, _ := filepath.Glob(path + ".*")
+	type numbered struct {
+		name string
+		n    int
+	}
+	var files []numbered
+	for _, m := range matches {
+		n, err := strconv.Atoi(strings.TrimPrefix(m, path+"."))
+		if err == nil && n > 0 {
+			files = append(files, numbered{m, n})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].n > files[j].n })
+	names := make([]string, len(files))
+	for i, f := range files {
+		names[i] = f.name
+	}
+	return names
+}
+
+func readLines(name string, emit func([]byte) error) error {
+	f, err := openShared(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil // rotated away meanwhile
+	}
+	if err != nil {
+		return fmt.Errorf("console log: %w", err)
+	}
+	defer f.Close()
+	return scanLines(f, emit)
+}
+
+// scanLines passes each line of r to emit, the last one possibly without
+// its newline.
+func scanLines(r io.Reader, emit func([]byte) error) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			if err := emit(line); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("console log: %w", err)
+		}
+	}
+}
+
+func sameFile(a, b *os.File) bool {
+	ai, err := a.Stat()
+	if err != nil {
+		return false
+	}
+	bi, err := b.Stat()
+	if err != nil {
+		return false
+	}
+	return os.SameFile(ai, bi)
+}
+
+// lineTime returns the stamp of a logged line.
+func lineTime(line []byte) (time.Time, bool) {
+	if len(line) < stampLen || line[stampLen-1] != ' ' {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(TimeFormat, string(line[:stampLen-1]))
+	return t, err == nil
+}
+
+// filter turns the bytes of a log file back into console output: it drops
+// lines from before opts.Since and, unless opts.Timestamps, the stamps.
+// Input may split lines, and stamps, anywhere.
+type filter struct {
+	w    io.Writer
+	opts ReadOptions
+
+	head   []byte // the start of a line, until its stamp is complete
+	inLine bool   // past the stamp of the current line
+	skip   bool   // the current line is dropped
+}
+
+func (f *filter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if !f.inLine {
+			take := stampLen - len(f.head)
+			if i := bytes.IndexByte(p, '\n'); i >= 0 && i < take {
+				// A line too short to have a stamp: pass it on as is.
+				f.head = append(f.head, p[:i+1]...)
+				p = p[i+1:]
+				f.skip = false
+				if err := f.emit(f.head); err != nil {
+					return 0, err
+				}
+				f.head = f.head[:0]
+				continue
+			}
+			if take > len(p) {
+				f.head = append(f.head, p...)
+				break
+			}
+			f.head = append(f.head, p[:take]...)
+			p = p[take:]
+			f.inLine = true
+			t, stamped := lineTime(f.head)
+			f.skip = stamped && !f.opts.Since.IsZero() && t.Before(f.opts.Since)
+			if !stamped || f.opts.Timestamps {
+				if err := f.emit(f.head); err != nil {
+					return 0, err
+				}
+			}
+			f.head = f.head[:0]
+			continue
+		}
+		end := len(p)
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			end = i + 1
+			f.inLine = false
+		}
+		if err := f.emit(p[:end]); err != nil {
+			return 0, err
+		}
+		p = p[end:]
+	}
+	return n, nil
+}
+
+func (f *filter) emit(b []byte) error {
+	if f.skip {
+		return nil
+	}
+	_, err := f.w.Write(b)
+	return err
+}
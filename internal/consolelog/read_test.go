@@ -0,0 +1,171 @@
+package consolelog
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// plain returns test lines from to to-1 as the console printed them.
+func plain(from, to int) string {
+	var s string
+	for i := from; i < to; i++ {
+		s += fmt.Sprintf("line %02d\n", i)
+	}
+	return s
+}
+
+// writeLines logs test lines from to to-1, one write each.
+func writeLines(t *testing.T, l *Logger, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		write(t, l, fmt.Sprintf("line %02d\n", i))
+	}
+}
+
+// rotatedLog returns a log of test lines 0 to 7 in three files: lines 0-2
+// in <path>.2, 3-5 in <path>.1 and 6-7 in <path>. Line i is stamped i
+// seconds after base.
+func rotatedLog(t *testing.T) (*Logger, string) {
+	t.Helper()
+	l, path := openTest(t, 3*int64(len(line(0))), 3)
+	writeLines(t, l, 0, 8)
+	if files := rotatedFiles(path); len(files) != 2 {
+		t.Fatalf("rotated files %q, want 2", files)
+	}
+	return l, path
+}
+
+func TestRead(t *testing.T) {
+	_, path := rotatedLog(t)
+	var stamped string
+	for i := 0; i < 8; i++ {
+		stamped += line(i)
+	}
+	for _, tt := range []struct {
+		name string
+		opts ReadOptions
+		want string
+	}{
+		{"all", ReadOptions{Tail: -1}, plain(0, 8)},
+		{"timestamps", ReadOptions{Tail: -1, Timestamps: true}, stamped},
+		{"since", ReadOptions{Tail: -1, Since: base.Add(4 * time.Second)}, plain(4, 8)},
+		{"since between lines", ReadOptions{Tail: -1, Since: base.Add(4500 * time.Millisecond)}, plain(5, 8)},
+		{"since rotated away", ReadOptions{Tail: -1, Since: base.Add(-time.Hour)}, plain(0, 8)},
+		{"since the future", ReadOptions{Tail: -1, Since: base.Add(time.Hour)}, ""},
+		{"tail across files", ReadOptions{Tail: 4}, plain(4, 8)},
+		{"tail of current", ReadOptions{Tail: 1}, plain(7, 8)},
+		{"tail none", ReadOptions{Tail: 0}, ""},
+		{"tail more than logged", ReadOptions{Tail: 100}, plain(0, 8)},
+		{"tail since", ReadOptions{Tail: 3, Since: base.Add(6 * time.Second)}, plain(6, 8)},
+		{"tail timestamps", ReadOptions{Tail: 2, Timestamps: true}, line(6) + line(7)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := Read(context.Background(), path, &out, tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			if got := out.String(); got != tt.want {
+				t.Fatalf("read %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadMissing(t *testing.T) {
+	var out bytes.Buffer
+	path := filepath.Join(t.TempDir(), "nope.log")
+	if err := Read(context.Background(), path, &out, ReadOptions{Tail: -1}); err != nil || out.Len() != 0 {
+		t.Fatalf("read of a missing log: %q, %v", out.String(), err)
+	}
+}
+
+// TestFilterSplits checks that the stamps are stripped however the bytes
+// of the file are split.
+func TestFilterSplits(t *testing.T) {
+	in := line(0) + "short\n" + line(1) + stamp(2) + "# "
+	want := "line 00\nshort\nline 01\n# "
+	for size := 1; size <= len(in); size++ {
+		var out bytes.Buffer
+		f := &filter{w: &out, opts: ReadOptions{Tail: -1}}
+		for p := in; len(p) > 0; {
+			n := min(size, len(p))
+			if _, err := f.Write([]byte(p[:n])); err != nil {
+				t.Fatal(err)
+			}
+			p = p[n:]
+		}
+		if out.String() != want {
+			t.Fatalf("in chunks of %d: %q, want %q", size, out.String(), want)
+		}
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for a writer and a reader.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// TestReadFollow checks that following a log neither loses nor repeats
+// output when the logger rotates the file being followed.
+func TestReadFollow(t *testing.T) {
+	l, path := openTest(t, 3*int64(len(line(0))), 3)
+	writeLines(t, l, 0, 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var out syncBuffer
+	done := make(chan error, 1)
+	go func() { done <- Read(ctx, path, &out, ReadOptions{Tail: -1, Follow: true}) }()
+	wait := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for out.String() != want {
+			if time.Now().After(deadline) || !strings.HasPrefix(want, out.String()) {
+				t.Fatalf("followed %q, want %q", out.String(), want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	wait(plain(0, 2))
+	// Line 3 rotates the followed file away.
+	writeLines(t, l, 2, 5)
+	wait(plain(0, 5))
+	// And line 6 the one after it.
+	writeLines(t, l, 5, 7)
+	wait(plain(0, 7))
+	write(t, l, "# ")
+	wait(plain(0, 7) + "# ")
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("follow did not end with its context")
+	}
+	if got, want := out.String(), plain(0, 7)+"# "; got != want {
+		t.Fatalf("followed %q, want %q", got, want)
+	}
+}
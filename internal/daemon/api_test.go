@@ -0,0 +1,246 @@
+package daemon
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/api"
+	"github.com/microsoft/hcsshim/vmrunner/internal/store"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vm"
+)
+
+// serve serves d on a Unix socket in a temporary directory and returns a
+// client of it.
+func serve(t *testing.T, d *Daemon) *api.Client {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "vmrunnerd.sock")
+	l, err := api.Listen(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: api.NewHandler(d)}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	c := api.NewClient(socket)
+	if err := c.WaitReady(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func listIDs(t *testing.T, c *api.Client, opts vm.ListOptions) []string {
+	t.Helper()
+	vms, err := c.List(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, v := range vms {
+		ids = append(ids, v.Id+" "+v.State)
+	}
+	return ids
+}
+
+func TestAPIRunListStopKill(t *testing.T) {
+	d, fake, guests := setup(t)
+	c := serve(t, d)
+
+	for _, id := range []string{"vm1", "vm2"} {
+		info, err := c.Run(testConfig(id), vm.StartOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.ID != id || info.State != "Running" {
+			t.Fatalf("run %s: %+v", id, info)
+		}
+	}
+	if _, err := c.Run(testConfig("vm1"), vm.StartOptions{}); !api.IsExists(err) {
+		t.Fatalf("run over a running VM: %v, want Exists", err)
+	}
+	if got, want := listIDs(t, c, vm.ListOptions{}), []string{"vm1 Running", "vm2 Running"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("list %q, want %q", got, want)
+	}
+
+	// Stop types the stop command on the console, and the guest obliges.
+	if err := c.Stop("vm1", vm.StopOptions{Timeout: 5 * time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	if typed := guests.lines("vm1"); len(typed) == 0 || typed[len(typed)-1] != vm.DefaultStopCommand {
+		t.Fatalf("typed on vm1 console: %q", typed)
+	}
+	if err := c.Kill("vm2"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		id     string
+		reason vm.ExitReason
+	}{{"vm1", vm.ExitGuestShutdown}, {"vm2", vm.ExitHostTerminate}} {
+		var rec store.Record
+		waitFor(t, tt.id+" exit recorded", func() bool {
+			var err error
+			rec, err = c.Inspect(tt.id)
+			return err == nil && rec.Exited != nil
+		})
+		if rec.State != "Stopped" || rec.LastExit == nil || rec.LastExit.Reason != tt.reason {
+			t.Fatalf("%s: state %s, exit %+v; want stopped by %s", tt.id, rec.State, rec.LastExit, tt.reason)
+		}
+	}
+	if fake.Exists("vm1") || fake.Exists("vm2") {
+		t.Fatal("systems left in HCS")
+	}
+
+	if got := listIDs(t, c, vm.ListOptions{}); len(got) != 0 {
+		t.Fatalf("list after stop: %q", got)
+	}
+	if got, want := listIDs(t, c, vm.ListOptions{Exited: true}), []string{"vm1 Stopped", "vm2 Stopped"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("list exited %q, want %q", got, want)
+	}
+	if err := c.Kill("vm2"); err == nil {
+		t.Fatal("kill of a stopped VM succeeded")
+	}
+	if err := c.Stop("nope", vm.StopOptions{}); !api.IsNotFound(err) {
+		t.Fatalf("stop of an unknown VM: %v, want NotFound", err)
+	}
+}
+
+// notifyWriter is a bytes.Buffer that signals each write on wrote.
+type notifyWriter struct {
+	mu    sync.Mutex
+	buf   bytes.Buffer
+	wrote chan struct{}
+}
+
+func (w *notifyWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n, err := w.buf.Write(p)
+	select {
+	case w.wrote <- struct{}{}:
+	default:
+	}
+	return n, err
+}
+
+func (w *notifyWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
+
+// TestAPIExecStreams checks that exec output reaches the client while the
+// command is still running, and that the exit code follows it.
+func TestAPIExecStreams(t *testing.T) {
+	d, fake, _ := setup(t)
+	c := serve(t, d)
+	release := make(chan struct{})
+	fake.Run = func(system, args string, stdin io.Reader, stdout, stderr io.Writer) int {
+		io.WriteString(stdout, "building\n")
+		<-release
+		io.WriteString(stderr, "warning: stale cache\n")
+		io.WriteString(stdout, "done\n")
+		return 3
+	}
+	if _, err := c.Run(testConfig("vm1"), vm.StartOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := &notifyWriter{wrote: make(chan struct{}, 1)}
+	var stderr bytes.Buffer
+	type result struct {
+		code int
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		code, err := c.Exec("vm1", api.ExecRequest{Args: []string{"make"}, GCS: true}, stdout, &stderr)
+		done <- result{code, err}
+	}()
+	select {
+	case <-stdout.wrote:
+	case r := <-done:
+		t.Fatalf("exec ended before the command did: %+v", r)
+	case <-time.After(5 * time.Second):
+		t.Fatal("output not streamed while the command runs")
+	}
+	if got := stdout.String(); got != "building\n" {
+		t.Fatalf("streamed stdout %q", got)
+	}
+	close(release)
+	r := <-done
+	if r.err != nil || r.code != 3 {
+		t.Fatalf("exec: code %d, %v; want 3", r.code, r.err)
+	}
+	if got := stdout.String(); got != "building\ndone\n" {
+		t.Fatalf("stdout %q", got)
+	}
+	if got := stderr.String(); got != "warning: stale cache\n" {
+		t.Fatalf("stderr %q", got)
+	}
+
+	if _, err := c.Exec("nope", api.ExecRequest{Args: []string{"true"}, GCS: true}, io.Discard, io.Discard); !api.IsNotFound(err) {
+		t.Fatalf("exec in an unknown VM: %v, want NotFound", err)
+	}
+}
+
+func TestAPIExecSerial(t *testing.T) {
+	d, _, _ := setup(t)
+	c := serve(t, d)
+	if _, err := c.Run(testConfig("vm1"), vm.StartOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if code, err := c.Exec("vm1", api.ExecRequest{Args: []string{"uname"}}, &out, io.Discard); err != nil || code != 0 {
+		t.Fatalf("exec: code %d, %v", code, err)
+	}
+	if !strings.Contains(out.String(), "Linux") {
+		t.Fatalf("exec output %q", out.String())
+	}
+}
+
+// TestAPIAttach checks that attach hijacks the connection into a raw
+// console stream and that detaching leaves the VM running.
+func TestAPIAttach(t *testing.T) {
+	d, _, _ := setup(t)
+	c := serve(t, d)
+	if _, err := c.Run(testConfig("vm1"), vm.StartOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := c.Attach("vm1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(conn, "uname\n"); err != nil {
+		t.Fatal(err)
+	}
+	var got []byte
+	buf := make([]byte, 256)
+	deadline := time.Now().Add(5 * time.Second)
+	for !bytes.Contains(got, []byte("Linux\r\n"+guestPrompt)) {
+		if time.Now().After(deadline) {
+			t.Fatalf("console output %q", got)
+		}
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("read console: %v (after %q)", err, got)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := c.Inspect("vm1")
+	if err != nil || rec.State != "Running" {
+		t.Fatalf("after detach: %s, %v", rec.State, err)
+	}
+
+	if _, err := c.Attach("nope"); !api.IsNotFound(err) {
+		t.Fatalf("attach to an unknown VM: %v, want NotFound", err)
+	}
+}
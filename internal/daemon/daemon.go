@@ -0,0 +1,741 @@
+// Package daemon implements vmrunnerd: it owns the HCS handles of the VMs it
+// runs, follows their state through HCS notifications, keeps their serial
+// consoles drained and records them in the state store, serving all of it
+// through the api package.
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/api"
+	"github.com/microsoft/hcsshim/vmrunner/internal/config"
+	"github.com/microsoft/hcsshim/vmrunner/internal/consolelog"
+	"github.com/microsoft/hcsshim/vmrunner/internal/store"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vm"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vmcompute"
+)
+
+// consoleTimeout bounds how long a new VM's console pipe may take to appear.
+const consoleTimeout = 30 * time.Second
+
+// Daemon implements api.Service on top of the vm package. It must be the only
+// user of vm.Compute in its process.
+type Daemon struct {
+	store *store.Store
+
+	mu      sync.Mutex
+	vms     map[string]*managed
+	pending map[string]*pendingRestart
+	backoff map[string]int // restarts since the VM last ran stably
+	reaper  chan struct{}  // closed to stop the reaper, if started
+}
+
+// managed is a VM whose handle and console the daemon holds.
+type managed struct {
+	vm      *vm.VM
+	console *hub
+	cancel  func()     // stops following the VM's events
+	execMu  sync.Mutex // one serial-console exec at a time
+
+	started time.Time
+	// stopping is set while a stop or kill asked through the API is in
+	// progress, so that the exit it causes is not restarted.
+	stopping atomic.Bool
+	// reaped is why the reaper is stopping the VM, if it is.
+	reaped atomic.Pointer[string]
+	// saved is the snapshot directory of a save that stops the VM.
+	saved atomic.Pointer[string]
+}
+
+var _ api.Service = (*Daemon)(nil)
+
+// New returns a daemon managing no VMs that records them in st.
+func New(st *store.Store) *Daemon {
+	return &Daemon{
+		store:   st,
+		vms:     make(map[string]*managed),
+		pending: make(map[string]*pendingRestart),
+		backoff: make(map[string]int),
+	}
+}
+
+// Adopt takes over the running VMs owned by vmrunner, typically started by
+// a previous daemon or by an older vmrunner without one, and reconciles the
+// store with them.
+func (d *Daemon) Adopt() error {
+	systems, err := d.reconcile()
+	if err != nil {
+		return err
+	}
+	for _, s := range systems {
+		if _, err := d.get(s.Id); err != nil {
+			log.Printf("[vmrunnerd] adopt VM %q: %v", s.Id, err)
+		}
+	}
+	return nil
+}
+
+// Close releases every handle and console and drops pending restarts. The
+// VMs keep running.
+func (d *Daemon) Close() {
+	d.mu.Lock()
+	vms := d.vms
+	d.vms = make(map[string]*managed)
+	for id, p := range d.pending {
+		p.timer.Stop()
+		delete(d.pending, id)
+	}
+	if d.reaper != nil {
+		close(d.reaper)
+		d.reaper = nil
+	}
+	d.mu.Unlock()
+	for _, m := range vms {
+		m.cancel()
+		m.console.close()
+		m.vm.Close()
+	}
+}
+
+// reconcile marks the records of VMs that HCS no longer knows as exited, and
+// returns the vmrunner systems HCS does know.
+func (d *Daemon) reconcile() ([]vmcompute.SystemSummary, error) {
+	systems, err := vm.Systems(vm.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	live := make(map[string]bool, len(systems))
+	for _, s := range systems {
+		live[s.Id] = true
+	}
+	records, err := d.store.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		if !live[r.ID] && r.Exited == nil {
+			d.vanished(r.ID)
+		}
+	}
+	return systems, nil
+}
+
+// vanished records that VM id disappeared from HCS without the daemon seeing
+// it exit, e.g. while no daemon was running or across a host reboot, and
+// applies its restart policy.
+func (d *Daemon) vanished(id string) {
+	if r, err := d.store.Get(id); err == nil && r.Config.Remove {
+		d.remove(id)
+		return
+	}
+	marked := false
+	err := d.store.Update(id, func(r *store.Record) {
+		if r.Exited == nil {
+			r.SetUnexpectedExit(vm.StateStopped.String(), "vanished: no longer known to HCS")
+			marked = true
+		}
+	})
+	if err != nil {
+		log.Printf("[vmrunnerd] VM %q: %v", id, err)
+	}
+	if marked {
+		// Vanishing is an unexpected exit.
+		d.exited(id, true, 0)
+	}
+}
+
+func (d *Daemon) Info() api.Info {
+	return api.Info{APIVersion: api.Version, Backend: vm.Compute.Name(), PID: os.Getpid(), StateDir: d.store.Dir()}
+}
+
+// manage registers v, connects its console in the background, logging it,
+// and releases both once the VM stops or fails.
+func (d *Daemon) manage(v *vm.VM, pipe string) *managed {
+	// The hub of a VM replaced under the same ID must stop logging first.
+	d.forget(v.ID())
+	var consoleLog io.WriteCloser
+	if l, err := consolelog.Open(d.store.ConsoleLog(v.ID()), 0, 0); err != nil {
+		log.Printf("[vmrunnerd] VM %q: %v", v.ID(), err)
+	} else {
+		consoleLog = l
+	}
+	m := &managed{vm: v, console: newHub(v.ID(), consoleLog), started: time.Now()}
+	// Read OpenConsole now, not in the goroutine, which may outlive it.
+	openConsole := vm.OpenConsole
+	events, cancel := v.Events()
+	m.cancel = cancel
+
+	d.mu.Lock()
+	d.vms[v.ID()] = m
+	d.mu.Unlock()
+
+	go func() {
+		console, err := openConsole(pipe, consoleTimeout)
+		if err != nil {
+			log.Printf("[vmrunnerd] VM %q: %v", v.ID(), err)
+			m.console.close()
+			return
+		}
+		m.console.run(console)
+	}()
+	go func() {
+		removed := false // the VM exited and must be removed
+		for ev := range events {
+			if ev.Err != nil {
+				log.Printf("[vmrunnerd] VM %q: %s → %s: %v", ev.ID, ev.From, ev.To, ev.Err)
+			} else {
+				log.Printf("[vmrunnerd] VM %q: %s → %s", ev.ID, ev.From, ev.To)
+			}
+			if !d.current(m) {
+				continue
+			}
+			var reason string
+			if r := m.reaped.Load(); r != nil {
+				reason = "reaped: " + *r
+			} else if dir := m.saved.Load(); dir != nil {
+				reason = "saved to " + *dir
+			}
+			d.record(ev, reason)
+			if ev.To.Final() && m.vm.Config().Remove {
+				removed = true
+				continue
+			}
+			if ev.To.Final() && !m.stopping.Load() {
+				failed := ev.To == vm.StateFailed
+				if ev.Exit != nil {
+					failed = ev.Exit.Failed()
+				}
+				d.exited(ev.ID, failed, time.Since(m.started))
+			}
+		}
+		d.release(m)
+		if removed {
+			d.remove(v.ID())
+		}
+	}()
+	return m
+}
+
+// current reports whether m is still the daemon's VM for its ID, rather than
+// one replaced by a new VM of the same ID.
+func (d *Daemon) current(m *managed) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.vms[m.vm.ID()] == m
+}
+
+// record stores the state change ev, an exit with reason if it was not
+// asked for plainly. VMs adopted without a record have nothing to update.
+func (d *Daemon) record(ev vm.Event, reason string) {
+	err := d.store.Update(ev.ID, func(r *store.Record) {
+		if ev.Exit != nil {
+			r.LastExit = ev.Exit
+		}
+		switch {
+		case !ev.To.Final():
+			r.State = ev.To.String()
+		case ev.Err != nil:
+			r.SetExited(ev.To.String(), ev.Err.Error())
+			r.LastFailure = ev.Err.Error()
+		case reason != "":
+			r.SetExited(ev.To.String(), reason)
+		default:
+			r.SetExited(ev.To.String(), "stopped")
+		}
+	})
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		log.Printf("[vmrunnerd] VM %q: %v", ev.ID, err)
+	}
+}
+
+// forget stops managing VM id, if it is managed, without recording anything
+// further about it.
+func (d *Daemon) forget(id string) {
+	d.mu.Lock()
+	m, ok := d.vms[id]
+	delete(d.vms, id)
+	d.mu.Unlock()
+	if ok {
+		m.cancel()
+		m.console.close()
+		m.vm.Close()
+	}
+}
+
+// remove deletes VM id, run to be removed on exit, once it has exited: its
+// scratch disk, console log and record.
+func (d *Daemon) remove(id string) {
+	rec, err := d.store.Get(id)
+	if err != nil {
+		log.Printf("[vmrunnerd] remove VM %q: %v", id, err)
+		return
+	}
+	if rec.Config.ScratchDisk != "" {
+		if err := vm.RemoveScratchDisk(rec.Config.ScratchDisk); err != nil {
+			log.Printf("[vmrunnerd] remove VM %q: %v", id, err)
+		}
+	}
+	if err := consolelog.Remove(d.store.ConsoleLog(id)); err != nil {
+		log.Printf("[vmrunnerd] remove VM %q: %v", id, err)
+	}
+	if err := d.store.Remove(id); err != nil {
+		log.Printf("[vmrunnerd] remove VM %q: %v", id, err)
+		return
+	}
+	log.Printf("[vmrunnerd] VM %q removed", id)
+}
+
+// release forgets m once its VM has reached a final state.
+func (d *Daemon) release(m *managed) {
+	d.mu.Lock()
+	if d.vms[m.vm.ID()] == m {
+		delete(d.vms, m.vm.ID())
+	}
+	d.mu.Unlock()
+	m.console.close()
+	m.vm.Close()
+}
+
+// get returns the managed VM id, adopting it if it exists but is not yet
+// managed. A VM adopted with a record gets the configuration it was started
+// with, hooks included.
+func (d *Daemon) get(id string) (*managed, error) {
+	d.mu.Lock()
+	m, ok := d.vms[id]
+	d.mu.Unlock()
+	if ok {
+		return m, nil
+	}
+	cfg, pipe := config.VMConfig{VMID: id}, config.ConsolePipe(id)
+	var lastActivity *time.Time
+	if r, err := d.store.Get(id); err == nil {
+		cfg, pipe, lastActivity = r.Config, r.Console, r.LastActivity
+		if lastActivity == nil {
+			lastActivity = r.Started
+		}
+	}
+	v, err := vm.OpenConfig(cfg)
+	if err != nil {
+		if vmcompute.IsNotFound(err) {
+			return nil, api.NotFound(id)
+		}
+		return nil, err
+	}
+	if v.State().Final() {
+		v.Close()
+		return nil, &vm.StateError{ID: id, Op: "manage", State: v.State()}
+	}
+	m = d.manage(v, pipe)
+	if lastActivity != nil {
+		// Nobody watched the console since: the idle timeout counts from
+		// the activity the last daemon saw, else from the start, not from
+		// now, or a reap without vmrunnerd would never find a VM idle.
+		m.console.touch(*lastActivity)
+	}
+	return m, nil
+}
+
+// Run starts a VM with cfg, under a new ID if cfg has none.
+func (d *Daemon) Run(cfg config.VMConfig, opts vm.StartOptions) (api.VMInfo, error) {
+	if cfg.VMID == "" {
+		cfg.VMID = config.NewVMID()
+		cfg.PipeName = config.ConsolePipe(cfg.VMID)
+	}
+	return d.run(cfg, opts, vm.Start)
+}
+
+// run starts a VM with start, records it and manages it.
+func (d *Daemon) run(cfg config.VMConfig, opts vm.StartOptions, start func(config.VMConfig, vm.StartOptions) (*vm.VM, error)) (api.VMInfo, error) {
+	if cfg.TTL < 0 || cfg.IdleTimeout < 0 {
+		return api.VMInfo{}, &api.Error{Kind: api.KindInvalid, Message: "TTL and idle timeout cannot be negative"}
+	}
+	for k, v := range cfg.Labels {
+		if err := config.CheckLabel(k, v); err != nil {
+			return api.VMInfo{}, &api.Error{Kind: api.KindInvalid, Message: fmt.Sprintf("label %q: %v", k, err)}
+		}
+	}
+	if cfg.Remove {
+		if cfg.Restart.Name != "" && cfg.Restart.Name != config.RestartNo {
+			return api.VMInfo{}, &api.Error{Kind: api.KindInvalid, Message: "a VM removed on exit cannot have a restart policy"}
+		}
+		// Its writes go to a scratch disk of its own, removed with it.
+		cfg.ScratchDisk = d.store.ScratchDisk(cfg.VMID)
+	}
+	if err := d.checkName(cfg.VMID, cfg.Name, opts.Replace); err != nil {
+		return api.VMInfo{}, err
+	}
+	if opts.Replace {
+		// The VM of the same ID is about to be replaced; stop following
+		// it so that its exit is not recorded over the new VM's record.
+		d.forget(cfg.VMID)
+	}
+	// A VM waiting to be restarted is not in HCS, so nothing stops
+	// running it anew; it then starts its restart history afresh.
+	d.cancelRestart(cfg.VMID)
+	d.mu.Lock()
+	delete(d.backoff, cfg.VMID)
+	d.mu.Unlock()
+	v, err := start(cfg, opts)
+	if err != nil {
+		return api.VMInfo{}, err
+	}
+	rec := store.NewRecord(cfg)
+	// A restart boots the VM afresh: the saved state it may have been
+	// restored from only matches its disks as they were saved.
+	rec.Config.RestoreStatePath = ""
+	rec.State = v.State().String()
+	if err := d.store.Put(rec); err != nil {
+		log.Printf("[vmrunnerd] VM %q: %v", v.ID(), err)
+	}
+	d.manage(v, rec.Console)
+	return api.VMInfo{ID: v.ID(), State: v.State().String()}, nil
+}
+
+// List lists the systems HCS knows, the recorded VMs waiting to be restarted
+// and, with opts.Exited, the recorded VMs that have exited.
+func (d *Daemon) List(opts vm.ListOptions) ([]api.VMSummary, error) {
+	sel, err := config.ParseSelector(opts.Labels)
+	if err != nil {
+		return nil, &api.Error{Kind: api.KindInvalid, Message: err.Error()}
+	}
+	live, err := d.reconcile()
+	if err != nil {
+		log.Printf("[vmrunnerd] reconcile state store: %v", err)
+	}
+	systems, err := vm.Systems(opts)
+	if err != nil {
+		return nil, err
+	}
+	records, err := d.store.List()
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]*store.Record, len(records))
+	for _, r := range records {
+		byID[r.ID] = r
+	}
+	running := make(map[string]bool, len(live))
+	for _, s := range live {
+		running[s.Id] = true
+	}
+
+	var down []vmcompute.SystemSummary
+	for _, r := range records {
+		if running[r.ID] || r.Exited == nil {
+			continue
+		}
+		s := vmcompute.SystemSummary{Id: r.ID, SystemType: "VirtualMachine", Owner: config.Owner, State: r.State}
+		switch {
+		case d.restarting(r.ID):
+			s.State = stateRestarting
+		case !opts.Exited:
+			continue
+		}
+		down = append(down, s)
+	}
+	down, err = opts.Select(down)
+	if err != nil {
+		return nil, err
+	}
+
+	vms := make([]api.VMSummary, 0, len(systems)+len(down))
+	for _, s := range append(systems, down...) {
+		v := api.VMSummary{SystemSummary: s}
+		if r, ok := byID[s.Id]; ok {
+			v.Restarts = r.Restarts
+			v.LastFailure = r.LastFailure
+			v.Labels = r.Labels
+			v.Name = r.Name
+		}
+		if !sel.Matches(v.Labels) {
+			continue
+		}
+		vms = append(vms, v)
+	}
+	return vms, nil
+}
+
+func (d *Daemon) Inspect(ref string) (store.Record, error) {
+	id, err := d.resolve(ref)
+	if err != nil {
+		return store.Record{}, err
+	}
+	rec, err := d.store.Get(id)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return store.Record{}, err
+	}
+	m, liveErr := d.get(id)
+	switch {
+	case liveErr == nil:
+		if rec == nil {
+			// Started outside the daemon: all that is known is HCS's view.
+			rec = &store.Record{ID: id, Config: config.VMConfig{VMID: id}, Console: config.ConsolePipe(id)}
+		}
+		rec.State = m.vm.State().String()
+		if rec.Config.IdleTimeout > 0 {
+			last := m.console.lastActivity().UTC()
+			rec.LastActivity = &last
+		}
+	case rec == nil:
+		return store.Record{}, liveErr
+	case rec.Exited == nil && api.IsNotFound(liveErr):
+		d.vanished(id)
+		if r, err := d.store.Get(id); err == nil {
+			rec = r
+		}
+	}
+	if d.restarting(id) {
+		rec.State = stateRestarting
+	}
+	return *rec, nil
+}
+
+// Stop stops VM ref, or cancels its pending restart.
+func (d *Daemon) Stop(ref string, opts vm.StopOptions) error {
+	id, err := d.resolve(ref)
+	if err != nil {
+		return err
+	}
+	if d.cancelRestart(id) {
+		log.Printf("[vmrunnerd] VM %q: pending restart cancelled", id)
+		return nil
+	}
+	m, err := d.get(id)
+	if err != nil {
+		return err
+	}
+	if opts.Command == "" {
+		opts.Command = d.stopCommand(id)
+	}
+	m.stopping.Store(true)
+	console := m.console.session(false)
+	defer console.Close()
+	err = m.vm.Stop(console, opts)
+	if err != nil && !m.vm.State().Final() {
+		m.stopping.Store(false)
+	}
+	return err
+}
+
+// stopCommand returns the stop command recorded for VM id, or the default.
+func (d *Daemon) stopCommand(id string) string {
+	if r, err := d.store.Get(id); err == nil && r.Config.StopCommand != "" {
+		return r.Config.StopCommand
+	}
+	return vm.DefaultStopCommand
+}
+
+// Ready waits for VM id to pass opts.Probe. The probe sees the console
+// output kept since the VM started, so a VM that is already ready passes at
+// once.
+func (d *Daemon) Ready(ref string, opts vm.ReadyOptions) error {
+	id, err := d.resolve(ref)
+	if err != nil {
+		return err
+	}
+	m, err := d.get(id)
+	if err != nil {
+		// It may have exited between being run and being waited for.
+		if r, recErr := d.store.Get(id); recErr == nil && r.Exited != nil {
+			return &vm.NotReadyError{ID: id, Probe: opts.Probe.String(), Reason: fmt.Sprintf("VM exited (%s): %s", r.State, r.ExitReason)}
+		}
+		return err
+	}
+	console := m.console.session(true)
+	defer console.Close()
+	return m.vm.WaitReady(console, opts)
+}
+
+// Wait waits for VM ref to exit and returns how it did. A VM that is not
+// running, having exited or waiting to be restarted, returns its last exit
+// at once.
+func (d *Daemon) Wait(ctx context.Context, ref string) (vm.Exit, error) {
+	id, err := d.resolve(ref)
+	if err != nil {
+		return vm.Exit{}, err
+	}
+	var liveErr error
+	if !d.restarting(id) {
+		var m *managed
+		if m, liveErr = d.get(id); liveErr == nil {
+			x, err := d.waitExit(ctx, m)
+			if err != nil {
+				return vm.Exit{}, err
+			}
+			if x != nil {
+				return *x, nil
+			}
+		}
+	}
+	rec, err := d.store.Get(id)
+	switch {
+	case err != nil && liveErr != nil:
+		return vm.Exit{}, liveErr
+	case err != nil:
+		return vm.Exit{}, err
+	case rec.LastExit != nil:
+		return *rec.LastExit, nil
+	case rec.Exited != nil:
+		// Recorded before exits were classified.
+		x := vm.Exit{Reason: vm.ExitGuestShutdown, Time: *rec.Exited, Detail: rec.ExitReason}
+		if rec.State == vm.StateFailed.String() {
+			x.Reason = vm.ExitUnexpected
+		}
+		return x, nil
+	}
+	return vm.Exit{}, fmt.Errorf("VM %q: exit not recorded", id)
+}
+
+// waitExit waits for the VM of m to exit and returns how, or nil if the
+// daemon stopped following it first (it was replaced or the daemon is
+// closing).
+func (d *Daemon) waitExit(ctx context.Context, m *managed) (*vm.Exit, error) {
+	events, cancel := m.vm.Events()
+	defer cancel()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case _, ok := <-events:
+			if !ok {
+				return m.vm.Exit(), nil
+			}
+		case <-ticker.C:
+			if !d.current(m) {
+				return m.vm.Exit(), nil
+			}
+		}
+	}
+}
+
+// Logs writes the console log of VM ref. A follow ends when the client goes
+// away (ctx) or once the VM has exited for good: neither running nor waiting
+// to be restarted.
+func (d *Daemon) Logs(ctx context.Context, ref string, opts consolelog.ReadOptions, w io.Writer) error {
+	id, err := d.resolve(ref)
+	if err != nil {
+		return err
+	}
+	path := d.store.ConsoleLog(id)
+	if _, err := os.Stat(path); err != nil && !d.known(id) {
+		return api.NotFound(id)
+	}
+	if opts.Follow {
+		var cancel func()
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					if !d.live(id) {
+						cancel()
+						return
+					}
+				}
+			}
+		}()
+	}
+	return consolelog.Read(ctx, path, w, opts)
+}
+
+// known reports whether VM id has a record or is running.
+func (d *Daemon) known(id string) bool {
+	if _, err := d.store.Get(id); err == nil {
+		return true
+	}
+	_, err := d.get(id)
+	return err == nil
+}
+
+// live reports whether VM id is managed or waiting to be restarted.
+func (d *Daemon) live(id string) bool {
+	d.mu.Lock()
+	_, managed := d.vms[id]
+	_, pending := d.pending[id]
+	d.mu.Unlock()
+	return managed || pending
+}
+
+// Kill terminates VM ref, or cancels its pending restart.
+func (d *Daemon) Kill(ref string) error {
+	id, err := d.resolve(ref)
+	if err != nil {
+		return err
+	}
+	if d.cancelRestart(id) {
+		log.Printf("[vmrunnerd] VM %q: pending restart cancelled", id)
+		return nil
+	}
+	m, err := d.get(id)
+	if err != nil {
+		return err
+	}
+	m.stopping.Store(true)
+	err = m.vm.Terminate()
+	if err != nil && !m.vm.State().Final() {
+		m.stopping.Store(false)
+	}
+	return err
+}
+
+func (d *Daemon) Exec(ref string, req api.ExecRequest, stdout, stderr io.Writer) (int, error) {
+	if len(req.Args) == 0 {
+		return -1, &api.Error{Kind: api.KindInvalid, Message: "exec: command required"}
+	}
+	id, err := d.resolve(ref)
+	if err != nil {
+		return -1, err
+	}
+	m, err := d.get(id)
+	if api.IsNotFound(err) && req.Config != nil {
+		log.Printf("[vmrunnerd] VM %q not running, starting...", req.Config.VMID)
+		var info api.VMInfo
+		if info, err = d.Run(*req.Config, vm.StartOptions{}); err == nil {
+			m, err = d.get(info.ID)
+		}
+	}
+	if err != nil {
+		return -1, err
+	}
+
+	if req.GCS {
+		// Not console activity, but use all the same.
+		m.console.touch(time.Now())
+		return m.vm.RunProcessIO(req.Args, nil, stdout, stderr)
+	}
+	m.execMu.Lock()
+	defer m.execMu.Unlock()
+	s := m.console.session(false)
+	defer s.Close()
+	if err := vm.RunCommand(s, req.Args, stdout); err != nil {
+		return -1, fmt.Errorf("exec on console: %w", err)
+	}
+	return 0, nil
+}
+
+func (d *Daemon) Attach(ref string) (io.ReadWriteCloser, error) {
+	id, err := d.resolve(ref)
+	if err != nil {
+		return nil, err
+	}
+	m, err := d.get(id)
+	if err != nil {
+		return nil, err
+	}
+	return m.console.session(false), nil
+}
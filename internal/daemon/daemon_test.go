@@ -0,0 +1,113 @@
+package daemon
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/config"
+	"github.com/microsoft/hcsshim/vmrunner/internal/store"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vm"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vmcompute/vmcomputetest"
+)
+
+// guestPrompt is the shell prompt of the fake guests.
+const guestPrompt = "/ # "
+
+// guests connects the consoles of the VMs of a fake backend to fake guests
+// running a shell: each echoes what is typed, answers "uname" with "Linux"
+// and powers off on the stop command.
+type guests struct {
+	fake *vmcomputetest.Fake
+
+	mu    sync.Mutex
+	typed map[string][]string // lines typed on each VM's console
+}
+
+func (g *guests) open(name string, timeout time.Duration) (io.ReadWriteCloser, error) {
+	id := strings.TrimSuffix(strings.TrimPrefix(name, `\\.\pipe\`), "-console")
+	host, guest := net.Pipe()
+	go g.run(id, guest)
+	return host, nil
+}
+
+func (g *guests) run(id string, conn net.Conn) {
+	defer conn.Close()
+	// Booted long ago: the console is silent until typed at.
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		g.mu.Lock()
+		g.typed[id] = append(g.typed[id], line)
+		g.mu.Unlock()
+		out := line + "\r\n"
+		switch line {
+		case vm.DefaultStopCommand:
+			io.WriteString(conn, out+"reboot: Power down\r\n")
+			g.fake.Exit(id, vmcomputetest.GracefulExit, 0)
+			return
+		case "uname":
+			out += "Linux\r\n"
+		}
+		if _, err := io.WriteString(conn, out+guestPrompt); err != nil {
+			return
+		}
+	}
+}
+
+// lines returns the lines typed on the console of VM id.
+func (g *guests) lines(id string) []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]string(nil), g.typed[id]...)
+}
+
+// setup returns a daemon over a fake backend whose VMs run fake guests, and
+// the backend. Everything is undone when the test ends.
+func setup(t *testing.T) (*Daemon, *vmcomputetest.Fake, *guests) {
+	t.Helper()
+	fake := vmcomputetest.New()
+	g := &guests{fake: fake, typed: map[string][]string{}}
+	compute, openConsole := vm.Compute, vm.OpenConsole
+	vm.Compute, vm.OpenConsole = fake, g.open
+	st, err := store.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := New(st)
+	t.Cleanup(func() {
+		d.Close()
+		vm.Compute, vm.OpenConsole = compute, openConsole
+	})
+	return d, fake, g
+}
+
+func testConfig(id string) config.VMConfig {
+	return config.VMConfig{
+		VMID:     id,
+		ImageDir: `C:\vmrunner\images\alpine`,
+		MemoryMB: 512,
+		CPUCount: 1,
+		PipeName: config.ConsolePipe(id),
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after five seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,220 @@
+package daemon
+
+import (
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sessionBuffer is how many chunks of console output a session may fall
+// behind before further output is dropped for it.
+const sessionBuffer = 256
+
+// historySize is how much recent console output a hub keeps for sessions
+// that ask for it.
+const historySize = 16 << 10
+
+// errConsoleClosed is returned by writes to a console that has gone away.
+var errConsoleClosed = errors.New("console closed")
+
+// hub owns a VM's serial console: it is the only reader of the pipe, and it
+// fans the output out to every session (attach clients, serial exec) and to
+// the console log. Sessions write to the console through it. The console is usually connected
+// a little after the VM starts; writes wait for it.
+type hub struct {
+	id string
+
+	ready     chan struct{} // closed once console is set or the hub closes
+	readyOnce sync.Once
+
+	mu       sync.Mutex
+	console  io.ReadWriteCloser
+	sessions map[*session]struct{}
+	closed   bool
+	history  []byte // the last historySize bytes of output
+	log      io.WriteCloser
+
+	wmu sync.Mutex // serializes writes from different sessions
+
+	// activity is when the console last saw input or output, in Unix
+	// nanoseconds, for the idle timeout.
+	activity atomic.Int64
+}
+
+// newHub returns a hub for VM id that logs the console output to
+// consoleLog, if not nil, and closes consoleLog when it closes.
+func newHub(id string, consoleLog io.WriteCloser) *hub {
+	h := &hub{id: id, ready: make(chan struct{}), sessions: make(map[*session]struct{}), log: consoleLog}
+	h.touch(time.Now())
+	return h
+}
+
+// touch records console activity at t.
+func (h *hub) touch(t time.Time) { h.activity.Store(t.UnixNano()) }
+
+// lastActivity returns when the console last saw input or output, or when
+// the hub was created (or last touched) if it has seen none since.
+func (h *hub) lastActivity() time.Time { return time.Unix(0, h.activity.Load()) }
+
+// run connects console and pumps its output to the sessions until the
+// console reaches EOF or the hub is closed.
+func (h *hub) run(console io.ReadWriteCloser) {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		console.Close()
+		return
+	}
+	h.console = console
+	h.mu.Unlock()
+	h.readyOnce.Do(func() { close(h.ready) })
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := console.Read(buf)
+		if n > 0 {
+			h.broadcast(buf[:n])
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("[vmrunnerd] VM %q console: %v", h.id, err)
+			}
+			h.close()
+			return
+		}
+	}
+}
+
+func (h *hub) broadcast(p []byte) {
+	h.touch(time.Now())
+	chunk := append([]byte(nil), p...)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.log != nil {
+		if _, err := h.log.Write(chunk); err != nil {
+			log.Printf("[vmrunnerd] VM %q: %v; console output no longer logged", h.id, err)
+			h.log.Close()
+			h.log = nil
+		}
+	}
+	h.history = append(h.history, chunk...)
+	if len(h.history) > historySize {
+		h.history = append(h.history[:0], h.history[len(h.history)-historySize:]...)
+	}
+	for s := range h.sessions {
+		select {
+		case s.ch <- chunk:
+		default:
+			// The session is not reading; drop rather than stall every
+			// other session and the guest's console.
+		}
+	}
+}
+
+func (h *hub) write(p []byte) (int, error) {
+	select {
+	case <-h.ready:
+	case <-time.After(30 * time.Second):
+		return 0, errors.New("console not connected")
+	}
+	h.mu.Lock()
+	console, closed := h.console, h.closed
+	h.mu.Unlock()
+	if closed || console == nil {
+		return 0, errConsoleClosed
+	}
+	h.touch(time.Now())
+	h.wmu.Lock()
+	defer h.wmu.Unlock()
+	return console.Write(p)
+}
+
+// session returns a new session receiving console output from now on, after
+// the recent output if history is set.
+func (h *hub) session(history bool) *session {
+	s := &session{h: h, ch: make(chan []byte, sessionBuffer), done: make(chan struct{})}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if history {
+		s.buf = append([]byte(nil), h.history...)
+	}
+	if h.closed {
+		s.end()
+		return s
+	}
+	h.sessions[s] = struct{}{}
+	return s
+}
+
+// close closes the console and ends every session.
+func (h *hub) close() {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return
+	}
+	h.closed = true
+	console := h.console
+	sessions := h.sessions
+	h.sessions = nil
+	if h.log != nil {
+		h.log.Close()
+		h.log = nil
+	}
+	h.mu.Unlock()
+
+	h.readyOnce.Do(func() { close(h.ready) })
+	if console != nil {
+		console.Close()
+	}
+	for s := range sessions {
+		s.end()
+	}
+}
+
+// session is one client's view of a console.
+type session struct {
+	h    *hub
+	ch   chan []byte
+	buf  []byte
+	done chan struct{}
+	once sync.Once
+}
+
+// Read returns console output. Output already queued is returned before EOF.
+func (s *session) Read(p []byte) (int, error) {
+	if len(s.buf) == 0 {
+		select {
+		case s.buf = <-s.ch:
+		default:
+			select {
+			case s.buf = <-s.ch:
+			case <-s.done:
+				select {
+				case s.buf = <-s.ch:
+				default:
+					return 0, io.EOF
+				}
+			}
+		}
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+func (s *session) Write(p []byte) (int, error) { return s.h.write(p) }
+
+// Close detaches the session; the console stays open for others.
+func (s *session) Close() error {
+	s.h.mu.Lock()
+	delete(s.h.sessions, s)
+	s.h.mu.Unlock()
+	s.end()
+	return nil
+}
+
+func (s *session) end() { s.once.Do(func() { close(s.done) }) }
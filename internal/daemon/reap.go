@@ -0,0 +1,158 @@
+package daemon
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/api"
+	"github.com/microsoft/hcsshim/vmrunner/internal/store"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vm"
+)
+
+// reapInterval is how often the reaper started by StartReaper looks for VMs
+// past their TTL or idle timeout.
+const reapInterval = time.Minute
+
+// StartReaper reaps VMs every reapInterval until Close.
+func (d *Daemon) StartReaper() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.reaper != nil {
+		return
+	}
+	done := make(chan struct{})
+	d.reaper = done
+	go func() {
+		ticker := time.NewTicker(reapInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, err := d.Reap(false); err != nil {
+					log.Printf("[vmrunnerd] reap: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Reap stops the VMs past their TTL or idle timeout, each through the same
+// escalation as Stop, and cancels the pending restarts of those past their
+// TTL. It returns once every stop has ended. VMs already being reaped are
+// left to the reap in progress.
+func (d *Daemon) Reap(dryRun bool) ([]api.Reaped, error) {
+	records, err := d.store.List()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var (
+		reaped []api.Reaped
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+	)
+	for _, r := range records {
+		if r.Config.TTL <= 0 && r.Config.IdleTimeout <= 0 {
+			continue
+		}
+		if d.restarting(r.ID) {
+			reason := expired(r, now)
+			if reason == "" {
+				continue
+			}
+			if !dryRun {
+				d.reapRestart(r.ID, reason)
+			}
+			reaped = append(reaped, api.Reaped{ID: r.ID, Name: r.Name, Reason: reason})
+			continue
+		}
+		if r.Exited != nil {
+			continue
+		}
+		m, err := d.get(r.ID)
+		if err != nil {
+			// It exited meanwhile, or vanished and is for the next
+			// reconcile to record.
+			continue
+		}
+		last := m.console.lastActivity()
+		if !dryRun && r.Config.IdleTimeout > 0 && (r.LastActivity == nil || last.After(*r.LastActivity)) {
+			d.saveActivity(r.ID, last)
+		}
+		reason := expired(r, now)
+		if reason == "" {
+			reason = idle(r, last, now)
+		}
+		if reason == "" {
+			continue
+		}
+		if dryRun {
+			reaped = append(reaped, api.Reaped{ID: r.ID, Name: r.Name, Reason: reason})
+			continue
+		}
+		if !m.reaped.CompareAndSwap(nil, &reason) {
+			continue
+		}
+		i := len(reaped)
+		reaped = append(reaped, api.Reaped{ID: r.ID, Name: r.Name, Reason: reason})
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			log.Printf("[vmrunnerd] VM %q: reaping, %s", id, reason)
+			if err := d.Stop(id, vm.StopOptions{}); err != nil && !api.IsNotFound(err) {
+				log.Printf("[vmrunnerd] VM %q: reap: %v", id, err)
+				m.reaped.Store(nil)
+				mu.Lock()
+				reaped[i].Error = err.Error()
+				mu.Unlock()
+			}
+		}(r.ID)
+	}
+	wg.Wait()
+	return reaped, nil
+}
+
+// expired returns why the VM of r is past its TTL, or "" if it is not.
+func expired(r *store.Record, now time.Time) string {
+	if r.Expires == nil || now.Before(*r.Expires) {
+		return ""
+	}
+	return fmt.Sprintf("TTL of %s expired", time.Duration(r.Config.TTL))
+}
+
+// idle returns why the VM of r, whose console last saw activity at last, is
+// past its idle timeout, or "" if it is not.
+func idle(r *store.Record, last, now time.Time) string {
+	timeout := time.Duration(r.Config.IdleTimeout)
+	if timeout <= 0 || now.Sub(last) < timeout {
+		return ""
+	}
+	return fmt.Sprintf("console idle for %s (idle timeout %s)", now.Sub(last).Round(time.Second), timeout)
+}
+
+// reapRestart cancels the pending restart of VM id, past its TTL.
+func (d *Daemon) reapRestart(id, reason string) {
+	if !d.cancelRestart(id) {
+		return
+	}
+	log.Printf("[vmrunnerd] VM %q: pending restart cancelled, %s", id, reason)
+	if err := d.store.Update(id, func(r *store.Record) {
+		r.ExitReason = "reaped: " + reason
+	}); err != nil {
+		log.Printf("[vmrunnerd] VM %q: %v", id, err)
+	}
+}
+
+// saveActivity records the last console activity of VM id.
+func (d *Daemon) saveActivity(id string, last time.Time) {
+	last = last.UTC()
+	if err := d.store.Update(id, func(r *store.Record) {
+		r.LastActivity = &last
+	}); err != nil {
+		log.Printf("[vmrunnerd] VM %q: %v", id, err)
+	}
+}
@@ -0,0 +1,78 @@
+package daemon
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/config"
+	"github.com/microsoft/hcsshim/vmrunner/internal/store"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vm"
+)
+
+// TestReapUnwatched checks a reap by a daemon that has not watched the
+// consoles, as with vmrunner --no-daemon reap: idle time counts from the
+// recorded activity, else from the start, not from the reap.
+func TestReapUnwatched(t *testing.T) {
+	d, fake, _ := setup(t)
+	hourAgo := time.Now().Add(-time.Hour).UTC()
+	minuteAgo := time.Now().Add(-time.Minute).UTC()
+	for _, tt := range []struct {
+		id           string
+		started      time.Time
+		lastActivity *time.Time
+	}{
+		{"started-long-ago", hourAgo, nil},
+		{"active-long-ago", hourAgo, &hourAgo},
+		{"active-lately", hourAgo, &minuteAgo},
+		{"started-lately", minuteAgo, nil},
+	} {
+		cfg := testConfig(tt.id)
+		cfg.IdleTimeout = config.Duration(30 * time.Minute)
+		rec := store.NewRecord(cfg)
+		rec.Started, rec.LastActivity = &tt.started, tt.lastActivity
+		rec.State = vm.StateRunning.String()
+		if err := d.store.Put(rec); err != nil {
+			t.Fatal(err)
+		}
+		fake.Add(tt.id, config.Owner)
+	}
+
+	due, err := d.Reap(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, r := range due {
+		ids = append(ids, r.ID)
+		if !strings.HasPrefix(r.Reason, "console idle for 1h0m0s") {
+			t.Errorf("%s: reason %q", r.ID, r.Reason)
+		}
+	}
+	if want := []string{"active-long-ago", "started-long-ago"}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("due %q, want %q", ids, want)
+	}
+
+	if _, err := d.Reap(false); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"active-long-ago", "started-long-ago"} {
+		if fake.Exists(id) {
+			t.Errorf("%s not stopped", id)
+		}
+		var rec *store.Record
+		waitFor(t, id+" exit recorded", func() bool {
+			rec, err = d.store.Get(id)
+			return err == nil && rec.Exited != nil
+		})
+		if !strings.HasPrefix(rec.ExitReason, "reaped: console idle") {
+			t.Errorf("%s: exit reason %q", id, rec.ExitReason)
+		}
+	}
+	for _, id := range []string{"active-lately", "started-lately"} {
+		if !fake.Exists(id) {
+			t.Errorf("%s stopped", id)
+		}
+	}
+}
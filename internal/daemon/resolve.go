@@ -0,0 +1,130 @@
+package daemon
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/api"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vm"
+)
+
+// candidate is a VM a reference may resolve to.
+type candidate struct {
+	id, name string
+	live     bool // running or waiting to be restarted
+	created  time.Time
+}
+
+func (c candidate) String() string {
+	if c.name == "" {
+		return c.id
+	}
+	return fmt.Sprintf("%s (%s)", c.id, c.name)
+}
+
+// resolve returns the ID of the VM ref refers to, in the style of docker: an
+// ID, a name, or a prefix of one ID. A name held by a live VM refers to it,
+// else to the VM that last had it. A ref matching nothing is returned as is,
+// for the caller to report or to reach a system of another owner by ID.
+func (d *Daemon) resolve(ref string) (string, error) {
+	if ref == "" || d.live(ref) {
+		return ref, nil
+	}
+	if _, err := d.store.Get(ref); err == nil {
+		return ref, nil
+	}
+	cands, err := d.candidates()
+	if err != nil {
+		return "", err
+	}
+	return resolve(ref, cands)
+}
+
+func resolve(ref string, cands []candidate) (string, error) {
+	var named, prefixed []candidate
+	for _, c := range cands {
+		switch {
+		case c.id == ref:
+			return ref, nil
+		case c.name == ref:
+			named = append(named, c)
+		case strings.HasPrefix(c.id, ref):
+			prefixed = append(prefixed, c)
+		}
+	}
+	if len(named) > 0 {
+		sort.Slice(named, func(i, j int) bool {
+			if named[i].live != named[j].live {
+				return named[i].live
+			}
+			return named[i].created.After(named[j].created)
+		})
+		return named[0].id, nil
+	}
+	switch len(prefixed) {
+	case 0:
+		return ref, nil
+	case 1:
+		return prefixed[0].id, nil
+	}
+	sort.Slice(prefixed, func(i, j int) bool { return prefixed[i].id < prefixed[j].id })
+	names := make([]string, len(prefixed))
+	for i, c := range prefixed {
+		names[i] = c.String()
+	}
+	return "", &api.Error{Kind: api.KindAmbiguous, Message: fmt.Sprintf(
+		"%q matches %d VMs: %s", ref, len(prefixed), strings.Join(names, ", "))}
+}
+
+// candidates returns the VMs the daemon knows: those it has records of and
+// the running systems vmrunner owns.
+func (d *Daemon) candidates() ([]candidate, error) {
+	records, err := d.store.List()
+	if err != nil {
+		return nil, err
+	}
+	var cands []candidate
+	seen := make(map[string]bool, len(records))
+	for _, r := range records {
+		cands = append(cands, candidate{id: r.ID, name: r.Name, live: d.live(r.ID), created: r.Created})
+		seen[r.ID] = true
+	}
+	systems, err := vm.Systems(vm.ListOptions{})
+	if err != nil {
+		log.Printf("[vmrunnerd] resolve: %v", err)
+	}
+	for _, s := range systems {
+		if !seen[s.Id] {
+			cands = append(cands, candidate{id: s.Id, live: true})
+		}
+	}
+	return cands, nil
+}
+
+// checkName returns an error if another live VM than id is named name. With
+// replace, that VM is terminated instead.
+func (d *Daemon) checkName(id, name string, replace bool) error {
+	if name == "" {
+		return nil
+	}
+	records, err := d.store.List()
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		if r.ID == id || r.Name != name || !d.live(r.ID) {
+			continue
+		}
+		if !replace {
+			return &api.Error{Kind: api.KindExists, Message: fmt.Sprintf("name %q is taken by VM %q", name, r.ID)}
+		}
+		log.Printf("[vmrunnerd] VM %q: replacing VM %q of the same name", id, r.ID)
+		if err := d.Kill(r.ID); err != nil && !api.IsNotFound(err) {
+			return fmt.Errorf("replace VM %q named %q: %w", r.ID, name, err)
+		}
+	}
+	return nil
+}
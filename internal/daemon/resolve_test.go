@@ -0,0 +1,77 @@
+package daemon
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/api"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vm"
+)
+
+func TestResolve(t *testing.T) {
+	now := time.Now()
+	cands := []candidate{
+		{id: "0a1b-1111", name: "web", created: now},
+		{id: "0a1b-2222", name: "web", live: true, created: now.Add(-time.Hour)},
+		{id: "0a1c-3333", name: "cache", created: now.Add(-time.Hour)},
+		{id: "0a1c-4444", name: "cache", created: now},
+		{id: "db"},
+		{id: "f0-5555", name: "db", live: true},
+		{id: "b1", name: "b"},
+		{id: "b2"},
+	}
+	for _, tt := range []struct {
+		name, ref, want string
+		err             string
+	}{
+		{"exact ID", "0a1b-1111", "0a1b-1111", ""},
+		{"ID before name", "db", "db", ""},
+		{"live name", "web", "0a1b-2222", ""},
+		{"newest name", "cache", "0a1c-4444", ""},
+		{"name before prefix", "b", "b1", ""},
+		{"unique prefix", "0a1c-3", "0a1c-3333", ""},
+		{"unknown", "nope", "nope", ""},
+		{"ambiguous prefix", "0a1", "", `"0a1" matches 4 VMs: 0a1b-1111 (web), 0a1b-2222 (web), 0a1c-3333 (cache), 0a1c-4444 (cache)`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := resolve(tt.ref, cands)
+			if tt.err != "" {
+				var apiErr *api.Error
+				if !errors.As(err, &apiErr) || apiErr.Kind != api.KindAmbiguous || apiErr.Message != tt.err {
+					t.Fatalf("resolved to %q, %v; want %s", id, err, tt.err)
+				}
+				return
+			}
+			if err != nil || id != tt.want {
+				t.Fatalf("resolved to %q, %v; want %q", id, err, tt.want)
+			}
+		})
+	}
+}
+
+// TestUpdateByName checks that update, disk and share, which modify the VM
+// in HCS, take the names and ID prefixes the other commands take.
+func TestUpdateByName(t *testing.T) {
+	d, fake, _ := setup(t)
+	c := serve(t, d)
+	cfg := testConfig("4f2e-vm1")
+	cfg.Name = "web"
+	if _, err := c.Run(cfg, vm.StartOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range []string{"web", "4f2e"} {
+		if err := c.Update(ref, api.UpdateRequest{MemoryMB: 1024}); err != nil {
+			t.Fatalf("update %s: %v", ref, err)
+		}
+	}
+	modified := 0
+	for _, call := range fake.Calls() {
+		if call == "modify 4f2e-vm1" {
+			modified++
+		}
+	}
+	if modified != 2 {
+		t.Fatalf("calls %q, want two modifies of 4f2e-vm1", fake.Calls())
+	}
+}
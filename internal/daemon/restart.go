@@ -0,0 +1,150 @@
+package daemon
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/config"
+	"github.com/microsoft/hcsshim/vmrunner/internal/store"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vm"
+)
+
+// Restart backoff: the first restart of a VM waits restartInitial and each
+// further one twice as long, up to restartMax. A VM that stays up for
+// stableRun starts over at restartInitial.
+const (
+	restartInitial = time.Second
+	restartMax     = 5 * time.Minute
+	stableRun      = 10 * time.Minute
+)
+
+// stateRestarting is reported for a VM waiting out its restart delay. It is
+// not a vm.State: there is no VM until the restart.
+const stateRestarting = "Restarting"
+
+// pendingRestart is a restart scheduled by the VM's restart policy.
+type pendingRestart struct {
+	timer *time.Timer
+}
+
+// restartDelay returns the delay before the restart following attempt
+// earlier restarts without a stable run.
+func restartDelay(attempt int) time.Duration {
+	d := restartInitial
+	for i := 0; i < attempt && d < restartMax; i++ {
+		d *= 2
+	}
+	if d > restartMax {
+		d = restartMax
+	}
+	return d
+}
+
+// exited applies the restart policy of VM id, which exited (or failed to
+// restart) without being asked to after running for ranFor.
+func (d *Daemon) exited(id string, failed bool, ranFor time.Duration) {
+	rec, err := d.store.Get(id)
+	if err != nil {
+		// Adopted VMs without a record have no policy.
+		return
+	}
+	if rec.Expires != nil && !time.Now().Before(*rec.Expires) {
+		if rec.Config.Restart.Name != "" && rec.Config.Restart.Name != config.RestartNo {
+			log.Printf("[vmrunnerd] VM %q: not restarting, its TTL has expired", id)
+		}
+		return
+	}
+	policy := rec.Config.Restart
+	if !policy.ShouldRestart(failed, rec.Restarts) {
+		if failed && policy.Name == config.RestartOnFailure {
+			log.Printf("[vmrunnerd] VM %q: not restarting, %d restart(s) already made", id, rec.Restarts)
+		}
+		return
+	}
+
+	d.mu.Lock()
+	if ranFor >= stableRun {
+		d.backoff[id] = 0
+	}
+	delay := restartDelay(d.backoff[id])
+	d.backoff[id]++
+	if old, ok := d.pending[id]; ok {
+		old.timer.Stop()
+	}
+	p := &pendingRestart{}
+	d.pending[id] = p
+	p.timer = time.AfterFunc(delay, func() { d.restart(id, p) })
+	d.mu.Unlock()
+
+	log.Printf("[vmrunnerd] VM %q: restarting in %s (policy %s, restart %d)", id, delay, policy, rec.Restarts+1)
+}
+
+// restart starts VM id again from its stored configuration, unless the
+// restart was cancelled or the VM was run again meanwhile.
+func (d *Daemon) restart(id string, p *pendingRestart) {
+	d.mu.Lock()
+	if d.pending[id] != p {
+		d.mu.Unlock()
+		return
+	}
+	delete(d.pending, id)
+	_, running := d.vms[id]
+	d.mu.Unlock()
+	if running {
+		return
+	}
+	rec, err := d.store.Get(id)
+	if err != nil || rec.Exited == nil {
+		return
+	}
+
+	// The exited system may linger in HCS for a moment; it is ours.
+	v, err := vm.Start(rec.Config, vm.StartOptions{Replace: true})
+	if err != nil {
+		reason := fmt.Sprintf("restart: %v", err)
+		log.Printf("[vmrunnerd] VM %q: %s", id, reason)
+		if err := d.store.Update(id, func(r *store.Record) {
+			r.Restarts++
+			r.SetUnexpectedExit(vm.StateFailed.String(), reason)
+			r.LastFailure = reason
+		}); err != nil {
+			log.Printf("[vmrunnerd] VM %q: %v", id, err)
+		}
+		d.exited(id, true, 0)
+		return
+	}
+	if err := d.store.Update(id, func(r *store.Record) {
+		now := time.Now().UTC()
+		r.Restarts++
+		r.Started = &now
+		r.State = v.State().String()
+		r.Exited = nil
+		r.ExitReason = ""
+	}); err != nil {
+		log.Printf("[vmrunnerd] VM %q: %v", id, err)
+	}
+	log.Printf("[vmrunnerd] VM %q restarted", id)
+	d.manage(v, rec.Console)
+}
+
+// cancelRestart cancels a pending restart of VM id and reports whether there
+// was one.
+func (d *Daemon) cancelRestart(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p, ok := d.pending[id]
+	if ok {
+		p.timer.Stop()
+		delete(d.pending, id)
+	}
+	return ok
+}
+
+// restarting reports whether VM id is waiting to be restarted.
+func (d *Daemon) restarting(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.pending[id]
+	return ok
+}
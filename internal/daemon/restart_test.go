@@ -0,0 +1,65 @@
+package daemon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/config"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vm"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vmcompute/vmcomputetest"
+)
+
+// TestRestartOnFailure checks that the on-failure policy restarts a VM by
+// how it exited, not by the state the exit left it in: an unexpected exit
+// with no failure status stops the VM but is still a failure.
+func TestRestartOnFailure(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		exitType string
+		status   uint32
+		restart  bool
+	}{
+		{"unexpected", vmcomputetest.UnexpectedExit, 0, true},
+		{"failure status", "", 0x80370100, true},
+		{"poweroff", vmcomputetest.GracefulExit, 0, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			d, fake, _ := setup(t)
+			cfg := testConfig("vm1")
+			cfg.Restart = config.RestartPolicy{Name: config.RestartOnFailure}
+			if _, err := d.Run(cfg, vm.StartOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			d.mu.Lock()
+			first := d.vms["vm1"]
+			d.mu.Unlock()
+			fake.Exit("vm1", tt.exitType, tt.status)
+			if tt.restart {
+				waitFor(t, "restart", func() bool {
+					rec, err := d.store.Get("vm1")
+					return err == nil && rec.Restarts == 1 && rec.State == vm.StateRunning.String()
+				})
+				// The restart is done once the daemon manages the new VM.
+				waitFor(t, "restarted VM managed", func() bool {
+					d.mu.Lock()
+					defer d.mu.Unlock()
+					m := d.vms["vm1"]
+					return m != nil && m != first
+				})
+				return
+			}
+			waitFor(t, "exit recorded", func() bool {
+				rec, err := d.store.Get("vm1")
+				return err == nil && rec.Exited != nil
+			})
+			time.Sleep(restartInitial + 500*time.Millisecond)
+			rec, err := d.store.Get("vm1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Restarts != 0 || rec.State != vm.StateStopped.String() || fake.Exists("vm1") {
+				t.Fatalf("after a clean exit: state %s, %d restart(s)", rec.State, rec.Restarts)
+			}
+		})
+	}
+}
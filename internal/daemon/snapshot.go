@@ -0,0 +1,56 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/api"
+	"github.com/microsoft/hcsshim/vmrunner/internal/store"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vm"
+)
+
+// Save saves VM ref to dir with the configuration it was recorded with.
+// Unless leaveRunning, the VM is terminated like a stop asked through the
+// API: its exit is recorded as the save and its restart policy does not
+// apply.
+func (d *Daemon) Save(ref, dir string, leaveRunning bool) error {
+	id, err := d.resolve(ref)
+	if err != nil {
+		return err
+	}
+	rec, err := d.store.Get(id)
+	switch {
+	case errors.Is(err, store.ErrNotFound) || err == nil && rec.Config.ImageDir == "":
+		return &api.Error{Kind: api.KindInvalid, Message: fmt.Sprintf(
+			"VM %q has no recorded configuration; only VMs started by vmrunner can be saved", id)}
+	case err != nil:
+		return err
+	case rec.Config.Remove:
+		return &api.Error{Kind: api.KindInvalid, Message: fmt.Sprintf(
+			"VM %q was run with -rm; its scratch disk is removed with it", id)}
+	}
+	m, err := d.get(id)
+	if err != nil {
+		return err
+	}
+	if !leaveRunning {
+		m.saved.Store(&dir)
+		m.stopping.Store(true)
+	}
+	err = m.vm.Save(rec.Config, dir, leaveRunning)
+	if err != nil && !m.vm.State().Final() {
+		m.stopping.Store(false)
+		m.saved.Store(nil)
+	}
+	return err
+}
+
+// Restore restores the VM saved in dir, under id if it is non-empty, and
+// records and manages it as Run does.
+func (d *Daemon) Restore(dir, id string, opts vm.StartOptions) (api.VMInfo, error) {
+	cfg, err := vm.ReadSnapshot(dir, id)
+	if err != nil {
+		return api.VMInfo{}, &api.Error{Kind: api.KindInvalid, Message: err.Error()}
+	}
+	return d.run(cfg, opts, vm.Restore)
+}
@@ -0,0 +1,143 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/config"
+	"github.com/microsoft/hcsshim/vmrunner/internal/store"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vm"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vmcompute/vmcomputetest"
+)
+
+// TestSaveNotRestarted checks that saving a VM with a restart policy
+// terminates it for good, and records the save as its exit.
+func TestSaveNotRestarted(t *testing.T) {
+	d, fake, _ := setup(t)
+	c := serve(t, d)
+	cfg := testConfig("vm1")
+	cfg.Restart = config.RestartPolicy{Name: config.RestartAlways}
+	if _, err := c.Run(cfg, vm.StartOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	if err := c.Save("vm1", dir, true); err != nil {
+		t.Fatal(err)
+	}
+	if !fake.Exists("vm1") {
+		t.Fatal("VM left running is gone")
+	}
+	if err := c.Save("vm1", dir, false); err != nil {
+		t.Fatal(err)
+	}
+	if fake.Exists("vm1") {
+		t.Fatal("saved VM still running")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "vmrunner-save.json")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "exit recorded", func() bool {
+		rec, err := d.store.Get("vm1")
+		return err == nil && rec.Exited != nil
+	})
+	time.Sleep(restartInitial + 500*time.Millisecond)
+	rec, err := c.Inspect("vm1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Restarts != 0 || rec.State != vm.StateStopped.String() || fake.Exists("vm1") {
+		t.Fatalf("after a save: state %s, %d restart(s)", rec.State, rec.Restarts)
+	}
+	if want := "saved to " + dir; rec.ExitReason != want {
+		t.Fatalf("exit reason %q, want %q", rec.ExitReason, want)
+	}
+}
+
+func TestSaveRefused(t *testing.T) {
+	d, fake, _ := setup(t)
+	c := serve(t, d)
+	cfg := testConfig("throwaway")
+	cfg.Remove = true
+	if err := d.store.Put(store.NewRecord(cfg)); err != nil {
+		t.Fatal(err)
+	}
+	fake.Add("throwaway", config.Owner)
+	fake.Add("unrecorded", config.Owner)
+	for _, id := range []string{"throwaway", "unrecorded"} {
+		if err := c.Save(id, t.TempDir(), false); err == nil {
+			t.Errorf("%s saved", id)
+		}
+		if !fake.Exists(id) {
+			t.Errorf("%s stopped", id)
+		}
+	}
+}
+
+// imageConfig returns the configuration of VM id over an image directory
+// whose root disk exists, as restoring needs.
+func imageConfig(t *testing.T, id string) config.VMConfig {
+	t.Helper()
+	cfg := testConfig(id)
+	cfg.ImageDir = t.TempDir()
+	if err := os.WriteFile(config.RootDiskPath(cfg), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// TestRestore checks that a restored VM is recorded and managed like a VM
+// run through the daemon: it can be inspected and saved again, and its
+// restart policy boots it afresh rather than from the snapshot.
+func TestRestore(t *testing.T) {
+	d, fake, _ := setup(t)
+	c := serve(t, d)
+	cfg := imageConfig(t, "vm1")
+	cfg.Restart = config.RestartPolicy{Name: config.RestartAlways}
+	if _, err := c.Run(cfg, vm.StartOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := c.Save("vm1", dir, false); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := c.Restore(dir, "vm2", vm.StartOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ID != "vm2" || info.State != "Running" {
+		t.Fatalf("restored %+v", info)
+	}
+	if !strings.Contains(fake.Config("vm2"), filepath.Join(dir, "state.vmrs")) {
+		t.Fatalf("restored VM created with %s", fake.Config("vm2"))
+	}
+	rec, err := c.Inspect("vm2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.State != "Running" || rec.Config.RestoreStatePath != "" || rec.Config.Restart.Name != config.RestartAlways {
+		t.Fatalf("restored VM recorded as %s with %+v", rec.State, rec.Config)
+	}
+
+	d.mu.Lock()
+	first := d.vms["vm2"]
+	d.mu.Unlock()
+	fake.Exit("vm2", vmcomputetest.UnexpectedExit, 0)
+	waitFor(t, "restarted VM managed", func() bool {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		m := d.vms["vm2"]
+		return m != nil && m != first
+	})
+	if strings.Contains(fake.Config("vm2"), "RestoreState") {
+		t.Fatalf("restarted from the snapshot: %s", fake.Config("vm2"))
+	}
+
+	if err := c.Save("vm2", t.TempDir(), false); err != nil {
+		t.Fatalf("save of the restored VM: %v", err)
+	}
+}
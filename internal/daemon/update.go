@@ -0,0 +1,58 @@
+package daemon
+
+import (
+	"errors"
+	"log"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/api"
+	"github.com/microsoft/hcsshim/vmrunner/internal/config"
+	"github.com/microsoft/hcsshim/vmrunner/internal/store"
+)
+
+// Update applies req to the running VM ref through the handle the daemon
+// holds, so that its commitment follows a resize, and records each change
+// once made: a restart of the VM attaches its disks and shares again.
+func (d *Daemon) Update(ref string, req api.UpdateRequest) error {
+	if req == (api.UpdateRequest{}) {
+		return &api.Error{Kind: api.KindInvalid, Message: "update: nothing to change"}
+	}
+	id, err := d.resolve(ref)
+	if err != nil {
+		return err
+	}
+	m, err := d.get(id)
+	if err != nil {
+		return err
+	}
+	keep := func(change func(*config.VMConfig)) {
+		err := d.store.Update(id, func(r *store.Record) { change(&r.Config) })
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			log.Printf("[vmrunnerd] VM %q: %v", id, err)
+		}
+	}
+	if req.MemoryMB != 0 {
+		if err := m.vm.UpdateMemory(req.MemoryMB); err != nil {
+			return err
+		}
+		keep(func(cfg *config.VMConfig) { cfg.MemoryMB = req.MemoryMB })
+	}
+	if disk := req.DetachDisk; disk != nil {
+		if err := m.vm.DetachDisk(*disk); err != nil {
+			return err
+		}
+		keep(func(cfg *config.VMConfig) { cfg.RemoveDisk(*disk) })
+	}
+	if disk := req.AttachDisk; disk != nil {
+		if err := m.vm.AttachDisk(*disk); err != nil {
+			return err
+		}
+		keep(func(cfg *config.VMConfig) { cfg.SetDisk(*disk) })
+	}
+	if share := req.AddShare; share != nil {
+		if err := m.vm.AddShare(*share); err != nil {
+			return err
+		}
+		keep(func(cfg *config.VMConfig) { cfg.SetShare(*share) })
+	}
+	return nil
+}
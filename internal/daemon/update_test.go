@@ -0,0 +1,69 @@
+package daemon
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/api"
+	"github.com/microsoft/hcsshim/vmrunner/internal/config"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vm"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vmcompute/vmcomputetest"
+)
+
+// TestUpdateSurvivesRestart checks that the changes made to a running VM
+// are recorded and made again when its restart policy restarts it.
+func TestUpdateSurvivesRestart(t *testing.T) {
+	d, fake, _ := setup(t)
+	c := serve(t, d)
+	cfg := testConfig("vm1")
+	cfg.Restart = config.RestartPolicy{Name: config.RestartAlways}
+	if _, err := c.Run(cfg, vm.StartOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	data := config.SCSIDisk{LUN: 1, Path: `C:\disks\data.vhdx`}
+	logs := config.SCSIDisk{LUN: 2, Path: `C:\disks\logs.vhdx`, ReadOnly: true}
+	share := config.Plan9Share{Name: "src", HostPath: `C:\src`}
+	for _, req := range []api.UpdateRequest{
+		{MemoryMB: 1024},
+		{AttachDisk: &data},
+		{AttachDisk: &logs, AddShare: &share},
+		{DetachDisk: &config.SCSIDisk{LUN: 1}},
+	} {
+		if err := c.Update("vm1", req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Update("vm1", api.UpdateRequest{}); err == nil {
+		t.Fatal("empty update succeeded")
+	}
+	rec, err := c.Inspect("vm1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Config.MemoryMB != 1024 || !reflect.DeepEqual(rec.Config.Disks, []config.SCSIDisk{logs}) ||
+		!reflect.DeepEqual(rec.Config.Shares, []config.Plan9Share{share}) {
+		t.Fatalf("recorded memory %d, disks %+v, shares %+v", rec.Config.MemoryMB, rec.Config.Disks, rec.Config.Shares)
+	}
+
+	d.mu.Lock()
+	first := d.vms["vm1"]
+	d.mu.Unlock()
+	fake.Exit("vm1", vmcomputetest.UnexpectedExit, 0)
+	waitFor(t, "restarted VM managed", func() bool {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		m := d.vms["vm1"]
+		return m != nil && m != first
+	})
+	created := fake.Config("vm1")
+	for _, want := range []string{`"SizeInMB":1024`, `"2":{"Type":"VirtualDisk","Path":"C:\\disks\\logs.vhdx","ReadOnly":true}`, `"Name":"src"`} {
+		if !strings.Contains(created, want) {
+			t.Errorf("restarted with %s, want %s", created, want)
+		}
+	}
+	if strings.Contains(created, "data.vhdx") {
+		t.Errorf("restarted with the detached disk: %s", created)
+	}
+}
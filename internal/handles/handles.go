@@ -0,0 +1,86 @@
+// Package handles tracks HCS handles that are open so that leaks can be
+// reported. Tracking is off by default; main turns it on for debugging and
+// tests turn it on through handlestest.Check.
+package handles
+
+import (
+	"fmt"
+	"io"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Enabled turns tracking on. Handles opened while it is false are never
+// reported. Set it before any handle is opened.
+var Enabled bool
+
+// Handle describes an open handle.
+type Handle struct {
+	Kind   string // "system" or "process"
+	Name   string // VM ID or process command line
+	Value  uintptr
+	Opened time.Time
+	// Stack is the goroutine stack at the point the handle was opened.
+	Stack string
+
+	seq uint64
+}
+
+var (
+	mu   sync.Mutex
+	seq  uint64
+	open = map[uint64]Handle{}
+)
+
+// Track records a newly opened handle and returns the function that must be
+// called when it is closed. When tracking is disabled it returns a no-op.
+func Track(kind, name string, value uintptr) (untrack func()) {
+	if !Enabled {
+		return func() {}
+	}
+	mu.Lock()
+	seq++
+	id := seq
+	open[id] = Handle{Kind: kind, Name: name, Value: value, Opened: time.Now(), Stack: string(debug.Stack()), seq: id}
+	mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			mu.Lock()
+			delete(open, id)
+			mu.Unlock()
+		})
+	}
+}
+
+// Open returns the handles that are currently tracked, oldest first.
+func Open() []Handle {
+	mu.Lock()
+	defer mu.Unlock()
+	out := make([]Handle, 0, len(open))
+	for _, h := range open {
+		out = append(out, h)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].seq < out[j].seq })
+	return out
+}
+
+// Report writes every handle still open to w, with the stack that opened
+// it, and returns how many there were.
+func Report(w io.Writer) int {
+	leaked := Open()
+	Write(w, leaked)
+	return len(leaked)
+}
+
+// Write writes each of the leaked handles to w, with the stack that opened
+// it.
+func Write(w io.Writer, leaked []Handle) {
+	for _, h := range leaked {
+		fmt.Fprintf(w, "[vmrunner] leaked %s handle %#x (%s), opened %s at:\n%s\n",
+			h.Kind, h.Value, h.Name, h.Opened.Format(time.RFC3339Nano), h.Stack)
+	}
+}
@@ -0,0 +1,36 @@
+// Package handlestest checks tests for leaked HCS handles.
+package handlestest
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/handles"
+)
+
+// Check enables handle tracking for the duration of the test and fails t if
+// any handle opened during the test is still open when the test ends.
+// Handles that were already open when Check was called are not reported.
+func Check(t testing.TB) {
+	t.Helper()
+	enabled := handles.Enabled
+	handles.Enabled = true
+	before := map[handles.Handle]bool{}
+	for _, h := range handles.Open() {
+		before[h] = true
+	}
+	t.Cleanup(func() {
+		handles.Enabled = enabled
+		var leaked []handles.Handle
+		for _, h := range handles.Open() {
+			if !before[h] {
+				leaked = append(leaked, h)
+			}
+		}
+		if len(leaked) > 0 {
+			var b strings.Builder
+			handles.Write(&b, leaked)
+			t.Errorf("%d handle(s) leaked:\n%s", len(leaked), b.String())
+		}
+	})
+}
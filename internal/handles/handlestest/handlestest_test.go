@@ -0,0 +1,50 @@
+package handlestest
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/handles"
+)
+
+// recorder is a testing.TB that keeps the errors and cleanups of Check.
+type recorder struct {
+	testing.TB
+	errors   []string
+	cleanups []func()
+}
+
+func (r *recorder) Helper()                           {}
+func (r *recorder) Cleanup(fn func())                 { r.cleanups = append(r.cleanups, fn) }
+func (r *recorder) Errorf(format string, args ...any) { r.errors = append(r.errors, format) }
+
+func (r *recorder) end() {
+	for i := len(r.cleanups) - 1; i >= 0; i-- {
+		r.cleanups[i]()
+	}
+}
+
+func TestCheck(t *testing.T) {
+	handles.Enabled = true
+	before := handles.Track("system", "open before Check", 1)
+	defer before()
+	handles.Enabled = false
+
+	r := &recorder{TB: t}
+	Check(r)
+	if !handles.Enabled {
+		t.Fatal("Check did not enable tracking")
+	}
+	closed := handles.Track("system", "closed", 2)
+	closed()
+	leaked := handles.Track("process", "leaked", 3)
+	defer leaked()
+	r.end()
+
+	if len(r.errors) != 1 || !strings.Contains(r.errors[0], "leaked") {
+		t.Fatalf("errors = %q, want one leak", r.errors)
+	}
+	if handles.Enabled {
+		t.Fatal("Enabled not restored")
+	}
+}
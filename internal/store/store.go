@@ -0,0 +1,326 @@
+// Package store keeps what vmrunner knows about its VMs beyond what HCS
+// reports: the configuration each was started with, its console pipe, the
+// digests of the images it booted and how it last exited. Each VM has one
+// JSON file, replaced atomically on every change.
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/config"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vm"
+)
+
+// SchemaVersion is the version of the record format written by this build.
+// Records of a newer version are refused rather than rewritten without the
+// fields this build does not know; bump it (and upgrade older records in
+// read) on incompatible changes.
+const SchemaVersion = 1
+
+// ErrNotFound is returned for a VM without a record.
+var ErrNotFound = errors.New("no record")
+
+// Record is the stored metadata of one VM.
+type Record struct {
+	Schema int
+	ID     string
+	Config config.VMConfig
+	// Console is the named pipe of the VM's serial console.
+	Console string
+	Created time.Time
+	// Images maps the boot images of Config.ImageDir to their digests
+	// ("sha256:<hex>") at creation time. The root disk is not hashed: the
+	// guest writes to it.
+	Images map[string]string `json:",omitempty"`
+	Labels map[string]string `json:",omitempty"`
+	Name   string            `json:",omitempty"`
+
+	// State is the last lifecycle state the daemon saw.
+	State string
+	// Started is when the VM was last started: run, or restarted.
+	Started *time.Time `json:",omitempty"`
+	// Exited and ExitReason are set once the VM stops or fails.
+	Exited     *time.Time `json:",omitempty"`
+	ExitReason string     `json:",omitempty"`
+	// LastExit is how the VM last exited; it is kept across restarts.
+	LastExit *vm.Exit `json:",omitempty"`
+
+	// Restarts counts the restarts made under Config.Restart since the VM
+	// was run; LastFailure is the reason of its last failure.
+	Restarts    int    `json:",omitempty"`
+	LastFailure string `json:",omitempty"`
+
+	// Expires is when the VM's TTL runs out: Created plus Config.TTL.
+	Expires *time.Time `json:",omitempty"`
+	// LastActivity is the last console input or output seen by the reaper
+	// of a VM with an idle timeout, so that a new daemon resumes counting
+	// from it.
+	LastActivity *time.Time `json:",omitempty"`
+}
+
+// NewRecord returns the record of a VM started now with cfg.
+func NewRecord(cfg config.VMConfig) *Record {
+	r := &Record{
+		ID:      cfg.VMID,
+		Config:  cfg,
+		Console: cfg.Console(),
+		Created: time.Now().UTC(),
+		Images:  ImageDigests(cfg.ImageDir),
+		Labels:  cfg.Labels,
+		Name:    cfg.Name,
+	}
+	started := r.Created
+	r.Started = &started
+	if cfg.TTL > 0 {
+		expires := r.Created.Add(time.Duration(cfg.TTL))
+		r.Expires = &expires
+	}
+	return r
+}
+
+// SetExited records that the VM exited now for reason.
+func (r *Record) SetExited(state, reason string) {
+	now := time.Now().UTC()
+	r.State = state
+	r.Exited = &now
+	r.ExitReason = reason
+}
+
+// SetUnexpectedExit records that the VM exited now for reason, without
+// HCS having reported how.
+func (r *Record) SetUnexpectedExit(state, reason string) {
+	r.SetExited(state, reason)
+	r.LastExit = &vm.Exit{Reason: vm.ExitUnexpected, Time: *r.Exited, Detail: reason}
+}
+
+// bootImages are the files of an image directory hashed into Record.Images.
+var bootImages = []string{"vmlinuz", "initrd"}
+
+// ImageDigests hashes the boot images in dir. Files that cannot be read are
+// left out.
+func ImageDigests(dir string) map[string]string {
+	if dir == "" {
+		return nil
+	}
+	digests := make(map[string]string)
+	for _, name := range bootImages {
+		d, err := fileDigest(filepath.Join(dir, name))
+		if err != nil {
+			log.Printf("[vmrunner] digest of %s: %v", name, err)
+			continue
+		}
+		digests[name] = d
+	}
+	return digests
+}
+
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// DefaultDir returns the store directory: $VMRUNNER_STATE_DIR, else
+// %ProgramData%\vmrunner\state on Windows and $XDG_STATE_HOME/vmrunner (or
+// ~/.local/state/vmrunner) elsewhere.
+func DefaultDir() string {
+	if d := os.Getenv("VMRUNNER_STATE_DIR"); d != "" {
+		return d
+	}
+	if runtime.GOOS == "windows" {
+		dir := os.Getenv("ProgramData")
+		if dir == "" {
+			dir = `C:\ProgramData`
+		}
+		return filepath.Join(dir, "vmrunner", "state")
+	}
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "vmrunner")
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".local", "state", "vmrunner")
+	}
+	return filepath.Join(os.TempDir(), "vmrunner-state")
+}
+
+// Store is a directory of records. A Store serializes its own writes; only
+// one process (the daemon) should write to a directory.
+type Store struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// Open opens the store in dir, creating the directory if needed.
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("state store: %w", err)
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Dir returns the store directory.
+func (s *Store) Dir() string { return s.dir }
+
+// path returns the file of VM id. IDs are escaped so that any HCS ID maps
+// to a valid file name.
+func (s *Store) path(id string) string {
+	return filepath.Join(s.dir, url.QueryEscape(id)+".json")
+}
+
+// ConsoleLog returns the console log file of VM id, in the logs
+// subdirectory.
+func (s *Store) ConsoleLog(id string) string {
+	return filepath.Join(s.dir, "logs", url.QueryEscape(id)+".log")
+}
+
+// ScratchDisk returns where the scratch disk of VM id goes, in the scratch
+// subdirectory.
+func (s *Store) ScratchDisk(id string) string {
+	return filepath.Join(s.dir, "scratch", url.QueryEscape(id)+".vhdx")
+}
+
+// Get returns the record of VM id, or an error wrapping ErrNotFound.
+func (s *Store) Get(id string) (*Record, error) {
+	return read(s.path(id), id)
+}
+
+func read(path, id string) (*Record, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("VM %q: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read record: %w", err)
+	}
+	var r Record
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, fmt.Errorf("record %s: %w", filepath.Base(path), err)
+	}
+	switch {
+	case r.Schema > SchemaVersion:
+		return nil, fmt.Errorf("record %s: schema %d is newer than this vmrunner's (%d)", filepath.Base(path), r.Schema, SchemaVersion)
+	case r.Schema < 1:
+		return nil, fmt.Errorf("record %s: missing schema version", filepath.Base(path))
+	}
+	return &r, nil
+}
+
+// Put writes r, replacing any record of the same VM.
+func (s *Store) Put(r *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write(r)
+}
+
+// Resources returns the resources VM id was started with, if it has a
+// record.
+func (s *Store) Resources(id string) (vm.Resources, bool) {
+	r, err := s.Get(id)
+	if err != nil {
+		return vm.Resources{}, false
+	}
+	return vm.Resources{MemoryMB: uint64(r.Config.MemoryMB), CPUs: uint64(r.Config.CPUCount)}, true
+}
+
+// Update applies fn to the record of VM id and writes it back. It returns an
+// error wrapping ErrNotFound if there is no record.
+func (s *Store) Update(id string, fn func(*Record)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+	fn(r)
+	return s.write(r)
+}
+
+// write replaces the record file through a temporary file in the same
+// directory, so readers see either the old or the new record.
+func (s *Store) write(r *Record) error {
+	r.Schema = SchemaVersion
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal record: %w", err)
+	}
+	tmp, err := os.CreateTemp(s.dir, ".record-*")
+	if err != nil {
+		return fmt.Errorf("write record: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly once renamed
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write record: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write record: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write record: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path(r.ID)); err != nil {
+		return fmt.Errorf("write record: %w", err)
+	}
+	return nil
+}
+
+// Remove deletes the record of VM id. Removing a missing record is not an
+// error.
+func (s *Store) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Remove(s.path(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove record: %w", err)
+	}
+	return nil
+}
+
+// List returns every readable record, sorted by ID. Unreadable records are
+// logged and skipped so that one bad file does not hide the others.
+func (s *Store) List() ([]*Record, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("state store: %w", err)
+	}
+	var records []*Record
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		id, err := url.QueryUnescape(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			id = name
+		}
+		r, err := read(filepath.Join(s.dir, name), id)
+		if err != nil {
+			log.Printf("[vmrunner] state store: skipping %s: %v", name, err)
+			continue
+		}
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+	return records, nil
+}
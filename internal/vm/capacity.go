@@ -0,0 +1,249 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/config"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vmcompute"
+)
+
+// Resources are what a VM takes from the host.
+type Resources struct {
+	MemoryMB uint64
+	CPUs     uint64
+}
+
+func configResources(cfg config.VMConfig) Resources {
+	return Resources{MemoryMB: uint64(cfg.MemoryMB), CPUs: uint64(cfg.CPUCount)}
+}
+
+// HostStats are the host resources admission control weighs a VM against.
+type HostStats struct {
+	TotalMemoryMB     uint64
+	AvailableMemoryMB uint64
+	LogicalProcessors uint64
+}
+
+// CapacityPolicy decides whether a VM may start on a host.
+type CapacityPolicy struct {
+	// MemoryOvercommit bounds the memory committed to vmrunner's VMs, as a
+	// multiple of the host's physical memory; 0 disables the bound.
+	MemoryOvercommit float64
+	// CPUOvercommit bounds the virtual CPUs of vmrunner's VMs, as a
+	// multiple of the host's logical processors; 0 disables the bound.
+	CPUOvercommit float64
+	// ReserveMB is memory that must stay available to the host once the VM
+	// has its own.
+	ReserveMB uint64
+}
+
+// DefaultCapacityPolicy commits no more memory than the host has and up to
+// four virtual CPUs per logical processor.
+var DefaultCapacityPolicy = CapacityPolicy{MemoryOvercommit: 1, CPUOvercommit: 4, ReserveMB: 512}
+
+// Capacity is the policy Start admits VMs by; main may change it.
+var Capacity = DefaultCapacityPolicy
+
+// HostStatsFunc returns the host's resources for admission control; nil
+// disables admission control. It is a variable so that the policy can be
+// exercised against made-up hosts.
+var HostStatsFunc = hostStats
+
+// ResourcesFunc returns the resources VM id was started with, if known; main
+// sets it to look the VM up in the state store. Admission counts the running
+// vmrunner VMs this process holds no commitment for by it.
+var ResourcesFunc func(id string) (Resources, bool)
+
+// CapacityError is returned by Start when the host cannot take the VM.
+type CapacityError struct {
+	ID     string
+	Reason string
+	// Permanent is set when the VM can never fit this host, so that
+	// waiting for capacity is pointless.
+	Permanent bool
+}
+
+func (e *CapacityError) Error() string {
+	return fmt.Sprintf("VM %q does not fit the host: %s", e.ID, e.Reason)
+}
+
+// Check returns a *CapacityError (without ID) if a VM needing req does not
+// fit host with committed already taken by vmrunner's VMs.
+func (p CapacityPolicy) Check(host HostStats, committed, req Resources) error {
+	if host.LogicalProcessors > 0 && req.CPUs > host.LogicalProcessors {
+		return &CapacityError{Permanent: true, Reason: fmt.Sprintf(
+			"%d CPUs requested, the host has %d logical processors", req.CPUs, host.LogicalProcessors)}
+	}
+	if p.MemoryOvercommit > 0 && host.TotalMemoryMB > 0 {
+		limit := uint64(float64(host.TotalMemoryMB) * p.MemoryOvercommit)
+		if req.MemoryMB > limit {
+			return &CapacityError{Permanent: true, Reason: fmt.Sprintf(
+				"%d MB requested, at most %d MB may be committed (%d MB physical, overcommit %g)",
+				req.MemoryMB, limit, host.TotalMemoryMB, p.MemoryOvercommit)}
+		}
+		if committed.MemoryMB+req.MemoryMB > limit {
+			return &CapacityError{Reason: fmt.Sprintf(
+				"%d MB requested, %d MB of at most %d MB already committed (%d MB physical, overcommit %g)",
+				req.MemoryMB, committed.MemoryMB, limit, host.TotalMemoryMB, p.MemoryOvercommit)}
+		}
+	}
+	if p.CPUOvercommit > 0 && host.LogicalProcessors > 0 {
+		limit := uint64(float64(host.LogicalProcessors) * p.CPUOvercommit)
+		if committed.CPUs+req.CPUs > limit {
+			return &CapacityError{Reason: fmt.Sprintf(
+				"%d CPUs requested, %d of at most %d already committed (%d logical processors, overcommit %g)",
+				req.CPUs, committed.CPUs, limit, host.LogicalProcessors, p.CPUOvercommit)}
+		}
+	}
+	if req.MemoryMB+p.ReserveMB > host.AvailableMemoryMB {
+		return &CapacityError{Reason: fmt.Sprintf(
+			"%d MB requested, %d MB available of which %d MB stay reserved for the host",
+			req.MemoryMB, host.AvailableMemoryMB, p.ReserveMB)}
+	}
+	return nil
+}
+
+// capacityPoll is how often a start waiting for capacity checks again.
+const capacityPoll = 2 * time.Second
+
+// commitments are the resources of the VMs this process started or opened
+// with their configuration, by ID, from admission until they exit or are
+// closed. They cover VMs not in HCS yet, and follow the resizes made with
+// VM.UpdateMemory; admission counts the other running VMs of vmrunner
+// through ResourcesFunc.
+var commitments = struct {
+	sync.Mutex
+	vms map[string]*commitment
+}{vms: map[string]*commitment{}}
+
+// waitMu queues the starts waiting for capacity, so that they are admitted
+// in turn rather than the smallest first.
+var waitMu sync.Mutex
+
+type commitment struct {
+	id string
+	Resources
+}
+
+// committed returns what vmrunner's VMs other than id, which a start
+// replaces, have committed: the commitments of this process, and for each
+// of the live systems it holds none for, the resources ResourcesFunc knows
+// it by or, for a VM started elsewhere and not recorded, run's defaults.
+func committed(id string, live []vmcompute.SystemSummary) Resources {
+	var sum Resources
+	add := func(r Resources) {
+		sum.MemoryMB += r.MemoryMB
+		sum.CPUs += r.CPUs
+	}
+	for other, c := range commitments.vms {
+		if other != id {
+			add(c.Resources)
+		}
+	}
+	for _, s := range live {
+		if _, held := commitments.vms[s.Id]; held || s.Id == id || parseHCSState(s.State).Final() {
+			continue
+		}
+		r, ok := Resources{}, false
+		if ResourcesFunc != nil {
+			r, ok = ResourcesFunc(s.Id)
+		}
+		if !ok {
+			r = Resources{MemoryMB: config.DefaultMemoryMB, CPUs: config.DefaultCPUCount}
+		}
+		add(r)
+	}
+	return sum
+}
+
+// admit checks that the host can take cfg's VM under Capacity, waiting up
+// to wait for capacity to free up, and commits its resources. The VM must
+// take over the commitment or release it.
+func admit(cfg config.VMConfig, wait time.Duration) (*commitment, error) {
+	if HostStatsFunc == nil {
+		return nil, nil
+	}
+	req := configResources(cfg)
+	if wait > 0 {
+		waitMu.Lock()
+		defer waitMu.Unlock()
+	}
+	deadline := time.Now().Add(wait)
+	logged := false
+	for {
+		c, err := tryAdmit(cfg.VMID, req)
+		var capErr *CapacityError
+		if err == nil || !errors.As(err, &capErr) || capErr.Permanent || !time.Now().Before(deadline) {
+			return c, err
+		}
+		if !logged {
+			log.Printf("[vmrunner] VM %q waiting for capacity: %s", cfg.VMID, capErr.Reason)
+			logged = true
+		}
+		time.Sleep(min(capacityPoll, time.Until(deadline)))
+	}
+}
+
+func tryAdmit(id string, req Resources) (*commitment, error) {
+	host, err := HostStatsFunc()
+	if err != nil {
+		return nil, fmt.Errorf("host resources: %w", err)
+	}
+	// Other vmrunner processes, and earlier runs of this one, may have VMs
+	// running: HCS knows them all.
+	live, err := Systems(ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("host resources: %w", err)
+	}
+	commitments.Lock()
+	defer commitments.Unlock()
+	if err := Capacity.Check(host, committed(id, live), req); err != nil {
+		err.(*CapacityError).ID = id
+		return nil, err
+	}
+	c := &commitment{id: id, Resources: req}
+	commitments.vms[id] = c
+	return c, nil
+}
+
+// commit records the resources of a VM that is already running, unless
+// something else already accounts for its ID.
+func commit(cfg config.VMConfig) *commitment {
+	if cfg.MemoryMB == 0 && cfg.CPUCount == 0 {
+		return nil
+	}
+	commitments.Lock()
+	defer commitments.Unlock()
+	if _, ok := commitments.vms[cfg.VMID]; ok {
+		return nil
+	}
+	c := &commitment{id: cfg.VMID, Resources: configResources(cfg)}
+	commitments.vms[cfg.VMID] = c
+	return c
+}
+
+// release gives c's resources back, unless a newer commitment replaced it.
+func (c *commitment) release() {
+	if c == nil {
+		return
+	}
+	commitments.Lock()
+	defer commitments.Unlock()
+	if commitments.vms[c.id] == c {
+		delete(commitments.vms, c.id)
+	}
+}
+
+// resize updates the committed memory of c's VM after a resize.
+func (c *commitment) resize(memoryMB uint32) {
+	if c == nil {
+		return
+	}
+	commitments.Lock()
+	defer commitments.Unlock()
+	c.MemoryMB = uint64(memoryMB)
+}
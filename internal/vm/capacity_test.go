@@ -0,0 +1,167 @@
+package vm
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/config"
+)
+
+func TestCapacityCheck(t *testing.T) {
+	host := HostStats{TotalMemoryMB: 8192, AvailableMemoryMB: 6144, LogicalProcessors: 4}
+	policy := CapacityPolicy{MemoryOvercommit: 1, CPUOvercommit: 2, ReserveMB: 512}
+	for _, tt := range []struct {
+		name      string
+		policy    CapacityPolicy
+		committed Resources
+		req       Resources
+		want      string // in the reason; "" if it fits
+		permanent bool
+	}{
+		{"fits", policy, Resources{4096, 4}, Resources{2048, 2}, "", false},
+		{"more CPUs than the host", policy, Resources{}, Resources{512, 5}, "5 CPUs requested, the host has 4", true},
+		{"more memory than may be committed", policy, Resources{}, Resources{9000, 1}, "at most 8192 MB may be committed", true},
+		{"memory committed", policy, Resources{6144, 1}, Resources{4096, 1}, "6144 MB of at most 8192 MB already committed", false},
+		{"memory overcommit", CapacityPolicy{MemoryOvercommit: 1.5}, Resources{6144, 1}, Resources{4096, 1}, "", false},
+		{"no memory bound", CapacityPolicy{}, Resources{1 << 20, 1}, Resources{4096, 1}, "", false},
+		{"CPUs committed", policy, Resources{1024, 7}, Resources{512, 2}, "7 of at most 8 already committed", false},
+		{"no CPU bound", CapacityPolicy{MemoryOvercommit: 1}, Resources{1024, 100}, Resources{512, 4}, "", false},
+		{"reserve", policy, Resources{}, Resources{5800, 1}, "6144 MB available of which 512 MB stay reserved", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Check(host, tt.committed, tt.req)
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("does not fit: %v", err)
+				}
+				return
+			}
+			var capErr *CapacityError
+			if !errors.As(err, &capErr) || !strings.Contains(capErr.Reason, tt.want) || capErr.Permanent != tt.permanent {
+				t.Fatalf("check: %v, want %q (permanent %v)", err, tt.want, tt.permanent)
+			}
+		})
+	}
+}
+
+// useHost admits VMs against host under policy for the duration of the
+// test, with records giving the resources of the VMs in recorded.
+func useHost(t *testing.T, host HostStats, policy CapacityPolicy, recorded map[string]Resources) {
+	t.Helper()
+	hostStats, capacity, resources := HostStatsFunc, Capacity, ResourcesFunc
+	HostStatsFunc = func() (HostStats, error) { return host, nil }
+	Capacity = policy
+	ResourcesFunc = func(id string) (Resources, bool) {
+		r, ok := recorded[id]
+		return r, ok
+	}
+	t.Cleanup(func() { HostStatsFunc, Capacity, ResourcesFunc = hostStats, capacity, resources })
+}
+
+func config512(id string) config.VMConfig {
+	cfg := testConfig(id)
+	cfg.MemoryMB, cfg.CPUCount = 512, 1
+	return cfg
+}
+
+// TestAdmitCountsRunningVMs checks that admission counts the vmrunner VMs
+// in HCS that this process did not start: by their record, or at run's
+// defaults without one.
+func TestAdmitCountsRunningVMs(t *testing.T) {
+	f := useFake(t)
+	f.Add("recorded", config.Owner)
+	f.Add("unrecorded", config.Owner)
+	f.Add("docker-uvm", "docker")
+	// recorded 1024 + unrecorded DefaultMemoryMB leave room for two 512 MB
+	// VMs; the Docker VM is not vmrunner's to count.
+	limit := uint64(1024 + config.DefaultMemoryMB + 2*512)
+	useHost(t, HostStats{TotalMemoryMB: limit, AvailableMemoryMB: 1 << 20, LogicalProcessors: 64},
+		CapacityPolicy{MemoryOvercommit: 1}, map[string]Resources{"recorded": {1024, 1}})
+
+	for _, id := range []string{"vm1", "vm2"} {
+		v, err := Start(config512(id), StartOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer v.Close()
+	}
+	var capErr *CapacityError
+	if _, err := Start(config512("vm3"), StartOptions{}); !errors.As(err, &capErr) || capErr.Permanent || capErr.ID != "vm3" {
+		t.Fatalf("start past the limit: %v, want a *CapacityError", err)
+	}
+	if f.Exists("vm3") {
+		t.Fatal("VM created past the limit")
+	}
+
+	// Once the unrecorded VM exits there is room again.
+	f.Exit("unrecorded", "", 0)
+	v, err := Start(config512("vm3"), StartOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.Close()
+}
+
+// TestAdmitReplace checks that a start replacing a VM does not count the VM
+// it replaces.
+func TestAdmitReplace(t *testing.T) {
+	f := useFake(t)
+	f.Add("vm1", config.Owner)
+	useHost(t, HostStats{TotalMemoryMB: 1024, AvailableMemoryMB: 1 << 20},
+		CapacityPolicy{MemoryOvercommit: 1}, map[string]Resources{"vm1": {1024, 1}})
+	v, err := Start(config512("vm1"), StartOptions{Replace: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.Close()
+}
+
+func TestAdmitWait(t *testing.T) {
+	f := useFake(t)
+	f.Add("big", config.Owner)
+	useHost(t, HostStats{TotalMemoryMB: 1024, AvailableMemoryMB: 1 << 20},
+		CapacityPolicy{MemoryOvercommit: 1}, map[string]Resources{"big": {1024, 1}})
+
+	// Capacity that does not free up in time fails once the wait is over.
+	start := time.Now()
+	var capErr *CapacityError
+	if _, err := Start(config512("vm1"), StartOptions{WaitForCapacity: 200 * time.Millisecond}); !errors.As(err, &capErr) || capErr.Permanent {
+		t.Fatalf("start: %v, want a *CapacityError", err)
+	}
+	if waited := time.Since(start); waited < 200*time.Millisecond {
+		t.Fatalf("gave up after %s", waited)
+	}
+
+	// A VM that can never fit fails without waiting.
+	start = time.Now()
+	cfg := config512("huge")
+	cfg.MemoryMB = 4096
+	if _, err := Start(cfg, StartOptions{WaitForCapacity: time.Minute}); !errors.As(err, &capErr) || !capErr.Permanent {
+		t.Fatalf("start: %v, want a permanent *CapacityError", err)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Fatalf("waited %s for a VM that cannot fit", waited)
+	}
+}
+
+// TestUpdateMemory checks that a resize carries over to the memory
+// committed to the VM.
+func TestUpdateMemory(t *testing.T) {
+	useFake(t)
+	v, err := Start(config512("vm1"), StartOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	if err := v.UpdateMemory(1024); err != nil {
+		t.Fatal(err)
+	}
+	commitments.Lock()
+	c := commitments.vms["vm1"]
+	commitments.Unlock()
+	if c == nil || c.MemoryMB != 1024 {
+		t.Fatalf("commitment %+v after resizing to 1024 MB", c)
+	}
+}
@@ -0,0 +1,276 @@
+//go:build windows
+
+package vm
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Terminal connects the process's console to conn bidirectionally
+// (stdin → conn, conn → stdout) until either side closes. conn is typically
+// a VM serial console, directly or through vmrunnerd.
+//
+// Console mode is switched to raw VTI inside stdinTo via prepareRawConsole.
+// ReadFile is used directly on the console HANDLE (not os.Stdin.Read / ReadConsole)
+// to avoid the ConPTY/Windows Terminal bug where SetConsoleMode causes indefinite
+// blocking when going through the ReadConsole path.
+func Terminal(conn io.ReadWriter) error {
+	readerDone := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(os.Stdout, conn)
+		readerDone <- err
+	}()
+
+	writerDone := make(chan error, 1)
+	go func() { writerDone <- stdinTo(conn) }()
+
+	select {
+	case err := <-readerDone:
+		return err
+	case err := <-writerDone:
+		return err
+	}
+}
+
+// kernel32 procedures for named pipe I/O and overlapped I/O.
+var (
+	kernel32                = syscall.NewLazyDLL("kernel32.dll")
+	procCreateFileW         = kernel32.NewProc("CreateFileW")
+	procCreateEventW        = kernel32.NewProc("CreateEventW")
+	procGetOverlappedResult = kernel32.NewProc("GetOverlappedResult")
+	procCancelIoEx          = kernel32.NewProc("CancelIoEx")
+	procGetConsoleMode      = kernel32.NewProc("GetConsoleMode")
+	procSetConsoleMode      = kernel32.NewProc("SetConsoleMode")
+)
+
+const (
+	genericReadWrite    = 0xC0000000 // GENERIC_READ | GENERIC_WRITE
+	openExisting        = 3
+	fileAttributeNormal = 0x80
+	fileFlagOverlapped  = 0x40000000
+
+	enableProcessedInput   = 0x0001 // keep Ctrl+C → SIGINT
+	enableLineInput        = 0x0002 // line-buffering (remove for char-at-a-time)
+	enableEchoInput        = 0x0004 // local echo (remove to prevent double echo)
+	enableVirtualTermInput = 0x0200 // VTI mode: ReadFile returns VT sequences
+)
+
+// openOverlappedPipe opens a named pipe with FILE_FLAG_OVERLAPPED so that
+// concurrent ReadFile and WriteFile on the same handle do not serialize.
+func openOverlappedPipe(name string) (syscall.Handle, error) {
+	namePtr, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return syscall.InvalidHandle, err
+	}
+	h, _, lastErr := procCreateFileW.Call(
+		uintptr(unsafe.Pointer(namePtr)),
+		genericReadWrite,
+		0,
+		0,
+		openExisting,
+		fileAttributeNormal|fileFlagOverlapped,
+		0,
+	)
+	if syscall.Handle(h) == syscall.InvalidHandle {
+		return syscall.InvalidHandle, lastErr
+	}
+	return syscall.Handle(h), nil
+}
+
+// openConsole is the default OpenConsole: openOverlappedPipe, retried every
+// 100 ms until timeout.
+func openConsole(name string, timeout time.Duration) (io.ReadWriteCloser, error) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		h, err := openOverlappedPipe(name)
+		if err == nil {
+			return &overlappedPipe{h: h}, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil, fmt.Errorf("timed out waiting for pipe %q after %s", name, timeout)
+}
+
+// overlappedPipe is a pipe handle opened with FILE_FLAG_OVERLAPPED. One Read
+// and one Write may be in progress at the same time, which a synchronous
+// handle would serialize: a reader blocked waiting for console output would
+// hold up every keystroke.
+type overlappedPipe struct {
+	h         syscall.Handle
+	closeOnce sync.Once
+}
+
+func (p *overlappedPipe) Read(b []byte) (int, error) {
+	n, err := overlappedIO(p.h, b, syscall.ReadFile)
+	if err != nil && isPipeClose(err) {
+		return n, io.EOF
+	}
+	return n, err
+}
+
+func (p *overlappedPipe) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		n, err := overlappedIO(p.h, b[written:], syscall.WriteFile)
+		written += n
+		if err != nil {
+			if isPipeClose(err) {
+				return written, io.ErrClosedPipe
+			}
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Close cancels any Read or Write in progress and closes the handle.
+func (p *overlappedPipe) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		procCancelIoEx.Call(uintptr(p.h), 0)
+		err = syscall.CloseHandle(p.h)
+	})
+	return err
+}
+
+// overlappedIO runs one ReadFile or WriteFile on h and waits for it.
+func overlappedIO(h syscall.Handle, b []byte, op func(syscall.Handle, []byte, *uint32, *syscall.Overlapped) error) (int, error) {
+	ev, err := createEvent()
+	if err != nil {
+		return 0, fmt.Errorf("createEvent: %w", err)
+	}
+	defer syscall.CloseHandle(ev)
+
+	var ol syscall.Overlapped
+	ol.HEvent = ev
+	var n uint32
+	err = op(h, b, &n, &ol)
+	if err == syscall.ERROR_IO_PENDING {
+		syscall.WaitForSingleObject(ev, syscall.INFINITE)
+		r, _, lastErr := procGetOverlappedResult.Call(uintptr(h), uintptr(unsafe.Pointer(&ol)), uintptr(unsafe.Pointer(&n)), 0)
+		if r == 0 {
+			err = lastErr
+		} else {
+			err = nil
+		}
+	}
+	return int(n), err
+}
+
+// createEvent creates a Win32 auto-reset, initially non-signaled event object.
+func createEvent() (syscall.Handle, error) {
+	h, _, lastErr := procCreateEventW.Call(0, 0, 0, 0)
+	if h == 0 {
+		return syscall.InvalidHandle, lastErr
+	}
+	return syscall.Handle(h), nil
+}
+
+// isPipeClose reports whether err means the remote end closed or disconnected.
+func isPipeClose(err error) bool {
+	if err == io.EOF {
+		return true
+	}
+	if e, ok := err.(syscall.Errno); ok {
+		// ERROR_BROKEN_PIPE, ERROR_PIPE_NOT_CONNECTED, ERROR_OPERATION_ABORTED
+		return e == 109 || e == 233 || e == 995
+	}
+	return false
+}
+
+// prepareRawConsole puts the Windows console stdin handle into raw VTI mode
+// (no local echo, no line buffering) and returns the raw HANDLE, a restore
+// function, and whether stdin is actually a console.
+//
+// ENABLE_PROCESSED_INPUT is kept so Ctrl+C continues to generate SIGINT.
+// ReadFile on the returned handle bypasses ReadConsole, avoiding the
+// ConPTY / Windows Terminal bug where SetConsoleMode causes indefinite blocking.
+func prepareRawConsole() (h syscall.Handle, restore func(), isConsole bool) {
+	stdinH, err := syscall.GetStdHandle(syscall.STD_INPUT_HANDLE)
+	if err != nil {
+		return syscall.InvalidHandle, nil, false
+	}
+	var old uint32
+	r, _, _ := procGetConsoleMode.Call(uintptr(stdinH), uintptr(unsafe.Pointer(&old)))
+	if r == 0 {
+		// stdin is not a console (redirected pipe, file, etc.)
+		return syscall.InvalidHandle, nil, false
+	}
+	newMode := (old &^ (enableLineInput | enableEchoInput)) | enableVirtualTermInput
+	procSetConsoleMode.Call(uintptr(stdinH), uintptr(newMode))
+	return stdinH, func() { procSetConsoleMode.Call(uintptr(stdinH), uintptr(old)) }, true
+}
+
+// stdinTo reads from stdin and writes to w.
+// CR (\r) and CRLF (\r\n) are converted to LF (\n) for the Linux tty.
+//
+// When stdin is a Windows console, the console is put into raw VTI mode
+// (no local echo, no line buffering) and ReadFile is used directly on the
+// console handle. This bypasses the ReadConsole path that causes indefinite
+// blocking under ConPTY/Windows Terminal after any SetConsoleMode call.
+func stdinTo(w io.Writer) error {
+	// Switch the console to raw VTI mode (removes local echo and line
+	// buffering). Falls back gracefully when stdin is redirected.
+	stdinH, restore, isConsole := prepareRawConsole()
+	if restore != nil {
+		defer restore()
+	}
+
+	inBuf := make([]byte, 256)
+	outBuf := make([]byte, 0, 256)
+	prevCR := false
+
+	for {
+		var n uint32
+		var readErr error
+		if isConsole {
+			// Use ReadFile directly on the console HANDLE so we bypass
+			// ReadConsole — which hangs in ConPTY after SetConsoleMode.
+			readErr = syscall.ReadFile(stdinH, inBuf, &n, nil)
+		} else {
+			nn, e := os.Stdin.Read(inBuf)
+			n, readErr = uint32(nn), e
+		}
+		if int(n) > 0 {
+			outBuf = outBuf[:0]
+			for _, b := range inBuf[:n] {
+				switch {
+				case b == '\r':
+					outBuf = append(outBuf, '\n')
+					prevCR = true
+				case b == '\n' && prevCR:
+					// CRLF: drop the LF, CR was already converted above.
+					prevCR = false
+				default:
+					prevCR = false
+					outBuf = append(outBuf, b)
+				}
+			}
+			if len(outBuf) > 0 {
+				written, werr := w.Write(outBuf)
+				if Trace {
+					log.Printf("[vmrunner] trace: stdin→console %q written=%d", outBuf, written)
+				}
+				if werr != nil {
+					if werr == io.ErrClosedPipe || isPipeClose(werr) {
+						return nil
+					}
+					return werr
+				}
+			}
+		}
+		if readErr != nil {
+			if readErr == io.EOF {
+				return nil
+			}
+			return readErr
+		}
+	}
+}
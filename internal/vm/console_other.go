@@ -0,0 +1,30 @@
+//go:build !windows
+
+package vm
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// openConsole fails: the serial console is a Windows named pipe.
+func openConsole(name string, timeout time.Duration) (io.ReadWriteCloser, error) {
+	return nil, fmt.Errorf("open console pipe %q: not supported on this platform", name)
+}
+
+// Terminal connects stdin and stdout to conn until either side closes. The
+// terminal is left in whatever mode it is in.
+func Terminal(conn io.ReadWriter) error {
+	done := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(os.Stdout, conn)
+		done <- err
+	}()
+	go func() {
+		_, err := io.Copy(conn, os.Stdin)
+		done <- err
+	}()
+	return <-done
+}
@@ -0,0 +1,109 @@
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/vmcompute"
+)
+
+// ExitReason classifies why a VM exited.
+type ExitReason string
+
+const (
+	// ExitGuestShutdown: the guest shut down cleanly, on its own (poweroff)
+	// or when asked to by Stop or HCS.
+	ExitGuestShutdown ExitReason = "GuestShutdown"
+	// ExitHostTerminate: the host terminated the VM (kill, or Stop
+	// escalating to terminate).
+	ExitHostTerminate ExitReason = "HostTerminate"
+	// ExitGuestCrash: HCS reported a guest crash.
+	ExitGuestCrash ExitReason = "GuestCrash"
+	// ExitUnexpected: the VM stopped without being asked to and not
+	// cleanly: a failed exit, a failed start, the HCS service going away,
+	// or vanishing from HCS.
+	ExitUnexpected ExitReason = "Unexpected"
+)
+
+// Exit describes how a VM exited.
+type Exit struct {
+	Reason ExitReason
+	Time   time.Time
+	// HCSExitType is the exit type of HCS's SystemExited notification
+	// (GracefulExit, ForcedExit, UnexpectedExit…), when it has one.
+	HCSExitType string `json:",omitempty"`
+	// Status is the failure HRESULT reported with the exit, if any.
+	Status uint32 `json:",omitempty"`
+	// Detail is the failure or crash report behind the exit, if any.
+	Detail string `json:",omitempty"`
+}
+
+// Failed reports whether the exit is a failure to restart policies: a crash
+// or an unexpected stop, whatever state it left the VM in.
+func (x Exit) Failed() bool {
+	return x.Reason == ExitGuestCrash || x.Reason == ExitUnexpected
+}
+
+func (x Exit) String() string {
+	if x.Detail == "" {
+		return string(x.Reason)
+	}
+	return fmt.Sprintf("%s: %s", x.Reason, x.Detail)
+}
+
+// systemExitStatus is the data of a SystemExited notification.
+type systemExitStatus struct {
+	ExitType string `json:"ExitType,omitempty"`
+}
+
+// HCS exit types, from the schema's NotificationType.
+const (
+	hcsGracefulExit   = "GracefulExit"
+	hcsForcedExit     = "ForcedExit"
+	hcsUnexpectedExit = "UnexpectedExit"
+)
+
+// systemExit classifies a SystemExited notification. Without an exit type
+// HCS knows, a failure status is unexpected unless the host was stopping
+// the VM; terminating says the host did it.
+func systemExit(n vmcompute.Notification, stopping, terminating bool) Exit {
+	var x Exit
+	if err := n.Err(); err != nil {
+		x.Status = n.Status
+		x.Detail = err.Error()
+	}
+	var status systemExitStatus
+	if n.Data != "" && json.Unmarshal([]byte(n.Data), &status) == nil {
+		x.HCSExitType = status.ExitType
+	}
+	switch {
+	case x.HCSExitType == hcsGracefulExit:
+		x.Reason = ExitGuestShutdown
+	case x.HCSExitType == hcsForcedExit || terminating:
+		x.Reason = ExitHostTerminate
+	case x.HCSExitType == hcsUnexpectedExit, x.Status != 0 && !stopping:
+		x.Reason = ExitUnexpected
+	default:
+		x.Reason = ExitGuestShutdown
+	}
+	return x
+}
+
+// defaultExit classifies a final transition that carries no HCS exit data:
+// the result of a call made through the VM, such as a failed start or a
+// terminate.
+func defaultExit(to State, err error, terminating bool) Exit {
+	switch {
+	case to == StateFailed:
+		x := Exit{Reason: ExitUnexpected}
+		if err != nil {
+			x.Detail = err.Error()
+		}
+		return x
+	case terminating:
+		return Exit{Reason: ExitHostTerminate}
+	default:
+		return Exit{Reason: ExitGuestShutdown}
+	}
+}
@@ -0,0 +1,99 @@
+package vm
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/config"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vmcompute"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vmcompute/vmcomputetest"
+)
+
+func TestSystemExit(t *testing.T) {
+	const failure = 0x80370100
+	for _, tt := range []struct {
+		name                  string
+		exitType              string
+		status                uint32
+		stopping, terminating bool
+		want                  ExitReason
+	}{
+		{"poweroff", vmcomputetest.GracefulExit, 0, false, false, ExitGuestShutdown},
+		{"stopped", vmcomputetest.GracefulExit, 0, true, false, ExitGuestShutdown},
+		{"graceful while terminating", vmcomputetest.GracefulExit, 0, true, true, ExitGuestShutdown},
+		{"forced", vmcomputetest.ForcedExit, 0, false, false, ExitHostTerminate},
+		{"terminated", "", 0, true, true, ExitHostTerminate},
+		{"unexpected while terminating", vmcomputetest.UnexpectedExit, 0, true, true, ExitHostTerminate},
+		{"unexpected", vmcomputetest.UnexpectedExit, 0, false, false, ExitUnexpected},
+		{"unexpected while stopping", vmcomputetest.UnexpectedExit, 0, true, false, ExitUnexpected},
+		{"failure status", "", failure, false, false, ExitUnexpected},
+		{"failure status while stopping", "", failure, true, false, ExitGuestShutdown},
+		{"forced with failure status", vmcomputetest.ForcedExit, failure, false, false, ExitHostTerminate},
+		{"no exit type", "", 0, false, false, ExitGuestShutdown},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			n := vmcompute.Notification{Type: vmcompute.NotificationSystemExited, Status: tt.status}
+			if tt.exitType != "" {
+				n.Data = `{"ExitType":"` + tt.exitType + `"}`
+			}
+			x := systemExit(n, tt.stopping, tt.terminating)
+			if x.Reason != tt.want || x.HCSExitType != tt.exitType {
+				t.Fatalf("exit %+v, want reason %s and exit type %q", x, tt.want, tt.exitType)
+			}
+			if tt.status != 0 && (x.Status != tt.status || x.Detail == "") {
+				t.Fatalf("exit %+v does not carry status %#x", x, tt.status)
+			}
+			if failed := tt.want == ExitUnexpected; x.Failed() != failed {
+				t.Fatalf("exit %+v: failed %v", x, x.Failed())
+			}
+		})
+	}
+}
+
+// TestPostStopExitReason checks that postStop hooks are told how the VM
+// exited in the terms wait uses.
+func TestPostStopExitReason(t *testing.T) {
+	f := useFake(t)
+	envs := make(chan []string, 1)
+	runHook := RunHook
+	RunHook = func(h config.Hook, env []string) error {
+		envs <- env
+		return nil
+	}
+	t.Cleanup(func() { RunHook = runHook })
+
+	for _, tt := range []struct {
+		name string
+		exit func(v *VM)
+		want []string
+	}{
+		{"poweroff", func(v *VM) { f.Exit(v.ID(), vmcomputetest.GracefulExit, 0) },
+			[]string{"VMRUNNER_EXIT_REASON=GuestShutdown", "VMRUNNER_EXIT_DETAIL=", "VMRUNNER_STATE=Stopped"}},
+		{"kill", func(v *VM) { v.Terminate() },
+			[]string{"VMRUNNER_EXIT_REASON=HostTerminate", "VMRUNNER_STATE=Stopped"}},
+		{"unexpected", func(v *VM) { f.Exit(v.ID(), vmcomputetest.UnexpectedExit, 0) },
+			[]string{"VMRUNNER_EXIT_REASON=Unexpected"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig("vm1")
+			cfg.Hooks.PostStop = []config.Hook{{Path: "post-stop"}}
+			v, err := Start(cfg, StartOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer v.Close()
+			tt.exit(v)
+			select {
+			case env := <-envs:
+				for _, want := range tt.want {
+					if !slices.Contains(env, want) {
+						t.Errorf("hook environment %q lacks %s", env, want)
+					}
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("postStop hook not run")
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package vm
+
+import (
+	"sync"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/handles"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vmcompute"
+)
+
+// systemHandle owns an HCS compute system handle. Close is idempotent, so
+// error paths can close unconditionally and deferred closes are safe after an
+// explicit one. Every handle this package opens goes through createSystem or
+// openSystem so that handles.Report sees it.
+type systemHandle struct {
+	id     string
+	handle vmcompute.HcsSystem
+
+	once    sync.Once
+	err     error
+	untrack func()
+}
+
+func newSystemHandle(id string, h vmcompute.HcsSystem) *systemHandle {
+	return &systemHandle{id: id, handle: h, untrack: handles.Track("system", id, uintptr(h))}
+}
+
+// createSystem creates a compute system and returns its owned handle.
+func createSystem(id, configuration string) (*systemHandle, error) {
+	h, err := Compute.CreateComputeSystem(id, configuration)
+	if err != nil {
+		return nil, err
+	}
+	return newSystemHandle(id, h), nil
+}
+
+// openSystem opens an existing compute system and returns its owned handle.
+func openSystem(id string) (*systemHandle, error) {
+	h, err := Compute.OpenComputeSystem(id)
+	if err != nil {
+		return nil, err
+	}
+	return newSystemHandle(id, h), nil
+}
+
+// Close closes the handle. Later calls return the first call's result.
+func (s *systemHandle) Close() error {
+	s.once.Do(func() {
+		s.err = Compute.CloseComputeSystem(s.handle)
+		s.untrack()
+	})
+	return s.err
+}
+
+// processHandle owns an HCS process handle, like systemHandle.
+type processHandle struct {
+	handle vmcompute.HcsProcess
+
+	once    sync.Once
+	err     error
+	untrack func()
+}
+
+// createProcess starts a process in system and returns its owned handle.
+func createProcess(system *systemHandle, cmdLine, params string) (*processHandle, *vmcompute.HcsProcessInformation, error) {
+	h, info, err := Compute.CreateProcess(system.handle, params)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &processHandle{handle: h, untrack: handles.Track("process", cmdLine, uintptr(h))}, info, nil
+}
+
+// Close closes the handle. Later calls return the first call's result.
+func (p *processHandle) Close() error {
+	p.once.Do(func() {
+		p.err = Compute.CloseProcess(p.handle)
+		p.untrack()
+	})
+	return p.err
+}
+
+// lookup returns the HCS summary of the compute system with the given ID, or
+// nil if there is none, without opening a handle to it.
+func lookup(id string) (*vmcompute.SystemSummary, error) {
+	query, err := vmcompute.SystemQuery{Ids: []string{id}}.JSON()
+	if err != nil {
+		return nil, err
+	}
+	result, err := Compute.EnumerateComputeSystems(query)
+	if err != nil {
+		return nil, err
+	}
+	systems, err := vmcompute.ParseSystems(result)
+	if err != nil {
+		return nil, err
+	}
+	for i := range systems {
+		if systems[i].Id == id {
+			return &systems[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// exists reports whether a compute system with the given ID exists, without
+// opening a handle to it.
+func exists(id string) (bool, error) {
+	s, err := lookup(id)
+	return s != nil, err
+}
@@ -0,0 +1,88 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/config"
+)
+
+// RunHook runs one hook executable with env added to its environment. Tests
+// substitute a fake.
+var RunHook = execHook
+
+// runHooks runs the hooks of stage for the VM of cfg in order. The first
+// failure of a hook whose policy is abort is returned and ends the stage;
+// other failures are logged.
+func runHooks(cfg config.VMConfig, stage string, extraEnv ...string) error {
+	env := append([]string{
+		"VMRUNNER_HOOK=" + stage,
+		"VMRUNNER_VM_ID=" + cfg.VMID,
+		"VMRUNNER_PIPE=" + cfg.Console(),
+		"VMRUNNER_IMAGE_DIR=" + cfg.ImageDir,
+	}, extraEnv...)
+	for i, h := range cfg.Hooks.Stage(stage) {
+		log.Printf("[vmrunner] VM %q: running %s hook %s", cfg.VMID, stage, h.Path)
+		err := RunHook(h, env)
+		if err == nil {
+			continue
+		}
+		err = fmt.Errorf("%s hook %d (%s): %w", stage, i, h.Path, err)
+		if h.Aborts(stage) {
+			return err
+		}
+		log.Printf("[vmrunner] VM %q: %v; continuing", cfg.VMID, err)
+	}
+	return nil
+}
+
+func execHook(h config.Hook, env []string) error {
+	timeout := h.TimeoutOrDefault()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, h.Path, h.Args...)
+	// The VMRUNNER_* variables come last so that they win over inherited
+	// ones.
+	cmd.Env = append(append(os.Environ(), h.Env...), env...)
+	out, err := cmd.CombinedOutput()
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		return fmt.Errorf("timed out after %s", timeout)
+	case err != nil && len(bytes.TrimSpace(out)) > 0:
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(out))
+	default:
+		return err
+	}
+}
+
+// watchExit runs the postStop hooks once the VM exits, telling them how
+// through VMRUNNER_EXIT_REASON (an ExitReason, as wait reports it),
+// VMRUNNER_EXIT_DETAIL and VMRUNNER_STATE. It gives up if events ends
+// without the VM exiting (v was closed first).
+func (v *VM) watchExit(events <-chan Event) {
+	var last Event
+	for ev := range events {
+		last = ev
+	}
+	state := v.State()
+	if !state.Final() {
+		return
+	}
+	x := last.Exit
+	if x == nil {
+		x = v.Exit()
+	}
+	if x == nil {
+		exit := defaultExit(state, last.Err, false)
+		x = &exit
+	}
+	err := runHooks(v.cfg, config.HookPostStop,
+		"VMRUNNER_EXIT_REASON="+string(x.Reason), "VMRUNNER_EXIT_DETAIL="+x.Detail, "VMRUNNER_STATE="+state.String())
+	if err != nil {
+		log.Printf("[vmrunner] VM %q: %v", v.id, err)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package vm
+
+// hostStats reports a host without limits: admission control is for the
+// Hyper-V hosts vmrunner runs VMs on.
+func hostStats() (HostStats, error) {
+	return HostStats{AvailableMemoryMB: ^uint64(0) >> 1}, nil
+}
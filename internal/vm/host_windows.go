@@ -0,0 +1,47 @@
+//go:build windows
+
+package vm
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var (
+	modKernel32                 = syscall.NewLazyDLL("kernel32.dll")
+	procGlobalMemoryStatusEx    = modKernel32.NewProc("GlobalMemoryStatusEx")
+	procGetActiveProcessorCount = modKernel32.NewProc("GetActiveProcessorCount")
+)
+
+// allProcessorGroups is ALL_PROCESSOR_GROUPS, to count the logical
+// processors of hosts with more than 64.
+const allProcessorGroups = 0xffff
+
+// memoryStatusEx is MEMORYSTATUSEX.
+type memoryStatusEx struct {
+	Length               uint32
+	MemoryLoad           uint32
+	TotalPhys            uint64
+	AvailPhys            uint64
+	TotalPageFile        uint64
+	AvailPageFile        uint64
+	TotalVirtual         uint64
+	AvailVirtual         uint64
+	AvailExtendedVirtual uint64
+}
+
+func hostStats() (HostStats, error) {
+	ms := memoryStatusEx{Length: uint32(unsafe.Sizeof(memoryStatusEx{}))}
+	if r, _, err := procGlobalMemoryStatusEx.Call(uintptr(unsafe.Pointer(&ms))); r == 0 {
+		return HostStats{}, err
+	}
+	n, _, err := procGetActiveProcessorCount.Call(allProcessorGroups)
+	if n == 0 {
+		return HostStats{}, err
+	}
+	return HostStats{
+		TotalMemoryMB:     ms.TotalPhys >> 20,
+		AvailableMemoryMB: ms.AvailPhys >> 20,
+		LogicalProcessors: uint64(n),
+	}, nil
+}
@@ -0,0 +1,130 @@
+package vm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/config"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vmcompute"
+)
+
+// ListOptions selects the compute systems List prints.
+type ListOptions struct {
+	// All includes systems of every owner (Docker, other tools, …).
+	All bool
+	// Owner restricts the list to one owner. It defaults to config.Owner
+	// unless All is set.
+	Owner string
+	// Filters are key=value conditions; see filterKeys.
+	Filters []string
+	// Quiet prints only system IDs, one per line.
+	Quiet bool
+	// Exited also lists VMs that have exited, from the daemon's state
+	// store. HCS itself only knows systems that still exist.
+	Exited bool
+	// Labels are label selectors (see config.ParseSelector) matched
+	// against the labels the daemon recorded; all must match.
+	Labels []string
+}
+
+// filterKeys are the keys accepted by ListOptions.Filters. Values are
+// compared case-insensitively.
+var filterKeys = []string{"id", "state", "type"}
+
+// listFilter is a parsed set of filter conditions: a system matches when,
+// for every key, it matches one of the values given for that key.
+type listFilter map[string][]string
+
+func parseFilters(filters []string) (listFilter, error) {
+	f := listFilter{}
+	for _, raw := range filters {
+		key, value, ok := strings.Cut(raw, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		if !ok || value == "" {
+			return nil, fmt.Errorf("invalid filter %q (want key=value)", raw)
+		}
+		known := false
+		for _, k := range filterKeys {
+			known = known || k == key
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown filter key %q (want one of %s)", key, strings.Join(filterKeys, ", "))
+		}
+		f[key] = append(f[key], value)
+	}
+	return f, nil
+}
+
+// owner returns the owner the listing is restricted to, or "" for all.
+func (o ListOptions) owner() string {
+	switch {
+	case o.Owner != "":
+		return o.Owner
+	case o.All:
+		return ""
+	default:
+		return config.Owner
+	}
+}
+
+// query returns the HCS query that pre-filters the enumeration. Conditions
+// HCS cannot evaluate (state) are applied afterwards by match.
+func (o ListOptions) query(f listFilter) vmcompute.SystemQuery {
+	q := vmcompute.SystemQuery{Ids: f["id"], Types: f["type"]}
+	if owner := o.owner(); owner != "" {
+		q.Owners = []string{owner}
+	}
+	return q
+}
+
+// match reports whether s satisfies the owner restriction and every filter.
+// HCS versions differ in how much of the query they honour, so the query
+// conditions are checked again here.
+func (o ListOptions) match(f listFilter, s vmcompute.SystemSummary) bool {
+	if owner := o.owner(); owner != "" && !strings.EqualFold(s.Owner, owner) {
+		return false
+	}
+	fields := map[string]string{"id": s.Id, "state": s.State, "type": s.SystemType}
+	for key, values := range f {
+		matched := false
+		for _, v := range values {
+			matched = matched || strings.EqualFold(fields[key], v)
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// selectSystems returns the systems in an enumeration result that match o,
+// sorted by ID.
+func (o ListOptions) selectSystems(f listFilter, result string) ([]vmcompute.SystemSummary, error) {
+	systems, err := vmcompute.ParseSystems(result)
+	if err != nil {
+		return nil, err
+	}
+	return o.filter(f, systems), nil
+}
+
+// Select returns the systems that match o, sorted by ID. It applies to
+// summaries from elsewhere than HCS the selection Systems makes.
+func (o ListOptions) Select(systems []vmcompute.SystemSummary) ([]vmcompute.SystemSummary, error) {
+	f, err := parseFilters(o.Filters)
+	if err != nil {
+		return nil, err
+	}
+	return o.filter(f, systems), nil
+}
+
+func (o ListOptions) filter(f listFilter, systems []vmcompute.SystemSummary) []vmcompute.SystemSummary {
+	var selected []vmcompute.SystemSummary
+	for _, s := range systems {
+		if o.match(f, s) {
+			selected = append(selected, s)
+		}
+	}
+	sort.Slice(selected, func(i, j int) bool { return selected[i].Id < selected[j].Id })
+	return selected
+}
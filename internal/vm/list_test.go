@@ -0,0 +1,108 @@
+package vm
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/vmcompute"
+)
+
+// enumeration is a captured HcsEnumerateComputeSystems result: three
+// vmrunner VMs (one with the owner in another case), a Docker container and
+// its utility VM, and a WSL VM.
+func enumeration(t *testing.T) string {
+	t.Helper()
+	b, err := os.ReadFile("../vmcompute/testdata/enumerate.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+const (
+	dockerContainer = "b94c31e0d6a7f2c8e5b1a9d4f7c2e8b0a3d6f9c1e4b7a2d5f8c0e3b6a9d2f5c8"
+	dockerUVM       = dockerContainer + "@vm"
+	wslVM           = "E1B6C73F-0A2D-4C8E-9B5F-3D7A1E9C4B20"
+	pausedVM        = "3f2a9c1e-8b4d-4e6f-a1c3-5d7e9f0b2a4c"
+)
+
+func TestParseFilters(t *testing.T) {
+	f, err := parseFilters([]string{"state=running", " STATE =Paused", "type=VirtualMachine"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := listFilter{"state": {"running", "Paused"}, "type": {"VirtualMachine"}}
+	if !reflect.DeepEqual(f, want) {
+		t.Fatalf("parseFilters = %v, want %v", f, want)
+	}
+	for _, bad := range []string{"state", "state=", "=running", "owner=docker"} {
+		if _, err := parseFilters([]string{bad}); err == nil {
+			t.Errorf("parseFilters(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestSelectSystems(t *testing.T) {
+	result := enumeration(t)
+	for _, tt := range []struct {
+		name string
+		opts ListOptions
+		want []string
+	}{
+		{"default owner", ListOptions{}, []string{pausedVM, "ci-build-7", "vmrunner-vm"}},
+		{"all owners", ListOptions{All: true}, []string{pausedVM, wslVM, dockerContainer, dockerUVM, "ci-build-7", "vmrunner-vm"}},
+		{"other owner", ListOptions{Owner: "docker"}, []string{dockerContainer, dockerUVM}},
+		{"owner overrides all", ListOptions{All: true, Owner: "wsl"}, []string{wslVM}},
+		{"state", ListOptions{Filters: []string{"state=running"}}, []string{"vmrunner-vm"}},
+		{"same key ORs", ListOptions{Filters: []string{"state=running", "state=paused"}}, []string{pausedVM, "vmrunner-vm"}},
+		{"different keys AND", ListOptions{All: true, Filters: []string{"type=container", "state=running"}}, []string{dockerContainer}},
+		{"different keys AND, none", ListOptions{Filters: []string{"type=container", "state=running"}}, nil},
+		{"id", ListOptions{All: true, Filters: []string{"id=" + strings.ToLower(wslVM)}}, []string{wslVM}},
+		{"id of another owner", ListOptions{Filters: []string{"id=" + dockerUVM}}, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := parseFilters(tt.opts.Filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+			systems, err := tt.opts.selectSystems(f, result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, s := range systems {
+				got = append(got, s.Id)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectSystemsEmpty(t *testing.T) {
+	for _, result := range []string{"", "null", "[]"} {
+		systems, err := ListOptions{}.selectSystems(listFilter{}, result)
+		if err != nil || systems != nil {
+			t.Errorf("selectSystems(%q) = %v, %v; want none", result, systems, err)
+		}
+	}
+}
+
+func TestListQuery(t *testing.T) {
+	f, _ := parseFilters([]string{"id=a", "id=b", "type=VirtualMachine", "state=running"})
+	for _, tt := range []struct {
+		opts ListOptions
+		want vmcompute.SystemQuery
+	}{
+		{ListOptions{}, vmcompute.SystemQuery{Ids: []string{"a", "b"}, Types: []string{"VirtualMachine"}, Owners: []string{"vmrunner"}}},
+		{ListOptions{All: true}, vmcompute.SystemQuery{Ids: []string{"a", "b"}, Types: []string{"VirtualMachine"}}},
+		{ListOptions{Owner: "docker"}, vmcompute.SystemQuery{Ids: []string{"a", "b"}, Types: []string{"VirtualMachine"}, Owners: []string{"docker"}}},
+	} {
+		if got := tt.opts.query(f); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v.query() = %+v, want %+v", tt.opts, got, tt.want)
+		}
+	}
+}
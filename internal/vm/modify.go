@@ -0,0 +1,71 @@
+package vm
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/config"
+)
+
+// AttachDisk hot-adds disk to the running VM.
+func (v *VM) AttachDisk(disk config.SCSIDisk) error {
+	req, err := disk.AddRequest()
+	if err != nil {
+		return err
+	}
+	log.Printf("[vmrunner] attaching %q to VM %q (controller %d, LUN %d)", disk.Path, v.id, disk.Controller, disk.LUN)
+	return v.modify(req)
+}
+
+// DetachDisk hot-removes the disk in disk's SCSI slot from the running VM.
+func (v *VM) DetachDisk(disk config.SCSIDisk) error {
+	req, err := disk.RemoveRequest()
+	if err != nil {
+		return err
+	}
+	log.Printf("[vmrunner] detaching %q from VM %q (controller %d, LUN %d)", disk.Path, v.id, disk.Controller, disk.LUN)
+	return v.modify(req)
+}
+
+// AddShare hot-adds a Plan9 share to the running VM.
+func (v *VM) AddShare(share config.Plan9Share) error {
+	req, err := share.AddRequest()
+	if err != nil {
+		return err
+	}
+	log.Printf("[vmrunner] adding Plan9 share %q (%s) to VM %q", share.Name, share.HostPath, v.id)
+	return v.modify(req)
+}
+
+// UpdateMemory resizes the memory of the running VM, and the host memory
+// committed to it with it.
+func (v *VM) UpdateMemory(sizeMB uint32) error {
+	req, err := config.MemoryUpdateRequest(sizeMB)
+	if err != nil {
+		return err
+	}
+	log.Printf("[vmrunner] resizing VM %q memory to %d MB", v.id, sizeMB)
+	if err := v.modify(req); err != nil {
+		return err
+	}
+	v.commitment.resize(sizeMB)
+	return nil
+}
+
+// modify applies req to the running VM.
+func (v *VM) modify(req config.ModifySettingRequest) error {
+	if err := v.life.check("modify", StateRunning, StatePaused); err != nil {
+		return err
+	}
+	reqJSON, err := req.JSON()
+	if err != nil {
+		return err
+	}
+	if Trace {
+		log.Printf("[vmrunner] trace: modify request %s", reqJSON)
+	}
+	if err := Compute.ModifyComputeSystem(v.system.handle, reqJSON); err != nil {
+		return fmt.Errorf("modify VM %q: %w", v.id, err)
+	}
+	return nil
+}
@@ -1,5 +1,3 @@
-//go:build windows
-
 package vm
 
 import (
@@ -8,9 +6,7 @@ import (
 	"io"
 	"log"
 	"os"
-	"syscall"
-	"time"
-	"unsafe"
+	"sync"
 
 	"github.com/microsoft/hcsshim/vmrunner/internal/vmcompute"
 )
@@ -28,9 +24,57 @@ type processParams struct {
 	EmulateConsole   bool              `json:"EmulateConsole"`
 }
 
-// RunProcess runs a command inside the VM via GCS (HcsCreateProcess).
-// It streams stdout/stderr to os.Stdout/os.Stderr and returns the process exit code.
-func (v *VM) RunProcess(args []string) (int, error) {
+// processStatus is the document returned by HcsGetProcessProperties.
+type processStatus struct {
+	ProcessId      uint32 `json:"ProcessId"`
+	Exited         bool   `json:"Exited"`
+	ExitCode       uint32 `json:"ExitCode"`
+	LastWaitResult int32  `json:"LastWaitResult"`
+}
+
+// processModifyRequest is the JSON payload for HcsModifyProcess.
+type processModifyRequest struct {
+	Operation   string       `json:"Operation"`
+	ConsoleSize *consoleSize `json:"ConsoleSize,omitempty"`
+	CloseHandle *closeHandle `json:"CloseHandle,omitempty"`
+}
+
+type consoleSize struct {
+	Height uint16 `json:"Height"`
+	Width  uint16 `json:"Width"`
+}
+
+type closeHandle struct {
+	Handle string `json:"Handle"`
+}
+
+// signalOptions is the JSON payload for HcsSignalProcess.
+type signalOptions struct {
+	Signal int `json:"Signal"`
+}
+
+// Process is a process running inside the VM, created via GCS.
+type Process struct {
+	handle *processHandle
+	pid    uint32
+
+	stdin  *os.File
+	stdout *os.File
+	stderr *os.File
+
+	unregister func()
+	exited     chan struct{} // closed once exitCode/exitErr are set
+	closed     chan struct{} // closed by Close
+	exitCode   int
+	exitErr    error
+
+	stdinOnce sync.Once
+	closeOnce sync.Once
+}
+
+// StartProcess creates args[0] inside the VM via GCS (HcsCreateProcess) with
+// stdio pipes. The caller must Close the returned Process.
+func (v *VM) StartProcess(args []string, emulateConsole bool) (*Process, error) {
 	if len(args) == 0 {
 		args = []string{"/bin/sh"}
 	}
@@ -42,367 +86,279 @@ func (v *VM) RunProcess(args []string) (int, error) {
 		WorkingDirectory: "/",
 		CreateStdInPipe:  true,
 		CreateStdOutPipe: true,
-		CreateStdErrPipe: true,
-		EmulateConsole:   false,
+		CreateStdErrPipe: !emulateConsole,
+		EmulateConsole:   emulateConsole,
 	}
 
 	paramsJSON, err := json.Marshal(params)
 	if err != nil {
-		return -1, fmt.Errorf("marshal process params: %w", err)
+		return nil, fmt.Errorf("marshal process params: %w", err)
 	}
 
 	log.Printf("[vmrunner] creating process via GCS: %s", cmdLine)
-	proc, info, err := vmcompute.HcsCreateProcess(v.system, string(paramsJSON))
+	handle, info, err := createProcess(v.system, cmdLine, string(paramsJSON))
 	if err != nil {
-		return -1, fmt.Errorf("HcsCreateProcess: %w", err)
+		return nil, fmt.Errorf("HcsCreateProcess: %w", err)
 	}
-	defer vmcompute.HcsCloseProcess(proc)
 
 	// GCS stdio handles are not returned by this HCS API version.
 	// Fail fast so the caller can fall back to the serial console.
 	if info.StdInput == 0 && info.StdOutput == 0 {
-		return -1, fmt.Errorf("GCS stdio handles not available; use serial console")
+		_ = handle.Close()
+		return nil, fmt.Errorf("GCS stdio handles not available; use serial console")
 	}
 
-	stdin  := os.NewFile(uintptr(info.StdInput),  "stdin")
-	stdout := os.NewFile(uintptr(info.StdOutput), "stdout")
-	stderr := os.NewFile(uintptr(info.StdError),  "stderr")
-
-	go func() {
-		defer stdin.Close()
-		io.Copy(stdin, os.Stdin)
-	}()
-
-	done := make(chan struct{})
-	go func() {
-		io.Copy(os.Stdout, stdout)
-		close(done)
-	}()
-	go io.Copy(os.Stderr, stderr)
-
-	<-done
-	stdout.Close()
-	stderr.Close()
-	return 0, nil
-}
-
-// InteractiveShell opens the serial console named pipe and connects it to the
-// terminal bidirectionally (stdin ↔ pipe, pipe → stdout).
-//
-// The pipe is opened with FILE_FLAG_OVERLAPPED so that concurrent ReadFile and
-// WriteFile on the same handle do not serialize.
-//
-// Console mode is switched to raw VTI inside stdinToPipe via prepareRawConsole.
-// ReadFile is used directly on the console HANDLE (not os.Stdin.Read / ReadConsole)
-// to avoid the ConPTY/Windows Terminal bug where SetConsoleMode causes indefinite
-// blocking when going through the ReadConsole path.
-func (v *VM) InteractiveShell(pipeName string) error {
-	h, err := openOverlappedPipeWithRetry(pipeName, 30*time.Second)
+	exited := make(chan error, 1)
+	unregister, err := Compute.NotifyProcess(handle.handle, func(n vmcompute.Notification) {
+		if n.Type != vmcompute.NotificationProcessExited {
+			return
+		}
+		select {
+		case exited <- n.Err():
+		default:
+		}
+	})
 	if err != nil {
-		return fmt.Errorf("open console pipe %q: %w", pipeName, err)
+		_ = handle.Close()
+		return nil, fmt.Errorf("register process exit callback: %w", err)
 	}
-	defer syscall.CloseHandle(h)
-
-	log.Printf("[vmrunner] connected to serial console %q", pipeName)
-
-	readerDone := make(chan error, 1)
-	go func() { readerDone <- pipeToStdout(h) }()
 
-	writerDone := make(chan error, 1)
-	go func() { writerDone <- stdinToPipe(h) }()
-
-	select {
-	case err := <-readerDone:
-		return err
-	case err := <-writerDone:
-		return err
+	p := &Process{
+		handle:     handle,
+		pid:        info.ProcessId,
+		stdin:      os.NewFile(uintptr(info.StdInput), "stdin"),
+		stdout:     os.NewFile(uintptr(info.StdOutput), "stdout"),
+		unregister: unregister,
+		exited:     make(chan struct{}),
+		closed:     make(chan struct{}),
+	}
+	if info.StdError != 0 {
+		p.stderr = os.NewFile(uintptr(info.StdError), "stderr")
 	}
+	go p.waitExit(exited)
+	return p, nil
 }
 
-// RunCommand sends a command over the serial console pipe and prints the output
-// until a shell prompt is detected.
-func (v *VM) RunCommand(pipeName string, args []string) error {
-	f, err := openSyncPipeWithRetry(pipeName, 30*time.Second)
+// waitExit records the exit code once the process-exited notification fires.
+func (p *Process) waitExit(exited <-chan error) {
+	defer close(p.exited)
+
+	// The process may have exited before the callback was registered, in
+	// which case no notification will ever arrive.
+	status, err := p.status()
+	if err == nil && !status.Exited {
+		select {
+		case err = <-exited:
+		case <-p.closed:
+			p.exitCode, p.exitErr = -1, fmt.Errorf("process handle closed before exit")
+			return
+		}
+		if err == nil {
+			status, err = p.status()
+		}
+	}
 	if err != nil {
-		return fmt.Errorf("open console pipe %q: %w", pipeName, err)
+		p.exitCode, p.exitErr = -1, err
+		return
 	}
-	defer f.Close()
+	p.exitCode = int(int32(status.ExitCode))
+}
 
-	// Wait for initial prompt.
-	if err := waitForPrompt(f); err != nil {
-		return fmt.Errorf("wait for prompt: %w", err)
+func (p *Process) status() (processStatus, error) {
+	var status processStatus
+	props, err := Compute.GetProcessProperties(p.handle.handle)
+	if err != nil {
+		return status, fmt.Errorf("HcsGetProcessProperties: %w", err)
 	}
-
-	cmd := shellJoin(args) + "\n"
-	if _, err := fmt.Fprint(f, cmd); err != nil {
-		return fmt.Errorf("write command: %w", err)
+	if err := json.Unmarshal([]byte(props), &status); err != nil {
+		return status, fmt.Errorf("parse process properties: %w", err)
 	}
+	return status, nil
+}
 
-	// Read until next prompt.
-	return collectUntilPrompt(f, os.Stdout)
+// Pid returns the guest process ID.
+func (p *Process) Pid() uint32 {
+	return p.pid
 }
 
-// Trace enables verbose I/O trace logging. Set via -trace flag in main.
-var Trace bool
+// Stdin returns the write end of the process's stdin pipe.
+func (p *Process) Stdin() io.Writer {
+	return p.stdin
+}
 
-// kernel32 procedures for named pipe I/O and overlapped I/O.
-var (
-	kernel32                = syscall.NewLazyDLL("kernel32.dll")
-	procCreateFileW         = kernel32.NewProc("CreateFileW")
-	procCreateEventW        = kernel32.NewProc("CreateEventW")
-	procGetOverlappedResult = kernel32.NewProc("GetOverlappedResult")
-	procGetConsoleMode      = kernel32.NewProc("GetConsoleMode")
-	procSetConsoleMode      = kernel32.NewProc("SetConsoleMode")
-)
+// Stdout returns the read end of the process's stdout pipe.
+func (p *Process) Stdout() io.Reader {
+	return p.stdout
+}
 
-const (
-	genericReadWrite    = 0xC0000000 // GENERIC_READ | GENERIC_WRITE
-	openExisting        = 3
-	fileAttributeNormal = 0x80
-	fileFlagOverlapped  = 0x40000000
+// Stderr returns the read end of the process's stderr pipe, or nil for a
+// process created with an emulated console (stderr is merged into stdout).
+func (p *Process) Stderr() io.Reader {
+	if p.stderr == nil {
+		return nil
+	}
+	return p.stderr
+}
 
-	enableProcessedInput   = 0x0001 // keep Ctrl+C → SIGINT
-	enableLineInput        = 0x0002 // line-buffering (remove for char-at-a-time)
-	enableEchoInput        = 0x0004 // local echo (remove to prevent double echo)
-	enableVirtualTermInput = 0x0200 // VTI mode: ReadFile returns VT sequences
-)
+// Wait blocks until the process exits and returns any error encountered while
+// waiting. It does not treat a non-zero exit code as an error; use ExitCode.
+func (p *Process) Wait() error {
+	<-p.exited
+	return p.exitErr
+}
 
-// openOverlappedPipe opens a named pipe with FILE_FLAG_OVERLAPPED so that
-// concurrent ReadFile and WriteFile on the same handle do not serialize.
-func openOverlappedPipe(name string) (syscall.Handle, error) {
-	namePtr, err := syscall.UTF16PtrFromString(name)
+// ExitCode returns the process exit code. It fails if the process has not
+// exited yet.
+func (p *Process) ExitCode() (int, error) {
+	select {
+	case <-p.exited:
+		return p.exitCode, p.exitErr
+	default:
+		return -1, fmt.Errorf("process %d has not exited", p.pid)
+	}
+}
+
+// Signal delivers a Linux signal number (e.g. 15 for SIGTERM) to the process.
+func (p *Process) Signal(sig int) error {
+	b, err := json.Marshal(signalOptions{Signal: sig})
 	if err != nil {
-		return syscall.InvalidHandle, err
+		return err
 	}
-	h, _, lastErr := procCreateFileW.Call(
-		uintptr(unsafe.Pointer(namePtr)),
-		genericReadWrite,
-		0,
-		0,
-		openExisting,
-		fileAttributeNormal|fileFlagOverlapped,
-		0,
-	)
-	if syscall.Handle(h) == syscall.InvalidHandle {
-		return syscall.InvalidHandle, lastErr
+	if err := Compute.SignalProcess(p.handle.handle, string(b)); err != nil {
+		return fmt.Errorf("HcsSignalProcess: %w", err)
 	}
-	return syscall.Handle(h), nil
+	return nil
 }
 
-// openOverlappedPipeWithRetry retries every 100 ms until timeout.
-func openOverlappedPipeWithRetry(name string, timeout time.Duration) (syscall.Handle, error) {
-	deadline := time.Now().Add(timeout)
-	for time.Now().Before(deadline) {
-		h, err := openOverlappedPipe(name)
-		if err == nil {
-			return h, nil
+// ResizeConsole sets the console size of a process created with an emulated
+// console.
+func (p *Process) ResizeConsole(width, height uint16) error {
+	return p.modify(processModifyRequest{
+		Operation:   "ConsoleSize",
+		ConsoleSize: &consoleSize{Height: height, Width: width},
+	})
+}
+
+// CloseStdin closes the process's stdin so that it sees EOF.
+func (p *Process) CloseStdin() error {
+	var err error
+	p.stdinOnce.Do(func() {
+		err = p.modify(processModifyRequest{
+			Operation:   "CloseHandle",
+			CloseHandle: &closeHandle{Handle: "StdIn"},
+		})
+		if closeErr := p.stdin.Close(); err == nil {
+			err = closeErr
 		}
-		time.Sleep(100 * time.Millisecond)
-	}
-	return syscall.InvalidHandle, fmt.Errorf("timed out waiting for pipe %q after %s", name, timeout)
+	})
+	return err
 }
 
-// openSyncPipe opens a named pipe in synchronous (non-overlapped) mode.
-// Suitable for RunCommand where reads and writes are sequential.
-func openSyncPipe(name string) (*os.File, error) {
-	namePtr, err := syscall.UTF16PtrFromString(name)
+func (p *Process) modify(req processModifyRequest) error {
+	b, err := json.Marshal(req)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	h, _, lastErr := procCreateFileW.Call(
-		uintptr(unsafe.Pointer(namePtr)),
-		genericReadWrite,
-		0,
-		0,
-		openExisting,
-		fileAttributeNormal,
-		0,
-	)
-	if syscall.Handle(h) == syscall.InvalidHandle {
-		return nil, lastErr
+	if err := Compute.ModifyProcess(p.handle.handle, string(b)); err != nil {
+		return fmt.Errorf("HcsModifyProcess %s: %w", req.Operation, err)
 	}
-	return os.NewFile(h, name), nil
+	return nil
 }
 
-// openSyncPipeWithRetry retries every 100 ms until timeout.
-func openSyncPipeWithRetry(name string, timeout time.Duration) (*os.File, error) {
-	deadline := time.Now().Add(timeout)
-	for time.Now().Before(deadline) {
-		f, err := openSyncPipe(name)
-		if err == nil {
-			return f, nil
-		}
-		time.Sleep(100 * time.Millisecond)
-	}
-	return nil, fmt.Errorf("timed out waiting for pipe %q after %s", name, timeout)
+// Kill forcibly terminates the process.
+func (p *Process) Kill() error {
+	return Compute.TerminateProcess(p.handle.handle)
 }
 
-// createEvent creates a Win32 auto-reset, initially non-signaled event object.
-func createEvent() (syscall.Handle, error) {
-	h, _, lastErr := procCreateEventW.Call(0, 0, 0, 0)
-	if h == 0 {
-		return syscall.InvalidHandle, lastErr
-	}
-	return syscall.Handle(h), nil
+// Close releases the stdio pipes and the process handle. It does not
+// terminate the process.
+func (p *Process) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		p.unregister()
+		p.stdinOnce.Do(func() { p.stdin.Close() })
+		p.stdout.Close()
+		if p.stderr != nil {
+			p.stderr.Close()
+		}
+		err = p.handle.Close()
+	})
+	return err
 }
 
-// isPipeClose reports whether err means the remote end closed or disconnected.
-func isPipeClose(err error) bool {
-	if err == io.EOF {
-		return true
-	}
-	if e, ok := err.(syscall.Errno); ok {
-		return e == 109 || e == 233 // ERROR_BROKEN_PIPE, ERROR_PIPE_NOT_CONNECTED
-	}
-	return false
+// RunProcess runs a command inside the VM via GCS (HcsCreateProcess).
+// It streams stdout/stderr to os.Stdout/os.Stderr and returns the process exit code.
+func (v *VM) RunProcess(args []string) (int, error) {
+	return v.RunProcessIO(args, os.Stdin, os.Stdout, os.Stderr)
 }
 
-// pipeToStdout reads from h using overlapped I/O and writes to stdout.
-func pipeToStdout(h syscall.Handle) error {
-	ev, err := createEvent()
+// RunProcessIO is RunProcess with explicit stdio. A nil stdin closes the
+// process's stdin immediately.
+func (v *VM) RunProcessIO(args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	p, err := v.StartProcess(args, false)
 	if err != nil {
-		return fmt.Errorf("createEvent: %w", err)
+		return -1, err
 	}
-	defer syscall.CloseHandle(ev)
+	defer p.Close()
 
-	buf := make([]byte, 4096)
-	for {
-		var ol syscall.Overlapped
-		ol.HEvent = ev
-
-		var n uint32
-		err := syscall.ReadFile(h, buf, &n, &ol)
-		if err == syscall.ERROR_IO_PENDING {
-			syscall.WaitForSingleObject(ev, syscall.INFINITE)
-			r, _, lastErr := procGetOverlappedResult.Call(uintptr(h), uintptr(unsafe.Pointer(&ol)), uintptr(unsafe.Pointer(&n)), 0)
-			if r == 0 {
-				err = lastErr
-			} else {
-				err = nil
-			}
-		}
-		if err != nil {
-			if isPipeClose(err) {
-				return nil
-			}
-			return err
-		}
-		if n > 0 {
-			os.Stdout.Write(buf[:n])
+	go func() {
+		if stdin != nil {
+			io.Copy(p.stdin, stdin)
 		}
+		p.CloseStdin()
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(stdout, p.stdout)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(stderr, p.stderr)
+	}()
+
+	if err := p.Wait(); err != nil {
+		return -1, err
 	}
+	wg.Wait()
+	return p.ExitCode()
 }
 
-// prepareRawConsole puts the Windows console stdin handle into raw VTI mode
-// (no local echo, no line buffering) and returns the raw HANDLE, a restore
-// function, and whether stdin is actually a console.
-//
-// ENABLE_PROCESSED_INPUT is kept so Ctrl+C continues to generate SIGINT.
-// ReadFile on the returned handle bypasses ReadConsole, avoiding the
-// ConPTY / Windows Terminal bug where SetConsoleMode causes indefinite blocking.
-func prepareRawConsole() (h syscall.Handle, restore func(), isConsole bool) {
-	stdinH, err := syscall.GetStdHandle(syscall.STD_INPUT_HANDLE)
-	if err != nil {
-		return syscall.InvalidHandle, nil, false
+// RunCommand sends a command over a connected serial console, such as a
+// vmrunnerd console session, and copies the output to w until a shell prompt
+// is detected. The shell may be sitting at a prompt printed before console
+// was connected, so a blank line is sent first to get a fresh one.
+func RunCommand(console io.ReadWriter, args []string, w io.Writer) error {
+	if _, err := io.WriteString(console, "\n"); err != nil {
+		return fmt.Errorf("write to console: %w", err)
 	}
-	var old uint32
-	r, _, _ := procGetConsoleMode.Call(uintptr(stdinH), uintptr(unsafe.Pointer(&old)))
-	if r == 0 {
-		// stdin is not a console (redirected pipe, file, etc.)
-		return syscall.InvalidHandle, nil, false
+	if err := waitForPrompt(console, io.Discard); err != nil {
+		return fmt.Errorf("wait for prompt: %w", err)
 	}
-	newMode := (old &^ (enableLineInput | enableEchoInput)) | enableVirtualTermInput
-	procSetConsoleMode.Call(uintptr(stdinH), uintptr(newMode))
-	return stdinH, func() { procSetConsoleMode.Call(uintptr(stdinH), uintptr(old)) }, true
-}
 
-// stdinToPipe reads from stdin and writes to h using overlapped I/O.
-// CR (\r) and CRLF (\r\n) are converted to LF (\n) for the Linux tty.
-//
-// When stdin is a Windows console, the console is put into raw VTI mode
-// (no local echo, no line buffering) and ReadFile is used directly on the
-// console handle. This bypasses the ReadConsole path that causes indefinite
-// blocking under ConPTY/Windows Terminal after any SetConsoleMode call.
-func stdinToPipe(h syscall.Handle) error {
-	ev, err := createEvent()
-	if err != nil {
-		return fmt.Errorf("createEvent: %w", err)
+	cmd := shellJoin(args) + "\n"
+	if _, err := fmt.Fprint(console, cmd); err != nil {
+		return fmt.Errorf("write command: %w", err)
 	}
-	defer syscall.CloseHandle(ev)
 
-	// Switch the console to raw VTI mode (removes local echo and line
-	// buffering). Falls back gracefully when stdin is redirected.
-	stdinH, restore, isConsole := prepareRawConsole()
-	if restore != nil {
-		defer restore()
-	}
+	// Read until next prompt.
+	return collectUntilPrompt(console, w)
+}
 
-	inBuf  := make([]byte, 256)
-	outBuf := make([]byte, 0, 256)
-	prevCR := false
+// Trace enables verbose I/O trace logging. Set via -trace flag in main.
+var Trace bool
 
-	for {
-		var n uint32
-		var readErr error
-		if isConsole {
-			// Use ReadFile directly on the console HANDLE so we bypass
-			// ReadConsole — which hangs in ConPTY after SetConsoleMode.
-			readErr = syscall.ReadFile(stdinH, inBuf, &n, nil)
-		} else {
-			nn, e := os.Stdin.Read(inBuf)
-			n, readErr = uint32(nn), e
-		}
-		if int(n) > 0 {
-			outBuf = outBuf[:0]
-			for _, b := range inBuf[:n] {
-				switch {
-				case b == '\r':
-					outBuf = append(outBuf, '\n')
-					prevCR = true
-				case b == '\n' && prevCR:
-					// CRLF: drop the LF, CR was already converted above.
-					prevCR = false
-				default:
-					prevCR = false
-					outBuf = append(outBuf, b)
-				}
-			}
-			if len(outBuf) > 0 {
-				var ol syscall.Overlapped
-				ol.HEvent = ev
-				var written uint32
-				werr := syscall.WriteFile(h, outBuf, &written, &ol)
-				if werr == syscall.ERROR_IO_PENDING {
-					syscall.WaitForSingleObject(ev, syscall.INFINITE)
-					r, _, lastErr := procGetOverlappedResult.Call(uintptr(h), uintptr(unsafe.Pointer(&ol)), uintptr(unsafe.Pointer(&written)), 0)
-					if r == 0 {
-						werr = lastErr
-					} else {
-						werr = nil
-					}
-				}
-				if Trace {
-					log.Printf("[vmrunner] trace: stdin→pipe %q written=%d", outBuf, written)
-				}
-				if werr != nil {
-					if isPipeClose(werr) {
-						return nil
-					}
-					return werr
-				}
-			}
-		}
-		if readErr != nil {
-			if readErr == io.EOF {
-				return nil
-			}
-			return readErr
-		}
-	}
-}
+// OpenConsole opens the serial console named pipe of a VM, retrying until
+// timeout while the pipe does not exist yet. One Read and one Write may be
+// in progress at once. main replaces it for --dry-run; tests substitute an
+// in-memory console.
+var OpenConsole = openConsole
 
-// waitForPrompt reads from r until it sees a shell prompt (# or $).
-func waitForPrompt(r io.Reader) error {
+// waitForPrompt copies r to w until it sees a shell prompt (# or $).
+func waitForPrompt(r io.Reader, w io.Writer) error {
 	buf := make([]byte, 1)
 	var last byte
 	for {
@@ -410,7 +366,7 @@ func waitForPrompt(r io.Reader) error {
 		if err != nil {
 			return err
 		}
-		os.Stdout.Write(buf)
+		w.Write(buf)
 		if (buf[0] == '#' || buf[0] == '$') && last == ' ' {
 			return nil
 		}
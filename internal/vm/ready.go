@@ -0,0 +1,328 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Readiness probe kinds.
+const (
+	ProbeRegex  = "regex"  // console output matches a regular expression
+	ProbePrompt = "prompt" // a shell prompt appears on the console
+	ProbeMarker = "marker" // init echoes a marker string to the console
+	ProbeVsock  = "vsock"  // a guest service accepts connections on a vsock port
+)
+
+// DefaultReadyTimeout bounds a readiness wait without a timeout of its own.
+const DefaultReadyTimeout = 2 * time.Minute
+
+// DefaultReadyMarker is what the marker probe looks for when given nothing
+// else: images built for vmrunner echo it from /etc/vmrunner-ready at the
+// end of init.
+const DefaultReadyMarker = "VMRUNNER-READY"
+
+// Console output kept for readiness probes and for the error of a failed
+// wait: probes match against readyWindow bytes, errors quote readyTailLines
+// lines of it.
+const (
+	readyWindow    = 4096
+	readyTailLines = 20
+)
+
+// promptNudge is how often the prompt probe sends a blank line, so that a
+// shell that printed its prompt before anyone was listening prints another.
+const promptNudge = 5 * time.Second
+
+// vsockRetry is the pause between connection attempts of the vsock probe.
+const vsockRetry = 500 * time.Millisecond
+
+// errVsockUnsupported is returned by dialVsock where there are no Hyper-V
+// sockets.
+var errVsockUnsupported = errors.New("vsock probes are not supported on this platform")
+
+// promptPattern matches a shell prompt at the end of the console output.
+var promptPattern = regexp.MustCompile(`[#$] ?$`)
+
+// ReadyProbe decides when a booting guest is ready for use.
+type ReadyProbe struct {
+	Kind string
+	// Pattern is the expression of a regex probe or the marker of a
+	// marker probe.
+	Pattern string `json:",omitempty"`
+	// Port is the vsock port of a vsock probe.
+	Port uint32 `json:",omitempty"`
+}
+
+// ParseReadyProbe parses a probe given on the command line:
+//
+//	prompt
+//	regex:<expression>
+//	marker[:<text>]     (default DefaultReadyMarker)
+//	vsock:<port>
+func ParseReadyProbe(s string) (ReadyProbe, error) {
+	kind, arg, hasArg := strings.Cut(s, ":")
+	p := ReadyProbe{Kind: kind}
+	switch kind {
+	case ProbePrompt:
+		if hasArg {
+			return ReadyProbe{}, fmt.Errorf("ready probe %q: prompt takes no argument", s)
+		}
+	case ProbeRegex:
+		p.Pattern = arg
+	case ProbeMarker:
+		p.Pattern = arg
+		if p.Pattern == "" {
+			p.Pattern = DefaultReadyMarker
+		}
+	case ProbeVsock:
+		port, err := strconv.ParseUint(arg, 10, 32)
+		if err != nil {
+			return ReadyProbe{}, fmt.Errorf("ready probe %q: invalid vsock port", s)
+		}
+		p.Port = uint32(port)
+	default:
+		return ReadyProbe{}, fmt.Errorf("ready probe %q: want prompt, regex:<expr>, marker[:<text>] or vsock:<port>", s)
+	}
+	return p, p.Validate()
+}
+
+func (p ReadyProbe) String() string {
+	switch p.Kind {
+	case ProbePrompt:
+		return p.Kind
+	case ProbeVsock:
+		return fmt.Sprintf("%s:%d", p.Kind, p.Port)
+	default:
+		return p.Kind + ":" + p.Pattern
+	}
+}
+
+// Validate checks that p is complete and, for a regex probe, compiles.
+func (p ReadyProbe) Validate() error {
+	switch p.Kind {
+	case ProbePrompt:
+	case ProbeRegex:
+		if p.Pattern == "" {
+			return fmt.Errorf("ready probe %s: expression required", p)
+		}
+		if _, err := regexp.Compile(p.Pattern); err != nil {
+			return fmt.Errorf("ready probe %s: %w", p, err)
+		}
+	case ProbeMarker:
+		if p.Pattern == "" {
+			return fmt.Errorf("ready probe %s: marker required", p)
+		}
+	case ProbeVsock:
+		if p.Port == 0 {
+			return fmt.Errorf("ready probe %s: port required", p)
+		}
+	default:
+		return fmt.Errorf("unknown ready probe %q", p.Kind)
+	}
+	return nil
+}
+
+// match returns the function deciding from recent console output whether
+// the guest is ready, or nil for a probe that does not watch the console.
+func (p ReadyProbe) match() func([]byte) bool {
+	switch p.Kind {
+	case ProbePrompt:
+		return promptPattern.Match
+	case ProbeRegex:
+		return regexp.MustCompile(p.Pattern).Match
+	case ProbeMarker:
+		marker := []byte(p.Pattern)
+		return func(b []byte) bool { return bytes.Contains(b, marker) }
+	default:
+		return nil
+	}
+}
+
+// ReadyOptions says how to wait for a VM to be ready.
+type ReadyOptions struct {
+	Probe ReadyProbe
+	// Timeout bounds the wait; 0 means DefaultReadyTimeout.
+	Timeout time.Duration
+}
+
+// NotReadyError is returned when a VM exits or times out before its
+// readiness probe succeeds. Tail is the last console output seen.
+type NotReadyError struct {
+	ID     string
+	Probe  string
+	Reason string
+	Tail   string
+}
+
+func (e *NotReadyError) Error() string {
+	msg := fmt.Sprintf("VM %q not ready (probe %s): %s", e.ID, e.Probe, e.Reason)
+	if e.Tail == "" {
+		return msg + "\n(no console output)"
+	}
+	return msg + "\n--- last console output ---\n" + e.Tail
+}
+
+// WaitReady waits for opts.Probe to succeed on the running VM. console is a session on its serial console,
+// such as a vmrunnerd one; it is read for every probe so that a failure can
+// quote the guest's last words. It returns a *NotReadyError if the VM exits,
+// the probe fails for good or time runs out.
+func (v *VM) WaitReady(console io.ReadWriter, opts ReadyOptions) error {
+	probe, timeout := opts.Probe, opts.Timeout
+	if err := probe.Validate(); err != nil {
+		return err
+	}
+	if err := v.life.check("wait for", StateRunning); err != nil {
+		return err
+	}
+	if timeout <= 0 {
+		timeout = DefaultReadyTimeout
+	}
+	events, cancel := v.Events()
+	defer cancel()
+
+	out := &recentOutput{}
+	result := make(chan error, 2)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	match := probe.match()
+	if console != nil {
+		go func() {
+			err := out.scan(console, match)
+			if match == nil {
+				return // only feeds the tail
+			}
+			if err != nil {
+				err = fmt.Errorf("console: %w", err)
+			}
+			result <- err
+		}()
+	} else if match != nil {
+		return fmt.Errorf("ready probe %s: VM %q has no console", probe, v.id)
+	}
+	if probe.Kind == ProbePrompt {
+		go nudge(console, stop)
+	}
+	if probe.Kind == ProbeVsock {
+		go func() { result <- v.pingVsock(probe.Port, stop) }()
+	}
+
+	notReady := func(reason string) error {
+		return &NotReadyError{ID: v.id, Probe: probe.String(), Reason: reason, Tail: out.tail(readyTailLines)}
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var last Event
+	for {
+		select {
+		case err := <-result:
+			if err != nil {
+				return notReady(err.Error())
+			}
+			return nil
+		case ev, ok := <-events:
+			if ok {
+				last = ev
+				continue
+			}
+			if last.Err != nil {
+				return notReady(fmt.Sprintf("VM exited (%s): %v", v.State(), last.Err))
+			}
+			return notReady(fmt.Sprintf("VM exited (%s)", v.State()))
+		case <-timer.C:
+			return notReady(fmt.Sprintf("timed out after %s", timeout))
+		}
+	}
+}
+
+// nudge sends console a blank line now and every promptNudge until stop
+// closes.
+func nudge(console io.Writer, stop <-chan struct{}) {
+	ticker := time.NewTicker(promptNudge)
+	defer ticker.Stop()
+	for {
+		if _, err := io.WriteString(console, "\n"); err != nil {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// pingVsock connects to port in the guest until a connection succeeds or
+// stop closes.
+func (v *VM) pingVsock(port uint32, stop <-chan struct{}) error {
+	s, err := lookup(v.id)
+	if err != nil {
+		return err
+	}
+	if s == nil || s.RuntimeId == "" {
+		return fmt.Errorf("no runtime ID for VM %q", v.id)
+	}
+	for {
+		err := dialVsock(s.RuntimeId, port)
+		if err == nil {
+			return nil
+		}
+		if err == errVsockUnsupported {
+			return err
+		}
+		select {
+		case <-time.After(vsockRetry):
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// recentOutput keeps the last readyWindow bytes read from a console.
+type recentOutput struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+// scan reads r until match reports a match on the recent output (returning
+// nil) or r fails. A nil match only records output.
+func (o *recentOutput) scan(r io.Reader, match func([]byte) bool) error {
+	chunk := make([]byte, 1024)
+	for {
+		n, err := r.Read(chunk)
+		if n > 0 {
+			o.mu.Lock()
+			o.buf = append(o.buf, chunk[:n]...)
+			if len(o.buf) > readyWindow {
+				o.buf = append(o.buf[:0], o.buf[len(o.buf)-readyWindow:]...)
+			}
+			matched := match != nil && match(o.buf)
+			o.mu.Unlock()
+			if matched {
+				return nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// tail returns the last n lines of the recent output.
+func (o *recentOutput) tail(n int) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	s := strings.TrimRight(strings.ReplaceAll(string(o.buf), "\r\n", "\n"), "\n")
+	lines := strings.Split(s, "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,111 @@
+package vm
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/config"
+	"github.com/microsoft/hcsshim/vmrunner/internal/handles/handlestest"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vmcompute"
+)
+
+// traceConfig is the configuration the VM of testdata/start-exec-list.jsonl
+// was started with.
+var traceConfig = config.VMConfig{
+	VMID:     "trace-vm",
+	ImageDir: `C:\vmrunner\images\alpine`,
+	MemoryMB: 1024,
+	CPUCount: 2,
+}
+
+// replay points Compute at the trace in file for the duration of the test.
+func replay(t *testing.T, file string) *vmcompute.Replay {
+	t.Helper()
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	p, err := vmcompute.NewReplay(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compute, hostStats := Compute, HostStatsFunc
+	Compute, HostStatsFunc = p, nil
+	t.Cleanup(func() { Compute, HostStatsFunc = compute, hostStats })
+	return p
+}
+
+func listIDs(t *testing.T) []string {
+	t.Helper()
+	systems, err := Systems(ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, s := range systems {
+		ids = append(ids, s.Id)
+	}
+	return ids
+}
+
+// TestReplayStartExecList replays a session that lists VMs, starts one, runs
+// a command in it, closes it and lists again. The command exits as its exit
+// callback is registered, so the exit is only seen if the replay delivers the
+// notification recorded after the registration to the new subscriber.
+func TestReplayStartExecList(t *testing.T) {
+	handlestest.Check(t)
+	p := replay(t, "testdata/start-exec-list.jsonl")
+
+	if ids := listIDs(t); len(ids) != 0 {
+		t.Fatalf("before start: listed %q", ids)
+	}
+	v, err := Start(traceConfig, StartOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	if v.State() != StateRunning {
+		t.Fatalf("state after start = %s", v.State())
+	}
+	if ids := listIDs(t); len(ids) != 1 || ids[0] != "trace-vm" {
+		t.Fatalf("after start: listed %q", ids)
+	}
+
+	proc, err := v.StartProcess([]string{"uname", "-r"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := io.ReadAll(proc.Stdout()); err != nil || len(out) != 0 {
+		t.Fatalf("replayed stdout = %q, %v; want empty", out, err)
+	}
+	waited := make(chan error, 1)
+	go func() { waited <- proc.Wait() }()
+	select {
+	case err := <-waited:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("process exit notification not delivered")
+	}
+	if code, err := proc.ExitCode(); code != 0 || err != nil {
+		t.Fatalf("exit code = %d, %v", code, err)
+	}
+	if err := proc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing the handle leaves the VM running.
+	if err := v.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if ids := listIDs(t); len(ids) != 1 {
+		t.Fatalf("after close: listed %q", ids)
+	}
+	if n := p.Remaining(); n != 0 {
+		t.Fatalf("%d trace records not replayed", n)
+	}
+}
@@ -0,0 +1,57 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// CreateScratchDisk creates the scratch disk path of VM id: a differencing
+// disk over parent that the VM can open. Dry runs replace it.
+var CreateScratchDisk = func(id, parent, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("scratch disk: %w", err)
+	}
+	if err := createDiffDisk(parent, path); err != nil {
+		return fmt.Errorf("create scratch disk %s over %s: %w", path, parent, err)
+	}
+	if err := grantVMAccess(id, path); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("grant VM %q access to %s: %w", id, path, err)
+	}
+	return nil
+}
+
+// Scratch disk removal is retried for a while: HCS may hold the file for a
+// moment after the system has exited.
+const (
+	removeAttempts = 10
+	removeInterval = 500 * time.Millisecond
+)
+
+// RemoveScratchDisk deletes the scratch disk at path. A disk that does not
+// exist is not an error.
+func RemoveScratchDisk(path string) error {
+	var err error
+	for i := 0; i < removeAttempts; i++ {
+		if i > 0 {
+			time.Sleep(removeInterval)
+		}
+		err = os.Remove(path)
+		if err == nil || errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+	}
+	return fmt.Errorf("remove scratch disk: %w", err)
+}
+
+// removeScratchAfterFailure deletes the scratch disk of a VM that failed to
+// start.
+func removeScratchAfterFailure(id, path string) {
+	if err := RemoveScratchDisk(path); err != nil {
+		log.Printf("[vmrunner] VM %q: %v", id, err)
+	}
+}
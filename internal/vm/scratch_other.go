@@ -0,0 +1,11 @@
+//go:build !windows
+
+package vm
+
+import "errors"
+
+var errDisksUnsupported = errors.New("virtual disks are only supported on Windows")
+
+func createDiffDisk(parent, path string) error { return errDisksUnsupported }
+
+func grantVMAccess(id, path string) error { return errDisksUnsupported }
@@ -0,0 +1,77 @@
+//go:build windows
+
+package vm
+
+import (
+	"syscall"
+	"unsafe"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/vmcompute"
+)
+
+var (
+	modVirtdisk           = syscall.NewLazyDLL("virtdisk.dll")
+	procCreateVirtualDisk = modVirtdisk.NewProc("CreateVirtualDisk")
+)
+
+// virtualStorageType is VIRTUAL_STORAGE_TYPE.
+type virtualStorageType struct {
+	DeviceID uint32
+	VendorID syscall.GUID
+}
+
+// createVirtualDiskParameters is CREATE_VIRTUAL_DISK_PARAMETERS, version 2.
+type createVirtualDiskParameters struct {
+	Version                   uint32
+	UniqueID                  syscall.GUID
+	MaximumSize               uint64
+	BlockSizeInBytes          uint32
+	SectorSizeInBytes         uint32
+	PhysicalSectorSizeInBytes uint32
+	ParentPath                *uint16
+	SourcePath                *uint16
+	OpenFlags                 uint32
+	ParentVirtualStorageType  virtualStorageType
+	SourceVirtualStorageType  virtualStorageType
+	ResiliencyGUID            syscall.GUID
+}
+
+// VIRTUAL_STORAGE_TYPE_DEVICE_VHDX and VIRTUAL_STORAGE_TYPE_VENDOR_MICROSOFT.
+var vhdxStorageType = virtualStorageType{
+	DeviceID: 3,
+	VendorID: syscall.GUID{Data1: 0xec984aec, Data2: 0xa0f9, Data3: 0x47e9, Data4: [8]byte{0x90, 0x1f, 0x71, 0x41, 0x5a, 0x66, 0x34, 0x5b}},
+}
+
+// createDiffDisk creates the VHDX differencing disk path over parent; size
+// and block size follow the parent.
+func createDiffDisk(parent, path string) error {
+	pathPtr, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+	parentPtr, err := syscall.UTF16PtrFromString(parent)
+	if err != nil {
+		return err
+	}
+	params := createVirtualDiskParameters{Version: 2, ParentPath: parentPtr}
+	var handle syscall.Handle
+	r, _, _ := procCreateVirtualDisk.Call(
+		uintptr(unsafe.Pointer(&vhdxStorageType)),
+		uintptr(unsafe.Pointer(pathPtr)),
+		0, // VIRTUAL_DISK_ACCESS_NONE, as version 2 requires
+		0, // default security descriptor
+		0, // CREATE_VIRTUAL_DISK_FLAG_NONE
+		0,
+		uintptr(unsafe.Pointer(&params)),
+		0, // synchronous
+		uintptr(unsafe.Pointer(&handle)),
+	)
+	if r != 0 {
+		return syscall.Errno(r)
+	}
+	return syscall.CloseHandle(handle)
+}
+
+func grantVMAccess(id, path string) error {
+	return vmcompute.GrantVmAccess(id, path)
+}
@@ -0,0 +1,162 @@
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/config"
+)
+
+// Files written into a snapshot directory by Save.
+const (
+	snapshotStateFile    = "state.vmrs"
+	snapshotManifestFile = "vmrunner-save.json"
+	snapshotVersion      = 1
+)
+
+// snapshotManifest is persisted next to the state file so that Restore can
+// recreate an identical VM without the original flags.
+type snapshotManifest struct {
+	Version  int             `json:"Version"`
+	SourceID string          `json:"SourceId"`
+	SavedAt  time.Time       `json:"SavedAt"`
+	Config   config.VMConfig `json:"Config"`
+	// Disks lists the host disk files the saved state references. They must
+	// still exist, unmodified, when the snapshot is restored.
+	Disks []string `json:"Disks"`
+}
+
+// Save pauses the VM, writes its state to dir and then terminates it, or
+// resumes it if leaveRunning is set. cfg must be the configuration the VM
+// runs with, as recorded in the state store with the disks hot-added since,
+// which restoring rebuilds the VM from.
+//
+// Leaving the VM running is only safe if it is not restored while the
+// original is still up: both would write to the same rootfs.vhdx.
+func (v *VM) Save(cfg config.VMConfig, dir string, leaveRunning bool) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return fmt.Errorf("snapshot dir: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("create snapshot dir: %w", err)
+	}
+	statePath := filepath.Join(dir, snapshotStateFile)
+	optionsJSON, err := config.BuildSaveJSON(statePath)
+	if err != nil {
+		return err
+	}
+
+	if err := v.Pause(); err != nil {
+		return err
+	}
+
+	log.Printf("[vmrunner] saving VM %q to %s", v.id, statePath)
+	if err := Compute.SaveComputeSystem(v.system.handle, optionsJSON); err != nil {
+		if resumeErr := v.Resume(); resumeErr != nil {
+			log.Printf("[vmrunner] resume after failed save: %v", resumeErr)
+		}
+		return fmt.Errorf("save VM %q: %w", v.id, err)
+	}
+
+	cfg.RestoreStatePath = ""
+	manifest := snapshotManifest{
+		Version:  snapshotVersion,
+		SourceID: v.id,
+		SavedAt:  time.Now().UTC(),
+		Config:   cfg,
+		Disks:    snapshotDisks(cfg),
+	}
+	if err := writeSnapshotManifest(dir, manifest); err != nil {
+		return err
+	}
+
+	if leaveRunning {
+		return v.Resume()
+	}
+	log.Printf("[vmrunner] terminating saved VM %q", v.id)
+	return v.Terminate()
+}
+
+// ReadSnapshot returns the configuration that restores the VM saved in dir,
+// under newID if it is non-empty, once it has checked that the disks the
+// saved state references still exist. Start the VM with Restore.
+func ReadSnapshot(dir, newID string) (config.VMConfig, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return config.VMConfig{}, fmt.Errorf("snapshot dir: %w", err)
+	}
+	manifest, err := readSnapshotManifest(dir)
+	if err != nil {
+		return config.VMConfig{}, err
+	}
+	for _, disk := range manifest.Disks {
+		if _, err := os.Stat(disk); err != nil {
+			return config.VMConfig{}, fmt.Errorf("snapshot disk: %w", err)
+		}
+	}
+
+	cfg := manifest.Config
+	if newID != "" {
+		cfg.VMID = newID
+	}
+	cfg.PipeName = config.ConsolePipe(cfg.VMID)
+	cfg.RestoreStatePath = filepath.Join(dir, snapshotStateFile)
+	log.Printf("[vmrunner] snapshot %s: VM %q saved %s", dir, manifest.SourceID, manifest.SavedAt.Format(time.RFC3339))
+	return cfg, nil
+}
+
+// Restore creates and starts a VM from the saved state cfg, as returned by
+// ReadSnapshot, points to; opts apply as for Start.
+func Restore(cfg config.VMConfig, opts StartOptions) (*VM, error) {
+	if cfg.RestoreStatePath == "" {
+		return nil, fmt.Errorf("restore VM %q: no saved state", cfg.VMID)
+	}
+	log.Printf("[vmrunner] restoring VM %q from %s", cfg.VMID, cfg.RestoreStatePath)
+	return Start(cfg, opts)
+}
+
+// snapshotDisks returns the disks the saved state of a VM running with cfg
+// references: its root disk and those attached to it since.
+func snapshotDisks(cfg config.VMConfig) []string {
+	disks := []string{config.RootDiskPath(cfg)}
+	for _, d := range cfg.Disks {
+		disks = append(disks, d.Path)
+	}
+	return disks
+}
+
+func writeSnapshotManifest(dir string, m snapshotManifest) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal snapshot manifest: %w", err)
+	}
+	path := filepath.Join(dir, snapshotManifestFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return fmt.Errorf("write snapshot manifest: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("write snapshot manifest: %w", err)
+	}
+	return nil
+}
+
+func readSnapshotManifest(dir string) (snapshotManifest, error) {
+	var m snapshotManifest
+	b, err := os.ReadFile(filepath.Join(dir, snapshotManifestFile))
+	if err != nil {
+		return m, fmt.Errorf("read snapshot manifest: %w", err)
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return m, fmt.Errorf("parse snapshot manifest: %w", err)
+	}
+	if m.Version != snapshotVersion {
+		return m, fmt.Errorf("snapshot manifest version %d not supported (want %d)", m.Version, snapshotVersion)
+	}
+	return m, nil
+}
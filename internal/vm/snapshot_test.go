@@ -0,0 +1,75 @@
+package vm
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/config"
+)
+
+// TestSnapshotRoundTrip checks that a snapshot lists every disk the VM has
+// attached, and restores the VM with them all, as long as they exist.
+func TestSnapshotRoundTrip(t *testing.T) {
+	f := useFake(t)
+	images := t.TempDir()
+	cfg := testConfig("vm1")
+	cfg.ImageDir = images
+	cfg.Restart = config.RestartPolicy{Name: config.RestartOnFailure}
+	data := config.SCSIDisk{LUN: 1, Path: filepath.Join(images, "data.vhdx")}
+	cfg.Disks = []config.SCSIDisk{data}
+	for _, disk := range []string{config.RootDiskPath(cfg), data.Path} {
+		if err := os.WriteFile(disk, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	v, err := Start(cfg, StartOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	dir := t.TempDir()
+	if err := v.Save(cfg, dir, false); err != nil {
+		t.Fatal(err)
+	}
+	if f.Exists("vm1") {
+		t.Fatal("saved VM still running")
+	}
+	manifest, err := readSnapshotManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{config.RootDiskPath(cfg), data.Path}; !reflect.DeepEqual(manifest.Disks, want) {
+		t.Fatalf("manifest disks %q, want %q", manifest.Disks, want)
+	}
+
+	restored, err := ReadSnapshot(dir, "vm2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := cfg
+	want.VMID, want.PipeName = "vm2", config.ConsolePipe("vm2")
+	want.RestoreStatePath = filepath.Join(dir, snapshotStateFile)
+	if !reflect.DeepEqual(restored, want) {
+		t.Fatalf("restore config %+v, want %+v", restored, want)
+	}
+	v2, err := Restore(restored, StartOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v2.Close()
+	if created := f.Config("vm2"); !strings.Contains(created, "data.vhdx") || !strings.Contains(created, "state.vmrs") {
+		t.Fatalf("restored VM created with %s", created)
+	}
+
+	// A disk gone since the save fails the restore before anything starts.
+	if err := os.Remove(data.Path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadSnapshot(dir, "vm3"); err == nil || !strings.Contains(err.Error(), "data.vhdx") {
+		t.Fatalf("restore without a disk: %v", err)
+	}
+}
@@ -0,0 +1,267 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/vmcompute"
+)
+
+// State is a VM's lifecycle state as vmrunner tracks it.
+type State int
+
+const (
+	StateCreated State = iota
+	StateStarting
+	StateRunning
+	StatePaused
+	StateStopping
+	StateStopped
+	StateFailed
+)
+
+var stateNames = [...]string{"Created", "Starting", "Running", "Paused", "Stopping", "Stopped", "Failed"}
+
+func (s State) String() string {
+	if s >= 0 && int(s) < len(stateNames) {
+		return stateNames[s]
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// Final reports whether no further transition can leave s.
+func (s State) Final() bool { return s == StateStopped || s == StateFailed }
+
+// transitions lists the states each state may move to. Stopped and Failed
+// are final; any live state can fail or stop abruptly (terminate, crash,
+// host shutdown).
+var transitions = map[State][]State{
+	StateCreated:  {StateStarting, StateStopping, StateStopped, StateFailed},
+	StateStarting: {StateRunning, StateStopping, StateStopped, StateFailed},
+	StateRunning:  {StatePaused, StateStopping, StateStopped, StateFailed},
+	StatePaused:   {StateRunning, StateStopping, StateStopped, StateFailed},
+	StateStopping: {StateStopped, StateFailed},
+}
+
+func canTransition(from, to State) bool {
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHCSState maps the State field of an HCS system summary.
+func parseHCSState(s string) State {
+	switch strings.ToLower(s) {
+	case "created":
+		return StateCreated
+	case "running":
+		return StateRunning
+	case "paused":
+		return StatePaused
+	case "stopped":
+		return StateStopped
+	default:
+		return StateFailed
+	}
+}
+
+// StateError is returned when an operation is not valid in the VM's
+// current state, such as stopping a VM that has already stopped.
+type StateError struct {
+	ID    string
+	Op    string
+	State State
+}
+
+func (e *StateError) Error() string {
+	return fmt.Sprintf("cannot %s VM %q: VM is %s", e.Op, e.ID, strings.ToLower(e.State.String()))
+}
+
+// Event is a state change of a VM.
+type Event struct {
+	ID   string
+	From State
+	To   State
+	Time time.Time
+	// Err is set when the change was caused by a failure: a failed HCS call,
+	// a crash, or an unexpected exit.
+	Err error
+	// Exit is set when the VM reached a final state: how it exited.
+	Exit *Exit
+}
+
+// lifecycle is the state machine of one VM. Transitions come from the
+// results of HCS calls and from HCS notifications, which may race each
+// other; moving to the current state again is therefore a no-op.
+type lifecycle struct {
+	id string
+
+	mu    sync.Mutex
+	state State
+	subs  map[int]chan Event
+	next  int
+
+	// onFinal, if set, is called (with mu held) on reaching a final state.
+	onFinal func()
+
+	// terminating is set once the host has asked HCS to terminate the VM.
+	terminating bool
+	// exit is how the VM exited, once it is in a final state.
+	exit *Exit
+}
+
+func newLifecycle(id string, initial State) *lifecycle {
+	return &lifecycle{id: id, state: initial}
+}
+
+func (l *lifecycle) State() State {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.state
+}
+
+// begin checks that op is allowed in the current state and, if so, moves to
+// the given transitional state (or stays put when to is the current state).
+func (l *lifecycle) begin(op string, to State, allowed ...State) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, s := range allowed {
+		if s == l.state {
+			l.setLocked(to, nil)
+			return nil
+		}
+	}
+	return &StateError{ID: l.id, Op: op, State: l.state}
+}
+
+// check returns a *StateError unless the current state is one of allowed.
+func (l *lifecycle) check(op string, allowed ...State) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, s := range allowed {
+		if s == l.state {
+			return nil
+		}
+	}
+	return &StateError{ID: l.id, Op: op, State: l.state}
+}
+
+// set moves to state to if that is a valid transition. Invalid transitions
+// (typically a late notification after a final state) are ignored.
+func (l *lifecycle) set(to State, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.setLocked(to, err)
+}
+
+func (l *lifecycle) setLocked(to State, err error) {
+	l.exitLocked(to, err, nil)
+}
+
+// exitLocked moves to state to like setLocked; on reaching a final state x,
+// if not nil, says how the VM exited, rather than err and the calls made.
+func (l *lifecycle) exitLocked(to State, err error, x *Exit) {
+	from := l.state
+	if from == to || !canTransition(from, to) {
+		return
+	}
+	l.state = to
+	ev := Event{ID: l.id, From: from, To: to, Time: time.Now(), Err: err}
+	if to.Final() {
+		if x == nil {
+			def := defaultExit(to, err, l.terminating)
+			x = &def
+		}
+		x.Time = ev.Time.UTC()
+		l.exit = x
+		ev.Exit = x
+	}
+	for _, ch := range l.subs {
+		select {
+		case ch <- ev:
+		default:
+			// Subscriber is not keeping up; drop rather than stall HCS
+			// callbacks.
+		}
+	}
+	if to.Final() {
+		for k, ch := range l.subs {
+			close(ch)
+			delete(l.subs, k)
+		}
+		if l.onFinal != nil {
+			l.onFinal()
+		}
+	}
+}
+
+// terminate records that the host is terminating the VM, so that its exit
+// is put down to the host.
+func (l *lifecycle) terminate() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.terminating = true
+}
+
+// lastExit returns how the VM exited, or nil if it has not.
+func (l *lifecycle) lastExit() *Exit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.exit
+}
+
+// subscribe returns a channel of future events, closed after the VM reaches
+// a final state or when cancel is called.
+func (l *lifecycle) subscribe() (<-chan Event, func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ch := make(chan Event, 16)
+	if l.state.Final() {
+		close(ch)
+		return ch, func() {}
+	}
+	if l.subs == nil {
+		l.subs = make(map[int]chan Event)
+	}
+	k := l.next
+	l.next++
+	l.subs[k] = ch
+	return ch, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if c, ok := l.subs[k]; ok {
+			close(c)
+			delete(l.subs, k)
+		}
+	}
+}
+
+// notify applies an HCS system notification.
+func (l *lifecycle) notify(n vmcompute.Notification) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch n.Type {
+	case vmcompute.NotificationSystemExited:
+		// An exit we asked for is a stop whatever status HCS reports with
+		// it; an unrequested exit with a failure status is a failure.
+		stopping := l.state == StateStopping
+		x := systemExit(n, stopping, l.terminating)
+		if err := n.Err(); err != nil && !stopping {
+			l.exitLocked(StateFailed, fmt.Errorf("system exited: %w", err), &x)
+			return
+		}
+		l.exitLocked(StateStopped, nil, &x)
+	case vmcompute.NotificationSystemCrashInitiated, vmcompute.NotificationSystemCrashReport:
+		x := Exit{Reason: ExitGuestCrash, Status: n.Status, Detail: n.Data}
+		l.exitLocked(StateFailed, fmt.Errorf("guest crashed: %s", n.Data), &x)
+	case vmcompute.NotificationServiceDisconnect:
+		err := fmt.Errorf("HCS service disconnected")
+		x := Exit{Reason: ExitUnexpected, Detail: err.Error()}
+		l.exitLocked(StateFailed, err, &x)
+	}
+}
@@ -0,0 +1,115 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/config"
+)
+
+// DefaultStopCommand is typed on the serial console to ask the guest to shut
+// down when the VM has no stop command of its own.
+const DefaultStopCommand = "poweroff"
+
+// DefaultStopTimeout is how long each cooperative step of Stop waits for the
+// VM to exit.
+const DefaultStopTimeout = 30 * time.Second
+
+// StopOptions controls how Stop asks the guest to shut down.
+type StopOptions struct {
+	// Command is typed on the serial console first. Empty skips the step.
+	Command string
+	// Timeout bounds each cooperative step; 0 means DefaultStopTimeout.
+	Timeout time.Duration
+}
+
+// Stop shuts the VM down, escalating until it has exited:
+//
+//  1. type opts.Command on console and wait for the guest to exit;
+//  2. ask HCS to shut the system down, which needs the GCS guest connection
+//     that plain Linux images lack, and wait for that;
+//  3. terminate.
+//
+// The first step is skipped without a console or command. Each step is
+// logged. The preStop hooks run first, and an aborting failure leaves the VM
+// running.
+func (v *VM) Stop(console io.Writer, opts StopOptions) error {
+	if err := v.life.check("stop", liveStates...); err != nil {
+		return err
+	}
+	if err := runHooks(v.cfg, config.HookPreStop); err != nil {
+		return err
+	}
+	events, cancel := v.Events()
+	defer cancel()
+	if err := v.life.begin("stop", StateStopping, liveStates...); err != nil {
+		return err
+	}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DefaultStopTimeout
+	}
+
+	if console != nil && opts.Command != "" {
+		log.Printf("[vmrunner] VM %q: typing %q on the serial console", v.id, opts.Command)
+		if _, err := io.WriteString(console, "\n"+opts.Command+"\n"); err != nil {
+			log.Printf("[vmrunner] VM %q: write to console: %v", v.id, err)
+		} else if exited, _ := waitExit(events, nil, timeout); exited {
+			log.Printf("[vmrunner] VM %q: guest shut down", v.id)
+			return nil
+		} else {
+			log.Printf("[vmrunner] VM %q: still running %s after %q", v.id, timeout, opts.Command)
+		}
+	}
+
+	log.Printf("[vmrunner] VM %q: requesting HCS shutdown", v.id)
+	done := make(chan error, 1)
+	go func() { done <- Compute.ShutdownComputeSystem(v.system.handle, "") }()
+	exited, err := waitExit(events, done, timeout)
+	switch {
+	case exited:
+		// Shutdown returns once the system has exited.
+		v.life.set(StateStopped, nil)
+		log.Printf("[vmrunner] VM %q: shut down by HCS", v.id)
+		return nil
+	case err != nil:
+		log.Printf("[vmrunner] VM %q: HCS shutdown failed: %v", v.id, err)
+	default:
+		log.Printf("[vmrunner] VM %q: still running %s after HCS shutdown request", v.id, timeout)
+	}
+
+	log.Printf("[vmrunner] VM %q: terminating", v.id)
+	v.life.terminate()
+	if err := Compute.TerminateComputeSystem(v.system.handle, ""); err != nil {
+		if v.State().Final() {
+			// It exited on its own while we gave up on it.
+			return nil
+		}
+		v.life.set(StateFailed, err)
+		return fmt.Errorf("terminate VM %q: %w", v.id, err)
+	}
+	v.life.set(StateStopped, nil)
+	return nil
+}
+
+// waitExit waits up to timeout for the VM to exit: for events to close, or
+// for a nil result on done (if done is non-nil). A failed call on done ends
+// the wait early with its error.
+func waitExit(events <-chan Event, done <-chan error, timeout time.Duration) (bool, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return true, nil
+			}
+		case err := <-done:
+			return err == nil, err
+		case <-timer.C:
+			return false, nil
+		}
+	}
+}
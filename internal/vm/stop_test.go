@@ -0,0 +1,129 @@
+package vm
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/vmcompute"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vmcompute/vmcomputetest"
+)
+
+// guestConsole is the serial console of a fake guest that powers off when
+// the stop command is typed, if it obeys.
+type guestConsole struct {
+	fake  *vmcomputetest.Fake
+	id    string
+	obey  bool
+	err   error // returned by writes
+	mu    sync.Mutex
+	typed strings.Builder
+}
+
+func (c *guestConsole) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	c.mu.Lock()
+	c.typed.Write(p)
+	typed := c.typed.String()
+	c.mu.Unlock()
+	if c.obey && strings.Contains(typed, "\n"+DefaultStopCommand+"\n") {
+		c.fake.Exit(c.id, vmcomputetest.GracefulExit, 0)
+	}
+	return len(p), nil
+}
+
+func (c *guestConsole) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.typed.String()
+}
+
+func TestStopEscalation(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		console bool
+		obey    bool
+		consErr error
+		setup   func(*vmcomputetest.Fake)
+		calls   []string // after create and start
+		reason  ExitReason
+	}{
+		{
+			name: "guest powers off", console: true, obey: true,
+			calls: nil, reason: ExitGuestShutdown,
+		},
+		{
+			name: "HCS shutdown", console: true,
+			calls: []string{"shutdown vm1"}, reason: ExitGuestShutdown,
+		},
+		{
+			name:  "no console",
+			calls: []string{"shutdown vm1"}, reason: ExitGuestShutdown,
+		},
+		{
+			name: "console broken", console: true, consErr: errors.New("pipe closed"),
+			calls: []string{"shutdown vm1"}, reason: ExitGuestShutdown,
+		},
+		{
+			name: "shutdown fails", console: true,
+			setup: func(f *vmcomputetest.Fake) {
+				f.ShutdownErr = &vmcompute.HcsError{HResult: 0x80370110}
+			},
+			calls: []string{"shutdown vm1", "terminate vm1"}, reason: ExitHostTerminate,
+		},
+		{
+			name: "both time out", console: true,
+			setup: func(f *vmcomputetest.Fake) { f.HangShutdown = true },
+			calls: []string{"shutdown vm1", "terminate vm1"}, reason: ExitHostTerminate,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f := useFake(t)
+			if tt.setup != nil {
+				tt.setup(f)
+			}
+			v, err := Start(testConfig("vm1"), StartOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer v.Close()
+			events, _ := v.Events()
+
+			cons := &guestConsole{fake: f, id: "vm1", obey: tt.obey, err: tt.consErr}
+			var w io.Writer
+			if tt.console {
+				w = cons
+			}
+			start := time.Now()
+			if err := v.Stop(w, StopOptions{Command: DefaultStopCommand, Timeout: 100 * time.Millisecond}); err != nil {
+				t.Fatal(err)
+			}
+			if tt.obey && time.Since(start) >= 100*time.Millisecond {
+				t.Fatalf("stop waited %s for a guest that powered off", time.Since(start))
+			}
+			got := states(collect(t, events))
+			if want := []State{StateStopping, StateStopped}; !reflect.DeepEqual(got, want) {
+				t.Fatalf("transitions %v, want %v", got, want)
+			}
+			if x := v.Exit(); x == nil || x.Reason != tt.reason {
+				t.Fatalf("exit %v, want %s", x, tt.reason)
+			}
+			want := append([]string{"create vm1", "start vm1"}, tt.calls...)
+			if calls := f.Calls(); !reflect.DeepEqual(calls, want) {
+				t.Fatalf("calls %q, want %q", calls, want)
+			}
+			if tt.console && tt.consErr == nil && cons.String() != "\n"+DefaultStopCommand+"\n" {
+				t.Fatalf("typed %q on the console", cons.String())
+			}
+			if f.Exists("vm1") {
+				t.Fatal("system still running")
+			}
+		})
+	}
+}
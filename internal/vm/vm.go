@@ -1,30 +1,186 @@
-//go:build windows
-
 package vm
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/microsoft/hcsshim/vmrunner/internal/config"
 	"github.com/microsoft/hcsshim/vmrunner/internal/vmcompute"
 )
 
-// VM wraps an HCS compute system handle and its configuration.
+// Compute is the HCS backend every operation in this package goes through.
+// main sets it from vmcompute.NewBackend before calling into the package.
+var Compute vmcompute.Backend
+
+// VM wraps an HCS compute system handle, its configuration and its
+// lifecycle state. The state follows the results of the operations below and
+// the HCS notifications for the system; subscribe with Events.
 type VM struct {
 	id     string
-	system vmcompute.HcsSystem
+	system *systemHandle
 	cfg    config.VMConfig
+
+	life       *lifecycle
+	unregister func()
+	unwatch    func()      // stops waiting to run the postStop hooks
+	commitment *commitment // host resources held, until exit or Close
+
+	closeOnce sync.Once
+	closeErr  error
 }
 
-// Start creates and starts a new VM. It first cleans up any existing VM with
-// the same ID to avoid "already exists" errors.
-func Start(cfg config.VMConfig) (*VM, error) {
-	// Clean up any pre-existing VM with the same ID.
-	if err := cleanup(cfg.VMID); err != nil {
-		log.Printf("[vmrunner] cleanup of existing VM %q: %v", cfg.VMID, err)
+// newVM wraps an owned handle and subscribes to its notifications. Without
+// notifications the state still follows the operations made through v, so a
+// registration failure is logged rather than returned. If cfg has postStop
+// hooks, they run when the VM exits while v is open. The host resources of
+// c, if any, are released when the VM exits or v is closed.
+func newVM(id string, system *systemHandle, cfg config.VMConfig, initial State, c *commitment) *VM {
+	v := &VM{id: id, system: system, cfg: cfg, life: newLifecycle(id, initial), unregister: func() {}, unwatch: func() {}, commitment: c}
+	v.life.onFinal = c.release
+	unregister, err := Compute.NotifySystem(system.handle, v.life.notify)
+	if err != nil {
+		log.Printf("[vmrunner] VM %q: no state notifications: %v", id, err)
+	} else {
+		v.unregister = unregister
+	}
+	if len(cfg.Hooks.PostStop) > 0 {
+		var events <-chan Event
+		events, v.unwatch = v.life.subscribe()
+		go v.watchExit(events)
+	}
+	return v
+}
+
+// Open opens the existing VM id, taking its initial state from HCS. The
+// caller must Close the returned VM.
+func Open(id string) (*VM, error) {
+	return OpenConfig(config.VMConfig{VMID: id})
+}
+
+// OpenConfig is Open for a VM known to have been started with cfg, whose
+// hooks then apply to it.
+func OpenConfig(cfg config.VMConfig) (*VM, error) {
+	id := cfg.VMID
+	system, err := openSystem(id)
+	if err != nil {
+		return nil, fmt.Errorf("open VM %q: %w", id, err)
+	}
+	state := StateRunning
+	if s, err := lookup(id); err == nil && s != nil {
+		state = parseHCSState(s.State)
+	}
+	var c *commitment
+	if !state.Final() {
+		c = commit(cfg)
+	}
+	return newVM(id, system, cfg, state, c), nil
+}
+
+// StartOptions says what Start may do to a compute system that already has
+// the new VM's ID.
+type StartOptions struct {
+	// Replace terminates the existing system instead of failing.
+	Replace bool
+	// Force lets Replace terminate a system owned by another tool.
+	Force bool
+	// WaitForCapacity is how long to wait for host capacity when the VM
+	// does not fit yet, instead of failing with a *CapacityError at once.
+	WaitForCapacity time.Duration `json:",omitempty"`
+}
+
+// ExistsError is returned by Start when a compute system with the VM's ID
+// exists and may not be replaced.
+type ExistsError struct {
+	ID    string
+	Owner string
+	// Foreign is set when replacing was asked for but the system is not
+	// vmrunner's.
+	Foreign bool
+}
+
+func (e *ExistsError) Error() string {
+	if e.Foreign {
+		return fmt.Sprintf("compute system %q already exists and belongs to %q, not %s", e.ID, e.Owner, config.Owner)
+	}
+	return fmt.Sprintf("compute system %q already exists (owner %q)", e.ID, e.Owner)
+}
+
+// checkReplace returns an *ExistsError if a system id exists and opts do not
+// allow replacing it, and whether one exists.
+func checkReplace(id string, opts StartOptions) (bool, error) {
+	existing, err := lookup(id)
+	if err != nil {
+		return false, fmt.Errorf("look up existing system %q: %w", id, err)
+	}
+	if existing == nil {
+		return false, nil
+	}
+	ours := strings.EqualFold(existing.Owner, config.Owner)
+	switch {
+	case ours && parseHCSState(existing.State).Final():
+		// Our own VM that has exited but is not yet gone from HCS.
+		return true, nil
+	case !opts.Replace:
+		return true, &ExistsError{ID: id, Owner: existing.Owner}
+	case !ours && !opts.Force:
+		return true, &ExistsError{ID: id, Owner: existing.Owner, Foreign: true}
+	}
+	return true, nil
+}
+
+// liveStates are the states in which a VM can be stopped.
+var liveStates = []State{StateCreated, StateStarting, StateRunning, StatePaused}
+
+// Start creates and starts a new VM. A compute system that already has its
+// ID is an *ExistsError unless opts allow replacing it: HCS systems are shared
+// with Docker and other tools, and an ID may be reused by mistake. The
+// preStart hooks run once that is settled, the postStart hooks once the VM
+// runs; an aborting postStart failure terminates the VM again.
+//
+// Before any of that the VM is admitted against the host's resources and
+// those committed to the other VMs, under Capacity: HCS failures for a host
+// out of memory are cryptic and may leave a half-created system behind.
+// A VM with a scratch disk gets a fresh one, removed again if it fails to
+// start.
+func Start(cfg config.VMConfig, opts StartOptions) (_ *VM, err error) {
+	exists, err := checkReplace(cfg.VMID, opts)
+	if err != nil {
+		return nil, err
+	}
+	c, err := admit(cfg, opts.WaitForCapacity)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			c.release()
+		}
+	}()
+	if err := runHooks(cfg, config.HookPreStart); err != nil {
+		return nil, err
+	}
+	if exists {
+		if err := cleanup(cfg.VMID); err != nil {
+			log.Printf("[vmrunner] cleanup of existing VM %q: %v", cfg.VMID, err)
+		}
+	}
+	if cfg.ScratchDisk != "" {
+		// A replaced VM of the same ID may have left its own behind.
+		if err := RemoveScratchDisk(cfg.ScratchDisk); err != nil {
+			return nil, err
+		}
+		log.Printf("[vmrunner] creating scratch disk %s for VM %q", cfg.ScratchDisk, cfg.VMID)
+		if err := CreateScratchDisk(cfg.VMID, config.ImageRootDisk(cfg), cfg.ScratchDisk); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				removeScratchAfterFailure(cfg.VMID, cfg.ScratchDisk)
+			}
+		}()
 	}
 
 	configJSON, err := config.BuildJSON(cfg)
@@ -33,23 +189,47 @@ func Start(cfg config.VMConfig) (*VM, error) {
 	}
 
 	log.Printf("[vmrunner] creating VM %q", cfg.VMID)
-	system, err := vmcompute.HcsCreateComputeSystem(cfg.VMID, configJSON)
+	system, err := createSystem(cfg.VMID, configJSON)
 	if err != nil {
 		return nil, fmt.Errorf("HcsCreateComputeSystem: %w", err)
 	}
+	v := newVM(cfg.VMID, system, cfg, StateCreated, c)
 
 	log.Printf("[vmrunner] starting VM %q", cfg.VMID)
-	if err := vmcompute.HcsStartComputeSystem(system, ""); err != nil {
-		_ = vmcompute.HcsCloseComputeSystem(system)
+	if err := v.life.begin("start", StateStarting, StateCreated); err != nil {
+		_ = v.Close()
+		return nil, err
+	}
+	if err := Compute.StartComputeSystem(system.handle, ""); err != nil {
+		v.life.set(StateFailed, err)
+		// The system exists in HCS until it is terminated; closing the
+		// handle alone would leave it behind.
+		if termErr := Compute.TerminateComputeSystem(system.handle, ""); termErr != nil {
+			log.Printf("[vmrunner] terminate after failed start: %v", termErr)
+		}
+		_ = v.Close()
 		return nil, fmt.Errorf("HcsStartComputeSystem: %w", err)
 	}
+	v.life.set(StateRunning, nil)
 
-	return &VM{id: cfg.VMID, system: system, cfg: cfg}, nil
+	if err := runHooks(cfg, config.HookPostStart); err != nil {
+		if termErr := Compute.TerminateComputeSystem(system.handle, ""); termErr != nil {
+			log.Printf("[vmrunner] terminate after failed postStart hook: %v", termErr)
+		}
+		v.life.set(StateFailed, err)
+		_ = v.Close()
+		return nil, err
+	}
+	return v, nil
 }
 
-// System returns the underlying HCS system handle.
+// System returns the underlying HCS system handle, or 0 if v does not hold
+// one.
 func (v *VM) System() vmcompute.HcsSystem {
-	return v.system
+	if v.system == nil {
+		return 0
+	}
+	return v.system.handle
 }
 
 // ID returns the VM identifier.
@@ -57,154 +237,138 @@ func (v *VM) ID() string {
 	return v.id
 }
 
-// Shutdown attempts a graceful shutdown, falling back to terminate.
-func (v *VM) Shutdown() error {
-	log.Printf("[vmrunner] shutting down VM %q", v.id)
-	err := vmcompute.HcsShutdownComputeSystem(v.system, "")
-	if err != nil {
-		log.Printf("[vmrunner] graceful shutdown failed (%v), terminating", err)
-		if termErr := vmcompute.HcsTerminateComputeSystem(v.system, ""); termErr != nil {
-			// Close the handle even if terminate fails.
-			_ = vmcompute.HcsCloseComputeSystem(v.system)
-			return fmt.Errorf("terminate: %w", termErr)
-		}
+// Config returns the configuration the VM was started or opened with.
+func (v *VM) Config() config.VMConfig {
+	return v.cfg
+}
+
+// State returns the VM's current lifecycle state.
+func (v *VM) State() State {
+	return v.life.State()
+}
+
+// Exit returns how the VM exited, or nil while it has not.
+func (v *VM) Exit() *Exit {
+	return v.life.lastExit()
+}
+
+// Events returns a channel of the VM's state changes from now on. The
+// channel is closed once the VM reaches Stopped or Failed, or when cancel is
+// called. Events are dropped for a subscriber that falls 16 behind.
+func (v *VM) Events() (events <-chan Event, cancel func()) {
+	return v.life.subscribe()
+}
+
+// Terminate forcibly stops the VM, after its preStop hooks.
+func (v *VM) Terminate() error {
+	if err := v.life.check("terminate", liveStates...); err != nil {
+		return err
+	}
+	if err := runHooks(v.cfg, config.HookPreStop); err != nil {
+		return err
+	}
+	if err := v.life.begin("terminate", StateStopping, liveStates...); err != nil {
+		return err
+	}
+	log.Printf("[vmrunner] killing VM %q", v.id)
+	v.life.terminate()
+	if err := Compute.TerminateComputeSystem(v.system.handle, ""); err != nil {
+		v.life.set(StateFailed, err)
+		return fmt.Errorf("terminate VM %q: %w", v.id, err)
+	}
+	v.life.set(StateStopped, nil)
+	return nil
+}
+
+// Pause suspends a running VM.
+func (v *VM) Pause() error {
+	if err := v.life.check("pause", StateRunning); err != nil {
+		return err
+	}
+	log.Printf("[vmrunner] pausing VM %q", v.id)
+	if err := Compute.PauseComputeSystem(v.system.handle, ""); err != nil {
+		return fmt.Errorf("pause VM %q: %w", v.id, err)
 	}
+	v.life.set(StatePaused, nil)
+	return nil
+}
 
-	// Give the system a moment to stop before closing the handle.
-	time.Sleep(500 * time.Millisecond)
-	if err := vmcompute.HcsCloseComputeSystem(v.system); err != nil {
-		return fmt.Errorf("close: %w", err)
+// Resume continues a paused VM.
+func (v *VM) Resume() error {
+	if err := v.life.check("resume", StatePaused); err != nil {
+		return err
+	}
+	log.Printf("[vmrunner] resuming VM %q", v.id)
+	if err := Compute.ResumeComputeSystem(v.system.handle, ""); err != nil {
+		return fmt.Errorf("resume VM %q: %w", v.id, err)
 	}
+	v.life.set(StateRunning, nil)
 	return nil
 }
 
 // Close releases the system handle without shutting down the VM.
 // The VM continues running in the background, managed by HCS.
+// Close is idempotent: later calls return the first call's result.
 func (v *VM) Close() error {
-	return vmcompute.HcsCloseComputeSystem(v.system)
+	if v.system == nil {
+		return nil
+	}
+	v.closeOnce.Do(func() {
+		if v.unregister != nil {
+			v.unregister()
+		}
+		if v.unwatch != nil {
+			v.unwatch()
+		}
+		v.commitment.release()
+		v.closeErr = v.system.Close()
+	})
+	return v.closeErr
 }
 
 // Kill opens a VM by ID and forcibly terminates it, then closes the handle.
 // It returns an error if the VM cannot be found or terminated.
 func Kill(id string) error {
-	system, err := vmcompute.HcsOpenComputeSystem(id)
+	v, err := Open(id)
 	if err != nil {
-		return fmt.Errorf("open VM %q: %w", id, err)
+		return err
 	}
-	log.Printf("[vmrunner] killing VM %q", id)
-	if err := vmcompute.HcsTerminateComputeSystem(system, ""); err != nil {
-		_ = vmcompute.HcsCloseComputeSystem(system)
-		return fmt.Errorf("terminate VM %q: %w", id, err)
+	defer v.Close()
+	if err := v.Terminate(); err != nil {
+		return err
 	}
-	return vmcompute.HcsCloseComputeSystem(system)
+	return v.Close()
 }
 
-// cleanup opens and terminates an existing VM with the given ID, then closes its handle.
+// cleanup opens and terminates an existing VM with the given ID, then closes
+// its handle. Start checks that the system may be replaced first.
 func cleanup(id string) error {
-	system, err := vmcompute.HcsOpenComputeSystem(id)
+	system, err := openSystem(id)
 	if err != nil {
 		// Not found or cannot open – nothing to clean up.
 		return nil
 	}
-	log.Printf("[vmrunner] found existing VM %q, cleaning up", id)
-	_ = vmcompute.HcsTerminateComputeSystem(system, "")
-	time.Sleep(300 * time.Millisecond)
-	return vmcompute.HcsCloseComputeSystem(system)
-}
-
-// List enumerates all running compute systems and prints a formatted table.
-func List() error {
-	result, err := vmcompute.HcsEnumerateComputeSystems("")
-	if err != nil {
-		return fmt.Errorf("enumerate compute systems: %w", err)
-	}
-	if result == "" || result == "null" {
-		fmt.Println("(no running VMs)")
-		return nil
-	}
-
-	var items []struct {
-		Id         string `json:"Id"`
-		RuntimeId  string `json:"RuntimeId"`
-		Owner      string `json:"Owner"`
-		SystemType string `json:"SystemType"`
-		State      string `json:"State"`
-	}
-	if err := json.Unmarshal([]byte(result), &items); err != nil {
-		fmt.Println(result)
-		return nil
-	}
-	if len(items) == 0 {
-		fmt.Println("(no running VMs)")
-		return nil
-	}
-
-	fmt.Printf("%-16s  %-16s  %-10s  %-24s  %s\n", "OWNER", "SYSTEMTYPE", "STATE", "NAME", "ID")
-	fmt.Printf("%-16s  %-16s  %-10s  %-24s  %s\n",
-		"----------------", "----------------", "----------", "------------------------", "------------------------------------")
-	for _, item := range items {
-		fmt.Printf("%-16s  %-16s  %-10s  %-24s  %s\n",
-			item.Owner, item.SystemType, item.State, item.Id, item.RuntimeId)
-	}
-	return nil
+	log.Printf("[vmrunner] replacing existing VM %q", id)
+	_ = Compute.TerminateComputeSystem(system.handle, "")
+	// HCS may still hold the ID briefly after the handle is closed; Create
+	// retries on "already exists" (see vmcompute.DefaultRetryPolicies).
+	return system.Close()
 }
 
-// Stop opens a VM by ID and requests a graceful shutdown.
-// Unlike Shutdown(), it does not fall back to terminate on failure.
-func Stop(id string) error {
-	system, err := vmcompute.HcsOpenComputeSystem(id)
+// Systems enumerates the compute systems selected by opts, sorted by ID. By
+// default only systems owned by vmrunner are returned.
+func Systems(opts ListOptions) ([]vmcompute.SystemSummary, error) {
+	f, err := parseFilters(opts.Filters)
 	if err != nil {
-		return fmt.Errorf("open VM %q: %w", id, err)
-	}
-	log.Printf("[vmrunner] stopping VM %q", id)
-	if err := vmcompute.HcsShutdownComputeSystem(system, ""); err != nil {
-		_ = vmcompute.HcsCloseComputeSystem(system)
-		return fmt.Errorf("shutdown VM %q: %w", id, err)
+		return nil, err
 	}
-	time.Sleep(500 * time.Millisecond)
-	return vmcompute.HcsCloseComputeSystem(system)
-}
-
-// Attach connects to the serial console of a running VM identified by id.
-// It verifies the VM exists, then opens the named pipe console and connects
-// it to the terminal bidirectionally.
-func Attach(id string) error {
-	system, err := vmcompute.HcsOpenComputeSystem(id)
+	query, err := opts.query(f).JSON()
 	if err != nil {
-		return fmt.Errorf("VM %q not found: %w", id, err)
-	}
-	_ = vmcompute.HcsCloseComputeSystem(system)
-
-	pipeName := fmt.Sprintf(`\\.\pipe\%s-console`, id)
-	v := &VM{id: id}
-	return v.InteractiveShell(pipeName)
-}
-
-// Exec runs args in the VM identified by cfg.VMID via the serial console.
-// If the VM is not already running it is started using cfg and left running
-// (detached) after the command completes.
-func Exec(cfg config.VMConfig, args []string) error {
-	pipeName := fmt.Sprintf(`\\.\pipe\%s-console`, cfg.VMID)
-
-	// Check if VM is already running.
-	system, err := vmcompute.HcsOpenComputeSystem(cfg.VMID)
-	if err == nil {
-		// VM exists; release the extra open handle and use the serial console.
-		_ = vmcompute.HcsCloseComputeSystem(system)
-		v := &VM{id: cfg.VMID}
-		return v.RunCommand(pipeName, args)
+		return nil, err
 	}
-
-	// VM not running; start it.
-	log.Printf("[vmrunner] VM %q not running, starting...", cfg.VMID)
-	machine, err := Start(cfg)
+	result, err := Compute.EnumerateComputeSystems(query)
 	if err != nil {
-		return fmt.Errorf("start VM: %w", err)
+		return nil, fmt.Errorf("enumerate compute systems: %w", err)
 	}
-
-	runErr := machine.RunCommand(pipeName, args)
-
-	// Detach: release the handle without shutting down the VM.
-	_ = vmcompute.HcsCloseComputeSystem(machine.system)
-	return runErr
+	return opts.selectSystems(f, result)
 }
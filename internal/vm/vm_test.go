@@ -0,0 +1,231 @@
+package vm
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/config"
+	"github.com/microsoft/hcsshim/vmrunner/internal/handles/handlestest"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vmcompute"
+	"github.com/microsoft/hcsshim/vmrunner/internal/vmcompute/vmcomputetest"
+)
+
+// useFake points Compute at a new fake backend for the duration of the test.
+func useFake(t *testing.T) *vmcomputetest.Fake {
+	t.Helper()
+	f := vmcomputetest.New()
+	compute := Compute
+	Compute = f
+	t.Cleanup(func() { Compute = compute })
+	return f
+}
+
+func testConfig(id string) config.VMConfig {
+	return config.VMConfig{VMID: id, ImageDir: `C:\vmrunner\images\alpine`, MemoryMB: 512, CPUCount: 1}
+}
+
+// collect returns the events sent on events until it is closed.
+func collect(t *testing.T, events <-chan Event) []Event {
+	t.Helper()
+	var evs []Event
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return evs
+			}
+			evs = append(evs, ev)
+		case <-timeout:
+			t.Fatalf("events not closed; got %v", evs)
+		}
+	}
+}
+
+func states(evs []Event) []State {
+	var states []State
+	for _, ev := range evs {
+		states = append(states, ev.To)
+	}
+	return states
+}
+
+func TestStartPauseTerminate(t *testing.T) {
+	handlestest.Check(t)
+	f := useFake(t)
+	v, err := Start(testConfig("vm1"), StartOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	if v.State() != StateRunning || v.Exit() != nil {
+		t.Fatalf("after start: %s, exit %v", v.State(), v.Exit())
+	}
+	events, _ := v.Events()
+
+	if err := v.Resume(); !errors.As(err, new(*StateError)) {
+		t.Fatalf("resume while running: %v, want a *StateError", err)
+	}
+	if err := v.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Pause(); !errors.As(err, new(*StateError)) {
+		t.Fatalf("pause while paused: %v, want a *StateError", err)
+	}
+	if err := v.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+	got := states(collect(t, events))
+	want := []State{StatePaused, StateRunning, StateStopping, StateStopped}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("transitions %v, want %v", got, want)
+	}
+	if x := v.Exit(); x == nil || x.Reason != ExitHostTerminate {
+		t.Fatalf("exit %v, want %s", x, ExitHostTerminate)
+	}
+	if err := v.Terminate(); !errors.As(err, new(*StateError)) {
+		t.Fatalf("terminate when stopped: %v, want a *StateError", err)
+	}
+	if err := v.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wantCalls := []string{"create vm1", "start vm1", "pause vm1", "resume vm1", "terminate vm1", "close vm1"}
+	if calls := f.Calls(); !reflect.DeepEqual(calls, wantCalls) {
+		t.Fatalf("calls %q, want %q", calls, wantCalls)
+	}
+}
+
+func TestCloseIdempotent(t *testing.T) {
+	handlestest.Check(t)
+	f := useFake(t)
+	v, err := Start(testConfig("vm1"), StartOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := v.Close(); err != nil {
+			t.Fatalf("close %d: %v", i, err)
+		}
+	}
+	if err := Kill("vm1"); err != nil {
+		t.Fatal(err)
+	}
+	closes := 0
+	for _, c := range f.Calls() {
+		if c == "close vm1" {
+			closes++
+		}
+	}
+	if closes != 2 {
+		t.Fatalf("calls %q: want one close per handle", f.Calls())
+	}
+	commitments.Lock()
+	_, held := commitments.vms["vm1"]
+	commitments.Unlock()
+	if held {
+		t.Fatal("resources still committed after close")
+	}
+}
+
+func TestStartFailure(t *testing.T) {
+	handlestest.Check(t)
+	f := useFake(t)
+	f.StartErr = &vmcompute.HcsError{HResult: 0x80070005}
+	if _, err := Start(testConfig("vm1"), StartOptions{}); vmcompute.HResult(err) != 0x80070005 {
+		t.Fatalf("start: %v, want the HCS failure", err)
+	}
+	// The half-started system is terminated, not left behind.
+	want := []string{"create vm1", "start vm1", "terminate vm1", "close vm1"}
+	if calls := f.Calls(); !reflect.DeepEqual(calls, want) {
+		t.Fatalf("calls %q, want %q", calls, want)
+	}
+	if f.Exists("vm1") {
+		t.Fatal("system left behind")
+	}
+}
+
+func TestStartExisting(t *testing.T) {
+	f := useFake(t)
+	f.Add("mine", config.Owner)
+	f.Add("docker-uvm", "docker")
+
+	var exists *ExistsError
+	if _, err := Start(testConfig("mine"), StartOptions{}); !errors.As(err, &exists) || exists.Foreign {
+		t.Fatalf("start over own system: %v, want an *ExistsError", err)
+	}
+	if _, err := Start(testConfig("docker-uvm"), StartOptions{Replace: true}); !errors.As(err, &exists) || !exists.Foreign {
+		t.Fatalf("replace foreign system: %v, want a foreign *ExistsError", err)
+	}
+	v, err := Start(testConfig("mine"), StartOptions{Replace: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.Close()
+	v, err = Start(testConfig("docker-uvm"), StartOptions{Replace: true, Force: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.Close()
+}
+
+func TestGuestExit(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		exitType string
+		status   uint32
+		state    State
+		reason   ExitReason
+	}{
+		{"poweroff", vmcomputetest.GracefulExit, 0, StateStopped, ExitGuestShutdown},
+		{"unexpected", vmcomputetest.UnexpectedExit, 0, StateStopped, ExitUnexpected},
+		{"failure", "", 0x80370100, StateFailed, ExitUnexpected},
+		{"unknown", "", 0, StateStopped, ExitGuestShutdown},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f := useFake(t)
+			v, err := Start(testConfig("vm1"), StartOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer v.Close()
+			events, _ := v.Events()
+			f.Exit("vm1", tt.exitType, tt.status)
+			evs := collect(t, events)
+			if len(evs) != 1 || evs[0].To != tt.state {
+				t.Fatalf("events %v, want one to %s", evs, tt.state)
+			}
+			x := evs[0].Exit
+			if x == nil || x.Reason != tt.reason || x.HCSExitType != tt.exitType || x.Status != tt.status {
+				t.Fatalf("exit %+v, want %s", x, tt.reason)
+			}
+			if v.Exit() != x {
+				t.Fatalf("VM exit %v, event exit %v", v.Exit(), x)
+			}
+		})
+	}
+}
+
+func TestCrash(t *testing.T) {
+	useFake(t)
+	v, err := Start(testConfig("vm1"), StartOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	events, _ := v.Events()
+	v.life.notify(vmcompute.Notification{Type: vmcompute.NotificationSystemCrashReport, Data: "kernel panic"})
+	evs := collect(t, events)
+	if len(evs) != 1 || evs[0].To != StateFailed || evs[0].Exit.Reason != ExitGuestCrash {
+		t.Fatalf("events %v, want a guest crash", evs)
+	}
+	// A late SystemExited does not leave the final state.
+	v.life.notify(vmcompute.Notification{Type: vmcompute.NotificationSystemExited})
+	if v.State() != StateFailed || v.Exit().Reason != ExitGuestCrash {
+		t.Fatalf("after late exit: %s, %v", v.State(), v.Exit())
+	}
+}
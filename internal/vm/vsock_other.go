@@ -0,0 +1,8 @@
+//go:build !windows
+
+package vm
+
+// dialVsock fails: Hyper-V sockets only exist on Windows.
+func dialVsock(runtimeID string, port uint32) error {
+	return errVsockUnsupported
+}
@@ -0,0 +1,89 @@
+//go:build windows
+
+package vm
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// Hyper-V socket constants from hvsocket.h.
+const (
+	afHyperV      = 34
+	hvProtocolRaw = 1
+)
+
+var (
+	modWs2_32   = syscall.NewLazyDLL("ws2_32.dll")
+	procConnect = modWs2_32.NewProc("connect")
+
+	wsaOnce sync.Once
+	wsaErr  error
+)
+
+// sockaddrHV is SOCKADDR_HV.
+type sockaddrHV struct {
+	Family    uint16
+	Reserved  uint16
+	VMID      syscall.GUID
+	ServiceID syscall.GUID
+}
+
+// vsockService returns the Hyper-V socket service ID of a Linux guest's
+// vsock port: the port in the first field of the VSOCK template GUID
+// xxxxxxxx-FACB-11E6-BD58-64006A7986D3.
+func vsockService(port uint32) syscall.GUID {
+	return syscall.GUID{
+		Data1: port,
+		Data2: 0xfacb,
+		Data3: 0x11e6,
+		Data4: [8]byte{0xbd, 0x58, 0x64, 0x00, 0x6a, 0x79, 0x86, 0xd3},
+	}
+}
+
+// parseGUID parses a GUID in its string form, with or without braces.
+func parseGUID(s string) (syscall.GUID, error) {
+	var g syscall.GUID
+	hexits := strings.ReplaceAll(strings.Trim(s, "{}"), "-", "")
+	b, err := hex.DecodeString(hexits)
+	if err != nil || len(b) != 16 {
+		return g, fmt.Errorf("invalid GUID %q", s)
+	}
+	g.Data1 = uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+	g.Data2 = uint16(b[4])<<8 | uint16(b[5])
+	g.Data3 = uint16(b[6])<<8 | uint16(b[7])
+	copy(g.Data4[:], b[8:])
+	return g, nil
+}
+
+// dialVsock connects to vsock port of the VM with HCS runtime ID runtimeID
+// and hangs up at once: the connection is the answer.
+func dialVsock(runtimeID string, port uint32) error {
+	vmID, err := parseGUID(runtimeID)
+	if err != nil {
+		return err
+	}
+	wsaOnce.Do(func() {
+		var data syscall.WSAData
+		wsaErr = syscall.WSAStartup(uint32(0x202), &data)
+	})
+	if wsaErr != nil {
+		return fmt.Errorf("WSAStartup: %w", wsaErr)
+	}
+	s, err := syscall.Socket(afHyperV, syscall.SOCK_STREAM, hvProtocolRaw)
+	if err != nil {
+		return fmt.Errorf("hvsocket: %w", err)
+	}
+	defer syscall.Closesocket(s)
+
+	sa := sockaddrHV{Family: afHyperV, VMID: vmID, ServiceID: vsockService(port)}
+	r, _, errno := procConnect.Call(uintptr(s), uintptr(unsafe.Pointer(&sa)), unsafe.Sizeof(sa))
+	if int32(r) != 0 {
+		return fmt.Errorf("connect to vsock port %d: %w", port, errno)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package vmcompute
+
+// Backend is the set of HCS operations vmrunner uses. It is implemented on top
+// of the legacy notification-callback API in vmcompute.dll and on top of the
+// operation-based API in computecore.dll.
+//
+// Methods that act on a system or process block until the operation has
+// completed, whichever mechanism the backend uses to learn about completion.
+// String parameters and results are HCS schema2 JSON documents.
+type Backend interface {
+	// Name identifies the backend ("vmcompute" or "computecore").
+	Name() string
+
+	CreateComputeSystem(id, configuration string) (HcsSystem, error)
+	OpenComputeSystem(id string) (HcsSystem, error)
+	StartComputeSystem(system HcsSystem, options string) error
+	ShutdownComputeSystem(system HcsSystem, options string) error
+	TerminateComputeSystem(system HcsSystem, options string) error
+	PauseComputeSystem(system HcsSystem, options string) error
+	ResumeComputeSystem(system HcsSystem, options string) error
+	SaveComputeSystem(system HcsSystem, options string) error
+	ModifyComputeSystem(system HcsSystem, configuration string) error
+	CloseComputeSystem(system HcsSystem) error
+	EnumerateComputeSystems(query string) (string, error)
+
+	// NotifySystem calls fn for every notification HCS delivers for system
+	// until the returned unregister function is called.
+	NotifySystem(system HcsSystem, fn func(Notification)) (unregister func(), err error)
+
+	CreateProcess(system HcsSystem, processParameters string) (HcsProcess, *HcsProcessInformation, error)
+	GetProcessProperties(process HcsProcess) (string, error)
+	SignalProcess(process HcsProcess, options string) error
+	ModifyProcess(process HcsProcess, settings string) error
+	TerminateProcess(process HcsProcess) error
+	CloseProcess(process HcsProcess) error
+
+	// NotifyProcess is NotifySystem for a process handle.
+	NotifyProcess(process HcsProcess, fn func(Notification)) (unregister func(), err error)
+}
+
+// Backend names accepted by NewBackend.
+const (
+	BackendAuto        = "auto"
+	BackendVmcompute   = "vmcompute"
+	BackendComputecore = "computecore"
+)
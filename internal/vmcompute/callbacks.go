@@ -0,0 +1,48 @@
+package vmcompute
+
+import "sync"
+
+// rawCallback receives an event exactly as HCS reported it: the notification
+// or event type, its HRESULT status (0 if the API has none) and its data.
+type rawCallback func(eventType, status uint32, data string)
+
+// callbackRegistry maps the context value handed to HCS when a callback is
+// registered to the Go function that handles it. HCS only ever sees the
+// context, so one syscall.NewCallback trampoline per API serves every
+// registration; Go can only create a limited number of callbacks per process
+// and never frees them.
+type callbackRegistry struct {
+	mu   sync.Mutex
+	next uintptr
+	fns  map[uintptr]rawCallback
+}
+
+// add registers fn and returns the context value that identifies it.
+func (r *callbackRegistry) add(fn rawCallback) uintptr {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.fns == nil {
+		r.fns = make(map[uintptr]rawCallback)
+	}
+	r.next++
+	r.fns[r.next] = fn
+	return r.next
+}
+
+// remove forgets the function registered under ctx.
+func (r *callbackRegistry) remove(ctx uintptr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.fns, ctx)
+}
+
+// dispatch calls the function registered under ctx, if any. Notifications for
+// a context that has already been removed are dropped.
+func (r *callbackRegistry) dispatch(ctx uintptr, eventType, status uint32, data string) {
+	r.mu.Lock()
+	fn := r.fns[ctx]
+	r.mu.Unlock()
+	if fn != nil {
+		fn(eventType, status, data)
+	}
+}
@@ -0,0 +1,471 @@
+package vmcompute
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// HRESULTs the computecore backend interprets itself.
+const (
+	hrTimeout    = 0x800705B4 // HRESULT_FROM_WIN32(ERROR_TIMEOUT)
+	hrInvalidArg = 0x80070057 // E_INVALIDARG
+)
+
+// HCS_EVENT_TYPE values delivered to computecore.dll event callbacks.
+const (
+	hcsEventSystemExited                = 0x00000001
+	hcsEventSystemCrashInitiated        = 0x00000002
+	hcsEventSystemCrashReport           = 0x00000003
+	hcsEventSystemGuestConnectionClosed = 0x00000006
+	hcsEventProcessExited               = 0x00010000
+	hcsEventServiceDisconnect           = 0x02000000
+)
+
+// eventNotification maps an HCS_EVENT_TYPE onto the NotificationType used by
+// the rest of vmrunner. Unknown events map to NotificationInvalid.
+func eventNotification(eventType uint32) NotificationType {
+	switch eventType {
+	case hcsEventSystemExited:
+		return NotificationSystemExited
+	case hcsEventSystemCrashInitiated:
+		return NotificationSystemCrashInitiated
+	case hcsEventSystemCrashReport:
+		return NotificationSystemCrashReport
+	case hcsEventSystemGuestConnectionClosed:
+		return NotificationSystemGuestClosed
+	case hcsEventProcessExited:
+		return NotificationProcessExited
+	case hcsEventServiceDisconnect:
+		return NotificationServiceDisconnect
+	}
+	return NotificationInvalid
+}
+
+// coreAPI is the subset of computecore.dll the computecore backend calls,
+// reduced to HRESULTs and Go strings. The Windows implementation calls the
+// DLL; tests substitute a fake to drive the operation state handling.
+type coreAPI interface {
+	CreateOperation() HcsOperation
+	CloseOperation(op HcsOperation)
+	CancelOperation(op HcsOperation) uint32
+	WaitForOperationResult(op HcsOperation, timeoutMs uint32) (hr uint32, result string)
+	WaitForOperationResultAndProcessInfo(op HcsOperation, timeoutMs uint32) (hr uint32, info HcsProcessInformation, result string)
+
+	CreateComputeSystem(id, configuration string, op HcsOperation) (uint32, HcsSystem)
+	OpenComputeSystem(id string) (uint32, HcsSystem)
+	CloseComputeSystem(system HcsSystem)
+	StartComputeSystem(system HcsSystem, op HcsOperation, options string) uint32
+	ShutDownComputeSystem(system HcsSystem, op HcsOperation, options string) uint32
+	TerminateComputeSystem(system HcsSystem, op HcsOperation, options string) uint32
+	PauseComputeSystem(system HcsSystem, op HcsOperation, options string) uint32
+	ResumeComputeSystem(system HcsSystem, op HcsOperation, options string) uint32
+	SaveComputeSystem(system HcsSystem, op HcsOperation, options string) uint32
+	ModifyComputeSystem(system HcsSystem, op HcsOperation, configuration string) uint32
+	EnumerateComputeSystems(query string, op HcsOperation) uint32
+	// SetComputeSystemCallback installs the single event callback HCS keeps
+	// per system handle; cb receives the raw HCS_EVENT_TYPE and event data.
+	SetComputeSystemCallback(system HcsSystem, cb func(eventType uint32, data string)) uint32
+
+	CreateProcess(system HcsSystem, processParameters string, op HcsOperation) (uint32, HcsProcess)
+	CloseProcess(process HcsProcess)
+	TerminateProcess(process HcsProcess, op HcsOperation, options string) uint32
+	SignalProcess(process HcsProcess, op HcsOperation, options string) uint32
+	ModifyProcess(process HcsProcess, op HcsOperation, settings string) uint32
+	GetProcessProperties(process HcsProcess, op HcsOperation, propertyQuery string) uint32
+	SetProcessCallback(process HcsProcess, cb func(eventType uint32, data string)) uint32
+}
+
+// opState tracks an HCS_OPERATION through its lifetime.
+type opState int
+
+const (
+	opCreated  opState = iota // handle allocated, not yet passed to a call
+	opPending                 // call accepted; result not yet collected
+	opDone                    // result collected (success or failure)
+	opTimedOut                // wait timed out; operation was cancelled
+	opClosed                  // handle released
+)
+
+func (s opState) String() string {
+	switch s {
+	case opCreated:
+		return "created"
+	case opPending:
+		return "pending"
+	case opDone:
+		return "done"
+	case opTimedOut:
+		return "timed out"
+	case opClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("opState(%d)", int(s))
+}
+
+// operation is a single-use HCS_OPERATION. The expected sequence is
+// newOperation → submit → wait → close; close is always safe and cancels an
+// operation that is still pending.
+type operation struct {
+	api    coreAPI
+	name   string
+	handle HcsOperation
+	state  opState
+}
+
+func newOperation(api coreAPI, name string) (*operation, error) {
+	h := api.CreateOperation()
+	if h == 0 {
+		return nil, fmt.Errorf("%s: HcsCreateOperation failed", name)
+	}
+	return &operation{api: api, name: name, handle: h, state: opCreated}, nil
+}
+
+// submit records the HRESULT returned by the call the operation was passed
+// to. A failing call never starts the operation, so there is nothing to wait
+// for.
+func (o *operation) submit(hr uint32) error {
+	if o.state != opCreated {
+		return fmt.Errorf("%s: submit on %s operation", o.name, o.state)
+	}
+	if hr != 0 {
+		o.state = opDone
+		return hcsError(hr, "")
+	}
+	o.state = opPending
+	return nil
+}
+
+// wait blocks until the operation completes and returns its result document.
+func (o *operation) wait(timeout time.Duration) (string, error) {
+	if o.state != opPending {
+		return "", fmt.Errorf("%s: wait on %s operation", o.name, o.state)
+	}
+	hr, result := o.api.WaitForOperationResult(o.handle, timeoutMs(timeout))
+	return result, o.complete(hr, result, timeout)
+}
+
+// waitProcessInfo is wait for an operation passed to HcsCreateProcess.
+func (o *operation) waitProcessInfo(timeout time.Duration) (HcsProcessInformation, string, error) {
+	if o.state != opPending {
+		return HcsProcessInformation{}, "", fmt.Errorf("%s: wait on %s operation", o.name, o.state)
+	}
+	hr, info, result := o.api.WaitForOperationResultAndProcessInfo(o.handle, timeoutMs(timeout))
+	return info, result, o.complete(hr, result, timeout)
+}
+
+func (o *operation) complete(hr uint32, result string, timeout time.Duration) error {
+	if hr == hrTimeout {
+		o.api.CancelOperation(o.handle)
+		o.state = opTimedOut
+		return fmt.Errorf("timeout after %s waiting for %s", timeout, o.name)
+	}
+	o.state = opDone
+	return hcsError(hr, result)
+}
+
+// close releases the operation handle, cancelling it first if a result was
+// never collected.
+func (o *operation) close() {
+	if o.state == opClosed {
+		return
+	}
+	if o.state == opPending {
+		o.api.CancelOperation(o.handle)
+	}
+	o.api.CloseOperation(o.handle)
+	o.state = opClosed
+}
+
+func timeoutMs(d time.Duration) uint32 {
+	if d <= 0 {
+		return 0xFFFFFFFF // INFINITE
+	}
+	return uint32(d / time.Millisecond)
+}
+
+// subscribers fans the single event callback computecore.dll allows per
+// handle out to any number of NotifySystem/NotifyProcess registrations.
+type subscribers struct {
+	mu   sync.Mutex
+	next int
+	// byHandle is keyed by system or process handle; a key is present once
+	// the DLL callback has been installed for that handle.
+	byHandle map[uintptr]map[int]func(Notification)
+}
+
+// add registers fn for handle. install is called, with the lock released, the
+// first time a handle is subscribed to.
+func (s *subscribers) add(handle uintptr, fn func(Notification), install func() error) (func(), error) {
+	s.mu.Lock()
+	if s.byHandle == nil {
+		s.byHandle = make(map[uintptr]map[int]func(Notification))
+	}
+	fns, installed := s.byHandle[handle]
+	if !installed {
+		fns = make(map[int]func(Notification))
+		s.byHandle[handle] = fns
+	}
+	s.next++
+	id := s.next
+	fns[id] = fn
+	s.mu.Unlock()
+
+	if !installed {
+		if err := install(); err != nil {
+			s.forget(handle)
+			return nil, err
+		}
+	}
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.byHandle[handle], id)
+	}, nil
+}
+
+// dispatch delivers n to every subscriber of handle.
+func (s *subscribers) dispatch(handle uintptr, n Notification) {
+	s.mu.Lock()
+	fns := make([]func(Notification), 0, len(s.byHandle[handle]))
+	for _, fn := range s.byHandle[handle] {
+		fns = append(fns, fn)
+	}
+	s.mu.Unlock()
+	for _, fn := range fns {
+		fn(n)
+	}
+}
+
+// forget drops every subscriber of handle; called when the handle is closed.
+func (s *subscribers) forget(handle uintptr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.byHandle, handle)
+}
+
+// computecoreBackend implements Backend on the operation-based API in
+// computecore.dll: every call is given an HCS_OPERATION and its completion is
+// collected with HcsWaitForOperationResult.
+type computecoreBackend struct {
+	api  coreAPI
+	subs subscribers
+}
+
+func newComputecoreBackend(api coreAPI) *computecoreBackend {
+	return &computecoreBackend{api: api}
+}
+
+func (b *computecoreBackend) Name() string { return BackendComputecore }
+
+// do runs call with a fresh operation and waits up to timeout for its result.
+func (b *computecoreBackend) do(name string, timeout time.Duration, call func(op HcsOperation) uint32) (string, error) {
+	op, err := newOperation(b.api, name)
+	if err != nil {
+		return "", err
+	}
+	defer op.close()
+	if err := op.submit(call(op.handle)); err != nil {
+		return "", err
+	}
+	return op.wait(timeout)
+}
+
+func (b *computecoreBackend) CreateComputeSystem(id, configuration string) (HcsSystem, error) {
+	op, err := newOperation(b.api, "HcsCreateComputeSystem")
+	if err != nil {
+		return 0, err
+	}
+	defer op.close()
+
+	hr, system := b.api.CreateComputeSystem(id, configuration, op.handle)
+	if err := op.submit(hr); err != nil {
+		return 0, err
+	}
+	if _, err := op.wait(60 * time.Second); err != nil {
+		if op.state == opTimedOut {
+			// The cancelled creation may still complete; do not leave a
+			// half-created system behind the closed handle.
+			if _, termErr := b.do("HcsTerminateComputeSystem", 10*time.Second, func(op HcsOperation) uint32 {
+				return b.api.TerminateComputeSystem(system, op, "")
+			}); termErr != nil {
+				err = fmt.Errorf("%w; terminate half-created system: %v", err, termErr)
+			}
+		}
+		b.api.CloseComputeSystem(system)
+		return 0, err
+	}
+	return system, nil
+}
+
+func (b *computecoreBackend) OpenComputeSystem(id string) (HcsSystem, error) {
+	hr, system := b.api.OpenComputeSystem(id)
+	if err := hcsError(hr, ""); err != nil {
+		return 0, err
+	}
+	return system, nil
+}
+
+func (b *computecoreBackend) StartComputeSystem(system HcsSystem, options string) error {
+	_, err := b.do("HcsStartComputeSystem", 120*time.Second, func(op HcsOperation) uint32 {
+		return b.api.StartComputeSystem(system, op, options)
+	})
+	return err
+}
+
+// ShutdownComputeSystem waits for the system to exit, as the vmcompute.dll
+// backend does, not just for the shutdown request to be accepted.
+func (b *computecoreBackend) ShutdownComputeSystem(system HcsSystem, options string) error {
+	return b.untilExited(system, 30*time.Second, "HcsShutDownComputeSystem", func(op HcsOperation) uint32 {
+		return b.api.ShutDownComputeSystem(system, op, options)
+	})
+}
+
+func (b *computecoreBackend) TerminateComputeSystem(system HcsSystem, options string) error {
+	return b.untilExited(system, 10*time.Second, "HcsTerminateComputeSystem", func(op HcsOperation) uint32 {
+		return b.api.TerminateComputeSystem(system, op, options)
+	})
+}
+
+// untilExited runs call and then waits for the SystemExited event. The
+// subscription is made first so that an exit racing the call is not missed.
+func (b *computecoreBackend) untilExited(system HcsSystem, timeout time.Duration, name string, call func(op HcsOperation) uint32) error {
+	exited := make(chan struct{})
+	var once sync.Once
+	unregister, err := b.NotifySystem(system, func(n Notification) {
+		if n.Type == NotificationSystemExited {
+			once.Do(func() { close(exited) })
+		}
+	})
+	if err != nil {
+		return err
+	}
+	defer unregister()
+
+	deadline := time.Now().Add(timeout)
+	if _, err := b.do(name, timeout, call); err != nil {
+		return err
+	}
+	select {
+	case <-exited:
+		return nil
+	case <-time.After(time.Until(deadline)):
+		return fmt.Errorf("timeout after %s waiting for system to exit", timeout)
+	}
+}
+
+func (b *computecoreBackend) PauseComputeSystem(system HcsSystem, options string) error {
+	_, err := b.do("HcsPauseComputeSystem", 60*time.Second, func(op HcsOperation) uint32 {
+		return b.api.PauseComputeSystem(system, op, options)
+	})
+	return err
+}
+
+func (b *computecoreBackend) ResumeComputeSystem(system HcsSystem, options string) error {
+	_, err := b.do("HcsResumeComputeSystem", 60*time.Second, func(op HcsOperation) uint32 {
+		return b.api.ResumeComputeSystem(system, op, options)
+	})
+	return err
+}
+
+func (b *computecoreBackend) SaveComputeSystem(system HcsSystem, options string) error {
+	_, err := b.do("HcsSaveComputeSystem", 5*time.Minute, func(op HcsOperation) uint32 {
+		return b.api.SaveComputeSystem(system, op, options)
+	})
+	return err
+}
+
+func (b *computecoreBackend) ModifyComputeSystem(system HcsSystem, configuration string) error {
+	_, err := b.do("HcsModifyComputeSystem", 60*time.Second, func(op HcsOperation) uint32 {
+		return b.api.ModifyComputeSystem(system, op, configuration)
+	})
+	return err
+}
+
+func (b *computecoreBackend) CloseComputeSystem(system HcsSystem) error {
+	b.subs.forget(uintptr(system))
+	b.api.CloseComputeSystem(system)
+	return nil
+}
+
+func (b *computecoreBackend) EnumerateComputeSystems(query string) (string, error) {
+	return b.do("HcsEnumerateComputeSystems", 30*time.Second, func(op HcsOperation) uint32 {
+		return b.api.EnumerateComputeSystems(query, op)
+	})
+}
+
+func (b *computecoreBackend) NotifySystem(system HcsSystem, fn func(Notification)) (func(), error) {
+	return b.subs.add(uintptr(system), fn, func() error {
+		return hcsError(b.api.SetComputeSystemCallback(system, b.eventHandler(uintptr(system))), "HcsSetComputeSystemCallback")
+	})
+}
+
+// eventHandler returns the DLL callback for handle, translating events into
+// Notifications for its subscribers.
+func (b *computecoreBackend) eventHandler(handle uintptr) func(eventType uint32, data string) {
+	return func(eventType uint32, data string) {
+		t := eventNotification(eventType)
+		if t == NotificationInvalid {
+			return
+		}
+		b.subs.dispatch(handle, Notification{Type: t, Data: data})
+	}
+}
+
+func (b *computecoreBackend) CreateProcess(system HcsSystem, processParameters string) (HcsProcess, *HcsProcessInformation, error) {
+	op, err := newOperation(b.api, "HcsCreateProcess")
+	if err != nil {
+		return 0, nil, err
+	}
+	defer op.close()
+
+	hr, process := b.api.CreateProcess(system, processParameters, op.handle)
+	if err := op.submit(hr); err != nil {
+		return 0, nil, err
+	}
+	info, _, err := op.waitProcessInfo(30 * time.Second)
+	if err != nil {
+		b.api.CloseProcess(process)
+		return 0, nil, err
+	}
+	return process, &info, nil
+}
+
+func (b *computecoreBackend) GetProcessProperties(process HcsProcess) (string, error) {
+	return b.do("HcsGetProcessProperties", 30*time.Second, func(op HcsOperation) uint32 {
+		return b.api.GetProcessProperties(process, op, "")
+	})
+}
+
+func (b *computecoreBackend) SignalProcess(process HcsProcess, options string) error {
+	_, err := b.do("HcsSignalProcess", 30*time.Second, func(op HcsOperation) uint32 {
+		return b.api.SignalProcess(process, op, options)
+	})
+	return err
+}
+
+func (b *computecoreBackend) ModifyProcess(process HcsProcess, settings string) error {
+	_, err := b.do("HcsModifyProcess", 30*time.Second, func(op HcsOperation) uint32 {
+		return b.api.ModifyProcess(process, op, settings)
+	})
+	return err
+}
+
+func (b *computecoreBackend) TerminateProcess(process HcsProcess) error {
+	_, err := b.do("HcsTerminateProcess", 30*time.Second, func(op HcsOperation) uint32 {
+		return b.api.TerminateProcess(process, op, "")
+	})
+	return err
+}
+
+func (b *computecoreBackend) CloseProcess(process HcsProcess) error {
+	b.subs.forget(uintptr(process))
+	b.api.CloseProcess(process)
+	return nil
+}
+
+func (b *computecoreBackend) NotifyProcess(process HcsProcess, fn func(Notification)) (func(), error) {
+	return b.subs.add(uintptr(process), fn, func() error {
+		return hcsError(b.api.SetProcessCallback(process, b.eventHandler(uintptr(process))), "HcsSetProcessCallback")
+	})
+}
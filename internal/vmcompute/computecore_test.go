@@ -0,0 +1,169 @@
+package vmcompute
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// fakeCore is a coreAPI that logs the calls made to it. Calls it does not
+// implement panic through the nil embedded interface.
+type fakeCore struct {
+	coreAPI
+
+	calls       []string
+	ops         HcsOperation
+	createHR    uint32
+	waitHRs     []uint32 // results of successive waits, then 0
+	terminateHR uint32
+}
+
+func (f *fakeCore) log(format string, args ...any) {
+	f.calls = append(f.calls, fmt.Sprintf(format, args...))
+}
+
+func (f *fakeCore) CreateOperation() HcsOperation {
+	f.ops++
+	f.log("CreateOperation %d", f.ops)
+	return f.ops
+}
+
+func (f *fakeCore) CloseOperation(op HcsOperation) { f.log("CloseOperation %d", op) }
+
+func (f *fakeCore) CancelOperation(op HcsOperation) uint32 {
+	f.log("CancelOperation %d", op)
+	return 0
+}
+
+func (f *fakeCore) WaitForOperationResult(op HcsOperation, timeoutMs uint32) (uint32, string) {
+	f.log("WaitForOperationResult %d", op)
+	var hr uint32
+	if len(f.waitHRs) > 0 {
+		hr, f.waitHRs = f.waitHRs[0], f.waitHRs[1:]
+	}
+	return hr, ""
+}
+
+func (f *fakeCore) CreateComputeSystem(id, configuration string, op HcsOperation) (uint32, HcsSystem) {
+	f.log("CreateComputeSystem %s %d", id, op)
+	return f.createHR, 100
+}
+
+func (f *fakeCore) TerminateComputeSystem(system HcsSystem, op HcsOperation, options string) uint32 {
+	f.log("TerminateComputeSystem %d %d", system, op)
+	return f.terminateHR
+}
+
+func (f *fakeCore) CloseComputeSystem(system HcsSystem) { f.log("CloseComputeSystem %d", system) }
+
+func checkCalls(t *testing.T, f *fakeCore, want ...string) {
+	t.Helper()
+	if got := strings.Join(f.calls, "\n"); got != strings.Join(want, "\n") {
+		t.Fatalf("calls:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+}
+
+func TestCreateComputeSystemSubmitFailure(t *testing.T) {
+	f := &fakeCore{createHR: HrSystemAlreadyExists}
+	b := newComputecoreBackend(f)
+	_, err := b.CreateComputeSystem("vm", "{}")
+	var hcsErr *HcsError
+	if !errors.As(err, &hcsErr) || hcsErr.HResult != HrSystemAlreadyExists {
+		t.Fatalf("err = %v, want HRESULT %#x", err, HrSystemAlreadyExists)
+	}
+	// The operation never started: nothing to wait for or cancel.
+	checkCalls(t, f,
+		"CreateOperation 1",
+		"CreateComputeSystem vm 1",
+		"CloseOperation 1",
+	)
+}
+
+func TestCreateComputeSystemWaitTimeout(t *testing.T) {
+	f := &fakeCore{waitHRs: []uint32{hrTimeout}}
+	b := newComputecoreBackend(f)
+	_, err := b.CreateComputeSystem("vm", "{}")
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("err = %v, want a timeout", err)
+	}
+	checkCalls(t, f,
+		"CreateOperation 1",
+		"CreateComputeSystem vm 1",
+		"WaitForOperationResult 1",
+		"CancelOperation 1",
+		"CreateOperation 2",
+		"TerminateComputeSystem 100 2",
+		"WaitForOperationResult 2",
+		"CloseOperation 2",
+		"CloseComputeSystem 100",
+		"CloseOperation 1",
+	)
+}
+
+func TestCreateComputeSystemWaitTimeoutTerminateFails(t *testing.T) {
+	f := &fakeCore{waitHRs: []uint32{hrTimeout}, terminateHR: HrInvalidState}
+	b := newComputecoreBackend(f)
+	_, err := b.CreateComputeSystem("vm", "{}")
+	if err == nil || !strings.Contains(err.Error(), "terminate half-created system") {
+		t.Fatalf("err = %v, want the terminate failure reported", err)
+	}
+	if last := f.calls[len(f.calls)-2]; last != "CloseComputeSystem 100" {
+		t.Fatalf("handle not closed after failed terminate: %v", f.calls)
+	}
+}
+
+func TestCreateComputeSystemFailedResult(t *testing.T) {
+	f := &fakeCore{waitHRs: []uint32{HrInvalidState}}
+	b := newComputecoreBackend(f)
+	if _, err := b.CreateComputeSystem("vm", "{}"); err == nil {
+		t.Fatal("want an error")
+	}
+	// Creation failed outright: there is no system to terminate.
+	checkCalls(t, f,
+		"CreateOperation 1",
+		"CreateComputeSystem vm 1",
+		"WaitForOperationResult 1",
+		"CloseComputeSystem 100",
+		"CloseOperation 1",
+	)
+}
+
+func TestOperationCloseWhilePending(t *testing.T) {
+	f := &fakeCore{}
+	op, err := newOperation(f, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := op.submit(0); err != nil {
+		t.Fatal(err)
+	}
+	op.close()
+	op.close()
+	if _, err := op.wait(0); err == nil {
+		t.Fatal("wait on a closed operation succeeded")
+	}
+	if err := op.submit(0); err == nil {
+		t.Fatal("submit on a closed operation succeeded")
+	}
+	checkCalls(t, f,
+		"CreateOperation 1",
+		"CancelOperation 1",
+		"CloseOperation 1",
+	)
+}
+
+func TestOperationCloseAfterResult(t *testing.T) {
+	f := &fakeCore{}
+	op, _ := newOperation(f, "test")
+	_ = op.submit(0)
+	if _, err := op.wait(0); err != nil {
+		t.Fatal(err)
+	}
+	op.close()
+	checkCalls(t, f,
+		"CreateOperation 1",
+		"WaitForOperationResult 1",
+		"CloseOperation 1",
+	)
+}
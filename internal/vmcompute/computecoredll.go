@@ -0,0 +1,316 @@
+//go:build windows
+
+package vmcompute
+
+import (
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	modComputecore = syscall.NewLazyDLL("computecore.dll")
+	modKernel32    = syscall.NewLazyDLL("kernel32.dll")
+
+	// Operations.
+	procCoreCreateOperation                      = modComputecore.NewProc("HcsCreateOperation")
+	procCoreCloseOperation                       = modComputecore.NewProc("HcsCloseOperation")
+	procCoreCancelOperation                      = modComputecore.NewProc("HcsCancelOperation")
+	procCoreWaitForOperationResult               = modComputecore.NewProc("HcsWaitForOperationResult")
+	procCoreWaitForOperationResultAndProcessInfo = modComputecore.NewProc("HcsWaitForOperationResultAndProcessInfo")
+
+	// Compute systems.
+	procCoreCreateComputeSystem      = modComputecore.NewProc("HcsCreateComputeSystem")
+	procCoreOpenComputeSystem        = modComputecore.NewProc("HcsOpenComputeSystem")
+	procCoreCloseComputeSystem       = modComputecore.NewProc("HcsCloseComputeSystem")
+	procCoreStartComputeSystem       = modComputecore.NewProc("HcsStartComputeSystem")
+	procCoreShutDownComputeSystem    = modComputecore.NewProc("HcsShutDownComputeSystem")
+	procCoreTerminateComputeSystem   = modComputecore.NewProc("HcsTerminateComputeSystem")
+	procCorePauseComputeSystem       = modComputecore.NewProc("HcsPauseComputeSystem")
+	procCoreResumeComputeSystem      = modComputecore.NewProc("HcsResumeComputeSystem")
+	procCoreSaveComputeSystem        = modComputecore.NewProc("HcsSaveComputeSystem")
+	procCoreModifyComputeSystem      = modComputecore.NewProc("HcsModifyComputeSystem")
+	procCoreEnumerateComputeSystems  = modComputecore.NewProc("HcsEnumerateComputeSystems")
+	procCoreSetComputeSystemCallback = modComputecore.NewProc("HcsSetComputeSystemCallback")
+
+	// Processes.
+	procCoreCreateProcess        = modComputecore.NewProc("HcsCreateProcess")
+	procCoreCloseProcess         = modComputecore.NewProc("HcsCloseProcess")
+	procCoreTerminateProcess     = modComputecore.NewProc("HcsTerminateProcess")
+	procCoreSignalProcess        = modComputecore.NewProc("HcsSignalProcess")
+	procCoreModifyProcess        = modComputecore.NewProc("HcsModifyProcess")
+	procCoreGetProcessProperties = modComputecore.NewProc("HcsGetProcessProperties")
+	procCoreSetProcessCallback   = modComputecore.NewProc("HcsSetProcessCallback")
+
+	procLocalFree = modKernel32.NewProc("LocalFree")
+)
+
+// genericAll is the requestedAccess passed to HcsOpenComputeSystem.
+const genericAll = 0x10000000
+
+// hcsEvent mirrors HCS_EVENT.
+type hcsEvent struct {
+	Type      uint32
+	EventData *uint16
+	Operation HcsOperation
+}
+
+// eventCallbacks holds every callback installed through the DLL layer;
+// eventCallback is the single HCS_EVENT_CALLBACK trampoline. eventContexts
+// maps a system or process handle to its registry context so the entry can
+// be dropped when the handle is closed.
+var (
+	eventCallbacks callbackRegistry
+	eventContexts  sync.Map // uintptr handle → uintptr ctx
+	eventCallback  = syscall.NewCallback(func(event *hcsEvent, ctx uintptr) uintptr {
+		if event != nil {
+			eventCallbacks.dispatch(ctx, event.Type, 0, ptrToString(event.EventData))
+		}
+		return 0
+	})
+)
+
+// computecoreDLL implements coreAPI by calling computecore.dll.
+type computecoreDLL struct{}
+
+// NewComputecoreBackend returns the Backend built on computecore.dll.
+func NewComputecoreBackend() Backend {
+	return newComputecoreBackend(computecoreDLL{})
+}
+
+// computecoreAvailable reports whether computecore.dll (Windows 10 1809 /
+// Server 2019 and later) can be loaded on this host.
+func computecoreAvailable() bool {
+	return modComputecore.Load() == nil && procCoreCreateOperation.Find() == nil
+}
+
+// takeLocalString converts and frees a string allocated by computecore.dll.
+// Unlike vmcompute.dll, computecore.dll allocates with LocalAlloc.
+func takeLocalString(ptr *uint16) string {
+	if ptr == nil {
+		return ""
+	}
+	s := ptrToString(ptr)
+	procLocalFree.Call(uintptr(unsafe.Pointer(ptr)))
+	return s
+}
+
+// utf16Ptr converts s for a PCWSTR argument; "" becomes NULL.
+func utf16Ptr(s string) (*uint16, uint32) {
+	if s == "" {
+		return nil, 0
+	}
+	p, err := syscall.UTF16PtrFromString(s)
+	if err != nil {
+		return nil, hrInvalidArg
+	}
+	return p, 0
+}
+
+func (computecoreDLL) CreateOperation() HcsOperation {
+	h, _, _ := procCoreCreateOperation.Call(0, 0)
+	return HcsOperation(h)
+}
+
+func (computecoreDLL) CloseOperation(op HcsOperation) {
+	procCoreCloseOperation.Call(uintptr(op))
+}
+
+func (computecoreDLL) CancelOperation(op HcsOperation) uint32 {
+	hr, _, _ := procCoreCancelOperation.Call(uintptr(op))
+	return uint32(hr)
+}
+
+func (computecoreDLL) WaitForOperationResult(op HcsOperation, timeoutMs uint32) (uint32, string) {
+	var result *uint16
+	hr, _, _ := procCoreWaitForOperationResult.Call(
+		uintptr(op),
+		uintptr(timeoutMs),
+		uintptr(unsafe.Pointer(&result)),
+	)
+	return uint32(hr), takeLocalString(result)
+}
+
+func (computecoreDLL) WaitForOperationResultAndProcessInfo(op HcsOperation, timeoutMs uint32) (uint32, HcsProcessInformation, string) {
+	var info HcsProcessInformation
+	var result *uint16
+	hr, _, _ := procCoreWaitForOperationResultAndProcessInfo.Call(
+		uintptr(op),
+		uintptr(timeoutMs),
+		uintptr(unsafe.Pointer(&info)),
+		uintptr(unsafe.Pointer(&result)),
+	)
+	return uint32(hr), info, takeLocalString(result)
+}
+
+func (computecoreDLL) CreateComputeSystem(id, configuration string, op HcsOperation) (uint32, HcsSystem) {
+	idPtr, hr := utf16Ptr(id)
+	if hr != 0 {
+		return hr, 0
+	}
+	configPtr, hr := utf16Ptr(configuration)
+	if hr != 0 {
+		return hr, 0
+	}
+	var system HcsSystem
+	r, _, _ := procCoreCreateComputeSystem.Call(
+		uintptr(unsafe.Pointer(idPtr)),
+		uintptr(unsafe.Pointer(configPtr)),
+		uintptr(op),
+		0, // SECURITY_DESCRIPTOR = NULL
+		uintptr(unsafe.Pointer(&system)),
+	)
+	return uint32(r), system
+}
+
+func (computecoreDLL) OpenComputeSystem(id string) (uint32, HcsSystem) {
+	idPtr, hr := utf16Ptr(id)
+	if hr != 0 {
+		return hr, 0
+	}
+	var system HcsSystem
+	r, _, _ := procCoreOpenComputeSystem.Call(
+		uintptr(unsafe.Pointer(idPtr)),
+		genericAll,
+		uintptr(unsafe.Pointer(&system)),
+	)
+	return uint32(r), system
+}
+
+func (computecoreDLL) CloseComputeSystem(system HcsSystem) {
+	procCoreCloseComputeSystem.Call(uintptr(system))
+	dropCallback(uintptr(system))
+}
+
+// callWithOptions calls an HCS function with the (Handle, Operation, PCWSTR)
+// signature shared by most computecore.dll entry points.
+func callWithOptions(proc *syscall.LazyProc, handle uintptr, op HcsOperation, options string) uint32 {
+	optionsPtr, hr := utf16Ptr(options)
+	if hr != 0 {
+		return hr
+	}
+	r, _, _ := proc.Call(handle, uintptr(op), uintptr(unsafe.Pointer(optionsPtr)))
+	return uint32(r)
+}
+
+func (computecoreDLL) StartComputeSystem(system HcsSystem, op HcsOperation, options string) uint32 {
+	return callWithOptions(procCoreStartComputeSystem, uintptr(system), op, options)
+}
+
+func (computecoreDLL) ShutDownComputeSystem(system HcsSystem, op HcsOperation, options string) uint32 {
+	return callWithOptions(procCoreShutDownComputeSystem, uintptr(system), op, options)
+}
+
+func (computecoreDLL) TerminateComputeSystem(system HcsSystem, op HcsOperation, options string) uint32 {
+	return callWithOptions(procCoreTerminateComputeSystem, uintptr(system), op, options)
+}
+
+func (computecoreDLL) PauseComputeSystem(system HcsSystem, op HcsOperation, options string) uint32 {
+	return callWithOptions(procCorePauseComputeSystem, uintptr(system), op, options)
+}
+
+func (computecoreDLL) ResumeComputeSystem(system HcsSystem, op HcsOperation, options string) uint32 {
+	return callWithOptions(procCoreResumeComputeSystem, uintptr(system), op, options)
+}
+
+func (computecoreDLL) SaveComputeSystem(system HcsSystem, op HcsOperation, options string) uint32 {
+	return callWithOptions(procCoreSaveComputeSystem, uintptr(system), op, options)
+}
+
+func (computecoreDLL) ModifyComputeSystem(system HcsSystem, op HcsOperation, configuration string) uint32 {
+	configPtr, hr := utf16Ptr(configuration)
+	if hr != 0 {
+		return hr
+	}
+	r, _, _ := procCoreModifyComputeSystem.Call(
+		uintptr(system),
+		uintptr(op),
+		uintptr(unsafe.Pointer(configPtr)),
+		0, // identity HANDLE = NULL
+	)
+	return uint32(r)
+}
+
+func (computecoreDLL) EnumerateComputeSystems(query string, op HcsOperation) uint32 {
+	queryPtr, hr := utf16Ptr(query)
+	if hr != 0 {
+		return hr
+	}
+	r, _, _ := procCoreEnumerateComputeSystems.Call(uintptr(unsafe.Pointer(queryPtr)), uintptr(op))
+	return uint32(r)
+}
+
+// setCallback installs cb as the event callback of handle via proc
+// (HcsSetComputeSystemCallback or HcsSetProcessCallback). HCS keeps the
+// callback until the handle is closed; see dropCallback.
+func setCallback(proc *syscall.LazyProc, handle uintptr, cb func(eventType uint32, data string)) uint32 {
+	ctx := eventCallbacks.add(func(eventType, _ uint32, data string) {
+		cb(eventType, data)
+	})
+	r, _, _ := proc.Call(
+		handle,
+		0, // HcsEventOptionNone
+		ctx,
+		eventCallback,
+	)
+	if r != 0 {
+		eventCallbacks.remove(ctx)
+		return uint32(r)
+	}
+	if old, loaded := eventContexts.Swap(handle, ctx); loaded {
+		eventCallbacks.remove(old.(uintptr))
+	}
+	return 0
+}
+
+// dropCallback forgets the callback installed for a handle being closed.
+func dropCallback(handle uintptr) {
+	if ctx, loaded := eventContexts.LoadAndDelete(handle); loaded {
+		eventCallbacks.remove(ctx.(uintptr))
+	}
+}
+
+func (computecoreDLL) SetComputeSystemCallback(system HcsSystem, cb func(eventType uint32, data string)) uint32 {
+	return setCallback(procCoreSetComputeSystemCallback, uintptr(system), cb)
+}
+
+func (computecoreDLL) CreateProcess(system HcsSystem, processParameters string, op HcsOperation) (uint32, HcsProcess) {
+	paramsPtr, hr := utf16Ptr(processParameters)
+	if hr != 0 {
+		return hr, 0
+	}
+	var process HcsProcess
+	r, _, _ := procCoreCreateProcess.Call(
+		uintptr(system),
+		uintptr(unsafe.Pointer(paramsPtr)),
+		uintptr(op),
+		0, // SECURITY_DESCRIPTOR = NULL
+		uintptr(unsafe.Pointer(&process)),
+	)
+	return uint32(r), process
+}
+
+func (computecoreDLL) CloseProcess(process HcsProcess) {
+	procCoreCloseProcess.Call(uintptr(process))
+	dropCallback(uintptr(process))
+}
+
+func (computecoreDLL) TerminateProcess(process HcsProcess, op HcsOperation, options string) uint32 {
+	return callWithOptions(procCoreTerminateProcess, uintptr(process), op, options)
+}
+
+func (computecoreDLL) SignalProcess(process HcsProcess, op HcsOperation, options string) uint32 {
+	return callWithOptions(procCoreSignalProcess, uintptr(process), op, options)
+}
+
+func (computecoreDLL) ModifyProcess(process HcsProcess, op HcsOperation, settings string) uint32 {
+	return callWithOptions(procCoreModifyProcess, uintptr(process), op, settings)
+}
+
+func (computecoreDLL) GetProcessProperties(process HcsProcess, op HcsOperation, propertyQuery string) uint32 {
+	return callWithOptions(procCoreGetProcessProperties, uintptr(process), op, propertyQuery)
+}
+
+func (computecoreDLL) SetProcessCallback(process HcsProcess, cb func(eventType uint32, data string)) uint32 {
+	return setCallback(procCoreSetProcessCallback, uintptr(process), cb)
+}
@@ -0,0 +1,157 @@
+package vmcompute
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// dryRunHandleBase is where fake handles start. It is far above anything
+// HCS hands out so that Close calls can tell fake handles from real ones.
+const dryRunHandleBase = 0xD000_0000
+
+// DryRun is a Backend that prints the HCS calls a command would make
+// instead of making them. Read-only calls (open, enumerate, process
+// properties) still go to the real backend so that commands can find the
+// systems they act on; every call that would change a system is printed
+// and reported as successful, returning a fake handle where one is due.
+type DryRun struct {
+	real Backend
+	w    io.Writer
+
+	mu   sync.Mutex
+	next uintptr
+}
+
+// NewDryRun returns a DryRun that reads through real and prints to w.
+func NewDryRun(real Backend, w io.Writer) *DryRun {
+	return &DryRun{real: real, w: w, next: dryRunHandleBase}
+}
+
+func (d *DryRun) print(call string, handle uintptr, args ...string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if handle != 0 {
+		fmt.Fprintf(d.w, "[dry-run] %s(%#x)\n", call, handle)
+	} else {
+		fmt.Fprintf(d.w, "[dry-run] %s\n", call)
+	}
+	for _, a := range args {
+		if a != "" {
+			fmt.Fprintf(d.w, "          %s\n", a)
+		}
+	}
+}
+
+func (d *DryRun) fakeHandle() uintptr {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.next++
+	return d.next
+}
+
+func isFakeHandle(h uintptr) bool { return h > dryRunHandleBase }
+
+func (d *DryRun) Name() string { return d.real.Name() + " (dry run)" }
+
+func (d *DryRun) CreateComputeSystem(id, configuration string) (HcsSystem, error) {
+	d.print(CallCreateComputeSystem, 0, "id="+id, configuration)
+	return HcsSystem(d.fakeHandle()), nil
+}
+
+func (d *DryRun) OpenComputeSystem(id string) (HcsSystem, error) {
+	d.print(CallOpenComputeSystem, 0, "id="+id)
+	return d.real.OpenComputeSystem(id)
+}
+
+func (d *DryRun) StartComputeSystem(system HcsSystem, options string) error {
+	d.print(CallStartComputeSystem, uintptr(system), options)
+	return nil
+}
+
+func (d *DryRun) ShutdownComputeSystem(system HcsSystem, options string) error {
+	d.print(CallShutdownComputeSystem, uintptr(system), options)
+	return nil
+}
+
+func (d *DryRun) TerminateComputeSystem(system HcsSystem, options string) error {
+	d.print(CallTerminateComputeSystem, uintptr(system), options)
+	return nil
+}
+
+func (d *DryRun) PauseComputeSystem(system HcsSystem, options string) error {
+	d.print(CallPauseComputeSystem, uintptr(system), options)
+	return nil
+}
+
+func (d *DryRun) ResumeComputeSystem(system HcsSystem, options string) error {
+	d.print(CallResumeComputeSystem, uintptr(system), options)
+	return nil
+}
+
+func (d *DryRun) SaveComputeSystem(system HcsSystem, options string) error {
+	d.print(CallSaveComputeSystem, uintptr(system), options)
+	return nil
+}
+
+func (d *DryRun) ModifyComputeSystem(system HcsSystem, configuration string) error {
+	d.print(CallModifyComputeSystem, uintptr(system), configuration)
+	return nil
+}
+
+func (d *DryRun) CloseComputeSystem(system HcsSystem) error {
+	if isFakeHandle(uintptr(system)) {
+		return nil
+	}
+	return d.real.CloseComputeSystem(system)
+}
+
+func (d *DryRun) EnumerateComputeSystems(query string) (string, error) {
+	d.print(CallEnumerateComputeSystems, 0, query)
+	return d.real.EnumerateComputeSystems(query)
+}
+
+// NotifySystem registers nothing: no operation is carried out, so no
+// notification will ever arrive.
+func (d *DryRun) NotifySystem(system HcsSystem, fn func(Notification)) (func(), error) {
+	return func() {}, nil
+}
+
+func (d *DryRun) CreateProcess(system HcsSystem, processParameters string) (HcsProcess, *HcsProcessInformation, error) {
+	d.print(CallCreateProcess, uintptr(system), processParameters)
+	return HcsProcess(d.fakeHandle()), &HcsProcessInformation{}, nil
+}
+
+func (d *DryRun) GetProcessProperties(process HcsProcess) (string, error) {
+	if isFakeHandle(uintptr(process)) {
+		// Report the process as exited so callers waiting on it return.
+		return `{"Exited":true,"ExitCode":0}`, nil
+	}
+	return d.real.GetProcessProperties(process)
+}
+
+func (d *DryRun) SignalProcess(process HcsProcess, options string) error {
+	d.print(CallSignalProcess, uintptr(process), options)
+	return nil
+}
+
+func (d *DryRun) ModifyProcess(process HcsProcess, settings string) error {
+	d.print(CallModifyProcess, uintptr(process), settings)
+	return nil
+}
+
+func (d *DryRun) TerminateProcess(process HcsProcess) error {
+	d.print(CallTerminateProcess, uintptr(process))
+	return nil
+}
+
+func (d *DryRun) CloseProcess(process HcsProcess) error {
+	if isFakeHandle(uintptr(process)) {
+		return nil
+	}
+	return d.real.CloseProcess(process)
+}
+
+func (d *DryRun) NotifyProcess(process HcsProcess, fn func(Notification)) (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,32 @@
+package vmcompute
+
+import "fmt"
+
+// HcsError is a failed HCS call: the HRESULT, the system message for it and
+// any detail HCS returned in its result document.
+type HcsError struct {
+	HResult uint32
+	Message string
+	Detail  string
+}
+
+func (e *HcsError) Error() string {
+	switch {
+	case e.Detail != "" && e.Message != "":
+		return fmt.Sprintf("HRESULT 0x%08X (%s): %s", e.HResult, e.Message, e.Detail)
+	case e.Detail != "":
+		return fmt.Sprintf("HRESULT 0x%08X: %s", e.HResult, e.Detail)
+	case e.Message != "":
+		return fmt.Sprintf("HRESULT 0x%08X (%s)", e.HResult, e.Message)
+	default:
+		return fmt.Sprintf("HRESULT 0x%08X", e.HResult)
+	}
+}
+
+// hcsError returns an *HcsError for hr, or nil if hr is S_OK.
+func hcsError(hr uint32, detail string) error {
+	if hr == 0 {
+		return nil
+	}
+	return &HcsError{HResult: hr, Message: systemMessage(hr), Detail: detail}
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package vmcompute
+
+// systemMessage has no message table to consult off Windows.
+func systemMessage(hr uint32) string {
+	return ""
+}
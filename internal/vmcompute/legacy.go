@@ -0,0 +1,91 @@
+//go:build windows
+
+package vmcompute
+
+// legacyBackend implements Backend with the vmcompute.dll bindings in this
+// package. Completion of asynchronous calls is signalled by notification
+// callbacks registered on the system handle.
+type legacyBackend struct{}
+
+// NewLegacyBackend returns the Backend built on vmcompute.dll.
+func NewLegacyBackend() Backend {
+	return legacyBackend{}
+}
+
+func (legacyBackend) Name() string { return BackendVmcompute }
+
+func (legacyBackend) CreateComputeSystem(id, configuration string) (HcsSystem, error) {
+	return HcsCreateComputeSystem(id, configuration)
+}
+
+func (legacyBackend) OpenComputeSystem(id string) (HcsSystem, error) {
+	return HcsOpenComputeSystem(id)
+}
+
+func (legacyBackend) StartComputeSystem(system HcsSystem, options string) error {
+	return HcsStartComputeSystem(system, options)
+}
+
+func (legacyBackend) ShutdownComputeSystem(system HcsSystem, options string) error {
+	return HcsShutdownComputeSystem(system, options)
+}
+
+func (legacyBackend) TerminateComputeSystem(system HcsSystem, options string) error {
+	return HcsTerminateComputeSystem(system, options)
+}
+
+func (legacyBackend) PauseComputeSystem(system HcsSystem, options string) error {
+	return HcsPauseComputeSystem(system, options)
+}
+
+func (legacyBackend) ResumeComputeSystem(system HcsSystem, options string) error {
+	return HcsResumeComputeSystem(system, options)
+}
+
+func (legacyBackend) SaveComputeSystem(system HcsSystem, options string) error {
+	return HcsSaveComputeSystem(system, options)
+}
+
+func (legacyBackend) ModifyComputeSystem(system HcsSystem, configuration string) error {
+	return HcsModifyComputeSystem(system, configuration)
+}
+
+func (legacyBackend) CloseComputeSystem(system HcsSystem) error {
+	return HcsCloseComputeSystem(system)
+}
+
+func (legacyBackend) EnumerateComputeSystems(query string) (string, error) {
+	return HcsEnumerateComputeSystems(query)
+}
+
+func (legacyBackend) NotifySystem(system HcsSystem, fn func(Notification)) (func(), error) {
+	return HcsRegisterComputeSystemCallback(system, fn)
+}
+
+func (legacyBackend) CreateProcess(system HcsSystem, processParameters string) (HcsProcess, *HcsProcessInformation, error) {
+	return HcsCreateProcess(system, processParameters)
+}
+
+func (legacyBackend) GetProcessProperties(process HcsProcess) (string, error) {
+	return HcsGetProcessProperties(process)
+}
+
+func (legacyBackend) SignalProcess(process HcsProcess, options string) error {
+	return HcsSignalProcess(process, options)
+}
+
+func (legacyBackend) ModifyProcess(process HcsProcess, settings string) error {
+	return HcsModifyProcess(process, settings)
+}
+
+func (legacyBackend) TerminateProcess(process HcsProcess) error {
+	return HcsTerminateProcess(process)
+}
+
+func (legacyBackend) CloseProcess(process HcsProcess) error {
+	return HcsCloseProcess(process)
+}
+
+func (legacyBackend) NotifyProcess(process HcsProcess, fn func(Notification)) (func(), error) {
+	return HcsRegisterProcessCallback(process, fn)
+}
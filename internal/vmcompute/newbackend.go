@@ -0,0 +1,26 @@
+//go:build windows
+
+package vmcompute
+
+import "fmt"
+
+// NewBackend returns the backend called name (BackendVmcompute or
+// BackendComputecore). BackendAuto, or "", picks computecore.dll when the
+// host has it and falls back to vmcompute.dll otherwise.
+func NewBackend(name string) (Backend, error) {
+	switch name {
+	case "", BackendAuto:
+		if computecoreAvailable() {
+			return NewComputecoreBackend(), nil
+		}
+		return NewLegacyBackend(), nil
+	case BackendVmcompute:
+		return NewLegacyBackend(), nil
+	case BackendComputecore:
+		if !computecoreAvailable() {
+			return nil, fmt.Errorf("backend %q: computecore.dll is not available on this host", name)
+		}
+		return NewComputecoreBackend(), nil
+	}
+	return nil, fmt.Errorf("unknown backend %q (want %s, %s or %s)", name, BackendAuto, BackendVmcompute, BackendComputecore)
+}
@@ -0,0 +1,52 @@
+package vmcompute
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// SystemQuery is the query document for HcsEnumerateComputeSystems. HCS
+// returns the systems matching every non-empty field; within a field any
+// listed value matches. The zero value matches all systems.
+type SystemQuery struct {
+	Ids    []string `json:"Ids,omitempty"`
+	Names  []string `json:"Names,omitempty"`
+	Types  []string `json:"Types,omitempty"`
+	Owners []string `json:"Owners,omitempty"`
+}
+
+// JSON returns the query serialized for HcsEnumerateComputeSystems, or "" for
+// a query that matches everything.
+func (q SystemQuery) JSON() (string, error) {
+	if len(q.Ids) == 0 && len(q.Names) == 0 && len(q.Types) == 0 && len(q.Owners) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(q)
+	if err != nil {
+		return "", fmt.Errorf("marshal system query: %w", err)
+	}
+	return string(b), nil
+}
+
+// SystemSummary is one entry of the HcsEnumerateComputeSystems result.
+type SystemSummary struct {
+	Id         string `json:"Id"`
+	RuntimeId  string `json:"RuntimeId"`
+	Name       string `json:"Name"`
+	Owner      string `json:"Owner"`
+	SystemType string `json:"SystemType"`
+	State      string `json:"State"`
+}
+
+// ParseSystems decodes an HcsEnumerateComputeSystems result. HCS reports no
+// systems as "", "null" or "[]".
+func ParseSystems(result string) ([]SystemSummary, error) {
+	if result == "" || result == "null" {
+		return nil, nil
+	}
+	var systems []SystemSummary
+	if err := json.Unmarshal([]byte(result), &systems); err != nil {
+		return nil, fmt.Errorf("parse enumeration result: %w", err)
+	}
+	return systems, nil
+}
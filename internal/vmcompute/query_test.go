@@ -0,0 +1,62 @@
+package vmcompute
+
+import (
+	"os"
+	"testing"
+)
+
+func TestParseSystems(t *testing.T) {
+	b, err := os.ReadFile("testdata/enumerate.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	systems, err := ParseSystems(string(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(systems) != 6 {
+		t.Fatalf("got %d systems, want 6", len(systems))
+	}
+	want := SystemSummary{
+		Id:         "vmrunner-vm",
+		RuntimeId:  "a9c1e4d2-5b7f-4c3e-9d12-6f0b8e2a7c41",
+		Name:       "vmrunner-vm",
+		Owner:      "vmrunner",
+		SystemType: "VirtualMachine",
+		State:      "Running",
+	}
+	if systems[0] != want {
+		t.Fatalf("systems[0] = %+v, want %+v", systems[0], want)
+	}
+	if s := systems[3]; s.SystemType != "Container" || s.Owner != "docker" {
+		t.Fatalf("systems[3] = %+v, want a docker container", s)
+	}
+}
+
+func TestParseSystemsEmpty(t *testing.T) {
+	for _, result := range []string{"", "null", "[]"} {
+		systems, err := ParseSystems(result)
+		if err != nil || len(systems) != 0 {
+			t.Errorf("ParseSystems(%q) = %v, %v; want none", result, systems, err)
+		}
+	}
+	if _, err := ParseSystems(`{"Id":"x"}`); err == nil {
+		t.Error("ParseSystems of an object succeeded")
+	}
+}
+
+func TestSystemQueryJSON(t *testing.T) {
+	for _, tt := range []struct {
+		q    SystemQuery
+		want string
+	}{
+		{SystemQuery{}, ""},
+		{SystemQuery{Owners: []string{"vmrunner"}}, `{"Owners":["vmrunner"]}`},
+		{SystemQuery{Ids: []string{"a", "b"}, Types: []string{"VirtualMachine"}}, `{"Ids":["a","b"],"Types":["VirtualMachine"]}`},
+	} {
+		got, err := tt.q.JSON()
+		if err != nil || got != tt.want {
+			t.Errorf("%+v.JSON() = %q, %v; want %q", tt.q, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+//go:build windows
+
+package vmcompute
+
+import (
+	"os"
+	"syscall"
+)
+
+// detach returns a duplicate of f's handle, owned by the caller, and closes
+// f.
+func detach(f *os.File) (uintptr, error) {
+	defer f.Close()
+	self, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return 0, os.NewSyscallError("GetCurrentProcess", err)
+	}
+	var h syscall.Handle
+	if err := syscall.DuplicateHandle(self, syscall.Handle(f.Fd()), self, &h, 0, false, syscall.DUPLICATE_SAME_ACCESS); err != nil {
+		return 0, os.NewSyscallError("DuplicateHandle", err)
+	}
+	return uintptr(h), nil
+}
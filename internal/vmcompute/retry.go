@@ -0,0 +1,271 @@
+package vmcompute
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// HRESULTs that RetryPolicy treats as transient, in the form computecore.dll
+// returns them. vmcompute.dll returns the HCS ones with the NTSTATUS error
+// severity instead (0xC037… for 0x8037…); compare with MatchHResult.
+const (
+	HrInvalidState        = 0x80370105 // HCS_E_INVALID_STATE: e.g. still stopping
+	HrConnectionTimeout   = 0x80370109 // HCS_E_CONNECTION_TIMEOUT
+	HrSystemNotFound      = 0x8037010E // HCS_E_SYSTEM_NOT_FOUND
+	HrSystemAlreadyExists = 0x8037010F // HCS_E_SYSTEM_ALREADY_EXISTS
+	HrServiceNotAvailable = 0x80370114 // HCS_E_SERVICE_NOT_AVAILABLE
+	HrOperationTimeout    = 0x80370118 // HCS_E_OPERATION_TIMEOUT
+	HrServiceDisconnect   = 0x8037011E // HCS_E_SERVICE_DISCONNECT
+	HrBusy                = 0x800700AA // HRESULT_FROM_WIN32(ERROR_BUSY)
+	HrServerTooBusy       = 0x800706BB // RPC_S_SERVER_TOO_BUSY
+)
+
+// HResult returns the HRESULT of an HCS failure anywhere in err's chain, or
+// 0 if err did not come from HCS.
+func HResult(err error) uint32 {
+	var hcsErr *HcsError
+	if errors.As(err, &hcsErr) {
+		return hcsErr.HResult
+	}
+	return 0
+}
+
+// MatchHResult reports whether hr is want, with either severity: the legacy
+// vmcompute.dll and computecore.dll report the same failure with different
+// top bits.
+func MatchHResult(hr, want uint32) bool {
+	const severity = 0xC0000000
+	return hr != 0 && hr&^severity == want&^severity
+}
+
+// IsNotFound reports whether err means the compute system does not exist.
+func IsNotFound(err error) bool { return MatchHResult(HResult(err), HrSystemNotFound) }
+
+// RetryPolicy says when and how often a failed call is attempted again.
+// Delays grow exponentially from Initial by Multiplier up to Max; Jitter
+// randomises each delay by up to that fraction in either direction so that
+// parallel callers do not retry in lockstep.
+type RetryPolicy struct {
+	MaxAttempts int // total attempts, including the first; <= 1 disables retry
+	Initial     time.Duration
+	Max         time.Duration
+	Multiplier  float64
+	Jitter      float64
+	// Retry lists the HRESULTs worth retrying.
+	Retry []uint32
+}
+
+// Retryable reports whether p retries err.
+func (p RetryPolicy) Retryable(err error) bool {
+	hr := HResult(err)
+	for _, r := range p.Retry {
+		if MatchHResult(hr, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// Delay returns the wait before attempt n+1 after n failed attempts (n >= 1).
+// r is a random number in [0, 1) that picks the jitter.
+func (p RetryPolicy) Delay(n int, r float64) time.Duration {
+	d := float64(p.Initial)
+	for i := 1; i < n; i++ {
+		d *= p.Multiplier
+		if p.Max > 0 && d >= float64(p.Max) {
+			d = float64(p.Max)
+			break
+		}
+	}
+	d += d * p.Jitter * (2*r - 1)
+	if d < 0 {
+		return 0
+	}
+	return time.Duration(d)
+}
+
+// retrier runs calls under per-call policies. sleep and random are
+// replaceable so that a policy can be exercised without waiting.
+type retrier struct {
+	policies map[string]RetryPolicy
+	sleep    func(time.Duration)
+	random   func() float64
+	logf     func(format string, args ...any)
+}
+
+func (r *retrier) do(call string, fn func() error) error {
+	p, ok := r.policies[call]
+	if !ok {
+		return fn()
+	}
+	for n := 1; ; n++ {
+		err := fn()
+		if err == nil || n >= p.MaxAttempts || !p.Retryable(err) {
+			if err != nil && n > 1 {
+				return fmt.Errorf("%w (after %d attempts)", err, n)
+			}
+			return err
+		}
+		d := p.Delay(n, r.random())
+		if r.logf != nil {
+			r.logf("[vmrunner] %s attempt %d failed (%v), retrying in %v", call, n, err, d)
+		}
+		r.sleep(d)
+	}
+}
+
+// DefaultRetryPolicies returns the policies NewRetrying uses when given
+// none. Every call retries while the service is busy or unavailable;
+// creating a system also retries while an old system with the same ID is
+// being torn down, and state changes retry while a transition is still in
+// progress. Close calls and notification registration are not retried.
+func DefaultRetryPolicies() map[string]RetryPolicy {
+	base := RetryPolicy{
+		MaxAttempts: 5,
+		Initial:     100 * time.Millisecond,
+		Max:         2 * time.Second,
+		Multiplier:  2,
+		Jitter:      0.2,
+		Retry:       []uint32{HrServiceNotAvailable, HrServiceDisconnect, HrConnectionTimeout, HrBusy, HrServerTooBusy},
+	}
+	with := func(p RetryPolicy, extra ...uint32) RetryPolicy {
+		p.Retry = append(append([]uint32(nil), p.Retry...), extra...)
+		return p
+	}
+	teardown := with(base, HrSystemAlreadyExists)
+	teardown.MaxAttempts = 8
+
+	return map[string]RetryPolicy{
+		CallCreateComputeSystem:     teardown,
+		CallOpenComputeSystem:       base,
+		CallStartComputeSystem:      with(base, HrInvalidState),
+		CallShutdownComputeSystem:   with(base, HrInvalidState),
+		CallTerminateComputeSystem:  with(base, HrInvalidState),
+		CallPauseComputeSystem:      with(base, HrInvalidState),
+		CallResumeComputeSystem:     with(base, HrInvalidState),
+		CallSaveComputeSystem:       with(base, HrInvalidState),
+		CallModifyComputeSystem:     with(base, HrInvalidState),
+		CallEnumerateComputeSystems: base,
+		CallCreateProcess:           base,
+		CallGetProcessProperties:    base,
+		CallSignalProcess:           base,
+		CallModifyProcess:           base,
+		CallTerminateProcess:        base,
+	}
+}
+
+// Retrying is a Backend that retries failed calls of another Backend
+// according to a RetryPolicy per call name (the Call* constants).
+type Retrying struct {
+	b Backend
+	r retrier
+}
+
+// NewRetrying wraps b. A nil policies map means DefaultRetryPolicies; calls
+// without a policy are made once.
+func NewRetrying(b Backend, policies map[string]RetryPolicy, logf func(format string, args ...any)) *Retrying {
+	if policies == nil {
+		policies = DefaultRetryPolicies()
+	}
+	return &Retrying{b: b, r: retrier{policies: policies, sleep: time.Sleep, random: rand.Float64, logf: logf}}
+}
+
+func (r *Retrying) Name() string { return r.b.Name() }
+
+func (r *Retrying) CreateComputeSystem(id, configuration string) (system HcsSystem, err error) {
+	err = r.r.do(CallCreateComputeSystem, func() error {
+		system, err = r.b.CreateComputeSystem(id, configuration)
+		return err
+	})
+	return system, err
+}
+
+func (r *Retrying) OpenComputeSystem(id string) (system HcsSystem, err error) {
+	err = r.r.do(CallOpenComputeSystem, func() error {
+		system, err = r.b.OpenComputeSystem(id)
+		return err
+	})
+	return system, err
+}
+
+func (r *Retrying) StartComputeSystem(system HcsSystem, options string) error {
+	return r.r.do(CallStartComputeSystem, func() error { return r.b.StartComputeSystem(system, options) })
+}
+
+func (r *Retrying) ShutdownComputeSystem(system HcsSystem, options string) error {
+	return r.r.do(CallShutdownComputeSystem, func() error { return r.b.ShutdownComputeSystem(system, options) })
+}
+
+func (r *Retrying) TerminateComputeSystem(system HcsSystem, options string) error {
+	return r.r.do(CallTerminateComputeSystem, func() error { return r.b.TerminateComputeSystem(system, options) })
+}
+
+func (r *Retrying) PauseComputeSystem(system HcsSystem, options string) error {
+	return r.r.do(CallPauseComputeSystem, func() error { return r.b.PauseComputeSystem(system, options) })
+}
+
+func (r *Retrying) ResumeComputeSystem(system HcsSystem, options string) error {
+	return r.r.do(CallResumeComputeSystem, func() error { return r.b.ResumeComputeSystem(system, options) })
+}
+
+func (r *Retrying) SaveComputeSystem(system HcsSystem, options string) error {
+	return r.r.do(CallSaveComputeSystem, func() error { return r.b.SaveComputeSystem(system, options) })
+}
+
+func (r *Retrying) ModifyComputeSystem(system HcsSystem, configuration string) error {
+	return r.r.do(CallModifyComputeSystem, func() error { return r.b.ModifyComputeSystem(system, configuration) })
+}
+
+func (r *Retrying) CloseComputeSystem(system HcsSystem) error {
+	return r.r.do(CallCloseComputeSystem, func() error { return r.b.CloseComputeSystem(system) })
+}
+
+func (r *Retrying) EnumerateComputeSystems(query string) (result string, err error) {
+	err = r.r.do(CallEnumerateComputeSystems, func() error {
+		result, err = r.b.EnumerateComputeSystems(query)
+		return err
+	})
+	return result, err
+}
+
+func (r *Retrying) NotifySystem(system HcsSystem, fn func(Notification)) (func(), error) {
+	return r.b.NotifySystem(system, fn)
+}
+
+func (r *Retrying) CreateProcess(system HcsSystem, processParameters string) (process HcsProcess, info *HcsProcessInformation, err error) {
+	err = r.r.do(CallCreateProcess, func() error {
+		process, info, err = r.b.CreateProcess(system, processParameters)
+		return err
+	})
+	return process, info, err
+}
+
+func (r *Retrying) GetProcessProperties(process HcsProcess) (result string, err error) {
+	err = r.r.do(CallGetProcessProperties, func() error {
+		result, err = r.b.GetProcessProperties(process)
+		return err
+	})
+	return result, err
+}
+
+func (r *Retrying) SignalProcess(process HcsProcess, options string) error {
+	return r.r.do(CallSignalProcess, func() error { return r.b.SignalProcess(process, options) })
+}
+
+func (r *Retrying) ModifyProcess(process HcsProcess, settings string) error {
+	return r.r.do(CallModifyProcess, func() error { return r.b.ModifyProcess(process, settings) })
+}
+
+func (r *Retrying) TerminateProcess(process HcsProcess) error {
+	return r.r.do(CallTerminateProcess, func() error { return r.b.TerminateProcess(process) })
+}
+
+func (r *Retrying) CloseProcess(process HcsProcess) error {
+	return r.r.do(CallCloseProcess, func() error { return r.b.CloseProcess(process) })
+}
+
+func (r *Retrying) NotifyProcess(process HcsProcess, fn func(Notification)) (func(), error) {
+	return r.b.NotifyProcess(process, fn)
+}
@@ -0,0 +1,62 @@
+package vmcompute
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestIsNotFound(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{&HcsError{HResult: 0x8037010E}, true},                         // computecore.dll
+		{&HcsError{HResult: 0xC037010E}, true},                         // vmcompute.dll
+		{fmt.Errorf("open: %w", &HcsError{HResult: 0xC037010E}), true}, // wrapped
+		{&HcsError{HResult: 0xC037010F}, false},
+		{fmt.Errorf("not found"), false},
+		{nil, false},
+	} {
+		if got := IsNotFound(tt.err); got != tt.want {
+			t.Errorf("IsNotFound(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+// TestRetryLegacyHResults checks that the default policies retry the
+// NTSTATUS-severity HRESULTs of vmcompute.dll like their computecore.dll
+// forms.
+func TestRetryLegacyHResults(t *testing.T) {
+	for _, hr := range []uint32{HrSystemAlreadyExists, 0xC037010F, HrServiceDisconnect, 0xC037011E} {
+		var slept []time.Duration
+		r := retrier{
+			policies: DefaultRetryPolicies(),
+			sleep:    func(d time.Duration) { slept = append(slept, d) },
+			random:   func() float64 { return 0.5 },
+		}
+		attempts := 0
+		err := r.do(CallCreateComputeSystem, func() error {
+			attempts++
+			if attempts < 3 {
+				return &HcsError{HResult: hr}
+			}
+			return nil
+		})
+		if err != nil || attempts != 3 || len(slept) != 2 {
+			t.Errorf("%#x: err %v after %d attempts, %d sleeps; want success on the third", hr, err, attempts, len(slept))
+		}
+	}
+}
+
+func TestRetryNotRetryable(t *testing.T) {
+	r := retrier{policies: DefaultRetryPolicies(), sleep: func(time.Duration) { t.Fatal("slept") }, random: func() float64 { return 0 }}
+	attempts := 0
+	err := r.do(CallOpenComputeSystem, func() error {
+		attempts++
+		return &HcsError{HResult: 0xC037010E}
+	})
+	if !IsNotFound(err) || attempts != 1 {
+		t.Fatalf("err %v after %d attempts, want not found after one", err, attempts)
+	}
+}
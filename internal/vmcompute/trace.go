@@ -0,0 +1,492 @@
+package vmcompute
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Call names used in traces. They follow the vmcompute.dll function names;
+// NotificationCall marks a notification delivered to a subscriber.
+const (
+	CallCreateComputeSystem     = "HcsCreateComputeSystem"
+	CallOpenComputeSystem       = "HcsOpenComputeSystem"
+	CallStartComputeSystem      = "HcsStartComputeSystem"
+	CallShutdownComputeSystem   = "HcsShutdownComputeSystem"
+	CallTerminateComputeSystem  = "HcsTerminateComputeSystem"
+	CallPauseComputeSystem      = "HcsPauseComputeSystem"
+	CallResumeComputeSystem     = "HcsResumeComputeSystem"
+	CallSaveComputeSystem       = "HcsSaveComputeSystem"
+	CallModifyComputeSystem     = "HcsModifyComputeSystem"
+	CallCloseComputeSystem      = "HcsCloseComputeSystem"
+	CallEnumerateComputeSystems = "HcsEnumerateComputeSystems"
+	CallRegisterSystemCallback  = "HcsRegisterComputeSystemCallback"
+	CallCreateProcess           = "HcsCreateProcess"
+	CallGetProcessProperties    = "HcsGetProcessProperties"
+	CallSignalProcess           = "HcsSignalProcess"
+	CallModifyProcess           = "HcsModifyProcess"
+	CallTerminateProcess        = "HcsTerminateProcess"
+	CallCloseProcess            = "HcsCloseProcess"
+	CallRegisterProcessCallback = "HcsRegisterProcessCallback"
+	NotificationCall            = "Notification"
+)
+
+// TraceRecord is one line of a JSONL trace: a Backend call with its
+// arguments and outcome, or a notification delivered to a subscriber of
+// Handle.
+type TraceRecord struct {
+	Seq  int       `json:"seq"`
+	Time time.Time `json:"time"`
+	Call string    `json:"call"`
+
+	// Arguments.
+	ID     string  `json:"id,omitempty"`
+	Handle uintptr `json:"handle,omitempty"`
+	Input  string  `json:"input,omitempty"`
+
+	// Outcome.
+	Result       string                 `json:"result,omitempty"`
+	ResultHandle uintptr                `json:"resultHandle,omitempty"`
+	ProcessInfo  *HcsProcessInformation `json:"processInfo,omitempty"`
+	HResult      uint32                 `json:"hresult,omitempty"`
+	Message      string                 `json:"message,omitempty"`
+	Detail       string                 `json:"detail,omitempty"`
+	Error        string                 `json:"error,omitempty"`
+
+	Notification *Notification `json:"notification,omitempty"`
+}
+
+func (r *TraceRecord) setError(err error) {
+	var hcsErr *HcsError
+	switch {
+	case err == nil:
+	case errors.As(err, &hcsErr):
+		r.HResult, r.Message, r.Detail = hcsErr.HResult, hcsErr.Message, hcsErr.Detail
+	default:
+		r.Error = err.Error()
+	}
+}
+
+func (r *TraceRecord) err() error {
+	switch {
+	case r.HResult != 0:
+		return &HcsError{HResult: r.HResult, Message: r.Message, Detail: r.Detail}
+	case r.Error != "":
+		return errors.New(r.Error)
+	}
+	return nil
+}
+
+// Recorder is a Backend that forwards every call to another Backend and
+// writes the call, its outcome and every notification delivered through it
+// to a JSONL trace. Notifications arrive asynchronously, so they appear in
+// the trace in the order they were received, between the calls around them.
+type Recorder struct {
+	b Backend
+
+	mu  sync.Mutex
+	enc *json.Encoder
+	seq int
+	err error
+}
+
+// NewRecorder returns a Recorder that wraps b and writes the trace to w.
+func NewRecorder(b Backend, w io.Writer) *Recorder {
+	return &Recorder{b: b, enc: json.NewEncoder(w)}
+}
+
+// Err returns the first error encountered writing the trace.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+func (r *Recorder) write(rec TraceRecord, err error) {
+	rec.setError(err)
+	rec.Time = time.Now().UTC()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+	rec.Seq = r.seq
+	if r.err == nil {
+		r.err = r.enc.Encode(rec)
+	}
+}
+
+func (r *Recorder) Name() string { return r.b.Name() }
+
+func (r *Recorder) CreateComputeSystem(id, configuration string) (HcsSystem, error) {
+	system, err := r.b.CreateComputeSystem(id, configuration)
+	r.write(TraceRecord{Call: CallCreateComputeSystem, ID: id, Input: configuration, ResultHandle: uintptr(system)}, err)
+	return system, err
+}
+
+func (r *Recorder) OpenComputeSystem(id string) (HcsSystem, error) {
+	system, err := r.b.OpenComputeSystem(id)
+	r.write(TraceRecord{Call: CallOpenComputeSystem, ID: id, ResultHandle: uintptr(system)}, err)
+	return system, err
+}
+
+func (r *Recorder) systemCall(call string, system HcsSystem, input string, fn func(HcsSystem, string) error) error {
+	err := fn(system, input)
+	r.write(TraceRecord{Call: call, Handle: uintptr(system), Input: input}, err)
+	return err
+}
+
+func (r *Recorder) StartComputeSystem(system HcsSystem, options string) error {
+	return r.systemCall(CallStartComputeSystem, system, options, r.b.StartComputeSystem)
+}
+
+func (r *Recorder) ShutdownComputeSystem(system HcsSystem, options string) error {
+	return r.systemCall(CallShutdownComputeSystem, system, options, r.b.ShutdownComputeSystem)
+}
+
+func (r *Recorder) TerminateComputeSystem(system HcsSystem, options string) error {
+	return r.systemCall(CallTerminateComputeSystem, system, options, r.b.TerminateComputeSystem)
+}
+
+func (r *Recorder) PauseComputeSystem(system HcsSystem, options string) error {
+	return r.systemCall(CallPauseComputeSystem, system, options, r.b.PauseComputeSystem)
+}
+
+func (r *Recorder) ResumeComputeSystem(system HcsSystem, options string) error {
+	return r.systemCall(CallResumeComputeSystem, system, options, r.b.ResumeComputeSystem)
+}
+
+func (r *Recorder) SaveComputeSystem(system HcsSystem, options string) error {
+	return r.systemCall(CallSaveComputeSystem, system, options, r.b.SaveComputeSystem)
+}
+
+func (r *Recorder) ModifyComputeSystem(system HcsSystem, configuration string) error {
+	return r.systemCall(CallModifyComputeSystem, system, configuration, r.b.ModifyComputeSystem)
+}
+
+func (r *Recorder) CloseComputeSystem(system HcsSystem) error {
+	err := r.b.CloseComputeSystem(system)
+	r.write(TraceRecord{Call: CallCloseComputeSystem, Handle: uintptr(system)}, err)
+	return err
+}
+
+func (r *Recorder) EnumerateComputeSystems(query string) (string, error) {
+	result, err := r.b.EnumerateComputeSystems(query)
+	r.write(TraceRecord{Call: CallEnumerateComputeSystems, Input: query, Result: result}, err)
+	return result, err
+}
+
+// notifyRecorder wraps fn so that every notification it receives is
+// written to the trace before being passed on.
+func (r *Recorder) notifyRecorder(handle uintptr, fn func(Notification)) func(Notification) {
+	return func(n Notification) {
+		r.write(TraceRecord{Call: NotificationCall, Handle: handle, Notification: &n}, nil)
+		fn(n)
+	}
+}
+
+func (r *Recorder) NotifySystem(system HcsSystem, fn func(Notification)) (func(), error) {
+	unregister, err := r.b.NotifySystem(system, r.notifyRecorder(uintptr(system), fn))
+	r.write(TraceRecord{Call: CallRegisterSystemCallback, Handle: uintptr(system)}, err)
+	return unregister, err
+}
+
+func (r *Recorder) CreateProcess(system HcsSystem, processParameters string) (HcsProcess, *HcsProcessInformation, error) {
+	process, info, err := r.b.CreateProcess(system, processParameters)
+	r.write(TraceRecord{Call: CallCreateProcess, Handle: uintptr(system), Input: processParameters,
+		ResultHandle: uintptr(process), ProcessInfo: info}, err)
+	return process, info, err
+}
+
+func (r *Recorder) GetProcessProperties(process HcsProcess) (string, error) {
+	result, err := r.b.GetProcessProperties(process)
+	r.write(TraceRecord{Call: CallGetProcessProperties, Handle: uintptr(process), Result: result}, err)
+	return result, err
+}
+
+func (r *Recorder) processCall(call string, process HcsProcess, input string, err error) error {
+	r.write(TraceRecord{Call: call, Handle: uintptr(process), Input: input}, err)
+	return err
+}
+
+func (r *Recorder) SignalProcess(process HcsProcess, options string) error {
+	return r.processCall(CallSignalProcess, process, options, r.b.SignalProcess(process, options))
+}
+
+func (r *Recorder) ModifyProcess(process HcsProcess, settings string) error {
+	return r.processCall(CallModifyProcess, process, settings, r.b.ModifyProcess(process, settings))
+}
+
+func (r *Recorder) TerminateProcess(process HcsProcess) error {
+	return r.processCall(CallTerminateProcess, process, "", r.b.TerminateProcess(process))
+}
+
+func (r *Recorder) CloseProcess(process HcsProcess) error {
+	return r.processCall(CallCloseProcess, process, "", r.b.CloseProcess(process))
+}
+
+func (r *Recorder) NotifyProcess(process HcsProcess, fn func(Notification)) (func(), error) {
+	unregister, err := r.b.NotifyProcess(process, r.notifyRecorder(uintptr(process), fn))
+	r.write(TraceRecord{Call: CallRegisterProcessCallback, Handle: uintptr(process)}, err)
+	return unregister, err
+}
+
+// Replay is a Backend that serves a trace written by Recorder. Calls must
+// arrive in the recorded order with the recorded arguments; anything else
+// fails with an error naming both the expected and the actual call.
+// Notification records are delivered to the subscribers of their handle as
+// soon as the call recorded before them has been served.
+//
+// Process output is not part of a trace. CreateProcess gives a process
+// that had stdio pipes when recorded new ones that carry nothing: its stdin
+// has no reader and its stdout and stderr are at EOF.
+type Replay struct {
+	mu      sync.Mutex
+	records []TraceRecord
+	next    int
+	subs    subscribers
+}
+
+// NewReplay reads a JSONL trace from r.
+func NewReplay(r io.Reader) (*Replay, error) {
+	var records []TraceRecord
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var rec TraceRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("trace line %d: %w", line, err)
+		}
+		records = append(records, rec)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read trace: %w", err)
+	}
+	return &Replay{records: records}, nil
+}
+
+// Remaining returns the number of records not yet served. A complete replay
+// of the recorded session leaves none.
+func (p *Replay) Remaining() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.records) - p.next
+}
+
+// take serves the next record, which must be call with the given arguments,
+// and then delivers the notifications recorded after it.
+func (p *Replay) take(call, id string, handle uintptr, input string) (TraceRecord, error) {
+	p.mu.Lock()
+	pending := p.notificationsLocked()
+	if p.next >= len(p.records) {
+		p.mu.Unlock()
+		p.deliver(pending)
+		return TraceRecord{}, fmt.Errorf("replay: unexpected %s(id=%q handle=%#x): trace exhausted", call, id, handle)
+	}
+	rec := p.records[p.next]
+	if rec.Call != call || rec.ID != id || rec.Handle != handle || rec.Input != input {
+		p.mu.Unlock()
+		p.deliver(pending)
+		return TraceRecord{}, fmt.Errorf("replay: record %d: got %s(id=%q handle=%#x input=%q), trace has %s(id=%q handle=%#x input=%q)",
+			rec.Seq, call, id, handle, input, rec.Call, rec.ID, rec.Handle, rec.Input)
+	}
+	p.next++
+	pending = append(pending, p.notificationsLocked()...)
+	p.mu.Unlock()
+	p.deliver(pending)
+	return rec, nil
+}
+
+// notificationsLocked consumes the run of notification records at the
+// current position.
+func (p *Replay) notificationsLocked() []TraceRecord {
+	var out []TraceRecord
+	for p.next < len(p.records) && p.records[p.next].Call == NotificationCall {
+		out = append(out, p.records[p.next])
+		p.next++
+	}
+	return out
+}
+
+func (p *Replay) deliver(records []TraceRecord) {
+	for _, rec := range records {
+		if rec.Notification != nil {
+			p.subs.dispatch(rec.Handle, *rec.Notification)
+		}
+	}
+}
+
+func (p *Replay) Name() string { return "replay" }
+
+func (p *Replay) CreateComputeSystem(id, configuration string) (HcsSystem, error) {
+	rec, err := p.take(CallCreateComputeSystem, id, 0, configuration)
+	if err != nil {
+		return 0, err
+	}
+	return HcsSystem(rec.ResultHandle), rec.err()
+}
+
+func (p *Replay) OpenComputeSystem(id string) (HcsSystem, error) {
+	rec, err := p.take(CallOpenComputeSystem, id, 0, "")
+	if err != nil {
+		return 0, err
+	}
+	return HcsSystem(rec.ResultHandle), rec.err()
+}
+
+func (p *Replay) call(call string, handle uintptr, input string) error {
+	rec, err := p.take(call, "", handle, input)
+	if err != nil {
+		return err
+	}
+	return rec.err()
+}
+
+func (p *Replay) StartComputeSystem(system HcsSystem, options string) error {
+	return p.call(CallStartComputeSystem, uintptr(system), options)
+}
+
+func (p *Replay) ShutdownComputeSystem(system HcsSystem, options string) error {
+	return p.call(CallShutdownComputeSystem, uintptr(system), options)
+}
+
+func (p *Replay) TerminateComputeSystem(system HcsSystem, options string) error {
+	return p.call(CallTerminateComputeSystem, uintptr(system), options)
+}
+
+func (p *Replay) PauseComputeSystem(system HcsSystem, options string) error {
+	return p.call(CallPauseComputeSystem, uintptr(system), options)
+}
+
+func (p *Replay) ResumeComputeSystem(system HcsSystem, options string) error {
+	return p.call(CallResumeComputeSystem, uintptr(system), options)
+}
+
+func (p *Replay) SaveComputeSystem(system HcsSystem, options string) error {
+	return p.call(CallSaveComputeSystem, uintptr(system), options)
+}
+
+func (p *Replay) ModifyComputeSystem(system HcsSystem, configuration string) error {
+	return p.call(CallModifyComputeSystem, uintptr(system), configuration)
+}
+
+func (p *Replay) CloseComputeSystem(system HcsSystem) error {
+	return p.call(CallCloseComputeSystem, uintptr(system), "")
+}
+
+func (p *Replay) EnumerateComputeSystems(query string) (string, error) {
+	rec, err := p.take(CallEnumerateComputeSystems, "", 0, query)
+	if err != nil {
+		return "", err
+	}
+	return rec.Result, rec.err()
+}
+
+func (p *Replay) NotifySystem(system HcsSystem, fn func(Notification)) (func(), error) {
+	return p.subscribe(CallRegisterSystemCallback, uintptr(system), fn)
+}
+
+// subscribe adds fn as a subscriber of handle and serves the registration
+// call. The subscriber is added first: serving the call delivers the
+// notifications recorded after it, which fn must receive.
+func (p *Replay) subscribe(call string, handle uintptr, fn func(Notification)) (func(), error) {
+	unregister, _ := p.subs.add(handle, fn, func() error { return nil })
+	if err := p.call(call, handle, ""); err != nil {
+		unregister()
+		return nil, err
+	}
+	return unregister, nil
+}
+
+func (p *Replay) CreateProcess(system HcsSystem, processParameters string) (HcsProcess, *HcsProcessInformation, error) {
+	rec, err := p.take(CallCreateProcess, "", uintptr(system), processParameters)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := rec.err(); err != nil {
+		return 0, nil, err
+	}
+	info := &HcsProcessInformation{}
+	if rec.ProcessInfo != nil {
+		info.ProcessId = rec.ProcessInfo.ProcessId
+		if err := replayStdio(info, rec.ProcessInfo); err != nil {
+			return 0, nil, fmt.Errorf("replay: stdio of %s: %w", CallCreateProcess, err)
+		}
+	}
+	return HcsProcess(rec.ResultHandle), info, nil
+}
+
+// replayStdio sets in info a pipe for each stdio handle recorded in
+// recorded: the write end of one without a reader for stdin, the read end
+// of a closed one for stdout and stderr.
+func replayStdio(info, recorded *HcsProcessInformation) (err error) {
+	var handles []uintptr
+	defer func() {
+		if err != nil {
+			for _, h := range handles {
+				os.NewFile(h, "stdio").Close()
+			}
+		}
+	}()
+	pipe := func(h *uintptr, recorded uintptr, input bool) error {
+		if recorded == 0 {
+			return nil
+		}
+		r, w, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		keep, drop := r, w
+		if input {
+			keep, drop = w, r
+		}
+		drop.Close()
+		*h, err = detach(keep)
+		if err != nil {
+			return err
+		}
+		handles = append(handles, *h)
+		return nil
+	}
+	if err := pipe(&info.StdInput, recorded.StdInput, true); err != nil {
+		return err
+	}
+	if err := pipe(&info.StdOutput, recorded.StdOutput, false); err != nil {
+		return err
+	}
+	return pipe(&info.StdError, recorded.StdError, false)
+}
+
+func (p *Replay) GetProcessProperties(process HcsProcess) (string, error) {
+	rec, err := p.take(CallGetProcessProperties, "", uintptr(process), "")
+	if err != nil {
+		return "", err
+	}
+	return rec.Result, rec.err()
+}
+
+func (p *Replay) SignalProcess(process HcsProcess, options string) error {
+	return p.call(CallSignalProcess, uintptr(process), options)
+}
+
+func (p *Replay) ModifyProcess(process HcsProcess, settings string) error {
+	return p.call(CallModifyProcess, uintptr(process), settings)
+}
+
+func (p *Replay) TerminateProcess(process HcsProcess) error {
+	return p.call(CallTerminateProcess, uintptr(process), "")
+}
+
+func (p *Replay) CloseProcess(process HcsProcess) error {
+	return p.call(CallCloseProcess, uintptr(process), "")
+}
+
+func (p *Replay) NotifyProcess(process HcsProcess, fn func(Notification)) (func(), error) {
+	return p.subscribe(CallRegisterProcessCallback, uintptr(process), fn)
+}
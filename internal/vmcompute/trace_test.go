@@ -0,0 +1,79 @@
+package vmcompute
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestReplayNotifyDeliversTrailing checks that notifications recorded right
+// after a callback registration reach the subscriber being registered.
+func TestReplayNotifyDeliversTrailing(t *testing.T) {
+	trace := `{"seq":1,"call":"HcsRegisterComputeSystemCallback","handle":708}
+{"seq":2,"call":"Notification","handle":708,"notification":{"Type":1,"Data":"{\"ExitType\":\"GracefulExit\"}"}}
+{"seq":3,"call":"HcsRegisterProcessCallback","handle":752}
+{"seq":4,"call":"Notification","handle":752,"notification":{"Type":65536}}
+`
+	p, err := NewReplay(strings.NewReader(trace))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []NotificationType
+	record := func(n Notification) { got = append(got, n.Type) }
+	if _, err := p.NotifySystem(708, record); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.NotifyProcess(752, record); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] != NotificationSystemExited || got[1] != NotificationProcessExited {
+		t.Fatalf("delivered %v, want SystemExited then ProcessExited", got)
+	}
+}
+
+// TestReplayNotifyFailure checks that a registration that does not match
+// the trace leaves no subscriber behind.
+func TestReplayNotifyFailure(t *testing.T) {
+	trace := `{"seq":1,"call":"HcsStartComputeSystem","handle":708}
+{"seq":2,"call":"Notification","handle":708,"notification":{"Type":1}}
+`
+	p, err := NewReplay(strings.NewReader(trace))
+	if err != nil {
+		t.Fatal(err)
+	}
+	called := false
+	if _, err := p.NotifySystem(708, func(Notification) { called = true }); err == nil {
+		t.Fatal("registration not in the trace succeeded")
+	}
+	if err := p.StartComputeSystem(708, ""); err != nil {
+		t.Fatal(err)
+	}
+	if called {
+		t.Fatal("notification delivered to a failed registration")
+	}
+}
+
+func TestReplayProcessStdio(t *testing.T) {
+	trace := `{"seq":1,"call":"HcsCreateProcess","handle":708,"input":"{}","resultHandle":752,"processInfo":{"ProcessId":241,"StdInput":760,"StdOutput":768}}
+`
+	p, err := NewReplay(strings.NewReader(trace))
+	if err != nil {
+		t.Fatal(err)
+	}
+	process, info, err := p.CreateProcess(708, "{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if process != 752 || info.ProcessId != 241 {
+		t.Fatalf("process %#x, pid %d", process, info.ProcessId)
+	}
+	if info.StdInput == 0 || info.StdOutput == 0 || info.StdError != 0 {
+		t.Fatalf("stdio handles %+v, want stdin and stdout only", info)
+	}
+	stdout := os.NewFile(info.StdOutput, "stdout")
+	defer stdout.Close()
+	defer os.NewFile(info.StdInput, "stdin").Close()
+	if n, err := stdout.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Fatalf("replayed stdout read %d, %v; want EOF", n, err)
+	}
+}
@@ -1,23 +1,56 @@
-//go:build windows
-
 package vmcompute
 
-import "syscall"
-
 // HcsSystem is an opaque handle to an HCS compute system (VM).
-type HcsSystem syscall.Handle
+type HcsSystem uintptr
 
 // HcsOperation is an opaque handle to an async HCS operation.
-type HcsOperation syscall.Handle
+type HcsOperation uintptr
 
 // HcsProcess is an opaque handle to a process running inside an HCS compute system.
-type HcsProcess syscall.Handle
+type HcsProcess uintptr
 
 // HcsProcessInformation holds stdio handle information for a process.
 type HcsProcessInformation struct {
 	ProcessId uint32
 	Reserved  uint32
-	StdInput  syscall.Handle
-	StdOutput syscall.Handle
-	StdError  syscall.Handle
+	StdInput  uintptr
+	StdOutput uintptr
+	StdError  uintptr
+}
+
+// NotificationType mirrors the HCS_NOTIFICATION_TYPE enum of vmcompute.dll.
+// The computecore backend maps its HCS_EVENT_TYPE values onto these.
+type NotificationType uint32
+
+const (
+	NotificationInvalid               NotificationType = 0x00000000
+	NotificationSystemExited          NotificationType = 0x00000001
+	NotificationSystemCreateCompleted NotificationType = 0x00000002
+	NotificationSystemStartCompleted  NotificationType = 0x00000003
+	NotificationSystemPauseCompleted  NotificationType = 0x00000004
+	NotificationSystemResumeCompleted NotificationType = 0x00000005
+	NotificationSystemCrashReport     NotificationType = 0x00000006
+	NotificationSystemSaveCompleted   NotificationType = 0x00000008
+	NotificationSystemModifyCompleted NotificationType = 0x0000000C
+	NotificationSystemCrashInitiated  NotificationType = 0x0000000D
+	NotificationSystemGuestClosed     NotificationType = 0x0000000E
+	NotificationProcessExited         NotificationType = 0x00010000
+	NotificationServiceDisconnect     NotificationType = 0x02000000
+)
+
+// Notification is an event HCS delivers for a compute system or process.
+type Notification struct {
+	Type NotificationType
+	// Status is the HRESULT attached to the notification (0 on success).
+	Status uint32
+	// Data is the JSON document attached to the notification, if any.
+	Data string
+}
+
+// Err returns the notification's failure status as an error, or nil.
+func (n Notification) Err() error {
+	if int32(n.Status) >= 0 {
+		return nil
+	}
+	return hcsError(n.Status, n.Data)
 }
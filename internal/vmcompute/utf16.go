@@ -0,0 +1,52 @@
+package vmcompute
+
+import (
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// maxResultUnits bounds how far ptrToString scans for the terminating NUL.
+// HCS documents are at most a few megabytes; anything longer is treated as
+// an unterminated buffer and cut off here rather than read past its end
+// without limit.
+const maxResultUnits = 1 << 28
+
+// utf16Len returns the number of code units before the first NUL, reading
+// units through at and stopping after limit units.
+func utf16Len(at func(i int) uint16, limit int) int {
+	n := 0
+	for n < limit && at(n) != 0 {
+		n++
+	}
+	return n
+}
+
+// decodeUTF16 converts UTF-16 code units to a UTF-8 string, stopping at the
+// first NUL. Surrogate pairs are combined; unpaired surrogates become
+// U+FFFD, matching syscall.UTF16ToString. Unlike UTF16ToString it does not
+// build an intermediate []rune, which matters for multi-megabyte property
+// documents.
+func decodeUTF16(units []uint16) string {
+	buf := make([]byte, 0, len(units))
+	for i := 0; i < len(units); i++ {
+		u := units[i]
+		switch {
+		case u == 0:
+			return string(buf)
+		case u < 0x80:
+			buf = append(buf, byte(u))
+		case utf16.IsSurrogate(rune(u)):
+			r := utf8.RuneError
+			if i+1 < len(units) {
+				if pair := utf16.DecodeRune(rune(u), rune(units[i+1])); pair != utf8.RuneError {
+					r = pair
+					i++
+				}
+			}
+			buf = utf8.AppendRune(buf, r)
+		default:
+			buf = utf8.AppendRune(buf, rune(u))
+		}
+	}
+	return string(buf)
+}
@@ -0,0 +1,58 @@
+package vmcompute
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// unitBytes encodes units as the little-endian bytes FuzzDecodeUTF16 takes.
+func unitBytes(units []uint16) []byte {
+	b := make([]byte, 0, 2*len(units))
+	for _, u := range units {
+		b = append(b, byte(u), byte(u>>8))
+	}
+	return b
+}
+
+// FuzzDecodeUTF16 checks decodeUTF16 and utf16Len against unicode/utf16 on
+// NUL-terminated buffers, as HCS returns them.
+func FuzzDecodeUTF16(f *testing.F) {
+	for _, units := range [][]uint16{
+		utf16.Encode([]rune(`{"Id":"vm","State":"Running"}`)),
+		utf16.Encode([]rune("héllo, 世界 😀")),
+		{0xD83D},                 // unpaired high surrogate at the end
+		{0xDE00, 'a'},            // unpaired low surrogate
+		{0xD83D, 0xD83D, 0xDE00}, // high surrogate before a pair
+		{0xD83D, 'a', 0xDE00},    // pair split by another unit
+		{'a', 0, 'b'},            // embedded NUL
+		utf16.Encode([]rune(strings.Repeat("ä😀x", 50000))),
+	} {
+		f.Add(unitBytes(units))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		units := make([]uint16, 0, len(b)/2+1)
+		for i := 0; i+1 < len(b); i += 2 {
+			units = append(units, uint16(b[i])|uint16(b[i+1])<<8)
+		}
+		n := 0
+		for n < len(units) && units[n] != 0 {
+			n++
+		}
+		want := string(utf16.Decode(units[:n]))
+		buf := append(units, 0)
+
+		if got := decodeUTF16(buf); got != want {
+			t.Fatalf("decodeUTF16(%#x) = %q, want %q", units, got, want)
+		}
+		at := func(i int) uint16 { return buf[i] }
+		if got := utf16Len(at, len(buf)); got != n {
+			t.Fatalf("utf16Len = %d, want %d", got, n)
+		}
+		if n > 0 {
+			if got := utf16Len(at, n-1); got != n-1 {
+				t.Fatalf("utf16Len with limit %d = %d", n-1, got)
+			}
+		}
+	})
+}
@@ -6,6 +6,9 @@
 // Several calls return HCS_OPERATION_PENDING (0xC0370103) to signal an async
 // operation. In that case the system handle IS valid, and callers must wait for
 // the corresponding HCS_NOTIFICATION_TYPE via the callback mechanism.
+//
+// The same operations are also available through the newer operation-based
+// API in computecore.dll; see Backend and NewBackend.
 package vmcompute
 
 import (
@@ -28,6 +31,14 @@ var (
 	procHcsTerminateComputeSystem = modVmcompute.NewProc("HcsTerminateComputeSystem")
 	procHcsCloseComputeSystem     = modVmcompute.NewProc("HcsCloseComputeSystem")
 
+	// Runtime reconfiguration (hot-plug).
+	procHcsModifyComputeSystem = modVmcompute.NewProc("HcsModifyComputeSystem")
+
+	// Snapshots: a system must be paused before it can be saved.
+	procHcsPauseComputeSystem  = modVmcompute.NewProc("HcsPauseComputeSystem")
+	procHcsResumeComputeSystem = modVmcompute.NewProc("HcsResumeComputeSystem")
+	procHcsSaveComputeSystem   = modVmcompute.NewProc("HcsSaveComputeSystem")
+
 	// Async completion: register/unregister a callback on a system handle.
 	procHcsRegisterComputeSystemCallback   = modVmcompute.NewProc("HcsRegisterComputeSystemCallback")
 	procHcsUnregisterComputeSystemCallback = modVmcompute.NewProc("HcsUnregisterComputeSystemCallback")
@@ -41,6 +52,15 @@ var (
 	procHcsTerminateProcess = modVmcompute.NewProc("HcsTerminateProcess")
 	procHcsGetProcessInfo   = modVmcompute.NewProc("HcsGetProcessInfo")
 
+	procHcsSignalProcess             = modVmcompute.NewProc("HcsSignalProcess")
+	procHcsModifyProcess             = modVmcompute.NewProc("HcsModifyProcess")
+	procHcsGetProcessProperties      = modVmcompute.NewProc("HcsGetProcessProperties")
+	procHcsRegisterProcessCallback   = modVmcompute.NewProc("HcsRegisterProcessCallback")
+	procHcsUnregisterProcessCallback = modVmcompute.NewProc("HcsUnregisterProcessCallback")
+
+	// Host file access for a system's worker process.
+	procGrantVmAccess = modVmcompute.NewProc("GrantVmAccess")
+
 	procCoTaskMemFree = modOle32.NewProc("CoTaskMemFree")
 )
 
@@ -48,15 +68,6 @@ var (
 // HCS call is accepted but completes asynchronously. The system handle is valid.
 const errOperationPending = uintptr(0xC0370103)
 
-// hcsNotificationType mirrors the HCS_NOTIFICATION_TYPE enum.
-type hcsNotificationType uint32
-
-const (
-	hcsNotificationSystemExited          hcsNotificationType = 0x00000001
-	hcsNotificationSystemCreateCompleted hcsNotificationType = 0x00000002
-	hcsNotificationSystemStartCompleted  hcsNotificationType = 0x00000003
-)
-
 // --- Memory helpers ---
 
 func freeCoTaskMem(ptr *uint16) {
@@ -65,93 +76,113 @@ func freeCoTaskMem(ptr *uint16) {
 	}
 }
 
+// ptrToString decodes a NUL-terminated UTF-16 string allocated by HCS. The
+// length is found by scanning, so documents of any size are read in full.
 func ptrToString(ptr *uint16) string {
 	if ptr == nil {
 		return ""
 	}
-	return syscall.UTF16ToString((*[4096]uint16)(unsafe.Pointer(ptr))[:])
+	n := utf16Len(func(i int) uint16 {
+		return *(*uint16)(unsafe.Add(unsafe.Pointer(ptr), 2*i))
+	}, maxResultUnits)
+	return decodeUTF16(unsafe.Slice(ptr, n))
 }
 
 // --- Error helpers ---
 
 func hresultError(hr uintptr, detail string) error {
-	if hr == 0 {
-		return nil
-	}
+	return hcsError(uint32(hr), detail)
+}
+
+// systemMessage returns the system message table text for hr, if any.
+func systemMessage(hr uint32) string {
 	var msgBuf [512]uint16
 	n, _ := syscall.FormatMessage(
 		syscall.FORMAT_MESSAGE_FROM_SYSTEM|syscall.FORMAT_MESSAGE_IGNORE_INSERTS,
-		0, uint32(hr), 0, msgBuf[:], nil,
+		0, hr, 0, msgBuf[:], nil,
 	)
-	sysMsg := ""
-	if n > 0 {
-		sysMsg = syscall.UTF16ToString(msgBuf[:n])
-	}
-	switch {
-	case detail != "" && sysMsg != "":
-		return fmt.Errorf("HRESULT 0x%08X (%s): %s", uint32(hr), sysMsg, detail)
-	case detail != "":
-		return fmt.Errorf("HRESULT 0x%08X: %s", uint32(hr), detail)
-	case sysMsg != "":
-		return fmt.Errorf("HRESULT 0x%08X (%s)", uint32(hr), sysMsg)
-	default:
-		return fmt.Errorf("HRESULT 0x%08X", uint32(hr))
+	if n == 0 {
+		return ""
 	}
+	return syscall.UTF16ToString(msgBuf[:n])
 }
 
 // --- Async wait helpers ---
 
+// notificationCallbacks holds every callback registered through
+// registerCallback; notificationCallback is the single trampoline HCS calls.
+//
+// Windows amd64 uses a single calling convention, so syscall.NewCallback works.
+var (
+	notificationCallbacks callbackRegistry
+	notificationCallback  = syscall.NewCallback(func(notType, ctx, status, data uintptr) uintptr {
+		dataStr := ""
+		if data != 0 {
+			dataStr = ptrToString((*uint16)(unsafe.Pointer(data)))
+		}
+		notificationCallbacks.dispatch(ctx, uint32(notType), uint32(status), dataStr)
+		return 0
+	})
+)
+
+// registerCallback registers fn for every notification on handle via
+// register (HcsRegisterComputeSystemCallback or HcsRegisterProcessCallback)
+// and returns the function that unregisters it.
+func registerCallback(register, unregister *syscall.LazyProc, name string, handle uintptr, fn func(Notification)) (func(), error) {
+	ctx := notificationCallbacks.add(func(notType, status uint32, data string) {
+		fn(Notification{Type: NotificationType(notType), Status: status, Data: data})
+	})
+
+	var callbackHandle uintptr
+	hr, _, _ := register.Call(
+		handle,
+		notificationCallback,
+		ctx,
+		uintptr(unsafe.Pointer(&callbackHandle)),
+	)
+	if hr != 0 {
+		notificationCallbacks.remove(ctx)
+		return nil, hresultError(hr, name)
+	}
+	return func() {
+		unregister.Call(callbackHandle)
+		notificationCallbacks.remove(ctx)
+	}, nil
+}
+
 // notificationWaiter registers a callback on a compute system handle BEFORE the
 // HCS operation is called, so that notifications fired during or immediately
 // after the call are never lost.
 //
 // Usage:
 //
-//	waiter, err := newNotificationWaiter(system, hcsNotificationSystemStartCompleted)
+//	waiter, err := newNotificationWaiter(system, NotificationSystemStartCompleted)
 //	defer waiter.Close()
 //	// … call HCS function …
 //	if hr == errOperationPending { return waiter.Wait(120 * time.Second) }
 type notificationWaiter struct {
-	ch             chan error
-	callbackHandle uintptr
+	ch         chan error
+	unregister func()
 }
 
 // newNotificationWaiter creates a notificationWaiter that listens for want on
 // system. Call this BEFORE the HCS operation to avoid race conditions.
-//
-// Windows amd64 uses a single calling convention, so syscall.NewCallback works.
-func newNotificationWaiter(system HcsSystem, want hcsNotificationType) (*notificationWaiter, error) {
+func newNotificationWaiter(system HcsSystem, want NotificationType) (*notificationWaiter, error) {
 	ch := make(chan error, 1)
-
-	cb := syscall.NewCallback(func(notType, _ /*ctx*/, status, data uintptr) uintptr {
-		if hcsNotificationType(notType) == want {
-			var err error
-			if int32(status) < 0 {
-				dataStr := ""
-				if data != 0 {
-					dataStr = ptrToString((*uint16)(unsafe.Pointer(data)))
-				}
-				err = hresultError(status, dataStr)
+	unregister, err := registerCallback(procHcsRegisterComputeSystemCallback, procHcsUnregisterComputeSystemCallback,
+		"HcsRegisterComputeSystemCallback", uintptr(system), func(n Notification) {
+			if n.Type != want {
+				return
 			}
 			select {
-			case ch <- err:
+			case ch <- n.Err():
 			default:
 			}
-		}
-		return 0
-	})
-
-	var callbackHandle uintptr
-	hr, _, _ := procHcsRegisterComputeSystemCallback.Call(
-		uintptr(system),
-		cb,
-		0, // context — not needed; closure captures ch
-		uintptr(unsafe.Pointer(&callbackHandle)),
-	)
-	if hr != 0 {
-		return nil, hresultError(hr, "HcsRegisterComputeSystemCallback")
+		})
+	if err != nil {
+		return nil, err
 	}
-	return &notificationWaiter{ch: ch, callbackHandle: callbackHandle}, nil
+	return &notificationWaiter{ch: ch, unregister: unregister}, nil
 }
 
 // Wait blocks until the notification arrives or the timeout expires.
@@ -166,7 +197,7 @@ func (w *notificationWaiter) Wait(timeout time.Duration) error {
 
 // Close unregisters the callback. Safe to call via defer.
 func (w *notificationWaiter) Close() {
-	procHcsUnregisterComputeSystemCallback.Call(w.callbackHandle)
+	w.unregister()
 }
 
 // waitForSystemNotification registers a one-shot callback on system, waits for
@@ -175,7 +206,7 @@ func (w *notificationWaiter) Close() {
 //
 // Used only for HcsCreateComputeSystem, where the handle is not available until
 // after the call returns, making pre-registration impossible.
-func waitForSystemNotification(system HcsSystem, want hcsNotificationType, timeout time.Duration) error {
+func waitForSystemNotification(system HcsSystem, want NotificationType, timeout time.Duration) error {
 	w, err := newNotificationWaiter(system, want)
 	if err != nil {
 		return err
@@ -184,6 +215,20 @@ func waitForSystemNotification(system HcsSystem, want hcsNotificationType, timeo
 	return w.Wait(timeout)
 }
 
+// HcsRegisterComputeSystemCallback calls fn for every notification on system
+// until the returned function is called.
+func HcsRegisterComputeSystemCallback(system HcsSystem, fn func(Notification)) (unregister func(), err error) {
+	return registerCallback(procHcsRegisterComputeSystemCallback, procHcsUnregisterComputeSystemCallback,
+		"HcsRegisterComputeSystemCallback", uintptr(system), fn)
+}
+
+// HcsRegisterProcessCallback calls fn for every notification on process
+// until the returned function is called.
+func HcsRegisterProcessCallback(process HcsProcess, fn func(Notification)) (unregister func(), err error) {
+	return registerCallback(procHcsRegisterProcessCallback, procHcsUnregisterProcessCallback,
+		"HcsRegisterProcessCallback", uintptr(process), fn)
+}
+
 // --- Public HCS API ---
 
 // HcsCreateComputeSystem creates a new compute system (VM).
@@ -217,7 +262,7 @@ func HcsCreateComputeSystem(id, configuration string) (HcsSystem, error) {
 		return 0, hresultError(hr, detail)
 	}
 	if hr == errOperationPending {
-		if err := waitForSystemNotification(system, hcsNotificationSystemCreateCompleted, 60*time.Second); err != nil {
+		if err := waitForSystemNotification(system, NotificationSystemCreateCompleted, 60*time.Second); err != nil {
 			procHcsCloseComputeSystem.Call(uintptr(system))
 			return 0, fmt.Errorf("wait for create: %w", err)
 		}
@@ -254,7 +299,7 @@ func HcsOpenComputeSystem(id string) (HcsSystem, error) {
 func HcsStartComputeSystem(system HcsSystem, options string) error {
 	// Register the callback BEFORE calling HCS to avoid missing a notification
 	// that fires before we have a chance to register (race condition).
-	waiter, err := newNotificationWaiter(system, hcsNotificationSystemStartCompleted)
+	waiter, err := newNotificationWaiter(system, NotificationSystemStartCompleted)
 	if err != nil {
 		return fmt.Errorf("register start callback: %w", err)
 	}
@@ -290,7 +335,7 @@ func HcsStartComputeSystem(system HcsSystem, options string) error {
 //
 // Old API: HcsShutdownComputeSystem(System, Options, *Result)
 func HcsShutdownComputeSystem(system HcsSystem, options string) error {
-	waiter, err := newNotificationWaiter(system, hcsNotificationSystemExited)
+	waiter, err := newNotificationWaiter(system, NotificationSystemExited)
 	if err != nil {
 		return fmt.Errorf("register shutdown callback: %w", err)
 	}
@@ -326,7 +371,7 @@ func HcsShutdownComputeSystem(system HcsSystem, options string) error {
 //
 // Old API: HcsTerminateComputeSystem(System, Options, *Result)
 func HcsTerminateComputeSystem(system HcsSystem, options string) error {
-	waiter, err := newNotificationWaiter(system, hcsNotificationSystemExited)
+	waiter, err := newNotificationWaiter(system, NotificationSystemExited)
 	if err != nil {
 		return fmt.Errorf("register terminate callback: %w", err)
 	}
@@ -366,6 +411,114 @@ func HcsCloseComputeSystem(system HcsSystem) error {
 	return hresultError(hr, "")
 }
 
+// GrantVmAccess grants the worker process of system id access to the file
+// at path, such as a disk created for the system outside its image
+// directory. It can be called before the system exists.
+func GrantVmAccess(id, path string) error {
+	idPtr, err := syscall.UTF16PtrFromString(id)
+	if err != nil {
+		return err
+	}
+	pathPtr, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+	hr, _, _ := procGrantVmAccess.Call(uintptr(unsafe.Pointer(idPtr)), uintptr(unsafe.Pointer(pathPtr)))
+	return hresultError(hr, path)
+}
+
+// HcsModifyComputeSystem applies a ModifySettingRequest document to a running
+// compute system (add/remove devices, resize memory, …).
+//
+// Old API: HcsModifyComputeSystem(System, Configuration, *Result)
+func HcsModifyComputeSystem(system HcsSystem, configuration string) error {
+	waiter, err := newNotificationWaiter(system, NotificationSystemModifyCompleted)
+	if err != nil {
+		return fmt.Errorf("register modify callback: %w", err)
+	}
+	defer waiter.Close()
+
+	configPtr, err := syscall.UTF16PtrFromString(configuration)
+	if err != nil {
+		return err
+	}
+
+	var result *uint16
+	hr, _, _ := procHcsModifyComputeSystem.Call(
+		uintptr(system),
+		uintptr(unsafe.Pointer(configPtr)),
+		uintptr(unsafe.Pointer(&result)),
+	)
+	detail := ptrToString(result)
+	freeCoTaskMem(result)
+
+	if hr != 0 && hr != errOperationPending {
+		return hresultError(hr, detail)
+	}
+	if hr == errOperationPending {
+		return waiter.Wait(60 * time.Second)
+	}
+	return nil
+}
+
+// HcsPauseComputeSystem suspends all virtual processors of the compute system.
+//
+// Old API: HcsPauseComputeSystem(System, Options, *Result)
+func HcsPauseComputeSystem(system HcsSystem, options string) error {
+	return callSystemOperation(procHcsPauseComputeSystem, "pause", system, options, NotificationSystemPauseCompleted, 60*time.Second)
+}
+
+// HcsResumeComputeSystem resumes a paused compute system.
+//
+// Old API: HcsResumeComputeSystem(System, Options, *Result)
+func HcsResumeComputeSystem(system HcsSystem, options string) error {
+	return callSystemOperation(procHcsResumeComputeSystem, "resume", system, options, NotificationSystemResumeCompleted, 60*time.Second)
+}
+
+// HcsSaveComputeSystem writes the state of a paused compute system to the file
+// named in options (see SaveOptions in the HCS schema).
+//
+// Old API: HcsSaveComputeSystem(System, Options, *Result)
+func HcsSaveComputeSystem(system HcsSystem, options string) error {
+	return callSystemOperation(procHcsSaveComputeSystem, "save", system, options, NotificationSystemSaveCompleted, 5*time.Minute)
+}
+
+// callSystemOperation runs an HCS function with the common
+// (System, Options, *Result) signature, waiting for want if the call
+// completes asynchronously.
+func callSystemOperation(proc *syscall.LazyProc, name string, system HcsSystem, options string, want NotificationType, timeout time.Duration) error {
+	waiter, err := newNotificationWaiter(system, want)
+	if err != nil {
+		return fmt.Errorf("register %s callback: %w", name, err)
+	}
+	defer waiter.Close()
+
+	var optionsPtr *uint16
+	if options != "" {
+		optionsPtr, err = syscall.UTF16PtrFromString(options)
+		if err != nil {
+			return err
+		}
+	}
+
+	var result *uint16
+	hr, _, _ := proc.Call(
+		uintptr(system),
+		uintptr(unsafe.Pointer(optionsPtr)),
+		uintptr(unsafe.Pointer(&result)),
+	)
+	detail := ptrToString(result)
+	freeCoTaskMem(result)
+
+	if hr != 0 && hr != errOperationPending {
+		return hresultError(hr, detail)
+	}
+	if hr == errOperationPending {
+		return waiter.Wait(timeout)
+	}
+	return nil
+}
+
 // HcsCreateProcess creates a new process inside the compute system via GCS.
 //
 // Old API: HcsCreateProcess(System, ProcessParams, *ProcessInfo, *Process, *Result)
@@ -392,9 +545,47 @@ func HcsCreateProcess(system HcsSystem, processParameters string) (HcsProcess, *
 	if hr != 0 && hr != errOperationPending {
 		return 0, nil, hresultError(hr, detail)
 	}
+	if hr == errOperationPending {
+		// The process handle is valid but the stdio pipes are not connected
+		// yet; poll until GCS has finished creating the process.
+		info, err := waitForProcessInfo(process, 30*time.Second)
+		if err != nil {
+			procHcsCloseProcess.Call(uintptr(process))
+			return 0, nil, fmt.Errorf("wait for process create: %w", err)
+		}
+		procInfo = *info
+	}
 	return process, &procInfo, nil
 }
 
+// waitForProcessInfo polls HcsGetProcessInfo every 100 ms while it reports
+// HCS_OPERATION_PENDING.
+func waitForProcessInfo(process HcsProcess, timeout time.Duration) (*HcsProcessInformation, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		var procInfo HcsProcessInformation
+		var result *uint16
+		hr, _, _ := procHcsGetProcessInfo.Call(
+			uintptr(process),
+			uintptr(unsafe.Pointer(&procInfo)),
+			uintptr(unsafe.Pointer(&result)),
+		)
+		detail := ptrToString(result)
+		freeCoTaskMem(result)
+
+		if hr != errOperationPending {
+			if err := hresultError(hr, detail); err != nil {
+				return nil, err
+			}
+			return &procInfo, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timeout after %s waiting for process", timeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
 // HcsCloseProcess closes the handle to a process.
 func HcsCloseProcess(process HcsProcess) error {
 	hr, _, _ := procHcsCloseProcess.Call(uintptr(process))
@@ -415,6 +606,71 @@ func HcsTerminateProcess(process HcsProcess) error {
 	return hresultError(hr, detail)
 }
 
+// HcsSignalProcess delivers a signal to a process. options is a JSON
+// SignalProcessOptions document, e.g. {"Signal":15} for a Linux guest.
+//
+// Old API: HcsSignalProcess(Process, Options, *Result)
+func HcsSignalProcess(process HcsProcess, options string) error {
+	optionsPtr, err := syscall.UTF16PtrFromString(options)
+	if err != nil {
+		return err
+	}
+	var result *uint16
+	hr, _, _ := procHcsSignalProcess.Call(
+		uintptr(process),
+		uintptr(unsafe.Pointer(optionsPtr)),
+		uintptr(unsafe.Pointer(&result)),
+	)
+	detail := ptrToString(result)
+	freeCoTaskMem(result)
+	return hresultError(hr, detail)
+}
+
+// HcsModifyProcess applies a ProcessModifyRequest document to a process.
+// vmcompute.dll has no HcsResizeConsole export; console resizing and closing
+// stdin both go through this call.
+//
+// Old API: HcsModifyProcess(Process, Settings, *Result)
+func HcsModifyProcess(process HcsProcess, settings string) error {
+	settingsPtr, err := syscall.UTF16PtrFromString(settings)
+	if err != nil {
+		return err
+	}
+	var result *uint16
+	hr, _, _ := procHcsModifyProcess.Call(
+		uintptr(process),
+		uintptr(unsafe.Pointer(settingsPtr)),
+		uintptr(unsafe.Pointer(&result)),
+	)
+	detail := ptrToString(result)
+	freeCoTaskMem(result)
+	return hresultError(hr, detail)
+}
+
+// HcsGetProcessProperties returns the ProcessStatus JSON document of a
+// process (ProcessId, Exited, ExitCode, LastWaitResult).
+//
+// Old API: HcsGetProcessProperties(Process, *ProcessProperties, *Result)
+func HcsGetProcessProperties(process HcsProcess) (string, error) {
+	var properties *uint16
+	var result *uint16
+	hr, _, _ := procHcsGetProcessProperties.Call(
+		uintptr(process),
+		uintptr(unsafe.Pointer(&properties)),
+		uintptr(unsafe.Pointer(&result)),
+	)
+	detail := ptrToString(result)
+	freeCoTaskMem(result)
+
+	if hr != 0 {
+		freeCoTaskMem(properties)
+		return "", hresultError(hr, detail)
+	}
+	propertiesStr := ptrToString(properties)
+	freeCoTaskMem(properties)
+	return propertiesStr, nil
+}
+
 // HcsEnumerateComputeSystems returns a JSON array describing all compute systems
 // visible to the caller.
 //
@@ -0,0 +1,24 @@
+//go:build !windows
+
+package vmcomputetest
+
+import (
+	"os"
+	"syscall"
+)
+
+// detach returns a duplicate of f's descriptor, owned by the caller, and
+// closes f.
+func detach(f *os.File) (uintptr, error) {
+	defer f.Close()
+	syscall.ForkLock.RLock()
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err == nil {
+		syscall.CloseOnExec(fd)
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return 0, os.NewSyscallError("dup", err)
+	}
+	return uintptr(fd), nil
+}
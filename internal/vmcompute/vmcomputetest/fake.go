@@ -0,0 +1,514 @@
+// Package vmcomputetest provides a fake vmcompute.Backend for tests of the
+// packages above vmcompute.
+package vmcomputetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/microsoft/hcsshim/vmrunner/internal/vmcompute"
+)
+
+// HCS exit types carried by the SystemExited notifications of a Fake.
+const (
+	GracefulExit   = "GracefulExit"
+	ForcedExit     = "ForcedExit"
+	UnexpectedExit = "UnexpectedExit"
+)
+
+// Fake is an in-memory Backend. Systems start when asked and exit on
+// shutdown, terminate or Exit, delivering SystemExited to their subscribers
+// asynchronously, as HCS does. A system that exited is gone: it is no longer
+// enumerated and cannot be opened. Processes run Run with real stdio pipes.
+//
+// The exported fields configure the fake; set them before use.
+type Fake struct {
+	// StartErr, if set, is returned by StartComputeSystem.
+	StartErr error
+	// ShutdownErr, if set, is returned by ShutdownComputeSystem, leaving the
+	// system running, like a guest without the GCS connection.
+	ShutdownErr error
+	// HangShutdown makes ShutdownComputeSystem block until the system exits
+	// some other way, like a guest that ignores the request.
+	HangShutdown bool
+	// Run is the body of every process: it reads stdin, writes the output
+	// and returns the exit code. Nil processes exit 0 without output.
+	Run func(system string, args string, stdin io.Reader, stdout, stderr io.Writer) int
+
+	mu        sync.Mutex
+	next      uintptr
+	systems   map[string]*system
+	handles   map[uintptr]*system // open system handles
+	processes map[uintptr]*process
+	subs      map[uintptr]map[int]func(vmcompute.Notification)
+	nextSub   int
+	calls     []string
+}
+
+type system struct {
+	id, owner, state, config string
+	exited                   chan struct{} // closed when the system exits
+}
+
+type process struct {
+	system string
+	pid    uint32
+	exited bool
+	code   int
+}
+
+// New returns an empty Fake.
+func New() *Fake {
+	return &Fake{
+		next:      0x100,
+		systems:   map[string]*system{},
+		handles:   map[uintptr]*system{},
+		processes: map[uintptr]*process{},
+		subs:      map[uintptr]map[int]func(vmcompute.Notification){},
+	}
+}
+
+var _ vmcompute.Backend = (*Fake)(nil)
+
+// NotFound is the error a Fake returns for a system that does not exist.
+var NotFound = &vmcompute.HcsError{HResult: vmcompute.HrSystemNotFound}
+
+// Calls returns the calls made so far that change a system, as "create id",
+// "start id", "shutdown id", "terminate id", "pause id", "resume id",
+// "save id", "modify id" and "close id".
+func (f *Fake) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+// Config returns the configuration system id was created with, or "" if
+// it does not exist.
+func (f *Fake) Config(id string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if s, ok := f.systems[id]; ok {
+		return s.config
+	}
+	return ""
+}
+
+// Add makes a running system exist, as if created by another process or
+// tool.
+func (f *Fake) Add(id, owner string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.systems[id] = &system{id: id, owner: owner, state: "Running", exited: make(chan struct{})}
+}
+
+// Exists reports whether system id exists.
+func (f *Fake) Exists(id string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.systems[id]
+	return ok
+}
+
+// Exit makes system id exit as HCS reports it with exitType (GracefulExit,
+// ForcedExit, UnexpectedExit or "") and HRESULT status.
+func (f *Fake) Exit(id, exitType string, status uint32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if s, ok := f.systems[id]; ok {
+		f.exitLocked(s, exitType, status)
+	}
+}
+
+// Vanish removes system id without any notification, like a system that
+// went away while nobody had it open.
+func (f *Fake) Vanish(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.systems, id)
+}
+
+func (f *Fake) log(format string, args ...any) {
+	f.calls = append(f.calls, fmt.Sprintf(format, args...))
+}
+
+func (f *Fake) exitLocked(s *system, exitType string, status uint32) {
+	delete(f.systems, s.id)
+	s.state = "Stopped"
+	close(s.exited)
+	n := vmcompute.Notification{Type: vmcompute.NotificationSystemExited, Status: status}
+	if exitType != "" {
+		n.Data = fmt.Sprintf(`{"ExitType":%q}`, exitType)
+	}
+	var fns []func(vmcompute.Notification)
+	for h, hs := range f.handles {
+		if hs == s {
+			for _, fn := range f.subs[h] {
+				fns = append(fns, fn)
+			}
+		}
+	}
+	go func() {
+		for _, fn := range fns {
+			fn(n)
+		}
+	}()
+}
+
+// system returns the live system of handle h.
+func (f *Fake) system(h vmcompute.HcsSystem) (*system, error) {
+	s, ok := f.handles[uintptr(h)]
+	if !ok {
+		return nil, fmt.Errorf("fake: invalid system handle %#x", h)
+	}
+	if f.systems[s.id] != s {
+		return nil, NotFound
+	}
+	return s, nil
+}
+
+func (f *Fake) open(s *system) vmcompute.HcsSystem {
+	f.next++
+	f.handles[f.next] = s
+	return vmcompute.HcsSystem(f.next)
+}
+
+func (f *Fake) Name() string { return "fake" }
+
+func (f *Fake) CreateComputeSystem(id, configuration string) (vmcompute.HcsSystem, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.log("create %s", id)
+	if _, ok := f.systems[id]; ok {
+		return 0, &vmcompute.HcsError{HResult: vmcompute.HrSystemAlreadyExists}
+	}
+	var doc struct{ Owner string }
+	_ = json.Unmarshal([]byte(configuration), &doc)
+	s := &system{id: id, owner: doc.Owner, state: "Created", config: configuration, exited: make(chan struct{})}
+	f.systems[id] = s
+	return f.open(s), nil
+}
+
+func (f *Fake) OpenComputeSystem(id string) (vmcompute.HcsSystem, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.systems[id]
+	if !ok {
+		return 0, NotFound
+	}
+	return f.open(s), nil
+}
+
+// change logs call and applies fn to the live system of h.
+func (f *Fake) change(call string, h vmcompute.HcsSystem, fn func(*system) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, err := f.system(h)
+	if s != nil {
+		f.log("%s %s", call, s.id)
+	} else if hs, ok := f.handles[uintptr(h)]; ok {
+		f.log("%s %s", call, hs.id)
+	}
+	if err != nil {
+		return err
+	}
+	return fn(s)
+}
+
+func (f *Fake) StartComputeSystem(h vmcompute.HcsSystem, options string) error {
+	return f.change("start", h, func(s *system) error {
+		if f.StartErr != nil {
+			return f.StartErr
+		}
+		s.state = "Running"
+		return nil
+	})
+}
+
+func (f *Fake) ShutdownComputeSystem(h vmcompute.HcsSystem, options string) error {
+	var exited chan struct{}
+	err := f.change("shutdown", h, func(s *system) error {
+		switch {
+		case f.ShutdownErr != nil:
+			return f.ShutdownErr
+		case f.HangShutdown:
+			exited = s.exited
+		default:
+			f.exitLocked(s, GracefulExit, 0)
+		}
+		return nil
+	})
+	if exited != nil {
+		<-exited
+		return NotFound
+	}
+	return err
+}
+
+func (f *Fake) TerminateComputeSystem(h vmcompute.HcsSystem, options string) error {
+	return f.change("terminate", h, func(s *system) error {
+		f.exitLocked(s, ForcedExit, 0)
+		return nil
+	})
+}
+
+func (f *Fake) PauseComputeSystem(h vmcompute.HcsSystem, options string) error {
+	return f.change("pause", h, func(s *system) error {
+		s.state = "Paused"
+		return nil
+	})
+}
+
+func (f *Fake) ResumeComputeSystem(h vmcompute.HcsSystem, options string) error {
+	return f.change("resume", h, func(s *system) error {
+		s.state = "Running"
+		return nil
+	})
+}
+
+func (f *Fake) SaveComputeSystem(h vmcompute.HcsSystem, options string) error {
+	return f.change("save", h, func(s *system) error { return nil })
+}
+
+func (f *Fake) ModifyComputeSystem(h vmcompute.HcsSystem, configuration string) error {
+	return f.change("modify", h, func(s *system) error { return nil })
+}
+
+// CloseComputeSystem closes the handle; its subscribers get no more
+// notifications.
+func (f *Fake) CloseComputeSystem(h vmcompute.HcsSystem) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.handles[uintptr(h)]
+	if !ok {
+		return fmt.Errorf("fake: invalid system handle %#x", h)
+	}
+	f.log("close %s", s.id)
+	delete(f.handles, uintptr(h))
+	delete(f.subs, uintptr(h))
+	return nil
+}
+
+// EnumerateComputeSystems returns the systems that exist, sorted by ID. Only
+// the Ids and Owners of the query are honoured.
+func (f *Fake) EnumerateComputeSystems(query string) (string, error) {
+	var q vmcompute.SystemQuery
+	if query != "" {
+		if err := json.Unmarshal([]byte(query), &q); err != nil {
+			return "", fmt.Errorf("fake: query: %w", err)
+		}
+	}
+	in := func(v string, set []string) bool {
+		for _, s := range set {
+			if strings.EqualFold(v, s) {
+				return true
+			}
+		}
+		return len(set) == 0
+	}
+	f.mu.Lock()
+	out := []vmcompute.SystemSummary{}
+	for _, s := range f.systems {
+		if in(s.id, q.Ids) && in(s.owner, q.Owners) {
+			out = append(out, vmcompute.SystemSummary{Id: s.id, Name: s.id, Owner: s.owner, SystemType: "VirtualMachine", State: s.state})
+		}
+	}
+	f.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Id < out[j].Id })
+	b, err := json.Marshal(out)
+	return string(b), err
+}
+
+func (f *Fake) subscribe(h uintptr, fn func(vmcompute.Notification)) func() {
+	if f.subs[h] == nil {
+		f.subs[h] = map[int]func(vmcompute.Notification){}
+	}
+	f.nextSub++
+	id := f.nextSub
+	f.subs[h][id] = fn
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.subs[h], id)
+	}
+}
+
+func (f *Fake) NotifySystem(h vmcompute.HcsSystem, fn func(vmcompute.Notification)) (func(), error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.handles[uintptr(h)]; !ok {
+		return nil, fmt.Errorf("fake: invalid system handle %#x", h)
+	}
+	return f.subscribe(uintptr(h), fn), nil
+}
+
+// processParams is the part of the HcsCreateProcess document a Fake reads.
+type processParams struct {
+	CommandLine      string
+	CreateStdInPipe  bool
+	CreateStdOutPipe bool
+	CreateStdErrPipe bool
+}
+
+// CreateProcess starts Run in a goroutine, connected to the pipes it
+// returns. The process exits, with ProcessExited, once Run returns.
+func (f *Fake) CreateProcess(h vmcompute.HcsSystem, processParameters string) (vmcompute.HcsProcess, *vmcompute.HcsProcessInformation, error) {
+	var params processParams
+	if err := json.Unmarshal([]byte(processParameters), &params); err != nil {
+		return 0, nil, fmt.Errorf("fake: process parameters: %w", err)
+	}
+	f.mu.Lock()
+	s, err := f.system(h)
+	if err != nil {
+		f.mu.Unlock()
+		return 0, nil, err
+	}
+	f.next++
+	ph := f.next
+	p := &process{system: s.id, pid: uint32(ph)}
+	f.processes[ph] = p
+	f.mu.Unlock()
+
+	info := &vmcompute.HcsProcessInformation{ProcessId: p.pid}
+	stdin, stdout, stderr, ours, err := stdio(params, info)
+	if err != nil {
+		return 0, nil, err
+	}
+	go func() {
+		code := 0
+		if f.Run != nil {
+			code = f.Run(p.system, params.CommandLine, stdin, stdout, stderr)
+		}
+		for _, file := range ours {
+			file.Close()
+		}
+		f.mu.Lock()
+		p.exited, p.code = true, code
+		var fns []func(vmcompute.Notification)
+		for _, fn := range f.subs[ph] {
+			fns = append(fns, fn)
+		}
+		f.mu.Unlock()
+		for _, fn := range fns {
+			fn(vmcompute.Notification{Type: vmcompute.NotificationProcessExited})
+		}
+	}()
+	return vmcompute.HcsProcess(ph), info, nil
+}
+
+// stdio creates the pipes params ask for. It sets the process's ends in
+// info and returns the fake's, for Run, and the files to close once Run
+// returns. Pipes not asked for read as empty and discard writes.
+func stdio(params processParams, info *vmcompute.HcsProcessInformation) (stdin io.Reader, stdout, stderr io.Writer, ours []*os.File, err error) {
+	stdin, stdout, stderr = strings.NewReader(""), io.Discard, io.Discard
+	var theirs []uintptr
+	defer func() {
+		if err != nil {
+			for _, file := range ours {
+				file.Close()
+			}
+			for _, h := range theirs {
+				os.NewFile(h, "stdio").Close()
+			}
+			err = fmt.Errorf("fake: stdio: %w", err)
+		}
+	}()
+	pipe := func(handle *uintptr, input bool) (*os.File, error) {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		mine, other := w, r
+		if input {
+			mine, other = r, w
+		}
+		ours = append(ours, mine)
+		if *handle, err = detach(other); err != nil {
+			return nil, err
+		}
+		theirs = append(theirs, *handle)
+		return mine, nil
+	}
+	if params.CreateStdInPipe {
+		r, err := pipe(&info.StdInput, true)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		stdin = r
+	}
+	if params.CreateStdOutPipe {
+		w, err := pipe(&info.StdOutput, false)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		stdout = w
+	}
+	if params.CreateStdErrPipe {
+		w, err := pipe(&info.StdError, false)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		stderr = w
+	}
+	return stdin, stdout, stderr, ours, nil
+}
+
+func (f *Fake) process(h vmcompute.HcsProcess) (*process, error) {
+	p, ok := f.processes[uintptr(h)]
+	if !ok {
+		return nil, fmt.Errorf("fake: invalid process handle %#x", h)
+	}
+	return p, nil
+}
+
+func (f *Fake) GetProcessProperties(h vmcompute.HcsProcess) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, err := f.process(h)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(struct {
+		ProcessId uint32
+		Exited    bool
+		ExitCode  uint32
+	}{p.pid, p.exited, uint32(p.code)})
+	return string(b), err
+}
+
+func (f *Fake) processCall(h vmcompute.HcsProcess) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, err := f.process(h)
+	return err
+}
+
+func (f *Fake) SignalProcess(h vmcompute.HcsProcess, options string) error { return f.processCall(h) }
+
+func (f *Fake) ModifyProcess(h vmcompute.HcsProcess, settings string) error { return f.processCall(h) }
+
+func (f *Fake) TerminateProcess(h vmcompute.HcsProcess) error { return f.processCall(h) }
+
+func (f *Fake) CloseProcess(h vmcompute.HcsProcess) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.process(h); err != nil {
+		return err
+	}
+	delete(f.processes, uintptr(h))
+	delete(f.subs, uintptr(h))
+	return nil
+}
+
+func (f *Fake) NotifyProcess(h vmcompute.HcsProcess, fn func(vmcompute.Notification)) (func(), error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.process(h); err != nil {
+		return nil, err
+	}
+	return f.subscribe(uintptr(h), fn), nil
+}